@@ -2,13 +2,33 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"time"
 
+	"github.com/shammianand/goproxy/internal/accesslog"
+	"github.com/shammianand/goproxy/internal/admin"
+	"github.com/shammianand/goproxy/internal/auth"
+	"github.com/shammianand/goproxy/internal/cache"
+	"github.com/shammianand/goproxy/internal/clientip"
+	"github.com/shammianand/goproxy/internal/concurrency"
 	"github.com/shammianand/goproxy/internal/config"
+	"github.com/shammianand/goproxy/internal/fastcgi"
+	"github.com/shammianand/goproxy/internal/forward"
+	"github.com/shammianand/goproxy/internal/ipaccess"
+	"github.com/shammianand/goproxy/internal/metrics"
 	"github.com/shammianand/goproxy/internal/proxy"
+	"github.com/shammianand/goproxy/internal/proxyproto"
+	"github.com/shammianand/goproxy/internal/ratelimit"
+	"github.com/shammianand/goproxy/internal/redis"
+	"github.com/shammianand/goproxy/internal/signing"
+	"github.com/shammianand/goproxy/internal/socks5"
+	"github.com/shammianand/goproxy/internal/tracing"
+	"github.com/shammianand/goproxy/internal/unixsock"
+	"github.com/shammianand/goproxy/internal/waf"
 	"github.com/shammianand/goproxy/pkg/logger"
 )
 
@@ -32,25 +52,592 @@ func run() error {
 	log.Info("Starting GoProxy", "config_path", *configPath)
 
 	loadBalancer, err := cfg.CreateLoadBalancer()
+	if err != nil {
+		return err
+	}
+
+	var proxyOpts []proxy.Option
+	proxyProtocolVersion, err := cfg.GetSendProxyProtocolVersion()
+	if err != nil {
+		return err
+	}
+	if proxyProtocolVersion != 0 {
+		proxyOpts = append(proxyOpts, proxy.WithProxyProtocol(proxyProtocolVersion))
+	}
+
+	splitPathInfo, err := cfg.GetFastCGISplitPathInfo()
+	if err != nil {
+		return err
+	}
+	proxyOpts = append(proxyOpts, proxy.WithFastCGI(fastcgi.Options{
+		DocumentRoot:   cfg.FastCGI.DocumentRoot,
+		ScriptFilename: cfg.FastCGI.ScriptFilename,
+		Index:          cfg.FastCGI.Index,
+		SplitPathInfo:  splitPathInfo,
+		Env:            cfg.FastCGI.Env,
+		MaxIdleConns:   cfg.FastCGI.MaxIdleConns,
+		DialTimeout:    cfg.GetProxyDialTimeout(),
+	}))
+
+	if cfg.Signing.Enabled && len(cfg.Signing.Upstreams) > 0 {
+		signers, err := newSigners(cfg)
+		if err != nil {
+			return err
+		}
+		proxyOpts = append(proxyOpts, proxy.WithSigners(signers...))
+		log.Info("Upstream request signing enabled", "rules", len(signers))
+	}
+
+	var collector *metrics.Metrics
+	if cfg.Metrics.Enabled {
+		collector = metrics.New(metrics.Options{
+			Routes:       cfg.Metrics.Routes,
+			LoadBalancer: loadBalancer,
+		})
+		proxyOpts = append(proxyOpts, proxy.WithMetrics(collector))
+	}
+
+	if cfg.Tracing.Enabled {
+		tracer, err := tracing.New(tracing.Options{
+			ServiceName:    cfg.Tracing.ServiceName,
+			Endpoint:       cfg.Tracing.Endpoint,
+			Protocol:       cfg.Tracing.Protocol,
+			Headers:        cfg.Tracing.Headers,
+			SampleRatio:    cfg.Tracing.SampleRatio,
+			Propagators:    cfg.Tracing.Propagators,
+			BatchSize:      cfg.Tracing.BatchSize,
+			ExportInterval: cfg.GetTracingExportInterval(),
+			Timeout:        cfg.GetTracingTimeout(),
+		}, log.Named("tracing"))
+		if err != nil {
+			return err
+		}
+		defer tracer.Close()
+		proxyOpts = append(proxyOpts, proxy.WithTracer(tracer))
+		log.Info("Tracing enabled", "endpoint", cfg.Tracing.Endpoint, "sample_ratio", cfg.Tracing.SampleRatio)
+	}
+
+	var accessLog *accesslog.Logger
+	if cfg.Logging.AccessLog.Enabled {
+		// API keys passed in the URL must not end up in the log
+		redact := cfg.Logging.AccessLog.RedactQueryParams
+		if cfg.Auth.APIKeys.Enabled && cfg.Auth.APIKeys.QueryParam != "" {
+			redact = append(redact, cfg.Auth.APIKeys.QueryParam)
+		}
+		accessLog, err = accesslog.New(accesslog.Options{
+			Format:            cfg.Logging.AccessLog.Format,
+			Template:          cfg.Logging.AccessLog.Template,
+			Output:            cfg.Logging.AccessLog.Output,
+			RequestIDHeader:   cfg.Logging.AccessLog.RequestIDHeader,
+			RedactQueryParams: redact,
+		})
+		if err != nil {
+			return err
+		}
+		defer accessLog.Close()
+		proxyOpts = append(proxyOpts, proxy.WithAccessLog(accessLog))
+	}
+
+	proxy, err := proxy.NewProxy(cfg.Proxy.TargetAddr, loadBalancer, log, proxyOpts...)
+	if err != nil {
+		return err
+	}
+
+	var handler http.Handler = proxy
+	var adminOpts []admin.Option
+	if cfg.ConcurrencyLimit.Enabled {
+		// Cache hits are served without taking a slot
+		limiter, err := concurrency.New(concurrency.Options{
+			Algorithm:        cfg.ConcurrencyLimit.Algorithm,
+			LatencyThreshold: cfg.GetConcurrencyLimitLatencyThreshold(),
+			InitialLimit:     cfg.ConcurrencyLimit.InitialLimit,
+			MinLimit:         cfg.ConcurrencyLimit.MinLimit,
+			MaxLimit:         cfg.ConcurrencyLimit.MaxLimit,
+			MaxQueue:         cfg.ConcurrencyLimit.MaxQueue,
+			QueueTimeout:     cfg.GetConcurrencyLimitQueueTimeout(),
+			Classes:          cfg.ConcurrencyLimit.PriorityClasses,
+			DefaultClass:     cfg.ConcurrencyLimit.DefaultClass,
+		}, log.Named("concurrency"))
+		if err != nil {
+			return err
+		}
+		handler = limiter.Handler(handler)
+		adminOpts = append(adminOpts, admin.WithConcurrencyLimiter(limiter))
+		if collector != nil {
+			collector.AddGauge("goproxy_concurrency_limit", "Current concurrency limit.", func() float64 {
+				return float64(limiter.Stats().Limit)
+			})
+			collector.AddGauge("goproxy_concurrency_in_flight", "Requests holding a concurrency slot.", func() float64 {
+				return float64(limiter.Stats().InFlight)
+			})
+			collector.AddGauge("goproxy_concurrency_queued", "Requests waiting for a concurrency slot.", func() float64 {
+				return float64(limiter.Stats().Queued)
+			})
+		}
+		log.Info("Adaptive concurrency limiting enabled",
+			"algorithm", cfg.ConcurrencyLimit.Algorithm,
+			"initial_limit", cfg.ConcurrencyLimit.InitialLimit,
+			"max_queue", cfg.ConcurrencyLimit.MaxQueue,
+			"priority_classes", len(cfg.ConcurrencyLimit.PriorityClasses),
+		)
+	}
+
+	if cfg.Caching.Enabled {
+		responseCache, err := newCache(cfg, log)
+		if err != nil {
+			return err
+		}
+		defer responseCache.Close()
+		handler = responseCache.Handler(handler)
+		adminOpts = append(adminOpts, admin.WithCache(responseCache))
+		log.Info("Response caching enabled",
+			"default_ttl", cfg.GetCachingDefaultTTL().String(),
+			"max_size_mb", cfg.Caching.MaxSizeMB,
+			"disk", cfg.Caching.Disk.Enabled,
+		)
+	}
+
+	if cfg.WAF.Enabled {
+		firewall, err := waf.New(waf.Options{
+			Mode:             cfg.WAF.Mode,
+			AnomalyThreshold: cfg.WAF.AnomalyThreshold,
+			BuiltinRules:     cfg.WAF.BuiltinRules,
+			Rules:            cfg.WAF.Rules,
+			Routes:           cfg.WAF.Routes,
+			MaxBodyBytes:     cfg.WAF.MaxBodyBytes,
+			BodyLimitAction:  cfg.WAF.BodyLimitAction,
+		}, log.Named("waf"))
+		if err != nil {
+			return err
+		}
+		handler = firewall.Handler(handler)
+		log.Info("Web application firewall enabled",
+			"mode", cfg.WAF.Mode,
+			"builtin_rules", cfg.WAF.BuiltinRules,
+			"rules", len(cfg.WAF.Rules),
+			"routes", len(cfg.WAF.Routes),
+		)
+	}
+
+	var rateLimiter *ratelimit.Limiter
+	if cfg.RateLimiting.Enabled {
+		limiter, err := newRateLimiter(cfg, log)
+		if err != nil {
+			return err
+		}
+		rateLimiter = limiter
+		log.Info("Rate limiting enabled",
+			"requests_per_second", cfg.RateLimiting.RequestsPerSecond,
+			"burst", cfg.RateLimiting.Burst,
+			"key_by", cfg.RateLimiting.KeyBy,
+			"shared", cfg.RateLimiting.Redis.Enabled,
+		)
+	}
+	// Limits by API key are keyed by the authenticated identity, so they
+	// apply inside authentication; other limits apply before it
+	if rateLimiter != nil && cfg.RateLimiting.KeyBy == "api_key" {
+		handler = rateLimiter.Handler(handler)
+	}
+
+	if cfg.Auth.Basic.Enabled {
+		users, err := auth.NewHtpasswd(cfg.Auth.Basic.HtpasswdFile)
+		if err != nil {
+			return err
+		}
+		basicAuth := auth.NewBasicAuth(users, auth.BasicAuthOptions{
+			Realm:                cfg.Auth.Basic.Realm,
+			Routes:               cfg.Auth.Basic.Routes,
+			StripAuthorization:   cfg.Auth.Basic.StripAuthorization,
+			IdentityHeaderPrefix: cfg.Auth.IdentityHeaderPrefix,
+			ReloadInterval:       cfg.GetBasicAuthReloadInterval(),
+		}, log.Named("auth"))
+		defer basicAuth.Close()
+		handler = basicAuth.Handler(handler)
+		log.Info("Basic authentication enabled", "htpasswd_file", cfg.Auth.Basic.HtpasswdFile, "users", users.Len())
+	}
+
+	if cfg.Auth.OIDC.Enabled {
+		oidcAuth, err := newOIDCAuth(cfg, log)
+		if err != nil {
+			return err
+		}
+		handler = oidcAuth.Handler(handler)
+		log.Info("OIDC login enabled", "issuer", cfg.Auth.OIDC.Issuer, "redirect_url", cfg.Auth.OIDC.RedirectURL)
+	}
+
+	if cfg.Auth.JWT.Enabled {
+		jwtAuth, err := newJWTAuth(cfg, log)
+		if err != nil {
+			return err
+		}
+		handler = jwtAuth.Handler(handler)
+		log.Info("JWT authentication enabled", "issuer", cfg.Auth.JWT.Issuer, "jwks_url", cfg.Auth.JWT.JWKSURL)
+	}
+
+	if cfg.Auth.APIKeys.Enabled {
+		apiKeys, err := newAPIKeyAuth(cfg, log)
+		if err != nil {
+			return err
+		}
+		defer apiKeys.Close()
+		handler = apiKeys.Handler(handler)
+		log.Info("API key authentication enabled", "key_file", cfg.Auth.APIKeys.KeyFile)
+	}
 
-	proxy, err := proxy.NewProxy(cfg.Proxy.TargetAddr, loadBalancer, log)
+	if cfg.Auth.ForwardAuth.Enabled {
+		forwardAuth, err := auth.NewForwardAuth(auth.ForwardAuthOptions{
+			URL:             cfg.Auth.ForwardAuth.URL,
+			RequestHeaders:  cfg.Auth.ForwardAuth.RequestHeaders,
+			ResponseHeaders: cfg.Auth.ForwardAuth.ResponseHeaders,
+			RedirectURL:     cfg.Auth.ForwardAuth.RedirectURL,
+			Timeout:         cfg.GetForwardAuthTimeout(),
+			CacheTTL:        cfg.GetForwardAuthCacheTTL(),
+			FailOpen:        cfg.Auth.ForwardAuth.FailOpen,
+		}, log.Named("auth"))
+		if err != nil {
+			return err
+		}
+		handler = forwardAuth.Handler(handler)
+		log.Info("Forward authentication enabled", "url", cfg.Auth.ForwardAuth.URL, "fail_open", cfg.Auth.ForwardAuth.FailOpen)
+	}
+	// Identity headers sent by clients never reach the backends, whatever
+	// the route and whether or not authentication is enabled
+	handler = auth.StripIdentityHeaders(cfg.Auth.IdentityHeaderPrefix, handler)
+
+	if cfg.Signing.Enabled && len(cfg.Signing.Webhooks) > 0 {
+		webhooks := make([]signing.WebhookOptions, len(cfg.Signing.Webhooks))
+		for i, w := range cfg.Signing.Webhooks {
+			webhooks[i] = signing.WebhookOptions{
+				PathPrefix:      w.PathPrefix,
+				Provider:        w.Provider,
+				Secret:          w.Secret,
+				Header:          w.Header,
+				TimestampHeader: w.TimestampHeader,
+				Tolerance:       w.Tolerance * time.Second,
+			}
+		}
+		verifier, err := signing.NewWebhookVerifier(webhooks, cfg.Signing.MaxBodyBytes, log.Named("signing"))
+		if err != nil {
+			return err
+		}
+		handler = verifier.Handler(handler)
+		log.Info("Webhook signature verification enabled", "webhooks", len(webhooks))
+	}
+
+	if rateLimiter != nil && cfg.RateLimiting.KeyBy != "api_key" {
+		handler = rateLimiter.Handler(handler)
+	}
+
+	if cfg.IPAccess.Enabled {
+		filter, err := ipaccess.New(config.IPAccessRule{
+			Allow:     cfg.IPAccess.Allow,
+			Deny:      cfg.IPAccess.Deny,
+			AllowFile: cfg.IPAccess.AllowFile,
+			DenyFile:  cfg.IPAccess.DenyFile,
+		}, cfg.IPAccess.Routes, cfg.GetIPAccessReloadInterval(), log.Named("ipaccess"))
+		if err != nil {
+			return err
+		}
+		defer filter.Close()
+		handler = filter.Handler(handler)
+		log.Info("IP access control enabled", "routes", len(cfg.IPAccess.Routes))
+	}
+
+	if accessLog != nil {
+		// Inside the client IP resolver, so records carry the real client
+		// address, and outside every middleware rejecting requests
+		handler = accessLog.Handler(handler)
+		log.Info("Access log enabled", "format", cfg.Logging.AccessLog.Format, "output", cfg.Logging.AccessLog.Output)
+	}
+
+	// The client IP is resolved for every request, so forwarding headers
+	// sent by untrusted clients never reach the upstream
+	resolver, err := clientip.NewResolver(cfg.Server.ClientIP.TrustedProxies, cfg.Server.ClientIP.Header)
 	if err != nil {
 		return err
 	}
+	handler = resolver.Handler(handler)
+	if collector != nil {
+		// Outermost, so rejected requests are counted too
+		handler = collector.Handler(handler)
+	}
 
 	server := &http.Server{
 		Addr:         cfg.Server.ListenAddr,
-		Handler:      proxy,
+		Handler:      handler,
 		ReadTimeout:  cfg.Server.ReadTimeout * time.Second,
 		WriteTimeout: cfg.Server.WriteTimeout * time.Second,
 		IdleTimeout:  cfg.Server.IdleTimeout * time.Second,
 	}
+	if collector != nil {
+		server.ConnState = collector.ConnState
+	}
+
+	listener, err := listen(cfg)
+	if err != nil {
+		return err
+	}
+	if cfg.Server.ProxyProtocol.Enabled {
+		listener, err = proxyproto.NewListener(listener, cfg.Server.ProxyProtocol.TrustedCIDRs, cfg.GetProxyProtocolHeaderTimeout())
+		if err != nil {
+			return err
+		}
+	}
+
+	errCh := make(chan error, 5)
+
+	if cfg.Admin.Enabled {
+		adminServer := &http.Server{
+			Addr:        cfg.Admin.ListenAddr,
+			Handler:     admin.NewServer(cfg.Admin.Token, log.Named("admin"), adminOpts...),
+			ReadTimeout: cfg.GetServerReadTimeout(),
+			IdleTimeout: cfg.GetServerIdleTimeout(),
+		}
+		log.Info("Starting admin API", "listen_addr", cfg.Admin.ListenAddr)
+		go func() {
+			errCh <- adminServer.ListenAndServe()
+		}()
+	}
+
+	if collector != nil {
+		path := cfg.Metrics.Path
+		if path == "" {
+			path = "/metrics"
+		}
+		mux := http.NewServeMux()
+		mux.Handle(path, collector)
+		metricsServer := &http.Server{
+			Addr:        cfg.Metrics.Address,
+			Handler:     mux,
+			ReadTimeout: cfg.GetServerReadTimeout(),
+			IdleTimeout: cfg.GetServerIdleTimeout(),
+		}
+		log.Info("Starting metrics server", "address", cfg.Metrics.Address, "path", path)
+		go func() {
+			errCh <- metricsServer.ListenAndServe()
+		}()
+	}
+
+	if cfg.SOCKS5.Enabled {
+		socksServer, err := newSOCKS5Server(cfg, log)
+		if err != nil {
+			return err
+		}
+		log.Info("Starting SOCKS5 server",
+			"listen_addr", cfg.SOCKS5.ListenAddr,
+			"udp_associate", cfg.SOCKS5.UDPAssociate,
+		)
+		go func() {
+			errCh <- socksServer.ListenAndServe(cfg.SOCKS5.ListenAddr)
+		}()
+	}
+
+	if cfg.ForwardProxy.Enabled {
+		forwardServer, err := newForwardServer(cfg, log)
+		if err != nil {
+			return err
+		}
+		log.Info("Starting forward proxy", "listen_addr", cfg.ForwardProxy.ListenAddr)
+		go func() {
+			errCh <- forwardServer.ListenAndServe()
+		}()
+	}
 
 	log.Info("Starting GoProxy",
 		"listen_addr", cfg.Server.ListenAddr,
 		"target_addr", cfg.Proxy.TargetAddr,
 		"log_level", cfg.Logging.Level,
+		"proxy_protocol", cfg.Server.ProxyProtocol.Enabled,
 	)
+	go func() {
+		errCh <- server.Serve(listener)
+	}()
+
+	return <-errCh
+}
+
+// listen opens the main listener, which is either a TCP address or a unix
+// domain socket given as unix:/path/to.sock
+func listen(cfg *config.Config) (net.Listener, error) {
+	path, ok := unixsock.ParseAddr(cfg.Server.ListenAddr)
+	if !ok {
+		return net.Listen("tcp", cfg.Server.ListenAddr)
+	}
+	return unixsock.Listen(path, unixsock.Options{
+		Mode:  cfg.Server.UnixSocket.Mode,
+		Owner: cfg.Server.UnixSocket.Owner,
+		Group: cfg.Server.UnixSocket.Group,
+	})
+}
+
+// newCache creates the response cache, backed by memory alone or by memory
+// and disk
+func newCache(cfg *config.Config, log *logger.Logger) (*cache.Cache, error) {
+	var opts []cache.Option
+	if cfg.Caching.CoalesceTimeout > 0 {
+		opts = append(opts, cache.WithCoalescing(cfg.GetCachingCoalesceTimeout()))
+	}
+
+	memoryBytes := int64(cfg.Caching.MaxSizeMB) << 20
+	memory := cache.NewMemoryStore(memoryBytes)
+	if !cfg.Caching.Disk.Enabled {
+		return cache.New(memory, cfg.GetCachingDefaultTTL(), memoryBytes, log.Named("cache"), opts...), nil
+	}
+
+	diskBytes := int64(cfg.Caching.Disk.MaxSizeMB) << 20
+	disk, err := cache.NewDiskStore(cfg.Caching.Disk.Path, diskBytes)
+	if err != nil {
+		return nil, err
+	}
+	maxObjectSize := int64(cfg.Caching.Disk.MaxObjectSizeMB) << 20
+	if maxObjectSize <= 0 {
+		maxObjectSize = min(cache.DefaultMaxObjectSize, diskBytes)
+	}
+	return cache.New(cache.NewTieredStore(memory, disk), cfg.GetCachingDefaultTTL(), maxObjectSize, log.Named("cache"), opts...), nil
+}
 
-	return server.ListenAndServe()
+func newAPIKeyAuth(cfg *config.Config, log *logger.Logger) (*auth.APIKeyAuth, error) {
+	keys, err := auth.NewKeyStore(cfg.Auth.APIKeys.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	quotas, err := auth.NewQuotas(cfg.Auth.APIKeys.UsageFile)
+	if err != nil {
+		return nil, err
+	}
+	return auth.NewAPIKeyAuth(keys, quotas, auth.APIKeyOptions{
+		Header:               cfg.Auth.APIKeys.Header,
+		QueryParam:           cfg.Auth.APIKeys.QueryParam,
+		IdentityHeaderPrefix: cfg.Auth.IdentityHeaderPrefix,
+		ReloadInterval:       cfg.GetAPIKeysReloadInterval(),
+		FlushInterval:        cfg.GetAPIKeysUsageFlushInterval(),
+	}, log.Named("auth")), nil
+}
+
+func newJWTAuth(cfg *config.Config, log *logger.Logger) (*auth.JWTAuth, error) {
+	log = log.Named("auth")
+	var keys *auth.KeySet
+	if cfg.Auth.JWT.JWKSURL != "" {
+		keys = auth.NewRemoteKeySet(cfg.Auth.JWT.JWKSURL, cfg.GetJWTRefreshInterval(), log)
+	} else {
+		var err error
+		keys, err = auth.NewStaticKeySet(cfg.Auth.JWT.JWKSFile, cfg.Auth.JWT.HMACSecret)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return auth.NewJWTAuth(keys, auth.JWTOptions{
+		Algorithms:           cfg.Auth.JWT.Algorithms,
+		Issuer:               cfg.Auth.JWT.Issuer,
+		Audiences:            cfg.Auth.JWT.Audiences,
+		ClockSkew:            cfg.GetJWTClockSkew(),
+		ForwardClaims:        cfg.Auth.JWT.ForwardClaims,
+		Rules:                cfg.Auth.JWT.Rules,
+		IdentityHeaderPrefix: cfg.Auth.IdentityHeaderPrefix,
+	}, log)
+}
+
+func newOIDCAuth(cfg *config.Config, log *logger.Logger) (*auth.OIDCAuth, error) {
+	return auth.NewOIDCAuth(auth.OIDCOptions{
+		Issuer:                cfg.Auth.OIDC.Issuer,
+		AuthorizationEndpoint: cfg.Auth.OIDC.AuthorizationEndpoint,
+		TokenEndpoint:         cfg.Auth.OIDC.TokenEndpoint,
+		JWKSURL:               cfg.Auth.OIDC.JWKSURL,
+		ClientID:              cfg.Auth.OIDC.ClientID,
+		ClientSecret:          cfg.Auth.OIDC.ClientSecret,
+		RedirectURL:           cfg.Auth.OIDC.RedirectURL,
+		Scopes:                cfg.Auth.OIDC.Scopes,
+		CookieName:            cfg.Auth.OIDC.CookieName,
+		CookieSecret:          cfg.Auth.OIDC.CookieSecret,
+		SessionLifetime:       cfg.GetOIDCSessionLifetime(),
+		ForwardClaims:         cfg.Auth.OIDC.ForwardClaims,
+		LogoutPath:            cfg.Auth.OIDC.LogoutPath,
+		IdentityHeaderPrefix:  cfg.Auth.IdentityHeaderPrefix,
+	}, log.Named("auth"))
+}
+
+// newSigners creates the signers of requests to upstreams
+func newSigners(cfg *config.Config) ([]*signing.Signer, error) {
+	var signers []*signing.Signer
+	for _, rule := range cfg.Signing.Upstreams {
+		signer, err := signing.NewSigner(signing.SignerOptions{
+			Algorithm:       rule.Algorithm,
+			Backends:        rule.Backends,
+			KeyID:           rule.KeyID,
+			Secret:          rule.Secret,
+			Header:          rule.Header,
+			SignedHeaders:   rule.SignedHeaders,
+			Region:          rule.AWS.Region,
+			Service:         rule.AWS.Service,
+			AccessKeyID:     rule.AWS.AccessKeyID,
+			SecretAccessKey: rule.AWS.SecretAccessKey,
+			SessionToken:    rule.AWS.SessionToken,
+			MaxBodyBytes:    cfg.Signing.MaxBodyBytes,
+		})
+		if err != nil {
+			return nil, err
+		}
+		signers = append(signers, signer)
+	}
+	return signers, nil
+}
+
+func newRateLimiter(cfg *config.Config, log *logger.Logger) (*ratelimit.Limiter, error) {
+	if cfg.RateLimiting.RequestsPerSecond <= 0 {
+		return nil, fmt.Errorf("rate_limiting.requests_per_second must be positive")
+	}
+	keyFunc, err := ratelimit.NewKeyFunc(cfg.RateLimiting.KeyBy, cfg.RateLimiting.Header, cfg.RateLimiting.Routes)
+	if err != nil {
+		return nil, err
+	}
+	var opts []ratelimit.Option
+	if cfg.RateLimiting.Redis.Enabled {
+		client := redis.NewClient(redis.Options{
+			Addr:        cfg.RateLimiting.Redis.Addr,
+			Password:    cfg.RateLimiting.Redis.Password,
+			DB:          cfg.RateLimiting.Redis.DB,
+			DialTimeout: cfg.GetRateLimitingRedisTimeout(),
+			Timeout:     cfg.GetRateLimitingRedisTimeout(),
+		})
+		opts = append(opts, ratelimit.WithRedis(client, cfg.RateLimiting.Redis.KeyPrefix))
+	}
+	return ratelimit.New(
+		float64(cfg.RateLimiting.RequestsPerSecond),
+		cfg.RateLimiting.Burst,
+		keyFunc,
+		cfg.GetRateLimitingCleanupInterval(),
+		log.Named("ratelimit"),
+		opts...,
+	), nil
+}
+
+func newForwardServer(cfg *config.Config, log *logger.Logger) (*http.Server, error) {
+	acl, err := forward.NewACL(cfg.ForwardProxy.Allow, cfg.ForwardProxy.Deny)
+	if err != nil {
+		return nil, err
+	}
+	forwardProxy := forward.NewProxy(acl, cfg.ForwardProxy.Users, cfg.GetForwardProxyDialTimeout(), log.Named("forward"))
+
+	// Tunnels are long lived, so only the request headers are bounded by a timeout
+	return &http.Server{
+		Addr:              cfg.ForwardProxy.ListenAddr,
+		Handler:           forwardProxy,
+		ReadHeaderTimeout: cfg.GetServerReadTimeout(),
+		IdleTimeout:       cfg.GetServerIdleTimeout(),
+	}, nil
+}
+
+func newSOCKS5Server(cfg *config.Config, log *logger.Logger) (*socks5.Server, error) {
+	acl, err := forward.NewACL(cfg.ForwardProxy.Allow, cfg.ForwardProxy.Deny)
+	if err != nil {
+		return nil, err
+	}
+	return socks5.NewServer(
+		acl,
+		cfg.ForwardProxy.Users,
+		cfg.GetForwardProxyDialTimeout(),
+		cfg.GetServerReadTimeout(),
+		cfg.SOCKS5.UDPAssociate,
+		log.Named("socks5"),
+	), nil
 }
@@ -1,8 +1,9 @@
 module github.com/shammianand/goproxy
 
-go 1.23.0
+go 1.24.0
 
 require (
+	golang.org/x/crypto v0.28.0
 	golang.org/x/exp v0.0.0-20241004190924-225e2abe05e6
 	gopkg.in/yaml.v2 v2.4.0
 )
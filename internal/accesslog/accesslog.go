@@ -0,0 +1,308 @@
+package accesslog
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Formats of the access log
+const (
+	// FormatCommon is the Common Log Format
+	FormatCommon = "common"
+	// FormatCombined is the Common Log Format followed by the referer and
+	// user agent, as written by Apache and nginx
+	FormatCombined = "combined"
+	// FormatJSON writes one JSON object per request
+	FormatJSON = "json"
+	// FormatTemplate writes the Template of the Options
+	FormatTemplate = "template"
+)
+
+const (
+	commonTemplate   = `$remote_addr - $remote_user [$time_local] "$request" $status $body_bytes_sent`
+	combinedTemplate = commonTemplate + ` "$http_referer" "$http_user_agent"`
+)
+
+// Options configures a Logger
+type Options struct {
+	// Format is common, combined (the default), json or template
+	Format string
+	// Template is the line written for the template format, with variables
+	// such as $remote_addr or ${request_time}
+	Template string
+	// Output is stdout (the default), stderr or the path of a file the log
+	// is appended to
+	Output string
+	// RequestIDHeader is the header carrying the request ID; it defaults to
+	// X-Request-Id
+	RequestIDHeader string
+	// RedactQueryParams are query parameters carrying credentials, such as
+	// an API key, whose values are replaced in records
+	RedactQueryParams []string
+}
+
+// Logger writes one access log record per request, apart from the
+// application log
+type Logger struct {
+	format          []segment
+	json            bool
+	requestIDHeader string
+	redact          []string
+
+	mu  sync.Mutex
+	out io.Writer
+	// file is the output when it is a file, and closed by Close
+	file *os.File
+}
+
+// New creates a Logger and opens its output
+func New(opts Options) (*Logger, error) {
+	l := &Logger{requestIDHeader: opts.RequestIDHeader, redact: opts.RedactQueryParams}
+	if l.requestIDHeader == "" {
+		l.requestIDHeader = "X-Request-Id"
+	}
+
+	var err error
+	switch opts.Format {
+	case "", FormatCombined:
+		l.format, err = parseTemplate(combinedTemplate)
+	case FormatCommon:
+		l.format, err = parseTemplate(commonTemplate)
+	case FormatJSON:
+		l.json = true
+	case FormatTemplate:
+		if opts.Template == "" {
+			return nil, fmt.Errorf("access log format template requires a template")
+		}
+		l.format, err = parseTemplate(opts.Template)
+	default:
+		return nil, fmt.Errorf("unsupported access log format: %s", opts.Format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch opts.Output {
+	case "", "stdout":
+		l.out = os.Stdout
+	case "stderr":
+		l.out = os.Stderr
+	default:
+		f, err := os.OpenFile(opts.Output, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open access log: %w", err)
+		}
+		l.out, l.file = f, f
+	}
+	return l, nil
+}
+
+// Close closes the output file, if any
+func (l *Logger) Close() error {
+	if l.file == nil {
+		return nil
+	}
+	return l.file.Close()
+}
+
+type contextKey int
+
+const (
+	entryKey contextKey = iota
+	upstreamAddrKey
+)
+
+// upstream is one attempt to reach a backend
+type upstream struct {
+	addr     string
+	status   int
+	duration time.Duration
+}
+
+// entry is the record of a request, filled in as it passes down the chain
+type entry struct {
+	r         *http.Request
+	requestID string
+	start     time.Time
+	duration  time.Duration
+	rw        *responseWriter
+	// redact names the query parameters whose values are not logged
+	redact []string
+
+	mu        sync.Mutex
+	upstreams []upstream
+}
+
+// Handler returns a handler writing a record of every request passed to
+// next once it has been served
+func (l *Logger) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e := &entry{start: time.Now(), rw: &responseWriter{ResponseWriter: w}, redact: l.redact}
+		e.requestID = r.Header.Get(l.requestIDHeader)
+		if !validRequestID(e.requestID) {
+			// Backends see the same ID as the log
+			e.requestID = newRequestID()
+			r.Header.Set(l.requestIDHeader, e.requestID)
+		}
+		// Records keep the request as the client sent it, not as rewritten
+		// for the backend
+		e.r = r.Clone(r.Context())
+		r = r.WithContext(context.WithValue(r.Context(), entryKey, e))
+
+		next.ServeHTTP(e.rw, r)
+		e.duration = time.Since(e.start)
+		l.write(e)
+	})
+}
+
+func (l *Logger) write(e *entry) {
+	var line []byte
+	if l.json {
+		line = appendJSON(nil, e)
+	} else {
+		for _, s := range l.format {
+			line = s(line, e)
+		}
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(line)
+}
+
+// Transport returns a RoundTripper recording the address, status and
+// response time of every upstream attempt of the requests being logged
+func (l *Logger) Transport(next http.RoundTripper) http.RoundTripper {
+	return &loggingTransport{next: next}
+}
+
+type loggingTransport struct {
+	next http.RoundTripper
+}
+
+func (t *loggingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	e, ok := req.Context().Value(entryKey).(*entry)
+	if !ok {
+		return t.next.RoundTrip(req)
+	}
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		e.addUpstream(upstream{addr: upstreamAddr(req), status: http.StatusBadGateway, duration: time.Since(start)})
+		return nil, err
+	}
+	// The response time lasts until the body is consumed, as in nginx
+	resp.Body = &upstreamBody{ReadCloser: resp.Body, entry: e, start: start, upstream: upstream{addr: upstreamAddr(req), status: resp.StatusCode}}
+	return resp, nil
+}
+
+func (e *entry) addUpstream(u upstream) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.upstreams = append(e.upstreams, u)
+}
+
+type upstreamBody struct {
+	io.ReadCloser
+	entry    *entry
+	start    time.Time
+	upstream upstream
+	once     sync.Once
+}
+
+func (b *upstreamBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() {
+		b.upstream.duration = time.Since(b.start)
+		b.entry.addUpstream(b.upstream)
+	})
+	return err
+}
+
+// SetUpstreamAddr names the backend of the upstream attempts of a request,
+// for backends whose requests are not addressed by their host, such as unix
+// sockets. The request is returned unchanged when it is not being logged.
+func SetUpstreamAddr(r *http.Request, addr string) *http.Request {
+	if _, ok := r.Context().Value(entryKey).(*entry); !ok {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), upstreamAddrKey, addr))
+}
+
+// upstreamAddr returns the address of a request sent upstream
+func upstreamAddr(req *http.Request) string {
+	if addr, ok := req.Context().Value(upstreamAddrKey).(string); ok {
+		return addr
+	}
+	return req.URL.Host
+}
+
+// validRequestID reports whether a client supplied request ID can be kept
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	return !strings.ContainsFunc(id, func(r rune) bool {
+		return r <= ' ' || r >= 0x7f || r == '"' || r == '\\'
+	})
+}
+
+func newRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// responseWriter captures the status code and counts the bytes sent
+type responseWriter struct {
+	http.ResponseWriter
+	status     int
+	header     int64
+	bodyBytes  int64
+	wroteFinal bool
+}
+
+func (rw *responseWriter) WriteHeader(code int) {
+	// Informational responses precede the final one, except for upgrades
+	if !rw.wroteFinal && (code >= 200 || code == http.StatusSwitchingProtocols) {
+		rw.wroteFinal = true
+		rw.status = code
+		rw.header = headerSize(code, rw.Header())
+	}
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+func (rw *responseWriter) Write(p []byte) (int, error) {
+	if !rw.wroteFinal {
+		rw.WriteHeader(http.StatusOK)
+	}
+	n, err := rw.ResponseWriter.Write(p)
+	rw.bodyBytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the flushing and hijacking of
+// the underlying writer
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// headerSize estimates the size of an HTTP/1.1 response header
+func headerSize(code int, h http.Header) int64 {
+	n := len("HTTP/1.1 000 ") + len(http.StatusText(code)) + len("\r\n\r\n")
+	for name, values := range h {
+		for _, v := range values {
+			n += len(name) + len(": ") + len(v) + len("\r\n")
+		}
+	}
+	return int64(n)
+}
@@ -0,0 +1,238 @@
+package accesslog
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shammianand/goproxy/internal/clientip"
+)
+
+// segment appends a part of a record to a line
+type segment func(line []byte, e *entry) []byte
+
+// variables are the values a template can refer to, named as in nginx.
+// Headers of the request are also available as $http_ followed by their
+// name in lowercase with dashes replaced by underscores.
+var variables = map[string]func(e *entry) string{
+	"remote_addr": func(e *entry) string { return clientip.FromRequest(e.r) },
+	"remote_user": func(e *entry) string {
+		user, _, _ := e.r.BasicAuth()
+		return user
+	},
+	"time_local":      func(e *entry) string { return e.start.Format("02/Jan/2006:15:04:05 -0700") },
+	"time_iso8601":    func(e *entry) string { return e.start.Format(time.RFC3339) },
+	"msec":            func(e *entry) string { return strconv.FormatFloat(float64(e.start.UnixMilli())/1000, 'f', 3, 64) },
+	"request":         func(e *entry) string { return e.r.Method + " " + e.requestURI() + " " + e.r.Proto },
+	"request_method":  func(e *entry) string { return e.r.Method },
+	"request_uri":     func(e *entry) string { return e.requestURI() },
+	"uri":             func(e *entry) string { return e.r.URL.Path },
+	"args":            func(e *entry) string { return redactQuery(e.r.URL.RawQuery, e.redact) },
+	"server_protocol": func(e *entry) string { return e.r.Proto },
+	"host":            func(e *entry) string { return e.r.Host },
+	"status":          func(e *entry) string { return strconv.Itoa(e.status()) },
+	"body_bytes_sent": func(e *entry) string { return strconv.FormatInt(e.rw.bodyBytes, 10) },
+	"bytes_sent":      func(e *entry) string { return strconv.FormatInt(e.rw.header+e.rw.bodyBytes, 10) },
+	"request_time":    func(e *entry) string { return seconds(e.duration) },
+	"request_id":      func(e *entry) string { return e.requestID },
+	"upstream_addr": func(e *entry) string {
+		return e.joinUpstreams(func(u upstream) string { return u.addr })
+	},
+	"upstream_status": func(e *entry) string {
+		return e.joinUpstreams(func(u upstream) string { return strconv.Itoa(u.status) })
+	},
+	"upstream_response_time": func(e *entry) string {
+		return e.joinUpstreams(func(u upstream) string { return seconds(u.duration) })
+	},
+}
+
+// parseTemplate compiles a template of literal text and variables written
+// as $name or ${name}
+func parseTemplate(template string) ([]segment, error) {
+	var segments []segment
+	for template != "" {
+		i := strings.IndexByte(template, '$')
+		if i < 0 {
+			segments = append(segments, literal(template))
+			break
+		}
+		if i > 0 {
+			segments = append(segments, literal(template[:i]))
+		}
+		template = template[i+1:]
+
+		var name string
+		if strings.HasPrefix(template, "{") {
+			end := strings.IndexByte(template, '}')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated variable in access log template")
+			}
+			name, template = template[1:end], template[end+1:]
+		} else {
+			end := strings.IndexFunc(template, func(r rune) bool {
+				return !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '_')
+			})
+			if end < 0 {
+				end = len(template)
+			}
+			name, template = template[:end], template[end:]
+		}
+
+		value, err := variable(name)
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, func(line []byte, e *entry) []byte {
+			return appendEscaped(line, value(e))
+		})
+	}
+	return segments, nil
+}
+
+func literal(s string) segment {
+	return func(line []byte, _ *entry) []byte {
+		return append(line, s...)
+	}
+}
+
+func variable(name string) (func(e *entry) string, error) {
+	if value, ok := variables[name]; ok {
+		return value, nil
+	}
+	if header, ok := strings.CutPrefix(name, "http_"); ok && header != "" {
+		header = http.CanonicalHeaderKey(strings.ReplaceAll(header, "_", "-"))
+		return func(e *entry) string { return e.r.Header.Get(header) }, nil
+	}
+	if name == "" {
+		return nil, fmt.Errorf("empty variable in access log template")
+	}
+	return nil, fmt.Errorf("unknown access log variable: $%s", name)
+}
+
+// appendEscaped appends a value as nginx does: empty values become a dash,
+// and quotes, backslashes and non-printable bytes are written as \xHH so a
+// client cannot forge or break records
+func appendEscaped(line []byte, value string) []byte {
+	if value == "" {
+		return append(line, '-')
+	}
+	const hex = "0123456789ABCDEF"
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c < ' ' || c >= 0x7f || c == '"' || c == '\\' {
+			line = append(line, '\\', 'x', hex[c>>4], hex[c&0xf])
+			continue
+		}
+		line = append(line, c)
+	}
+	return line
+}
+
+// requestURI returns the target of the request line, with the values of
+// credential parameters redacted
+func (e *entry) requestURI() string {
+	uri := e.r.RequestURI
+	if uri == "" {
+		uri = e.r.URL.RequestURI()
+	}
+	if path, query, ok := strings.Cut(uri, "?"); ok {
+		return path + "?" + redactQuery(query, e.redact)
+	}
+	return uri
+}
+
+// redacted replaces the values of credential parameters
+const redacted = "REDACTED"
+
+// redactQuery replaces the values of the named parameters of a query string,
+// leaving the rest as sent
+func redactQuery(query string, names []string) string {
+	if len(names) == 0 || query == "" {
+		return query
+	}
+	pairs := strings.Split(query, "&")
+	for i, pair := range pairs {
+		key, _, _ := strings.Cut(pair, "=")
+		name, err := url.QueryUnescape(key)
+		if err != nil {
+			name = key
+		}
+		if slices.Contains(names, name) {
+			pairs[i] = key + "=" + redacted
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+func (e *entry) status() int {
+	if e.rw.status == 0 {
+		return http.StatusOK
+	}
+	return e.rw.status
+}
+
+// joinUpstreams lists a field of every upstream attempt, as nginx does when
+// a request is retried
+func (e *entry) joinUpstreams(field func(u upstream) string) string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	values := make([]string, len(e.upstreams))
+	for i, u := range e.upstreams {
+		values[i] = field(u)
+	}
+	return strings.Join(values, ", ")
+}
+
+func seconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', 3, 64)
+}
+
+// record is the JSON form of an entry
+type record struct {
+	Time                 string  `json:"time"`
+	RequestID            string  `json:"request_id"`
+	RemoteAddr           string  `json:"remote_addr"`
+	RemoteUser           string  `json:"remote_user,omitempty"`
+	Method               string  `json:"method"`
+	URI                  string  `json:"uri"`
+	Protocol             string  `json:"protocol"`
+	Host                 string  `json:"host"`
+	Status               int     `json:"status"`
+	BytesSent            int64   `json:"bytes_sent"`
+	BodyBytesSent        int64   `json:"body_bytes_sent"`
+	RequestTime          float64 `json:"request_time"`
+	UpstreamAddr         string  `json:"upstream_addr,omitempty"`
+	UpstreamStatus       string  `json:"upstream_status,omitempty"`
+	UpstreamResponseTime string  `json:"upstream_response_time,omitempty"`
+	Referer              string  `json:"referer,omitempty"`
+	UserAgent            string  `json:"user_agent,omitempty"`
+}
+
+func appendJSON(line []byte, e *entry) []byte {
+	user, _, _ := e.r.BasicAuth()
+	b, _ := json.Marshal(record{
+		Time:                 e.start.Format(time.RFC3339Nano),
+		RequestID:            e.requestID,
+		RemoteAddr:           clientip.FromRequest(e.r),
+		RemoteUser:           user,
+		Method:               e.r.Method,
+		URI:                  e.requestURI(),
+		Protocol:             e.r.Proto,
+		Host:                 e.r.Host,
+		Status:               e.status(),
+		BytesSent:            e.rw.header + e.rw.bodyBytes,
+		BodyBytesSent:        e.rw.bodyBytes,
+		RequestTime:          e.duration.Seconds(),
+		UpstreamAddr:         variables["upstream_addr"](e),
+		UpstreamStatus:       variables["upstream_status"](e),
+		UpstreamResponseTime: variables["upstream_response_time"](e),
+		Referer:              e.r.Referer(),
+		UserAgent:            e.r.UserAgent(),
+	})
+	return append(line, b...)
+}
@@ -0,0 +1,190 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/shammianand/goproxy/internal/cache"
+	"github.com/shammianand/goproxy/internal/concurrency"
+	"github.com/shammianand/goproxy/pkg/logger"
+)
+
+// Server is the admin HTTP API
+type Server struct {
+	mux    *http.ServeMux
+	token  string
+	logger *logger.Logger
+}
+
+// Option configures the endpoints of a Server
+type Option func(*Server)
+
+// WithCache serves the cache inspection and purge endpoints
+func WithCache(responseCache *cache.Cache) Option {
+	return func(s *Server) {
+		h := &cacheHandler{cache: responseCache, logger: s.logger}
+		s.mux.HandleFunc("GET /cache/entries", h.list)
+		s.mux.HandleFunc("GET /cache/entry", h.inspect)
+		s.mux.HandleFunc("POST /cache/purge", h.purge)
+	}
+}
+
+// WithConcurrencyLimiter serves the current limit and load of the upstream
+// concurrency limiter
+func WithConcurrencyLimiter(limiter *concurrency.Limiter) Option {
+	return func(s *Server) {
+		s.mux.HandleFunc("GET /concurrency", func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, http.StatusOK, limiter.Stats())
+		})
+	}
+}
+
+// NewServer creates the admin API. Requests must carry the token as a bearer
+// token unless it is empty.
+func NewServer(token string, logger *logger.Logger, opts ...Option) *Server {
+	s := &Server{
+		mux:    http.NewServeMux(),
+		token:  token,
+		logger: logger,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.token != "" {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+			s.logger.Warn("Admin request rejected", "method", r.Method, "path", r.URL.Path, "remote_addr", r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="goproxy-admin"`)
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+type cacheHandler struct {
+	cache  *cache.Cache
+	logger *logger.Logger
+}
+
+// entryInfo describes a cached entry
+type entryInfo struct {
+	Key        string            `json:"key"`
+	URL        string            `json:"url"`
+	StatusCode int               `json:"status_code"`
+	AgeSeconds int64             `json:"age_seconds"`
+	TTLSeconds int64             `json:"ttl_seconds"`
+	Fresh      bool              `json:"fresh"`
+	Size       int64             `json:"size"`
+	Vary       []string          `json:"vary,omitempty"`
+	Variant    map[string]string `json:"variant,omitempty"`
+	Tags       []string          `json:"tags,omitempty"`
+	Header     http.Header       `json:"header,omitempty"`
+}
+
+func newEntryInfo(e *cache.Entry, now time.Time, withHeader bool) entryInfo {
+	info := entryInfo{
+		Key:        strings.ReplaceAll(e.Key, "\x00", " "),
+		URL:        e.URL,
+		StatusCode: e.StatusCode,
+		AgeSeconds: int64(e.Age(now) / time.Second),
+		TTLSeconds: int64(e.TTL(now) / time.Second),
+		Fresh:      e.Fresh(now),
+		Size:       e.Size(),
+		Vary:       e.VaryHeaders,
+		Variant:    e.Variant,
+		Tags:       e.Tags,
+	}
+	if withHeader {
+		info.Header = e.Header
+	}
+	return info
+}
+
+// list returns the cached entries, optionally filtered by URL prefix or tag
+func (h *cacheHandler) list(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	entries := h.cache.Entries(filters(r)...)
+	infos := make([]entryInfo, 0, len(entries))
+	var size int64
+	for _, e := range entries {
+		infos = append(infos, newEntryInfo(e, now, false))
+		size += e.Size()
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"count":   len(infos),
+		"size":    size,
+		"entries": infos,
+	})
+}
+
+// inspect returns every variant of a URL, including the stored headers
+func (h *cacheHandler) inspect(w http.ResponseWriter, r *http.Request) {
+	url := r.URL.Query().Get("url")
+	if url == "" {
+		writeError(w, http.StatusBadRequest, "url is required")
+		return
+	}
+	now := time.Now()
+	entries := h.cache.Entries(cache.MatchURL(url))
+	if len(entries) == 0 {
+		writeError(w, http.StatusNotFound, "not cached")
+		return
+	}
+	infos := make([]entryInfo, 0, len(entries))
+	for _, e := range entries {
+		infos = append(infos, newEntryInfo(e, now, true))
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"entries": infos})
+}
+
+// purge removes the entries selected by url, prefix or tag
+func (h *cacheHandler) purge(w http.ResponseWriter, r *http.Request) {
+	matchers := filters(r)
+	if len(matchers) == 0 {
+		writeError(w, http.StatusBadRequest, "one of url, prefix or tag is required")
+		return
+	}
+	purged := h.cache.Purge(matchers...)
+	h.logger.Info("Cache purge requested",
+		"url", r.URL.Query().Get("url"),
+		"prefix", r.URL.Query().Get("prefix"),
+		"tags", r.URL.Query()["tag"],
+		"purged", purged,
+	)
+	writeJSON(w, http.StatusOK, map[string]any{"purged": purged})
+}
+
+// filters builds matchers from the url, prefix and tag query parameters.
+// Several tags select entries carrying any of them.
+func filters(r *http.Request) []cache.Matcher {
+	query := r.URL.Query()
+	var matchers []cache.Matcher
+	if url := query.Get("url"); url != "" {
+		matchers = append(matchers, cache.MatchURL(url))
+	}
+	if prefix := query.Get("prefix"); prefix != "" {
+		matchers = append(matchers, cache.MatchPrefix(prefix))
+	}
+	if tags := query["tag"]; len(tags) > 0 {
+		matchers = append(matchers, cache.MatchTag(tags...))
+	}
+	return matchers
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
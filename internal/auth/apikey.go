@@ -0,0 +1,158 @@
+package auth
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/shammianand/goproxy/pkg/logger"
+)
+
+// APIKeyOptions configures APIKeyAuth
+type APIKeyOptions struct {
+	// Header carries the API key; it defaults to X-API-Key
+	Header string
+	// QueryParam carries the API key when the header is missing; empty
+	// disables keys in the query string
+	QueryParam string
+	// IdentityHeaderPrefix prefixes the identity headers sent upstream
+	IdentityHeaderPrefix string
+	// ReloadInterval is how often the key file is checked for changes, and
+	// FlushInterval how often usage counters are written; both default to
+	// ten seconds
+	ReloadInterval time.Duration
+	FlushInterval  time.Duration
+}
+
+// APIKeyAuth authenticates requests by API key, enforcing the routes and
+// quotas of each key
+type APIKeyAuth struct {
+	keys   *KeyStore
+	quotas *Quotas
+	opts   APIKeyOptions
+	logger *logger.Logger
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// NewAPIKeyAuth creates an APIKeyAuth and starts reloading the key file and
+// flushing usage counters in the background
+func NewAPIKeyAuth(keys *KeyStore, quotas *Quotas, opts APIKeyOptions, logger *logger.Logger) *APIKeyAuth {
+	if opts.Header == "" {
+		opts.Header = "X-API-Key"
+	}
+	if opts.IdentityHeaderPrefix == "" {
+		opts.IdentityHeaderPrefix = DefaultIdentityHeaderPrefix
+	}
+	if opts.ReloadInterval <= 0 {
+		opts.ReloadInterval = 10 * time.Second
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = 10 * time.Second
+	}
+	a := &APIKeyAuth{
+		keys:   keys,
+		quotas: quotas,
+		opts:   opts,
+		logger: logger,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go a.maintain()
+	return a
+}
+
+// Close stops the background work and writes the usage counters
+func (a *APIKeyAuth) Close() error {
+	close(a.stop)
+	<-a.done
+	return a.quotas.Flush()
+}
+
+func (a *APIKeyAuth) maintain() {
+	defer close(a.done)
+	reload := time.NewTicker(a.opts.ReloadInterval)
+	defer reload.Stop()
+	flush := time.NewTicker(a.opts.FlushInterval)
+	defer flush.Stop()
+	for {
+		select {
+		case <-a.stop:
+			return
+		case <-reload.C:
+			if !a.keys.Changed() {
+				continue
+			}
+			if err := a.keys.Reload(); err != nil {
+				a.logger.Error("Failed to reload API keys, keeping the current keys", "error", err)
+				continue
+			}
+			a.logger.Info("Reloaded API keys", "keys", a.keys.Len())
+		case <-flush.C:
+			if err := a.quotas.Flush(); err != nil {
+				a.logger.Error("Failed to persist API key usage", "error", err)
+			}
+		}
+	}
+}
+
+// credential returns the API key presented by a request
+func (a *APIKeyAuth) credential(r *http.Request) (string, bool) {
+	if key := r.Header.Get(a.opts.Header); key != "" {
+		return key, true
+	}
+	if a.opts.QueryParam != "" {
+		if key := r.URL.Query().Get(a.opts.QueryParam); key != "" {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// Handler returns a handler passing authenticated requests to next, without
+// the API key and with the identity of its owner in headers
+func (a *APIKeyAuth) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, ok := a.credential(r)
+		if !ok {
+			a.unauthorized(w, "API key required")
+			return
+		}
+		k, ok := a.keys.Lookup(key)
+		if !ok || k.Disabled {
+			a.logger.Warn("Invalid API key", "method", r.Method, "path", r.URL.Path, "remote_addr", r.RemoteAddr)
+			a.unauthorized(w, "Invalid API key")
+			return
+		}
+		if !k.allows(r.URL.Path) {
+			a.logger.Warn("API key not allowed on route", "key_id", k.ID, "path", r.URL.Path)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		now := time.Now()
+		if allowed, reset := a.quotas.Take(k, now); !allowed {
+			a.logger.Warn("API key quota exceeded", "key_id", k.ID, "reset", reset.Format(time.RFC3339))
+			w.Header().Set("Retry-After", strconv.FormatInt(int64(reset.Sub(now).Seconds())+1, 10))
+			http.Error(w, "Quota exceeded", http.StatusTooManyRequests)
+			return
+		}
+
+		id := &Identity{Subject: k.ID, Owner: k.Owner, Method: "api_key", Attributes: k.Metadata}
+		r = r.Clone(NewContext(r.Context(), id))
+		r.Header.Del(a.opts.Header)
+		if a.opts.QueryParam != "" {
+			query := r.URL.Query()
+			if query.Has(a.opts.QueryParam) {
+				query.Del(a.opts.QueryParam)
+				r.URL.RawQuery = query.Encode()
+			}
+		}
+		forwardIdentity(r.Header, a.opts.IdentityHeaderPrefix, id)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *APIKeyAuth) unauthorized(w http.ResponseWriter, message string) {
+	w.Header().Set("WWW-Authenticate", `ApiKey realm="goproxy"`)
+	http.Error(w, message, http.StatusUnauthorized)
+}
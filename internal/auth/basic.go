@@ -0,0 +1,143 @@
+package auth
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shammianand/goproxy/internal/urlpath"
+	"github.com/shammianand/goproxy/pkg/logger"
+)
+
+// BasicAuthOptions configures BasicAuth
+type BasicAuthOptions struct {
+	// Realm is announced to clients; it defaults to goproxy
+	Realm string
+	// Routes are the path prefixes requiring a login; empty guards every path
+	Routes []string
+	// StripAuthorization removes the credentials before proxying
+	StripAuthorization bool
+	// IdentityHeaderPrefix prefixes the identity headers sent upstream
+	IdentityHeaderPrefix string
+	// ReloadInterval is how often the htpasswd file is checked for changes;
+	// it defaults to ten seconds
+	ReloadInterval time.Duration
+}
+
+// BasicAuth authenticates requests with HTTP Basic credentials checked
+// against an htpasswd file
+type BasicAuth struct {
+	users  *Htpasswd
+	opts   BasicAuthOptions
+	logger *logger.Logger
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// NewBasicAuth creates a BasicAuth and starts reloading the htpasswd file in
+// the background
+func NewBasicAuth(users *Htpasswd, opts BasicAuthOptions, logger *logger.Logger) *BasicAuth {
+	if opts.Realm == "" {
+		opts.Realm = "goproxy"
+	}
+	if opts.IdentityHeaderPrefix == "" {
+		opts.IdentityHeaderPrefix = DefaultIdentityHeaderPrefix
+	}
+	if opts.ReloadInterval <= 0 {
+		opts.ReloadInterval = 10 * time.Second
+	}
+	a := &BasicAuth{
+		users:  users,
+		opts:   opts,
+		logger: logger,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	a.warnSkipped()
+	go a.maintain()
+	return a
+}
+
+// Close stops reloading the htpasswd file
+func (a *BasicAuth) Close() {
+	close(a.stop)
+	<-a.done
+}
+
+func (a *BasicAuth) maintain() {
+	defer close(a.done)
+	reload := time.NewTicker(a.opts.ReloadInterval)
+	defer reload.Stop()
+	for {
+		select {
+		case <-a.stop:
+			return
+		case <-reload.C:
+			if !a.users.Changed() {
+				continue
+			}
+			if err := a.users.Reload(); err != nil {
+				a.logger.Error("Failed to reload htpasswd file, keeping the current users", "error", err)
+				continue
+			}
+			a.logger.Info("Reloaded htpasswd file", "users", a.users.Len())
+			a.warnSkipped()
+		}
+	}
+}
+
+func (a *BasicAuth) warnSkipped() {
+	if skipped := a.users.Skipped(); len(skipped) > 0 {
+		a.logger.Warn("Skipped htpasswd users with an unsupported hash, use bcrypt, SHA or APR1", "users", skipped)
+	}
+}
+
+// guards reports whether a path requires a login, matching it once cleaned
+// so //staging/ cannot skip it
+func (a *BasicAuth) guards(path string) bool {
+	if len(a.opts.Routes) == 0 {
+		return true
+	}
+	path = urlpath.Clean(path)
+	for _, route := range a.opts.Routes {
+		if strings.HasPrefix(path, route) {
+			return true
+		}
+	}
+	return false
+}
+
+// Handler returns a handler passing authenticated requests to next, with the
+// username in the identity headers
+func (a *BasicAuth) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.guards(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		user, password, ok := r.BasicAuth()
+		if !ok {
+			a.unauthorized(w)
+			return
+		}
+		if !a.users.Verify(user, password) {
+			a.logger.Warn("Invalid basic auth credentials", "user", user, "path", r.URL.Path, "remote_addr", r.RemoteAddr)
+			a.unauthorized(w)
+			return
+		}
+
+		id := &Identity{Subject: user, Method: "basic"}
+		r = r.Clone(NewContext(r.Context(), id))
+		if a.opts.StripAuthorization {
+			r.Header.Del("Authorization")
+		}
+		forwardIdentity(r.Header, a.opts.IdentityHeaderPrefix, id)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *BasicAuth) unauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Basic realm=`+strconv.Quote(a.opts.Realm)+`, charset="UTF-8"`)
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+}
@@ -0,0 +1,247 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shammianand/goproxy/internal/clientip"
+	"github.com/shammianand/goproxy/pkg/logger"
+)
+
+// ForwardAuthOptions configures ForwardAuth
+type ForwardAuthOptions struct {
+	// URL is the authorization service every request is checked with
+	URL string
+	// RequestHeaders are copied from the request to the subrequest
+	RequestHeaders []string
+	// ResponseHeaders are copied from an allowing response to the upstream
+	// request, replacing any sent by the client
+	ResponseHeaders []string
+	// RedirectURL, when set, is where browsers denied with 401 are sent,
+	// with the original URL in the rd query parameter
+	RedirectURL string
+	// Timeout bounds the subrequest; it defaults to five seconds
+	Timeout time.Duration
+	// CacheTTL is how long decisions are reused for identical subrequests;
+	// zero disables caching
+	CacheTTL time.Duration
+	// FailOpen lets requests through when the service cannot be reached or
+	// fails with a 5xx, instead of rejecting them
+	FailOpen bool
+}
+
+// maxForwardAuthBody bounds the body of a denying response passed to clients
+const maxForwardAuthBody = 64 << 10
+
+// maxCachedDecisions bounds the decision cache
+const maxCachedDecisions = 10000
+
+// decision is the answer of the authorization service
+type decision struct {
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+// ForwardAuth delegates the authorization of each request to an external
+// service: 2xx allows the request, anything else is returned to the client
+type ForwardAuth struct {
+	opts   ForwardAuthOptions
+	client *http.Client
+	logger *logger.Logger
+
+	mutex     sync.Mutex
+	decisions map[[sha256.Size]byte]*decision
+}
+
+// NewForwardAuth creates a ForwardAuth
+func NewForwardAuth(opts ForwardAuthOptions, logger *logger.Logger) (*ForwardAuth, error) {
+	if opts.URL == "" {
+		return nil, errors.New("forward auth URL is required")
+	}
+	if _, err := url.Parse(opts.URL); err != nil {
+		return nil, err
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 5 * time.Second
+	}
+	return &ForwardAuth{
+		opts: opts,
+		client: &http.Client{
+			Timeout: opts.Timeout,
+			// Redirects are answers for the client, not for the proxy
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+		logger:    logger,
+		decisions: make(map[[sha256.Size]byte]*decision),
+	}, nil
+}
+
+// Handler returns a handler checking each request with the authorization
+// service before passing it to next
+func (a *ForwardAuth) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req, err := a.subrequest(r)
+		if err != nil {
+			a.logger.Error("Failed to create authorization request", "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		key := a.decisionKey(req)
+		d := a.cached(key)
+		if d == nil {
+			d, err = a.check(req)
+			if err != nil || d.status >= http.StatusInternalServerError {
+				if a.opts.FailOpen {
+					// Allowed without headers, so clients cannot supply them
+					a.logger.Warn("Authorization service failed, allowing request", "url", r.URL.String(), "error", err)
+					d = &decision{status: http.StatusOK, header: http.Header{}}
+				} else if err != nil {
+					a.logger.Error("Authorization service failed", "url", r.URL.String(), "error", err)
+					http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+					return
+				}
+			} else {
+				a.store(key, d)
+			}
+		}
+
+		if d.status < 200 || d.status > 299 {
+			a.logger.Debug("Request denied by authorization service", "method", r.Method, "url", r.URL.String(), "status", d.status)
+			a.deny(w, r, d)
+			return
+		}
+
+		r = r.Clone(r.Context())
+		for _, name := range a.opts.ResponseHeaders {
+			r.Header.Del(name)
+			for _, value := range d.header.Values(name) {
+				r.Header.Add(name, value)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// subrequest builds the request sent to the authorization service. The
+// original method, URL and client are passed as X-Forwarded-* headers.
+func (a *ForwardAuth) subrequest(r *http.Request) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, a.opts.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range a.opts.RequestHeaders {
+		for _, value := range r.Header.Values(name) {
+			req.Header.Add(name, value)
+		}
+	}
+	req.Header.Set("X-Forwarded-Method", r.Method)
+	req.Header.Set("X-Forwarded-Proto", scheme(r))
+	req.Header.Set("X-Forwarded-Host", r.Host)
+	req.Header.Set("X-Forwarded-Uri", r.URL.RequestURI())
+	req.Header.Set("X-Forwarded-For", clientip.FromRequest(r))
+	return req, nil
+}
+
+// decisionKey identifies the subrequests that get the same decision. The
+// client address is part of it, as services may decide by source IP.
+func (a *ForwardAuth) decisionKey(req *http.Request) [sha256.Size]byte {
+	h := sha256.New()
+	for _, name := range []string{"X-Forwarded-Method", "X-Forwarded-Proto", "X-Forwarded-Host", "X-Forwarded-Uri", "X-Forwarded-For"} {
+		io.WriteString(h, req.Header.Get(name)+"\n")
+	}
+	for _, name := range a.opts.RequestHeaders {
+		io.WriteString(h, name+": "+strings.Join(req.Header.Values(name), ", ")+"\n")
+	}
+	var key [sha256.Size]byte
+	h.Sum(key[:0])
+	return key
+}
+
+// check sends the subrequest
+func (a *ForwardAuth) check(req *http.Request) (*decision, error) {
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxForwardAuthBody))
+	if err != nil {
+		return nil, err
+	}
+	return &decision{status: resp.StatusCode, header: resp.Header, body: body}, nil
+}
+
+func (a *ForwardAuth) cached(key [sha256.Size]byte) *decision {
+	if a.opts.CacheTTL <= 0 {
+		return nil
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	d, ok := a.decisions[key]
+	if !ok || time.Now().After(d.expires) {
+		return nil
+	}
+	return d
+}
+
+func (a *ForwardAuth) store(key [sha256.Size]byte, d *decision) {
+	if a.opts.CacheTTL <= 0 {
+		return
+	}
+	now := time.Now()
+	d.expires = now.Add(a.opts.CacheTTL)
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if len(a.decisions) >= maxCachedDecisions {
+		for k, cached := range a.decisions {
+			if now.After(cached.expires) {
+				delete(a.decisions, k)
+			}
+		}
+		if len(a.decisions) >= maxCachedDecisions {
+			a.decisions = make(map[[sha256.Size]byte]*decision)
+		}
+	}
+	a.decisions[key] = d
+}
+
+// deny returns the answer of the authorization service to the client, or
+// redirects browsers to log in
+func (a *ForwardAuth) deny(w http.ResponseWriter, r *http.Request, d *decision) {
+	if a.opts.RedirectURL != "" && d.status == http.StatusUnauthorized &&
+		(r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		original := scheme(r) + "://" + r.Host + r.URL.RequestURI()
+		separator := "?"
+		if strings.Contains(a.opts.RedirectURL, "?") {
+			separator = "&"
+		}
+		http.Redirect(w, r, a.opts.RedirectURL+separator+"rd="+url.QueryEscape(original), http.StatusFound)
+		return
+	}
+	for name, values := range d.header {
+		switch name {
+		case "Connection", "Keep-Alive", "Transfer-Encoding", "Content-Length", "Trailer", "Upgrade":
+			continue
+		}
+		w.Header()[name] = values
+	}
+	w.WriteHeader(d.status)
+	w.Write(d.body)
+}
+
+func scheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
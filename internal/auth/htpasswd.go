@@ -0,0 +1,219 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Htpasswd holds the users of an htpasswd file. Passwords may be hashed with
+// bcrypt ($2y$), SHA-1 ({SHA}) or Apache MD5 ($apr1$).
+type Htpasswd struct {
+	path string
+
+	mutex   sync.RWMutex
+	users   map[string]string
+	modTime time.Time
+	size    int64
+	skipped []string
+	// verified remembers bcrypt checks that passed, which are slow by design
+	verified map[[sha256.Size]byte]bool
+}
+
+// maxVerified bounds the remembered bcrypt checks
+const maxVerified = 1024
+
+// NewHtpasswd loads the users from an htpasswd file
+func NewHtpasswd(path string) (*Htpasswd, error) {
+	h := &Htpasswd{path: path}
+	if err := h.Reload(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Reload reads the htpasswd file again. The current users are kept when it
+// is invalid; users with an unsupported hash are skipped.
+func (h *Htpasswd) Reload() error {
+	info, err := os.Stat(h.path)
+	if err != nil {
+		return fmt.Errorf("failed to read htpasswd file: %w", err)
+	}
+	data, err := os.ReadFile(h.path)
+	if err != nil {
+		return fmt.Errorf("failed to read htpasswd file: %w", err)
+	}
+
+	users := make(map[string]string)
+	var skipped []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return fmt.Errorf("invalid htpasswd file %s: malformed line", h.path)
+		}
+		if !supportedHash(hash) {
+			skipped = append(skipped, user)
+			continue
+		}
+		users[user] = hash
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.users = users
+	h.modTime = info.ModTime()
+	h.size = info.Size()
+	h.skipped = skipped
+	h.verified = make(map[[sha256.Size]byte]bool)
+	return nil
+}
+
+// Changed reports whether the htpasswd file was modified since it was read
+func (h *Htpasswd) Changed() bool {
+	info, err := os.Stat(h.path)
+	if err != nil {
+		return true
+	}
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return !info.ModTime().Equal(h.modTime) || info.Size() != h.size
+}
+
+// Len returns the number of users
+func (h *Htpasswd) Len() int {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return len(h.users)
+}
+
+// Skipped returns the users whose hash is not supported
+func (h *Htpasswd) Skipped() []string {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return h.skipped
+}
+
+// Verify reports whether the password of a user matches
+func (h *Htpasswd) Verify(user, password string) bool {
+	h.mutex.RLock()
+	hash, ok := h.users[user]
+	h.mutex.RUnlock()
+	if !ok {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		key := sha256.Sum256([]byte(user + "\x00" + password + "\x00" + hash))
+		h.mutex.RLock()
+		verified := h.verified[key]
+		h.mutex.RUnlock()
+		if verified {
+			return true
+		}
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+			return false
+		}
+		h.mutex.Lock()
+		if len(h.verified) >= maxVerified {
+			h.verified = make(map[[sha256.Size]byte]bool)
+		}
+		h.verified[key] = true
+		h.mutex.Unlock()
+		return true
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		expected := "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(expected)) == 1
+	case strings.HasPrefix(hash, "$apr1$"):
+		salt, _, _ := strings.Cut(strings.TrimPrefix(hash, "$apr1$"), "$")
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(apr1(password, salt))) == 1
+	}
+	return false
+}
+
+func supportedHash(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$") ||
+		strings.HasPrefix(hash, "{SHA}") || strings.HasPrefix(hash, "$apr1$")
+}
+
+// apr1 hashes a password with the Apache variant of MD5-crypt
+func apr1(password, salt string) string {
+	const magic = "$apr1$"
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw, s := []byte(password), []byte(salt)
+
+	alt := md5.New()
+	alt.Write(pw)
+	alt.Write(s)
+	alt.Write(pw)
+	altSum := alt.Sum(nil)
+
+	d := md5.New()
+	d.Write(pw)
+	d.Write([]byte(magic))
+	d.Write(s)
+	for i := len(pw); i > 0; i -= 16 {
+		d.Write(altSum[:min(i, 16)])
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			d.Write([]byte{0})
+		} else {
+			d.Write(pw[:1])
+		}
+	}
+	sum := d.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		round := md5.New()
+		if i&1 != 0 {
+			round.Write(pw)
+		} else {
+			round.Write(sum)
+		}
+		if i%3 != 0 {
+			round.Write(s)
+		}
+		if i%7 != 0 {
+			round.Write(pw)
+		}
+		if i&1 != 0 {
+			round.Write(sum)
+		} else {
+			round.Write(pw)
+		}
+		sum = round.Sum(nil)
+	}
+
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	var out strings.Builder
+	encode := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			out.WriteByte(itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint32(sum[g[0]])<<16|uint32(sum[g[1]])<<8|uint32(sum[g[2]]), 4)
+	}
+	encode(uint32(sum[11]), 2)
+	return magic + salt + "$" + out.String()
+}
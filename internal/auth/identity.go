@@ -0,0 +1,89 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// DefaultIdentityHeaderPrefix prefixes the headers carrying the identity
+// upstream when no other prefix is configured
+const DefaultIdentityHeaderPrefix = "X-Auth-"
+
+// Identity is an authenticated client
+type Identity struct {
+	// Subject identifies the client, such as the ID of its API key
+	Subject string
+	Owner   string
+	// Method is the authentication method, such as "api_key"
+	Method string
+	// Attributes are forwarded upstream alongside the subject
+	Attributes map[string]string
+}
+
+type identityKey struct{}
+
+// NewContext returns a context carrying an identity
+func NewContext(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// FromContext returns the identity of an authenticated request
+func FromContext(ctx context.Context) (*Identity, bool) {
+	id, ok := ctx.Value(identityKey{}).(*Identity)
+	return id, ok
+}
+
+// StripIdentityHeaders returns a handler removing the identity headers sent
+// by clients from every request before passing it to next. It belongs in
+// front of all the authentication middlewares, so the identity headers
+// reaching the backends are set by GoProxy alone, whatever the route.
+func StripIdentityHeaders(prefix string, next http.Handler) http.Handler {
+	if prefix == "" {
+		prefix = DefaultIdentityHeaderPrefix
+	}
+	canonical := http.CanonicalHeaderKey(prefix)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for name := range r.Header {
+			if strings.HasPrefix(name, canonical) {
+				r = r.Clone(r.Context())
+				stripIdentity(r.Header, prefix)
+				break
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// forwardIdentity replaces any identity headers sent by the client with the
+// authenticated identity
+func forwardIdentity(h http.Header, prefix string, id *Identity) {
+	stripIdentity(h, prefix)
+	prefix = http.CanonicalHeaderKey(prefix)
+	h.Set(prefix+"Subject", id.Subject)
+	h.Set(prefix+"Method", id.Method)
+	if id.Owner != "" {
+		h.Set(prefix+"Owner", id.Owner)
+	}
+	names := make([]string, 0, len(id.Attributes))
+	for name := range id.Attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		// Proxies commonly drop header names with underscores
+		h.Set(prefix+http.CanonicalHeaderKey(strings.ReplaceAll(name, "_", "-")), id.Attributes[name])
+	}
+}
+
+// stripIdentity removes the headers starting with prefix, so clients cannot
+// pose as another identity
+func stripIdentity(h http.Header, prefix string) {
+	prefix = http.CanonicalHeaderKey(prefix)
+	for name := range h {
+		if strings.HasPrefix(name, prefix) {
+			h.Del(name)
+		}
+	}
+}
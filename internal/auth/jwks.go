@@ -0,0 +1,276 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/shammianand/goproxy/pkg/logger"
+)
+
+// jwk is a JSON Web Key (RFC 7517)
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+// verificationKey is a parsed key with the algorithm it is restricted to
+type verificationKey struct {
+	kid string
+	alg string
+	key any
+}
+
+// parseJWKS parses a JWK Set, skipping keys that are not for signatures or
+// of an unsupported type
+func parseJWKS(data []byte) ([]verificationKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %w", err)
+	}
+	var keys []verificationKey
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			continue
+		}
+		keys = append(keys, verificationKey{kid: k.Kid, alg: k.Alg, key: key})
+	}
+	return keys, nil
+}
+
+func (k *jwk) publicKey() (any, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil || len(e) > 4 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("invalid EC point")
+		}
+		return key, nil
+	case "OKP":
+		x, err := decode(k.X)
+		if err != nil || k.Crv != "Ed25519" || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	case "oct":
+		secret, err := decode(k.K)
+		if err != nil || len(secret) == 0 {
+			return nil, errors.New("invalid symmetric key")
+		}
+		return secret, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+	}
+}
+
+// jwksMinRefresh bounds how often an unknown key ID triggers a refetch, unless
+// the refresh interval is shorter
+const jwksMinRefresh = 10 * time.Second
+
+// KeySet holds the keys tokens are verified with: static keys, or keys
+// fetched from a JWKS URL, cached and refreshed as the provider rotates them
+type KeySet struct {
+	url             string
+	refreshInterval time.Duration
+	client          *http.Client
+	logger          *logger.Logger
+
+	mutex       sync.Mutex
+	keys        []verificationKey
+	fetchedAt   time.Time
+	attemptedAt time.Time
+	// refreshing is closed when the fetch in progress completes, and nil
+	// when there is none
+	refreshing chan struct{}
+}
+
+// NewStaticKeySet creates a KeySet from a JWKS file and an HMAC secret,
+// either of which may be empty
+func NewStaticKeySet(jwksFile string, hmacSecret string) (*KeySet, error) {
+	s := &KeySet{}
+	if jwksFile != "" {
+		data, err := os.ReadFile(jwksFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read JWKS file: %w", err)
+		}
+		keys, err := parseJWKS(data)
+		if err != nil {
+			return nil, err
+		}
+		s.keys = keys
+	}
+	if hmacSecret != "" {
+		s.keys = append(s.keys, verificationKey{key: []byte(hmacSecret)})
+	}
+	if len(s.keys) == 0 {
+		return nil, errors.New("no verification keys configured")
+	}
+	return s, nil
+}
+
+// NewRemoteKeySet creates a KeySet fetching keys from a JWKS URL. Keys older
+// than refreshInterval are refetched in the background when the next token is
+// verified, and at once when a token names an unknown key. Failed fetches keep
+// the current keys.
+func NewRemoteKeySet(url string, refreshInterval time.Duration, logger *logger.Logger) *KeySet {
+	if refreshInterval <= 0 {
+		refreshInterval = 5 * time.Minute
+	}
+	s := &KeySet{
+		url:             url,
+		refreshInterval: refreshInterval,
+		client:          &http.Client{Timeout: 10 * time.Second},
+		logger:          logger,
+	}
+	s.attemptedAt = time.Now()
+	s.refresh()
+	return s
+}
+
+// candidates returns the keys that may have signed a token. Expired keys are
+// refreshed in the background and meanwhile still used; only tokens naming
+// an unknown key wait for a fetch, which never holds the mutex.
+func (s *KeySet) candidates(ctx context.Context, kid string) []verificationKey {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	minRefresh := min(jwksMinRefresh, s.refreshInterval)
+	if s.url != "" && time.Since(s.fetchedAt) > s.refreshInterval && time.Since(s.attemptedAt) > minRefresh {
+		s.startRefresh()
+	}
+	matching := s.match(kid)
+	if len(matching) == 0 && kid != "" && s.url != "" && (s.refreshing != nil || time.Since(s.attemptedAt) > minRefresh) {
+		// The provider may have rotated its keys
+		done := s.startRefresh()
+		s.mutex.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+		}
+		s.mutex.Lock()
+		matching = s.match(kid)
+	}
+	return matching
+}
+
+// startRefresh fetches the keys in the background unless a fetch is already
+// in progress, and returns a channel closed once it completes; the mutex must
+// be held
+func (s *KeySet) startRefresh() <-chan struct{} {
+	if s.refreshing == nil {
+		done := make(chan struct{})
+		s.refreshing = done
+		s.attemptedAt = time.Now()
+		go func() {
+			s.refresh()
+			close(done)
+		}()
+	}
+	return s.refreshing
+}
+
+func (s *KeySet) match(kid string) []verificationKey {
+	if kid == "" {
+		return s.keys
+	}
+	var matching []verificationKey
+	for _, k := range s.keys {
+		if k.kid == kid || k.kid == "" {
+			matching = append(matching, k)
+		}
+	}
+	return matching
+}
+
+// refresh fetches the keys and swaps them in; the mutex must not be held
+func (s *KeySet) refresh() {
+	keys, err := s.fetch()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.refreshing = nil
+	if err != nil {
+		s.logger.Error("Failed to fetch JWKS, keeping the current keys", "url", s.url, "error", err)
+		return
+	}
+	s.keys = keys
+	s.fetchedAt = time.Now()
+	s.logger.Debug("Fetched JWKS", "url", s.url, "keys", len(keys))
+}
+
+func (s *KeySet) fetch() ([]verificationKey, error) {
+	req, err := http.NewRequest(http.MethodGet, s.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	return parseJWKS(data)
+}
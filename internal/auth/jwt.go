@@ -0,0 +1,195 @@
+package auth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+var (
+	errMalformedToken   = errors.New("malformed token")
+	errInvalidSignature = errors.New("invalid signature")
+)
+
+// jwtHeader is the JOSE header of a token
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Typ string `json:"typ"`
+}
+
+// Claims are the claims of a verified token
+type Claims map[string]any
+
+// String returns a claim as a string
+func (c Claims) String(name string) string {
+	switch v := c[name].(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return fmt.Sprint(v)
+	default:
+		return ""
+	}
+}
+
+// Strings returns a claim holding a string or an array of strings
+func (c Claims) Strings(name string) []string {
+	switch v := c[name].(type) {
+	case string:
+		return []string{v}
+	case []any:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	default:
+		return nil
+	}
+}
+
+// Scopes returns the OAuth scopes of the token, from the space-separated
+// "scope" claim or the "scp" array
+func (c Claims) Scopes() []string {
+	if scope, ok := c["scope"].(string); ok {
+		return strings.Fields(scope)
+	}
+	return c.Strings("scp")
+}
+
+// time returns a NumericDate claim
+func (c Claims) time(name string) (time.Time, bool, error) {
+	v, ok := c[name]
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	n, ok := v.(json.Number)
+	if !ok {
+		return time.Time{}, false, fmt.Errorf("invalid %s claim", name)
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("invalid %s claim", name)
+	}
+	return time.Unix(0, int64(f*float64(time.Second))), true, nil
+}
+
+// decodeJWT splits a compact JWS into its header, claims, signing input and
+// signature
+func decodeJWT(token string) (*jwtHeader, Claims, []byte, []byte, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, nil, nil, nil, errMalformedToken
+	}
+	rawHeader, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, nil, nil, nil, errMalformedToken
+	}
+	rawClaims, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, nil, nil, nil, errMalformedToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, nil, nil, nil, errMalformedToken
+	}
+
+	var header jwtHeader
+	if err := json.Unmarshal(rawHeader, &header); err != nil {
+		return nil, nil, nil, nil, errMalformedToken
+	}
+	var claims Claims
+	dec := json.NewDecoder(bytes.NewReader(rawClaims))
+	dec.UseNumber()
+	if err := dec.Decode(&claims); err != nil || claims == nil {
+		return nil, nil, nil, nil, errMalformedToken
+	}
+	return &header, claims, []byte(parts[0] + "." + parts[1]), sig, nil
+}
+
+// algorithms maps the supported JWS algorithms to their hash
+var algorithms = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+	"ES256": crypto.SHA256,
+	"ES384": crypto.SHA384,
+	"ES512": crypto.SHA512,
+	"HS256": crypto.SHA256,
+	"HS384": crypto.SHA384,
+	"HS512": crypto.SHA512,
+	"EdDSA": 0,
+}
+
+// verifySignature checks a JWS signature. The key type must match the
+// algorithm, so a public key is never used as an HMAC secret.
+func verifySignature(alg string, key any, input, sig []byte) error {
+	hash, ok := algorithms[alg]
+	if !ok {
+		return fmt.Errorf("unsupported algorithm %s", alg)
+	}
+	var digest []byte
+	if hash != 0 && alg[0] != 'H' {
+		h := hash.New()
+		h.Write(input)
+		digest = h.Sum(nil)
+	}
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if alg[:2] != "RS" {
+			return errInvalidSignature
+		}
+		if rsa.VerifyPKCS1v15(k, hash, digest, sig) != nil {
+			return errInvalidSignature
+		}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if alg[:2] != "ES" || len(sig) != 2*size || curveAlgorithm[k.Curve.Params().Name] != alg {
+			return errInvalidSignature
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return errInvalidSignature
+		}
+	case ed25519.PublicKey:
+		if alg != "EdDSA" || !ed25519.Verify(k, input, sig) {
+			return errInvalidSignature
+		}
+	case []byte:
+		if alg[:2] != "HS" {
+			return errInvalidSignature
+		}
+		mac := hmac.New(hash.New, k)
+		mac.Write(input)
+		if !hmac.Equal(mac.Sum(nil), sig) {
+			return errInvalidSignature
+		}
+	default:
+		return errInvalidSignature
+	}
+	return nil
+}
+
+// curveAlgorithm maps each curve to the only algorithm it may be used with
+var curveAlgorithm = map[string]string{
+	"P-256": "ES256",
+	"P-384": "ES384",
+	"P-521": "ES512",
+}
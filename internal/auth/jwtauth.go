@@ -0,0 +1,183 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/shammianand/goproxy/internal/config"
+	"github.com/shammianand/goproxy/internal/urlpath"
+	"github.com/shammianand/goproxy/pkg/logger"
+)
+
+// JWTOptions configures JWTAuth
+type JWTOptions struct {
+	// Algorithms are the accepted signing algorithms; empty accepts all
+	// supported ones
+	Algorithms []string
+	// Issuer and Audiences are checked against the iss and aud claims when set
+	Issuer    string
+	Audiences []string
+	// ClockSkew is the tolerance applied to exp and nbf
+	ClockSkew time.Duration
+	// ForwardClaims are the claims sent upstream as identity headers
+	ForwardClaims []string
+	// Rules require claims or scopes on path prefixes; the longest prefix
+	// matching a request applies
+	Rules                []config.JWTRule
+	IdentityHeaderPrefix string
+}
+
+// JWTAuth authenticates requests carrying a bearer JWT
+type JWTAuth struct {
+	keys       *KeySet
+	opts       JWTOptions
+	algorithms map[string]bool
+	logger     *logger.Logger
+}
+
+// NewJWTAuth creates a JWTAuth verifying tokens with keys
+func NewJWTAuth(keys *KeySet, opts JWTOptions, logger *logger.Logger) (*JWTAuth, error) {
+	if opts.IdentityHeaderPrefix == "" {
+		opts.IdentityHeaderPrefix = DefaultIdentityHeaderPrefix
+	}
+	a := &JWTAuth{keys: keys, opts: opts, algorithms: make(map[string]bool), logger: logger}
+	for _, alg := range opts.Algorithms {
+		if _, ok := algorithms[alg]; !ok {
+			return nil, fmt.Errorf("unsupported JWT algorithm: %s", alg)
+		}
+		a.algorithms[alg] = true
+	}
+	if len(a.algorithms) == 0 {
+		for alg := range algorithms {
+			a.algorithms[alg] = true
+		}
+	}
+	return a, nil
+}
+
+// Verify checks the signature and registered claims of a token and returns
+// its claims
+func (a *JWTAuth) Verify(ctx context.Context, token string) (Claims, error) {
+	header, claims, input, sig, err := decodeJWT(token)
+	if err != nil {
+		return nil, err
+	}
+	if !a.algorithms[header.Alg] {
+		return nil, fmt.Errorf("algorithm %q not accepted", header.Alg)
+	}
+
+	verified := false
+	for _, k := range a.keys.candidates(ctx, header.Kid) {
+		if k.alg != "" && k.alg != header.Alg {
+			continue
+		}
+		if verifySignature(header.Alg, k.key, input, sig) == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errInvalidSignature
+	}
+
+	now := time.Now()
+	exp, ok, err := claims.time("exp")
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New("token has no expiry")
+	}
+	if !now.Before(exp.Add(a.opts.ClockSkew)) {
+		return nil, errors.New("token expired")
+	}
+	nbf, ok, err := claims.time("nbf")
+	if err != nil {
+		return nil, err
+	}
+	if ok && now.Add(a.opts.ClockSkew).Before(nbf) {
+		return nil, errors.New("token not valid yet")
+	}
+	if a.opts.Issuer != "" && claims.String("iss") != a.opts.Issuer {
+		return nil, errors.New("unexpected issuer")
+	}
+	if len(a.opts.Audiences) > 0 && !slices.ContainsFunc(claims.Strings("aud"), func(aud string) bool {
+		return slices.Contains(a.opts.Audiences, aud)
+	}) {
+		return nil, errors.New("unexpected audience")
+	}
+	return claims, nil
+}
+
+// rule returns the rule with the longest prefix matching a path, which is
+// matched once cleaned
+func (a *JWTAuth) rule(path string) *config.JWTRule {
+	path = urlpath.Clean(path)
+	var best *config.JWTRule
+	for i := range a.opts.Rules {
+		r := &a.opts.Rules[i]
+		if strings.HasPrefix(path, r.PathPrefix) && (best == nil || len(r.PathPrefix) > len(best.PathPrefix)) {
+			best = r
+		}
+	}
+	return best
+}
+
+// authorize checks the claims and scopes a rule requires
+func authorize(rule *config.JWTRule, claims Claims) bool {
+	for name, value := range rule.Claims {
+		if !slices.Contains(claims.Strings(name), value) && claims.String(name) != value {
+			return false
+		}
+	}
+	scopes := claims.Scopes()
+	for _, scope := range rule.Scopes {
+		if !slices.Contains(scopes, scope) {
+			return false
+		}
+	}
+	return true
+}
+
+// Handler returns a handler passing requests with a valid bearer token to
+// next, with the selected claims in identity headers
+func (a *JWTAuth) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="goproxy"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		claims, err := a.Verify(r.Context(), token)
+		if err != nil {
+			a.logger.Warn("Invalid bearer token", "method", r.Method, "url", r.URL.String(), "error", err)
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="goproxy", error="invalid_token", error_description=%q`, err.Error()))
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if rule := a.rule(r.URL.Path); rule != nil && !authorize(rule, claims) {
+			a.logger.Warn("Bearer token lacks required claims", "subject", claims.String("sub"), "path", r.URL.Path)
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="goproxy", error="insufficient_scope", scope=%q`, strings.Join(rule.Scopes, " ")))
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		id := &Identity{Subject: claims.String("sub"), Method: "jwt", Attributes: make(map[string]string)}
+		for _, name := range a.opts.ForwardClaims {
+			if value := strings.Join(claims.Strings(name), ","); value != "" {
+				id.Attributes[name] = value
+			} else if value := claims.String(name); value != "" {
+				id.Attributes[name] = value
+			}
+		}
+		r = r.Clone(NewContext(r.Context(), id))
+		forwardIdentity(r.Header, a.opts.IdentityHeaderPrefix, id)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,153 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/shammianand/goproxy/internal/urlpath"
+)
+
+// APIKey is an entry of the key file
+type APIKey struct {
+	ID string `yaml:"id"`
+	// Key is the key in clear text; KeySHA256 its hex SHA-256 digest, which
+	// keeps the key itself out of the file
+	Key       string `yaml:"key"`
+	KeySHA256 string `yaml:"key_sha256"`
+	Owner     string `yaml:"owner"`
+	// Routes are the path prefixes the key may access; empty allows all
+	Routes       []string          `yaml:"routes"`
+	DailyQuota   int64             `yaml:"daily_quota"`
+	MonthlyQuota int64             `yaml:"monthly_quota"`
+	Disabled     bool              `yaml:"disabled"`
+	Metadata     map[string]string `yaml:"metadata"`
+}
+
+// allows reports whether the key may access a path, which is matched once
+// cleaned so /public/../admin is not taken for a public route
+func (k *APIKey) allows(path string) bool {
+	if len(k.Routes) == 0 {
+		return true
+	}
+	path = urlpath.Clean(path)
+	for _, route := range k.Routes {
+		if strings.HasPrefix(path, route) {
+			return true
+		}
+	}
+	return false
+}
+
+type keyFile struct {
+	Keys []*APIKey `yaml:"keys"`
+}
+
+// KeyStore holds the API keys of a key file, indexed by digest
+type KeyStore struct {
+	path string
+
+	mutex   sync.RWMutex
+	keys    map[[sha256.Size]byte]*APIKey
+	modTime time.Time
+	size    int64
+}
+
+// NewKeyStore loads the API keys from a YAML key file
+func NewKeyStore(path string) (*KeyStore, error) {
+	s := &KeyStore{path: path}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload reads the key file again. The current keys are kept when it is invalid.
+func (s *KeyStore) Reload() error {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return fmt.Errorf("failed to read key file: %w", err)
+	}
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return fmt.Errorf("failed to read key file: %w", err)
+	}
+	// An empty file is most likely being rewritten, and would revoke every
+	// key
+	if strings.TrimSpace(string(data)) == "" {
+		return fmt.Errorf("invalid key file %s: file is empty", s.path)
+	}
+	var file keyFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("invalid key file %s: %w", s.path, err)
+	}
+
+	keys := make(map[[sha256.Size]byte]*APIKey, len(file.Keys))
+	ids := make(map[string]bool, len(file.Keys))
+	for i, k := range file.Keys {
+		if k.ID == "" {
+			return fmt.Errorf("invalid key file %s: key %d has no id", s.path, i)
+		}
+		if ids[k.ID] {
+			return fmt.Errorf("invalid key file %s: duplicate key id %s", s.path, k.ID)
+		}
+		ids[k.ID] = true
+
+		var digest [sha256.Size]byte
+		switch {
+		case k.Key != "":
+			digest = sha256.Sum256([]byte(k.Key))
+		case k.KeySHA256 != "":
+			b, err := hex.DecodeString(k.KeySHA256)
+			if err != nil || len(b) != sha256.Size {
+				return fmt.Errorf("invalid key file %s: key %s has an invalid key_sha256", s.path, k.ID)
+			}
+			copy(digest[:], b)
+		default:
+			return fmt.Errorf("invalid key file %s: key %s has no key or key_sha256", s.path, k.ID)
+		}
+		// Only the digest is needed from here on
+		k.Key = ""
+		keys[digest] = k
+	}
+
+	s.mutex.Lock()
+	s.keys = keys
+	s.modTime = info.ModTime()
+	s.size = info.Size()
+	s.mutex.Unlock()
+	return nil
+}
+
+// Changed reports whether the key file was modified since it was last loaded
+func (s *KeyStore) Changed() bool {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return false
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return !info.ModTime().Equal(s.modTime) || info.Size() != s.size
+}
+
+// Lookup returns the API key matching a key presented by a client
+func (s *KeyStore) Lookup(key string) (*APIKey, bool) {
+	digest := sha256.Sum256([]byte(key))
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	k, ok := s.keys[digest]
+	return k, ok
+}
+
+// Len returns the number of keys
+func (s *KeyStore) Len() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return len(s.keys)
+}
@@ -0,0 +1,439 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/shammianand/goproxy/pkg/logger"
+)
+
+// OIDCOptions configures OIDCAuth
+type OIDCOptions struct {
+	// Issuer is the provider; endpoints left empty are discovered from its
+	// /.well-known/openid-configuration
+	Issuer                string
+	AuthorizationEndpoint string
+	TokenEndpoint         string
+	JWKSURL               string
+	ClientID              string
+	ClientSecret          string
+	// RedirectURL is the callback URL registered with the provider; its path
+	// is served by OIDCAuth
+	RedirectURL string
+	Scopes      []string
+	// CookieName names the session cookie; CookieSecret encrypts it
+	CookieName      string
+	CookieSecret    string
+	SessionLifetime time.Duration
+	// ForwardClaims are the ID token claims sent upstream as identity headers
+	ForwardClaims        []string
+	LogoutPath           string
+	IdentityHeaderPrefix string
+}
+
+// session is the content of the session cookie
+type session struct {
+	Subject      string            `json:"sub"`
+	Claims       map[string]string `json:"claims,omitempty"`
+	RefreshToken string            `json:"rt,omitempty"`
+	// RefreshAt is when the tokens expire and the session is refreshed
+	RefreshAt int64 `json:"ra"`
+	Expires   int64 `json:"exp"`
+}
+
+// loginState is kept in a short-lived cookie between the redirect to the
+// provider and the callback
+type loginState struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	ReturnTo string `json:"return_to"`
+}
+
+// tokenResponse is the token endpoint response
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	IDToken      string `json:"id_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+	Error        string `json:"error"`
+}
+
+// loginStateLifetime bounds how long a login at the provider may take
+const loginStateLifetime = 10 * time.Minute
+
+// OIDCAuth protects upstreams with an OpenID Connect login, keeping the
+// session in an encrypted cookie
+type OIDCAuth struct {
+	opts         OIDCOptions
+	idTokens     *JWTAuth
+	cookies      *cookieCodec
+	callbackPath string
+	secure       bool
+	client       *http.Client
+	logger       *logger.Logger
+}
+
+// NewOIDCAuth creates an OIDCAuth, discovering the provider endpoints that
+// are not configured
+func NewOIDCAuth(opts OIDCOptions, logger *logger.Logger) (*OIDCAuth, error) {
+	if opts.ClientID == "" || opts.RedirectURL == "" {
+		return nil, errors.New("oidc requires a client_id and a redirect_url")
+	}
+	redirect, err := url.Parse(opts.RedirectURL)
+	if err != nil || !redirect.IsAbs() {
+		return nil, fmt.Errorf("invalid oidc redirect_url: %s", opts.RedirectURL)
+	}
+	cookies, err := newCookieCodec(opts.CookieSecret)
+	if err != nil {
+		return nil, err
+	}
+	if opts.CookieName == "" {
+		opts.CookieName = "goproxy_session"
+	}
+	if opts.SessionLifetime <= 0 {
+		opts.SessionLifetime = 24 * time.Hour
+	}
+	if len(opts.Scopes) == 0 {
+		opts.Scopes = []string{"openid", "email", "profile"}
+	}
+	if opts.IdentityHeaderPrefix == "" {
+		opts.IdentityHeaderPrefix = DefaultIdentityHeaderPrefix
+	}
+
+	a := &OIDCAuth{
+		opts:         opts,
+		cookies:      cookies,
+		callbackPath: redirect.Path,
+		secure:       redirect.Scheme == "https",
+		client:       &http.Client{Timeout: 10 * time.Second},
+		logger:       logger,
+	}
+	if opts.AuthorizationEndpoint == "" || opts.TokenEndpoint == "" || opts.JWKSURL == "" {
+		if err := a.discover(); err != nil {
+			return nil, err
+		}
+	}
+	a.idTokens, err = NewJWTAuth(NewRemoteKeySet(a.opts.JWKSURL, 0, logger), JWTOptions{
+		Issuer:    opts.Issuer,
+		Audiences: []string{opts.ClientID},
+		ClockSkew: time.Minute,
+	}, logger)
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// discover fills in the endpoints from the provider metadata
+func (a *OIDCAuth) discover() error {
+	if a.opts.Issuer == "" {
+		return errors.New("oidc requires an issuer or the provider endpoints")
+	}
+	resp, err := a.client.Get(strings.TrimSuffix(a.opts.Issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return fmt.Errorf("oidc discovery failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("oidc discovery failed: unexpected status %d", resp.StatusCode)
+	}
+	var metadata struct {
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		JWKSURI               string `json:"jwks_uri"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&metadata); err != nil {
+		return fmt.Errorf("oidc discovery failed: %w", err)
+	}
+	if a.opts.AuthorizationEndpoint == "" {
+		a.opts.AuthorizationEndpoint = metadata.AuthorizationEndpoint
+	}
+	if a.opts.TokenEndpoint == "" {
+		a.opts.TokenEndpoint = metadata.TokenEndpoint
+	}
+	if a.opts.JWKSURL == "" {
+		a.opts.JWKSURL = metadata.JWKSURI
+	}
+	return nil
+}
+
+// Handler returns a handler serving the callback and logout paths and
+// passing requests with a valid session to next
+func (a *OIDCAuth) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == a.callbackPath {
+			a.callback(w, r)
+			return
+		}
+		if a.opts.LogoutPath != "" && r.URL.Path == a.opts.LogoutPath {
+			a.setCookie(w, a.opts.CookieName, "", -1)
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+
+		s, ok := a.session(w, r)
+		if !ok {
+			a.login(w, r)
+			return
+		}
+
+		id := &Identity{Subject: s.Subject, Method: "oidc", Attributes: s.Claims}
+		r = r.Clone(NewContext(r.Context(), id))
+		stripCookies(r, a.opts.CookieName, a.opts.CookieName+"_login")
+		forwardIdentity(r.Header, a.opts.IdentityHeaderPrefix, id)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// session returns the session of a request, refreshing its tokens when they
+// have expired
+func (a *OIDCAuth) session(w http.ResponseWriter, r *http.Request) (*session, bool) {
+	cookie, err := r.Cookie(a.opts.CookieName)
+	if err != nil {
+		return nil, false
+	}
+	var s session
+	if err := a.cookies.decode(a.opts.CookieName, cookie.Value, &s); err != nil {
+		return nil, false
+	}
+	if time.Now().Unix() < s.RefreshAt {
+		return &s, true
+	}
+	if s.RefreshToken == "" {
+		return nil, false
+	}
+
+	tokens, err := a.exchange(r.Context(), url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {s.RefreshToken},
+	})
+	if err != nil {
+		a.logger.Info("Failed to refresh session, logging in again", "subject", s.Subject, "error", err)
+		return nil, false
+	}
+	if tokens.IDToken != "" {
+		claims, err := a.idTokens.Verify(r.Context(), tokens.IDToken)
+		if err != nil || claims.String("sub") != s.Subject {
+			a.logger.Warn("Invalid ID token on refresh", "subject", s.Subject, "error", err)
+			return nil, false
+		}
+		s.Claims = a.forwardedClaims(claims)
+	}
+	if tokens.RefreshToken != "" {
+		s.RefreshToken = tokens.RefreshToken
+	}
+	s.RefreshAt = a.refreshAt(tokens, nil)
+	if err := a.saveSession(w, &s); err != nil {
+		a.logger.Error("Failed to save session", "error", err)
+		return nil, false
+	}
+	a.logger.Debug("Refreshed session", "subject", s.Subject)
+	return &s, true
+}
+
+// login redirects browsers to the provider; other requests are rejected
+func (a *OIDCAuth) login(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	state := loginState{
+		State:    randomString(32),
+		Nonce:    randomString(32),
+		Verifier: randomString(32),
+		ReturnTo: r.URL.RequestURI(),
+	}
+	value, err := a.cookies.encode(a.opts.CookieName+"_login", state, time.Now().Add(loginStateLifetime))
+	if err != nil {
+		a.logger.Error("Failed to encode login state", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	a.setCookie(w, a.opts.CookieName+"_login", value, int(loginStateLifetime/time.Second))
+
+	challenge := sha256.Sum256([]byte(state.Verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {a.opts.ClientID},
+		"redirect_uri":          {a.opts.RedirectURL},
+		"scope":                 {strings.Join(a.opts.Scopes, " ")},
+		"state":                 {state.State},
+		"nonce":                 {state.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(a.opts.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	http.Redirect(w, r, a.opts.AuthorizationEndpoint+separator+query.Encode(), http.StatusFound)
+}
+
+// callback completes a login: it checks the state, exchanges the code with
+// the PKCE verifier and starts a session from the ID token
+func (a *OIDCAuth) callback(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	cookie, err := r.Cookie(a.opts.CookieName + "_login")
+	var state loginState
+	if err != nil || a.cookies.decode(a.opts.CookieName+"_login", cookie.Value, &state) != nil || query.Get("state") != state.State {
+		a.logger.Warn("Invalid OIDC callback state", "remote_addr", r.RemoteAddr)
+		http.Error(w, "Invalid login state", http.StatusBadRequest)
+		return
+	}
+	a.setCookie(w, a.opts.CookieName+"_login", "", -1)
+	if e := query.Get("error"); e != "" {
+		a.logger.Warn("OIDC login failed", "error", e, "description", query.Get("error_description"))
+		http.Error(w, "Login failed", http.StatusForbidden)
+		return
+	}
+
+	tokens, err := a.exchange(r.Context(), url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {query.Get("code")},
+		"redirect_uri":  {a.opts.RedirectURL},
+		"code_verifier": {state.Verifier},
+	})
+	if err != nil {
+		a.logger.Error("Failed to exchange authorization code", "error", err)
+		http.Error(w, "Login failed", http.StatusBadGateway)
+		return
+	}
+	claims, err := a.idTokens.Verify(r.Context(), tokens.IDToken)
+	if err == nil && claims.String("nonce") != state.Nonce {
+		err = errors.New("nonce mismatch")
+	}
+	if err != nil {
+		a.logger.Warn("Invalid ID token", "error", err)
+		http.Error(w, "Login failed", http.StatusForbidden)
+		return
+	}
+
+	s := &session{
+		Subject:      claims.String("sub"),
+		Claims:       a.forwardedClaims(claims),
+		RefreshToken: tokens.RefreshToken,
+		RefreshAt:    a.refreshAt(tokens, claims),
+		Expires:      time.Now().Add(a.opts.SessionLifetime).Unix(),
+	}
+	if err := a.saveSession(w, s); err != nil {
+		a.logger.Error("Failed to save session", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	a.logger.Info("User logged in", "subject", s.Subject)
+
+	returnTo := state.ReturnTo
+	if !strings.HasPrefix(returnTo, "/") || strings.HasPrefix(returnTo, "//") {
+		returnTo = "/"
+	}
+	http.Redirect(w, r, returnTo, http.StatusFound)
+}
+
+// exchange calls the token endpoint
+func (a *OIDCAuth) exchange(ctx context.Context, form url.Values) (*tokenResponse, error) {
+	if a.opts.ClientSecret == "" {
+		form.Set("client_id", a.opts.ClientID)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.opts.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if a.opts.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(a.opts.ClientID), url.QueryEscape(a.opts.ClientSecret))
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var tokens tokenResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tokens); err != nil {
+		return nil, fmt.Errorf("invalid token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint returned %d: %s", resp.StatusCode, tokens.Error)
+	}
+	return &tokens, nil
+}
+
+// refreshAt returns when the tokens expire: after expires_in, or at the
+// expiry of the ID token
+func (a *OIDCAuth) refreshAt(tokens *tokenResponse, claims Claims) int64 {
+	if tokens.ExpiresIn > 0 {
+		return time.Now().Unix() + tokens.ExpiresIn
+	}
+	if exp, ok, _ := claims.time("exp"); ok {
+		return exp.Unix()
+	}
+	return time.Now().Add(5 * time.Minute).Unix()
+}
+
+func (a *OIDCAuth) forwardedClaims(claims Claims) map[string]string {
+	forwarded := make(map[string]string)
+	for _, name := range a.opts.ForwardClaims {
+		if value := strings.Join(claims.Strings(name), ","); value != "" {
+			forwarded[name] = value
+		} else if value := claims.String(name); value != "" {
+			forwarded[name] = value
+		}
+	}
+	return forwarded
+}
+
+func (a *OIDCAuth) saveSession(w http.ResponseWriter, s *session) error {
+	expires := time.Unix(s.Expires, 0)
+	value, err := a.cookies.encode(a.opts.CookieName, s, expires)
+	if err != nil {
+		return err
+	}
+	if len(value) > 4000 {
+		a.logger.Warn("Session cookie exceeds 4000 bytes and may be dropped by browsers", "size", len(value))
+	}
+	a.setCookie(w, a.opts.CookieName, value, int(time.Until(expires)/time.Second))
+	return nil
+}
+
+func (a *OIDCAuth) setCookie(w http.ResponseWriter, name, value string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   maxAge,
+		Secure:   a.secure,
+		HttpOnly: true,
+		// Lax lets the cookies accompany the redirect back from the provider
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// stripCookies removes the named cookies from a request, keeping the
+// upstream's own cookies
+func stripCookies(r *http.Request, names ...string) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, c := range cookies {
+		keep := true
+		for _, name := range names {
+			if c.Name == name {
+				keep = false
+			}
+		}
+		if keep {
+			r.AddCookie(c)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/shammianand/goproxy/internal/fsutil"
+)
+
+// Usage counts the requests of an API key in the current day and month (UTC)
+type Usage struct {
+	Day        string `json:"day"`
+	DayCount   int64  `json:"day_count"`
+	Month      string `json:"month"`
+	MonthCount int64  `json:"month_count"`
+}
+
+// roll resets the counters of a past day or month
+func (u *Usage) roll(now time.Time) {
+	if day := now.Format(time.DateOnly); u.Day != day {
+		u.Day, u.DayCount = day, 0
+	}
+	if month := now.Format("2006-01"); u.Month != month {
+		u.Month, u.MonthCount = month, 0
+	}
+}
+
+// Quotas counts the requests of each API key, persisting the counters to a
+// file so they survive restarts
+type Quotas struct {
+	path string
+
+	mutex sync.Mutex
+	usage map[string]*Usage
+	dirty bool
+}
+
+// NewQuotas loads the usage counters from path. Without a path, counters are
+// only kept in memory.
+func NewQuotas(path string) (*Quotas, error) {
+	q := &Quotas{path: path, usage: make(map[string]*Usage)}
+	if path == "" {
+		return q, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read usage file: %w", err)
+	}
+	if err := json.Unmarshal(data, &q.usage); err != nil {
+		return nil, fmt.Errorf("invalid usage file %s: %w", path, err)
+	}
+	return q, nil
+}
+
+// Take counts a request of a key unless it would exceed one of its quotas,
+// in which case it returns when the exhausted quota resets
+func (q *Quotas) Take(k *APIKey, now time.Time) (bool, time.Time) {
+	now = now.UTC()
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	u, ok := q.usage[k.ID]
+	if !ok {
+		u = &Usage{}
+		q.usage[k.ID] = u
+	}
+	u.roll(now)
+
+	if k.MonthlyQuota > 0 && u.MonthCount >= k.MonthlyQuota {
+		return false, time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	if k.DailyQuota > 0 && u.DayCount >= k.DailyQuota {
+		return false, time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+	}
+	u.DayCount++
+	u.MonthCount++
+	q.dirty = true
+	return true, time.Time{}
+}
+
+// Usage returns the counters of a key
+func (q *Quotas) Usage(id string, now time.Time) Usage {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	u := Usage{}
+	if current, ok := q.usage[id]; ok {
+		u = *current
+	}
+	u.roll(now.UTC())
+	return u
+}
+
+// Flush writes the counters to the usage file if they changed
+func (q *Quotas) Flush() error {
+	if q.path == "" {
+		return nil
+	}
+	q.mutex.Lock()
+	if !q.dirty {
+		q.mutex.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(q.usage)
+	q.dirty = false
+	q.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := fsutil.WriteFileAtomic(q.path, data); err != nil {
+		q.mutex.Lock()
+		q.dirty = true
+		q.mutex.Unlock()
+		return fmt.Errorf("failed to write usage file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package auth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+var errInvalidCookie = errors.New("invalid cookie")
+
+// cookieCodec seals values into cookies with AES-256-GCM, which both
+// encrypts them and authenticates them against tampering
+type cookieCodec struct {
+	aead cipher.AEAD
+}
+
+// newCookieCodec derives the cookie key from a secret
+func newCookieCodec(secret string) (*cookieCodec, error) {
+	if len(secret) < 32 {
+		return nil, errors.New("cookie secret must be at least 32 characters")
+	}
+	key := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &cookieCodec{aead: aead}, nil
+}
+
+// sealed is the envelope of a sealed value. The cookie name is bound as
+// additional data, so a value cannot be moved to another cookie.
+type sealed struct {
+	Expires int64           `json:"exp"`
+	Value   json.RawMessage `json:"v"`
+}
+
+// encode seals v into a cookie value valid until expires
+func (c *cookieCodec) encode(name string, v any, expires time.Time) (string, error) {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := json.Marshal(sealed{Expires: expires.Unix(), Value: value})
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(c.aead.Seal(nonce, nonce, plaintext, []byte(name))), nil
+}
+
+// decode opens a cookie value into v
+func (c *cookieCodec) decode(name, value string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(data) < c.aead.NonceSize() {
+		return errInvalidCookie
+	}
+	nonce, ciphertext := data[:c.aead.NonceSize()], data[c.aead.NonceSize():]
+	plaintext, err := c.aead.Open(nil, nonce, ciphertext, []byte(name))
+	if err != nil {
+		return errInvalidCookie
+	}
+	var env sealed
+	if err := json.Unmarshal(plaintext, &env); err != nil {
+		return errInvalidCookie
+	}
+	if time.Now().Unix() >= env.Expires {
+		return errors.New("cookie expired")
+	}
+	return json.Unmarshal(env.Value, v)
+}
+
+// randomString returns a URL-safe random string of n bytes of entropy
+func randomString(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
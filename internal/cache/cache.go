@@ -0,0 +1,585 @@
+package cache
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shammianand/goproxy/internal/auth"
+	"github.com/shammianand/goproxy/pkg/logger"
+)
+
+// Store holds cached entries
+type Store interface {
+	Get(key string) (*Entry, bool)
+	Set(entry *Entry) bool
+	Delete(key string)
+	Entries() []*Entry
+}
+
+// Cache is a shared HTTP cache (RFC 9111) placed in front of a handler
+type Cache struct {
+	store           Store
+	defaultTTL      time.Duration
+	maxObjectSize   int64
+	coalesceTimeout time.Duration
+	logger          *logger.Logger
+
+	varyMutex sync.RWMutex
+	vary      map[string][]string
+
+	refreshMutex sync.Mutex
+	refreshing   map[string]bool
+
+	flightMutex sync.Mutex
+	flights     map[string]*flight
+}
+
+// Option configures optional Cache behavior
+type Option func(*Cache)
+
+// WithCoalescing makes concurrent misses for the same resource share a
+// single upstream request. Waiting requests give up after timeout and fetch
+// on their own.
+func WithCoalescing(timeout time.Duration) Option {
+	return func(c *Cache) {
+		c.coalesceTimeout = timeout
+	}
+}
+
+// DefaultMaxObjectSize is the largest body stored when no other limit is
+// configured. Bodies are buffered in memory before they are stored.
+const DefaultMaxObjectSize = 64 << 20
+
+// New creates a new Cache. defaultTTL is used only for responses without
+// explicit freshness information; responses with bodies larger than
+// maxObjectSize are never stored.
+func New(store Store, defaultTTL time.Duration, maxObjectSize int64, logger *logger.Logger, opts ...Option) *Cache {
+	c := &Cache{
+		store:         store,
+		defaultTTL:    defaultTTL,
+		maxObjectSize: maxObjectSize,
+		logger:        logger,
+		vary:          make(map[string][]string),
+		refreshing:    make(map[string]bool),
+		flights:       make(map[string]*flight),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	// Entries loaded from a persistent store still vary on their headers
+	for _, e := range store.Entries() {
+		if len(e.VaryHeaders) > 0 {
+			c.vary[e.PrimaryKey] = e.VaryHeaders
+		}
+	}
+	return c
+}
+
+// Close closes the store, writing out what a persistent store still holds in
+// memory
+func (c *Cache) Close() error {
+	if closer, ok := c.store.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// Handler returns a handler serving requests from the cache where possible
+// and forwarding everything else to next
+func (c *Cache) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.serveHTTP(w, r, next)
+	})
+}
+
+func (c *Cache) serveHTTP(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	primary := primaryKey(r)
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		rw := &statusWriter{ResponseWriter: w, statusCode: http.StatusOK}
+		next.ServeHTTP(rw, r)
+		// A successful unsafe request invalidates the stored resource (RFC 9111 section 4.4)
+		if isUnsafe(r.Method) && rw.statusCode < 400 {
+			c.invalidate(primary)
+		}
+		return
+	}
+
+	reqCC := parseCacheControl(r.Header)
+	if reqCC.has("no-store") {
+		next.ServeHTTP(w, r)
+		return
+	}
+	// Range requests are answered from fresh stored full responses, but
+	// partial responses from upstream are never stored
+	if r.Header.Get("Range") != "" {
+		now := time.Now()
+		if _, entry, ok := c.lookup(primary, r); ok && satisfies(entry, reqCC, r.Header, now) && c.serveEntry(w, r, entry, now, "HIT") {
+			return
+		}
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	c.serve(w, r, next, primary, reqCC, c.coalesceTimeout > 0)
+}
+
+// serve answers a cacheable request from the store, or forwards it when no
+// usable response is stored
+func (c *Cache) serve(w http.ResponseWriter, r *http.Request, next http.Handler, primary string, reqCC cacheControl, coalesce bool) {
+	now := time.Now()
+	key, entry, ok := c.lookup(primary, r)
+	if ok && satisfies(entry, reqCC, r.Header, now) {
+		c.logger.Debug("Cache hit", "key", entry.Key, "age", entry.Age(now).String())
+		if c.serveEntry(w, r, entry, now, "HIT") {
+			return
+		}
+		entry, ok = nil, false
+	}
+	if ok && allowsStale(reqCC, r.Header) && entry.ServableStale(now, entry.StaleWhileRevalidate) {
+		c.logger.Debug("Serving stale response while revalidating", "key", entry.Key, "age", entry.Age(now).String())
+		if c.serveEntry(w, r, entry, now, "STALE") {
+			c.revalidateInBackground(r, next, entry, primary)
+			return
+		}
+		entry = nil
+	}
+
+	if coalesce && r.Method == http.MethodGet && !isConditional(r.Header) {
+		f, leader := c.join(key)
+		if !leader {
+			c.wait(w, r, next, f, primary, reqCC)
+			return
+		}
+		defer c.leave(key, f)
+		f.entry, f.cacheStatus = c.forward(w, r, next, entry, primary)
+		return
+	}
+	c.forward(w, r, next, entry, primary)
+}
+
+// forward fetches a response from upstream, revalidating the stored entry
+// when there is one. It returns the entry now stored for the request, if any,
+// and the X-Cache status under which it may be shared.
+func (c *Cache) forward(w http.ResponseWriter, r *http.Request, next http.Handler, entry *Entry, primary string) (*Entry, string) {
+	// Conditional requests from the client are passed through untouched
+	if entry == nil || isConditional(r.Header) {
+		return c.fetch(w, r, next, primary), "HIT"
+	}
+	return c.revalidate(w, r, next, entry, primary)
+}
+
+// fetch forwards the request while streaming the response to the client and
+// buffering it for storage
+func (c *Cache) fetch(w http.ResponseWriter, r *http.Request, next http.Handler, primary string) *Entry {
+	requestTime := time.Now()
+	rw := &captureWriter{ResponseWriter: w, limit: c.maxObjectSize, buffer: r.Method == http.MethodGet}
+	// The next handler may rewrite the request, which is still needed to
+	// build the cache entry
+	next.ServeHTTP(rw, r.Clone(r.Context()))
+	return c.storeResponse(r, primary, rw, requestTime)
+}
+
+// storeResponse stores a response recorded by a captureWriter if it is
+// complete and cacheable
+func (c *Cache) storeResponse(r *http.Request, primary string, rw *captureWriter, requestTime time.Time) *Entry {
+	if !rw.buffer || rw.overflow || !rw.wroteHeader || rw.intercepted {
+		return nil
+	}
+	entry := c.newEntry(r, primary, rw.statusCode, rw.Header(), rw.body.Bytes(), requestTime, time.Now())
+	if entry == nil {
+		return nil
+	}
+	c.storeEntry(entry)
+	return entry
+}
+
+// storeEntry records the entry and the headers its resource varies on
+func (c *Cache) storeEntry(entry *Entry) {
+	if !c.store.Set(entry) {
+		return
+	}
+	c.varyMutex.Lock()
+	if len(entry.VaryHeaders) > 0 {
+		c.vary[entry.PrimaryKey] = entry.VaryHeaders
+	} else {
+		delete(c.vary, entry.PrimaryKey)
+	}
+	c.varyMutex.Unlock()
+
+	c.logger.Debug("Cache store",
+		"key", entry.Key,
+		"status", entry.StatusCode,
+		"ttl", entry.Lifetime.String(),
+		"size", entry.Size(),
+	)
+}
+
+// lookup finds the stored variant matching the request. The key of the
+// variant is returned even when nothing is stored under it.
+func (c *Cache) lookup(primary string, r *http.Request) (string, *Entry, bool) {
+	c.varyMutex.RLock()
+	names := c.vary[primary]
+	c.varyMutex.RUnlock()
+	key := variantKey(primary, names, r.Header)
+	entry, ok := c.store.Get(key)
+	return key, entry, ok
+}
+
+// invalidate removes every stored variant of a resource
+func (c *Cache) invalidate(primary string) {
+	c.varyMutex.Lock()
+	delete(c.vary, primary)
+	c.varyMutex.Unlock()
+
+	for _, e := range c.store.Entries() {
+		if e.PrimaryKey == primary {
+			c.store.Delete(e.Key)
+		}
+	}
+}
+
+// newEntry builds a cache entry from a response, or returns nil when the
+// response must not be stored by a shared cache
+func (c *Cache) newEntry(r *http.Request, primary string, status int, header http.Header, body []byte, requestTime, responseTime time.Time) *Entry {
+	// Partial and not-modified responses do not represent the full resource
+	if status == http.StatusPartialContent || status == http.StatusNotModified {
+		return nil
+	}
+	resCC := parseCacheControl(header)
+	if resCC.has("no-store") || resCC.has("private") {
+		return nil
+	}
+	if r.Header.Get("Authorization") != "" &&
+		!resCC.has("public") && !resCC.has("s-maxage") && !resCC.has("must-revalidate") {
+		return nil
+	}
+	// Authentication middlewares may have removed the credentials, so the
+	// authenticated identity is checked as well
+	if _, ok := auth.FromContext(r.Context()); ok && !resCC.has("public") && !resCC.has("s-maxage") {
+		return nil
+	}
+	// Responses setting cookies are specific to one client
+	if header.Get("Set-Cookie") != "" {
+		return nil
+	}
+
+	varyHeaders, ok := parseVary(header)
+	if !ok {
+		return nil
+	}
+
+	lifetime, explicit := freshnessLifetime(header, resCC)
+	if !explicit {
+		if !cacheableByDefault[status] || c.defaultTTL <= 0 {
+			return nil
+		}
+		lifetime = c.defaultTTL
+	}
+
+	stored := header.Clone()
+	stored.Del("X-Cache")
+	stored.Del("Age")
+
+	entry := &Entry{
+		Key:          variantKey(primary, varyHeaders, r.Header),
+		PrimaryKey:   primary,
+		URL:          requestURL(r),
+		StatusCode:   status,
+		Header:       stored,
+		Body:         bytes.Clone(body),
+		BodySize:     int64(len(body)),
+		VaryHeaders:  varyHeaders,
+		Variant:      variant(varyHeaders, r.Header),
+		Tags:         parseTags(header),
+		RequestTime:  requestTime,
+		ResponseTime: responseTime,
+		Lifetime:     lifetime,
+		InitialAge:   initialAge(header, requestTime, responseTime),
+	}
+	applyDirectives(entry, resCC)
+
+	// Responses that are stale on arrival are only worth keeping when they can
+	// be revalidated or served on errors
+	if (lifetime <= 0 || entry.NoCache) && !entry.HasValidators() && !entry.ServableStale(responseTime, entry.StaleIfError) {
+		return nil
+	}
+	return entry
+}
+
+// applyDirectives records the response directives that control reuse of a
+// stored response
+func applyDirectives(e *Entry, cc cacheControl) {
+	e.NoCache = cc.has("no-cache")
+	e.MustRevalidate = cc.has("must-revalidate") || cc.has("proxy-revalidate")
+	e.StaleWhileRevalidate, _ = cc.duration("stale-while-revalidate")
+	e.StaleIfError, _ = cc.duration("stale-if-error")
+}
+
+// satisfies reports whether a stored entry may answer the request without
+// contacting the origin, taking request directives into account
+func satisfies(e *Entry, reqCC cacheControl, reqHeader http.Header, now time.Time) bool {
+	if e.NoCache || requestsNoCache(reqCC, reqHeader) {
+		return false
+	}
+	age := e.Age(now)
+	if maxAge, ok := reqCC.duration("max-age"); ok && age > maxAge {
+		return false
+	}
+	if minFresh, ok := reqCC.duration("min-fresh"); ok && e.TTL(now) < minFresh {
+		return false
+	}
+	return e.Fresh(now)
+}
+
+// allowsStale reports whether the request tolerates a stale response
+func allowsStale(reqCC cacheControl, reqHeader http.Header) bool {
+	return !requestsNoCache(reqCC, reqHeader) && !reqCC.has("max-age") && !reqCC.has("min-fresh")
+}
+
+func requestsNoCache(reqCC cacheControl, reqHeader http.Header) bool {
+	if reqCC.has("no-cache") {
+		return true
+	}
+	return len(reqCC) == 0 && strings.Contains(strings.ToLower(reqHeader.Get("Pragma")), "no-cache")
+}
+
+// serveEntry writes a stored response to the client. It returns false,
+// having written nothing, when the stored body is no longer readable; the
+// entry is then dropped.
+func (c *Cache) serveEntry(w http.ResponseWriter, r *http.Request, e *Entry, now time.Time, status string) bool {
+	body, err := e.Open()
+	if err != nil {
+		c.logger.Error("Failed to open cached body", "key", e.Key, "error", err)
+		c.store.Delete(e.Key)
+		return false
+	}
+	defer body.Close()
+
+	h := w.Header()
+	for name, values := range e.Header {
+		h[name] = append([]string(nil), values...)
+	}
+	h.Set("Age", strconv.FormatInt(int64(e.Age(now)/time.Second), 10))
+	h.Set("X-Cache", status)
+
+	if e.StatusCode != http.StatusOK {
+		w.WriteHeader(e.StatusCode)
+		if r.Method != http.MethodHead {
+			io.Copy(w, body)
+		}
+		return true
+	}
+	// ServeContent answers range and conditional requests from the full
+	// stored response
+	modtime, _ := http.ParseTime(e.Header.Get("Last-Modified"))
+	http.ServeContent(w, r, "", modtime, body)
+	return true
+}
+
+// parseVary returns the canonical request header names listed in Vary. ok is
+// false for "Vary: *", which can never be matched.
+func parseVary(h http.Header) ([]string, bool) {
+	var names []string
+	for _, line := range h.Values("Vary") {
+		for _, name := range strings.Split(line, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			if name == "*" {
+				return nil, false
+			}
+			names = append(names, http.CanonicalHeaderKey(name))
+		}
+	}
+	sort.Strings(names)
+	return names, true
+}
+
+func primaryKey(r *http.Request) string {
+	return requestURL(r)
+}
+
+func requestURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + strings.ToLower(r.Host) + r.URL.RequestURI()
+}
+
+// variantKey extends the primary key with the request header values the
+// response varies on
+func variantKey(primary string, varyHeaders []string, reqHeader http.Header) string {
+	if len(varyHeaders) == 0 {
+		return primary
+	}
+	var b strings.Builder
+	b.WriteString(primary)
+	for _, name := range varyHeaders {
+		b.WriteString("\x00")
+		b.WriteString(name)
+		b.WriteString("=")
+		b.WriteString(strings.Join(reqHeader.Values(name), ","))
+	}
+	return b.String()
+}
+
+func variant(varyHeaders []string, reqHeader http.Header) map[string]string {
+	if len(varyHeaders) == 0 {
+		return nil
+	}
+	values := make(map[string]string, len(varyHeaders))
+	for _, name := range varyHeaders {
+		values[name] = strings.Join(reqHeader.Values(name), ",")
+	}
+	return values
+}
+
+// parseTags returns the surrogate keys of a response, taken from the
+// space-separated Surrogate-Key and comma-separated Cache-Tag headers
+func parseTags(h http.Header) []string {
+	var tags []string
+	for _, line := range h.Values("Surrogate-Key") {
+		tags = append(tags, strings.Fields(line)...)
+	}
+	for _, line := range h.Values("Cache-Tag") {
+		for _, tag := range strings.Split(line, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return tags
+}
+
+func isUnsafe(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return false
+	}
+	return true
+}
+
+// captureWriter passes a response through to the client while recording its
+// status and headers and, optionally, buffering up to limit body bytes.
+// Responses whose status is claimed by intercept are recorded but never
+// reach the client.
+type captureWriter struct {
+	http.ResponseWriter
+	header      http.Header
+	statusCode  int
+	wroteHeader bool
+	intercept   func(code int) bool
+	intercepted bool
+	buffer      bool
+	limit       int64
+	body        bytes.Buffer
+	overflow    bool
+}
+
+func (cw *captureWriter) Header() http.Header {
+	if cw.header == nil {
+		cw.header = make(http.Header)
+	}
+	return cw.header
+}
+
+func (cw *captureWriter) WriteHeader(code int) {
+	if cw.wroteHeader {
+		return
+	}
+	// Informational responses are forwarded as they are
+	if code >= 100 && code < 200 && code != http.StatusSwitchingProtocols {
+		if cw.intercept == nil {
+			copyHeader(cw.ResponseWriter.Header(), cw.Header())
+			cw.ResponseWriter.WriteHeader(code)
+		}
+		return
+	}
+	cw.wroteHeader = true
+	cw.statusCode = code
+	if cw.intercept != nil && cw.intercept(code) {
+		cw.intercepted = true
+		return
+	}
+	copyHeader(cw.ResponseWriter.Header(), cw.Header())
+	cw.ResponseWriter.Header().Set("X-Cache", "MISS")
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+func (cw *captureWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.intercepted {
+		return len(b), nil
+	}
+	if cw.buffer && !cw.overflow {
+		if int64(cw.body.Len()+len(b)) > cw.limit {
+			cw.overflow = true
+			cw.body = bytes.Buffer{}
+		} else {
+			cw.body.Write(b)
+		}
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+func (cw *captureWriter) Flush() {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.intercepted {
+		return
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// discardWriter is the client side of background revalidations
+type discardWriter struct {
+	header http.Header
+}
+
+func (d *discardWriter) Header() http.Header {
+	if d.header == nil {
+		d.header = make(http.Header)
+	}
+	return d.header
+}
+
+func (d *discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+
+func (d *discardWriter) WriteHeader(int) {}
+
+func copyHeader(dst, src http.Header) {
+	for name, values := range src {
+		dst[name] = values
+	}
+}
+
+// statusWriter records the status code of a response passed through untouched
+type statusWriter struct {
+	http.ResponseWriter
+	statusCode int
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	sw.statusCode = code
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *statusWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,66 @@
+package cache
+
+import (
+	"net/http"
+	"time"
+)
+
+// flight is an upstream request shared by concurrent misses for the same key
+type flight struct {
+	done chan struct{}
+	// entry is the response stored by the leading request, if any, and
+	// cacheStatus the X-Cache status it is shared under
+	entry       *Entry
+	cacheStatus string
+}
+
+// join returns the flight for key, starting a new one when none is in
+// progress. leader is true for the request that has to fetch the response.
+func (c *Cache) join(key string) (f *flight, leader bool) {
+	c.flightMutex.Lock()
+	defer c.flightMutex.Unlock()
+	if f, ok := c.flights[key]; ok {
+		return f, false
+	}
+	f = &flight{done: make(chan struct{})}
+	c.flights[key] = f
+	return f, true
+}
+
+// leave completes a flight and releases the requests waiting on it
+func (c *Cache) leave(key string, f *flight) {
+	c.flightMutex.Lock()
+	delete(c.flights, key)
+	c.flightMutex.Unlock()
+	close(f.done)
+}
+
+// wait serves a request from the response of the flight it joined. Requests
+// the shared response cannot answer, and requests that wait too long, are
+// forwarded on their own.
+func (c *Cache) wait(w http.ResponseWriter, r *http.Request, next http.Handler, f *flight, primary string, reqCC cacheControl) {
+	timer := time.NewTimer(c.coalesceTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-f.done:
+	case <-timer.C:
+		c.logger.Debug("Coalesced request timed out", "url", requestURL(r))
+		c.serve(w, r, next, primary, reqCC, false)
+		return
+	case <-r.Context().Done():
+		return
+	}
+
+	// The shared response may vary on headers this request does not match,
+	// and no-cache responses must be validated for every request
+	e := f.entry
+	if e == nil || e.NoCache || e.Key != variantKey(primary, e.VaryHeaders, r.Header) {
+		c.serve(w, r, next, primary, reqCC, false)
+		return
+	}
+	c.logger.Debug("Coalesced request served", "key", e.Key)
+	if !c.serveEntry(w, r, e, time.Now(), f.cacheStatus) {
+		c.serve(w, r, next, primary, reqCC, false)
+	}
+}
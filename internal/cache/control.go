@@ -0,0 +1,106 @@
+package cache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cacheControl holds the parsed directives of a Cache-Control header
+type cacheControl map[string]string
+
+func parseCacheControl(h http.Header) cacheControl {
+	cc := cacheControl{}
+	for _, line := range h.Values("Cache-Control") {
+		for _, part := range strings.Split(line, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			name, value, _ := strings.Cut(part, "=")
+			cc[strings.ToLower(strings.TrimSpace(name))] = strings.Trim(strings.TrimSpace(value), `"`)
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(directive string) bool {
+	_, ok := cc[directive]
+	return ok
+}
+
+// duration returns a delta-seconds directive value
+func (cc cacheControl) duration(directive string) (time.Duration, bool) {
+	value, ok := cc[directive]
+	if !ok {
+		return 0, false
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+// cacheableByDefault lists status codes that may be stored using heuristic or
+// default freshness (RFC 9110 section 15.1)
+var cacheableByDefault = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+// freshnessLifetime computes how long a response stays fresh in a shared
+// cache (RFC 9111 section 4.2.1). ok is false when the response carries no
+// explicit freshness information.
+func freshnessLifetime(h http.Header, cc cacheControl) (lifetime time.Duration, ok bool) {
+	if d, ok := cc.duration("s-maxage"); ok {
+		return d, true
+	}
+	if d, ok := cc.duration("max-age"); ok {
+		return d, true
+	}
+	if expires := h.Get("Expires"); expires != "" {
+		exp, err := http.ParseTime(expires)
+		if err != nil {
+			// Invalid dates, such as "0", mean already expired
+			return 0, true
+		}
+		date := time.Now()
+		if d, err := http.ParseTime(h.Get("Date")); err == nil {
+			date = d
+		}
+		if exp.Before(date) {
+			return 0, true
+		}
+		return exp.Sub(date), true
+	}
+	return 0, false
+}
+
+// initialAge computes the corrected initial age of a response (RFC 9111
+// section 4.2.3)
+func initialAge(h http.Header, requestTime, responseTime time.Time) time.Duration {
+	var apparentAge time.Duration
+	if date, err := http.ParseTime(h.Get("Date")); err == nil && responseTime.After(date) {
+		apparentAge = responseTime.Sub(date)
+	}
+	var ageValue time.Duration
+	if seconds, err := strconv.ParseInt(h.Get("Age"), 10, 64); err == nil && seconds > 0 {
+		ageValue = time.Duration(seconds) * time.Second
+	}
+	correctedAge := ageValue + responseTime.Sub(requestTime)
+	if apparentAge > correctedAge {
+		return apparentAge
+	}
+	return correctedAge
+}
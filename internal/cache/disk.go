@@ -0,0 +1,326 @@
+package cache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/shammianand/goproxy/internal/fsutil"
+)
+
+const indexFile = "index.json"
+
+// indexFlushInterval is how often changes to the index are written, so a
+// burst of stores costs one write rather than one per entry
+const indexFlushInterval = 5 * time.Second
+
+// DiskStore is a Store keeping response bodies on disk as content-addressed
+// files next to a JSON index of the entries, so cached responses survive
+// restarts. Entries are evicted least recently used first once the bodies
+// exceed the byte budget; identical bodies are stored once. The index is
+// written every few seconds and on Close; entries stored since the last write
+// are lost on a crash, and their bodies removed on the next start.
+type DiskStore struct {
+	dir      string
+	maxBytes int64
+	done     chan struct{}
+	closed   sync.WaitGroup
+
+	mutex   sync.Mutex
+	size    int64
+	lru     *list.List
+	records map[string]*list.Element
+	refs    map[string]int
+	dirty   bool
+
+	// saveMutex orders the writes of the index
+	saveMutex sync.Mutex
+}
+
+// diskRecord is an index entry
+type diskRecord struct {
+	Entry      *Entry    `json:"entry"`
+	Hash       string    `json:"hash"`
+	LastAccess time.Time `json:"last_access"`
+}
+
+// NewDiskStore opens the disk store in dir, loading the entries stored by a
+// previous run. A missing or unreadable index starts an empty store.
+func NewDiskStore(dir string, maxBytes int64) (*DiskStore, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "objects"), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	d := &DiskStore{
+		dir:      dir,
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		records:  make(map[string]*list.Element),
+		refs:     make(map[string]int),
+		done:     make(chan struct{}),
+	}
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+	d.closed.Add(1)
+	go d.flushLoop()
+	return d, nil
+}
+
+// Close writes the pending changes to the index and stops writing it
+func (d *DiskStore) Close() error {
+	close(d.done)
+	d.closed.Wait()
+	return d.saveIndex()
+}
+
+func (d *DiskStore) flushLoop() {
+	defer d.closed.Done()
+	ticker := time.NewTicker(indexFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			d.saveIndex()
+		case <-d.done:
+			return
+		}
+	}
+}
+
+// Get returns the entry stored under key, with its body left on disk
+func (d *DiskStore) Get(key string) (*Entry, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	el, ok := d.records[key]
+	if !ok {
+		return nil, false
+	}
+	d.lru.MoveToFront(el)
+	rec := el.Value.(*diskRecord)
+	rec.LastAccess = time.Now()
+	return d.entry(rec), true
+}
+
+// Set writes the entry body and records the entry in the index, evicting
+// older entries as needed. Bodies larger than the whole budget are not stored.
+// The body is written before the mutex is taken.
+func (d *DiskStore) Set(entry *Entry) bool {
+	if entry.bodySize() > d.maxBytes {
+		return false
+	}
+	tmp, hash, size, err := d.writeTemp(entry)
+	if err != nil {
+		return false
+	}
+	defer os.Remove(tmp)
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.refs[hash] == 0 {
+		path := d.objectPath(hash)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return false
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			return false
+		}
+	}
+
+	stored := *entry
+	stored.Body = nil
+	stored.bodyPath = ""
+	stored.BodySize = size
+
+	// Reference the new body before releasing the old one, which may be the same
+	d.refs[hash]++
+	if d.refs[hash] == 1 {
+		d.size += size
+	}
+	if el, ok := d.records[entry.Key]; ok {
+		d.removeElement(el)
+	}
+	d.records[entry.Key] = d.lru.PushFront(&diskRecord{Entry: &stored, Hash: hash, LastAccess: time.Now()})
+
+	for d.size > d.maxBytes {
+		oldest := d.lru.Back()
+		if oldest == nil {
+			break
+		}
+		d.removeElement(oldest)
+	}
+	d.dirty = true
+	_, ok := d.records[entry.Key]
+	return ok
+}
+
+// Delete removes the entry stored under key
+func (d *DiskStore) Delete(key string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if el, ok := d.records[key]; ok {
+		d.removeElement(el)
+		d.dirty = true
+	}
+}
+
+// Entries returns all stored entries, most recently used first
+func (d *DiskStore) Entries() []*Entry {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	entries := make([]*Entry, 0, d.lru.Len())
+	for el := d.lru.Front(); el != nil; el = el.Next() {
+		entries = append(entries, d.entry(el.Value.(*diskRecord)))
+	}
+	return entries
+}
+
+// Size returns the number of body bytes currently stored
+func (d *DiskStore) Size() int64 {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.size
+}
+
+func (d *DiskStore) entry(rec *diskRecord) *Entry {
+	e := *rec.Entry
+	e.bodyPath = d.objectPath(rec.Hash)
+	return &e
+}
+
+func (d *DiskStore) objectPath(hash string) string {
+	return filepath.Join(d.dir, "objects", hash[:2], hash)
+}
+
+// writeTemp streams the entry body to a temporary file, returning its path
+// and the SHA-256 the body is stored under
+func (d *DiskStore) writeTemp(entry *Entry) (string, string, int64, error) {
+	body, err := entry.Open()
+	if err != nil {
+		return "", "", 0, err
+	}
+	defer body.Close()
+
+	tmp, err := os.CreateTemp(d.dir, fsutil.TempPrefix+"*")
+	if err != nil {
+		return "", "", 0, err
+	}
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", "", 0, err
+	}
+	return tmp.Name(), hex.EncodeToString(h.Sum(nil)), size, nil
+}
+
+func (d *DiskStore) removeElement(el *list.Element) {
+	rec := d.lru.Remove(el).(*diskRecord)
+	delete(d.records, rec.Entry.Key)
+	d.refs[rec.Hash]--
+	if d.refs[rec.Hash] > 0 {
+		return
+	}
+	delete(d.refs, rec.Hash)
+	d.size -= rec.Entry.BodySize
+	os.Remove(d.objectPath(rec.Hash))
+}
+
+// saveIndex writes the index if it changed, most recently used entries
+// first. The records are copied under the mutex and written outside it.
+// Failures only cost the entries added since the last successful write.
+func (d *DiskStore) saveIndex() error {
+	d.saveMutex.Lock()
+	defer d.saveMutex.Unlock()
+
+	d.mutex.Lock()
+	if !d.dirty {
+		d.mutex.Unlock()
+		return nil
+	}
+	records := make([]diskRecord, 0, d.lru.Len())
+	for el := d.lru.Front(); el != nil; el = el.Next() {
+		records = append(records, *el.Value.(*diskRecord))
+	}
+	d.dirty = false
+	d.mutex.Unlock()
+
+	data, err := json.Marshal(records)
+	if err == nil {
+		err = fsutil.WriteFileAtomic(filepath.Join(d.dir, indexFile), data)
+	}
+	if err != nil {
+		d.mutex.Lock()
+		d.dirty = true
+		d.mutex.Unlock()
+	}
+	return err
+}
+
+// load restores the index of a previous run, dropping entries whose body is
+// gone and body files no entry refers to
+func (d *DiskStore) load() error {
+	var records []*diskRecord
+	data, err := os.ReadFile(filepath.Join(d.dir, indexFile))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to read cache index: %w", err)
+	}
+	if len(data) > 0 && json.Unmarshal(data, &records) != nil {
+		records = nil
+	}
+
+	for _, rec := range records {
+		if rec.Entry == nil || len(rec.Hash) != sha256.Size*2 {
+			continue
+		}
+		if _, ok := d.records[rec.Entry.Key]; ok {
+			continue
+		}
+		info, err := os.Stat(d.objectPath(rec.Hash))
+		if err != nil || info.Size() != rec.Entry.BodySize {
+			continue
+		}
+		d.refs[rec.Hash]++
+		if d.refs[rec.Hash] == 1 {
+			d.size += rec.Entry.BodySize
+		}
+		d.records[rec.Entry.Key] = d.lru.PushBack(rec)
+	}
+
+	// Remove partial writes and bodies without entries, such as those of an
+	// index that was lost
+	if tmps, err := filepath.Glob(filepath.Join(d.dir, fsutil.TempPrefix+"*")); err == nil {
+		for _, tmp := range tmps {
+			os.Remove(tmp)
+		}
+	}
+	filepath.WalkDir(filepath.Join(d.dir, "objects"), func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return nil
+		}
+		if d.refs[entry.Name()] == 0 {
+			os.Remove(path)
+		}
+		return nil
+	})
+
+	// The budget may have shrunk since the last run
+	for d.size > d.maxBytes {
+		d.removeElement(d.lru.Back())
+	}
+	d.dirty = true
+	d.saveIndex()
+	return nil
+}
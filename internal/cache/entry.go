@@ -0,0 +1,121 @@
+package cache
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Entry is a stored response
+type Entry struct {
+	// Key identifies the entry, including the request headers it varies on
+	Key string `json:"key"`
+	// PrimaryKey identifies the resource regardless of variants
+	PrimaryKey  string      `json:"primary_key"`
+	URL         string      `json:"url"`
+	StatusCode  int         `json:"status_code"`
+	Header      http.Header `json:"header"`
+	Body        []byte      `json:"-"`
+	BodySize    int64       `json:"body_size"`
+	VaryHeaders []string    `json:"vary_headers,omitempty"`
+	// Variant holds the request header values this entry was selected by
+	Variant map[string]string `json:"variant,omitempty"`
+	// Tags are the surrogate keys the entry can be purged by
+	Tags []string `json:"tags,omitempty"`
+
+	RequestTime  time.Time     `json:"request_time"`
+	ResponseTime time.Time     `json:"response_time"`
+	Lifetime     time.Duration `json:"lifetime"`
+	InitialAge   time.Duration `json:"initial_age"`
+
+	// NoCache entries must be revalidated before every reuse
+	NoCache bool `json:"no_cache,omitempty"`
+	// MustRevalidate entries are never served stale
+	MustRevalidate       bool          `json:"must_revalidate,omitempty"`
+	StaleWhileRevalidate time.Duration `json:"stale_while_revalidate,omitempty"`
+	StaleIfError         time.Duration `json:"stale_if_error,omitempty"`
+
+	// bodyPath is set instead of Body for entries read from disk
+	bodyPath string
+}
+
+// Age returns the current age of the entry (RFC 9111 section 4.2.3)
+func (e *Entry) Age(now time.Time) time.Duration {
+	return e.InitialAge + now.Sub(e.ResponseTime)
+}
+
+// Fresh reports whether the entry can be served without contacting the origin
+func (e *Entry) Fresh(now time.Time) bool {
+	return e.Lifetime > e.Age(now)
+}
+
+// TTL returns the remaining freshness of the entry, which is negative once
+// the entry is stale
+func (e *Entry) TTL(now time.Time) time.Duration {
+	return e.Lifetime - e.Age(now)
+}
+
+// ServableStale reports whether the entry may still be served within the
+// given window past its freshness lifetime
+func (e *Entry) ServableStale(now time.Time, window time.Duration) bool {
+	if e.NoCache || e.MustRevalidate || window <= 0 {
+		return false
+	}
+	return -e.TTL(now) < window
+}
+
+// HasValidators reports whether the entry can be revalidated with a
+// conditional request
+func (e *Entry) HasValidators() bool {
+	return e.Header.Get("ETag") != "" || e.Header.Get("Last-Modified") != ""
+}
+
+// Open returns a reader for the body of the entry
+func (e *Entry) Open() (io.ReadSeekCloser, error) {
+	if e.bodyPath != "" {
+		return os.Open(e.bodyPath)
+	}
+	return nopCloser{bytes.NewReader(e.Body)}, nil
+}
+
+// Size approximates the memory used by the entry
+func (e *Entry) Size() int64 {
+	size := e.bodySize() + int64(len(e.Key)+len(e.URL))
+	for name, values := range e.Header {
+		size += int64(len(name))
+		for _, v := range values {
+			size += int64(len(v))
+		}
+	}
+	return size
+}
+
+func (e *Entry) bodySize() int64 {
+	if e.Body != nil || e.bodyPath == "" {
+		return int64(len(e.Body))
+	}
+	return e.BodySize
+}
+
+// withBody returns a copy of the entry holding its body in memory
+func (e *Entry) withBody() (*Entry, error) {
+	if e.bodyPath == "" {
+		return e, nil
+	}
+	body, err := os.ReadFile(e.bodyPath)
+	if err != nil {
+		return nil, err
+	}
+	loaded := *e
+	loaded.Body = body
+	loaded.bodyPath = ""
+	return &loaded, nil
+}
+
+type nopCloser struct {
+	io.ReadSeeker
+}
+
+func (nopCloser) Close() error { return nil }
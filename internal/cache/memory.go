@@ -0,0 +1,97 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+)
+
+// MemoryStore is an in-memory Store that evicts the least recently used
+// entries once the total size exceeds its byte budget
+type MemoryStore struct {
+	maxBytes int64
+
+	mutex   sync.Mutex
+	size    int64
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+// NewMemoryStore creates a new MemoryStore holding at most maxBytes
+func NewMemoryStore(maxBytes int64) *MemoryStore {
+	return &MemoryStore{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// Get returns the entry stored under key and marks it as recently used
+func (m *MemoryStore) Get(key string) (*Entry, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	el, ok := m.entries[key]
+	if !ok {
+		return nil, false
+	}
+	m.lru.MoveToFront(el)
+	return el.Value.(*Entry), true
+}
+
+// Set stores an entry, evicting older entries as needed. Entries larger than
+// the whole budget are not stored.
+func (m *MemoryStore) Set(entry *Entry) bool {
+	size := entry.Size()
+	if size > m.maxBytes {
+		return false
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if el, ok := m.entries[entry.Key]; ok {
+		m.removeElement(el)
+	}
+	m.entries[entry.Key] = m.lru.PushFront(entry)
+	m.size += size
+
+	for m.size > m.maxBytes {
+		oldest := m.lru.Back()
+		if oldest == nil {
+			break
+		}
+		m.removeElement(oldest)
+	}
+	return true
+}
+
+// Delete removes the entry stored under key
+func (m *MemoryStore) Delete(key string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if el, ok := m.entries[key]; ok {
+		m.removeElement(el)
+	}
+}
+
+// Entries returns all stored entries, most recently used first
+func (m *MemoryStore) Entries() []*Entry {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	entries := make([]*Entry, 0, m.lru.Len())
+	for el := m.lru.Front(); el != nil; el = el.Next() {
+		entries = append(entries, el.Value.(*Entry))
+	}
+	return entries
+}
+
+// Size returns the number of bytes currently stored
+func (m *MemoryStore) Size() int64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.size
+}
+
+func (m *MemoryStore) removeElement(el *list.Element) {
+	entry := m.lru.Remove(el).(*Entry)
+	delete(m.entries, entry.Key)
+	m.size -= entry.Size()
+}
@@ -0,0 +1,101 @@
+package cache
+
+import (
+	"slices"
+	"strings"
+)
+
+// Matcher selects cache entries
+type Matcher func(e *Entry) bool
+
+// MatchURL selects the variants of a URL. A URL starting with "/" matches
+// that path and query on any host.
+func MatchURL(url string) Matcher {
+	return func(e *Entry) bool {
+		if strings.HasPrefix(url, "/") {
+			return entryPath(e) == url
+		}
+		return e.URL == url
+	}
+}
+
+// MatchPrefix selects entries whose URL starts with prefix. A prefix
+// starting with "/" is matched against the path and query on any host.
+func MatchPrefix(prefix string) Matcher {
+	return func(e *Entry) bool {
+		if strings.HasPrefix(prefix, "/") {
+			return strings.HasPrefix(entryPath(e), prefix)
+		}
+		return strings.HasPrefix(e.URL, prefix)
+	}
+}
+
+// MatchTag selects entries carrying any of the surrogate keys
+func MatchTag(tags ...string) Matcher {
+	return func(e *Entry) bool {
+		for _, tag := range tags {
+			if slices.Contains(e.Tags, tag) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Entries returns the stored entries matching all matchers
+func (c *Cache) Entries(matchers ...Matcher) []*Entry {
+	var entries []*Entry
+	for _, e := range c.store.Entries() {
+		if matchesAll(e, matchers) {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// Purge removes the stored entries matching all matchers and returns how
+// many were removed
+func (c *Cache) Purge(matchers ...Matcher) int {
+	purged := 0
+	remaining := make(map[string]bool)
+	for _, e := range c.store.Entries() {
+		if !matchesAll(e, matchers) {
+			remaining[e.PrimaryKey] = true
+			continue
+		}
+		c.store.Delete(e.Key)
+		purged++
+	}
+
+	c.varyMutex.Lock()
+	for primary := range c.vary {
+		if !remaining[primary] {
+			delete(c.vary, primary)
+		}
+	}
+	c.varyMutex.Unlock()
+
+	c.logger.Debug("Cache purged", "entries", purged)
+	return purged
+}
+
+func matchesAll(e *Entry, matchers []Matcher) bool {
+	for _, match := range matchers {
+		if !match(e) {
+			return false
+		}
+	}
+	return true
+}
+
+// entryPath returns the path and query of the entry URL
+func entryPath(e *Entry) string {
+	_, rest, ok := strings.Cut(e.URL, "://")
+	if !ok {
+		return e.URL
+	}
+	if i := strings.Index(rest, "/"); i >= 0 {
+		return rest[i:]
+	}
+	return "/"
+}
@@ -0,0 +1,145 @@
+package cache
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// revalidate asks the origin whether a stored response is still valid. A 304
+// refreshes and serves the stored response; server errors are answered with
+// the stale response when stale-if-error allows it; any other response is
+// passed to the client and stored like a miss.
+func (c *Cache) revalidate(w http.ResponseWriter, r *http.Request, next http.Handler, entry *Entry, primary string) (*Entry, string) {
+	now := time.Now()
+	req := conditionalRequest(r.Context(), r, entry)
+	rw := &captureWriter{
+		ResponseWriter: w,
+		limit:          c.maxObjectSize,
+		buffer:         r.Method == http.MethodGet,
+		intercept: func(code int) bool {
+			return code == http.StatusNotModified && entry.HasValidators() ||
+				code >= http.StatusInternalServerError && entry.ServableStale(now, entry.StaleIfError)
+		},
+	}
+	requestTime := time.Now()
+	next.ServeHTTP(rw, req)
+
+	if !rw.intercepted {
+		return c.storeResponse(r, primary, rw, requestTime), "HIT"
+	}
+	if rw.statusCode == http.StatusNotModified {
+		refreshed := c.refresh(entry, rw.Header(), requestTime, time.Now())
+		c.logger.Debug("Cache revalidated", "key", entry.Key)
+		if !c.serveEntry(w, r, refreshed, time.Now(), "REVALIDATED") {
+			http.Error(w, "Bad Gateway", http.StatusBadGateway)
+			return nil, ""
+		}
+		return refreshed, "HIT"
+	}
+	c.logger.Warn("Serving stale response after upstream error",
+		"key", entry.Key,
+		"status", rw.statusCode,
+		"age", entry.Age(now).String(),
+	)
+	if !c.serveEntry(w, r, entry, time.Now(), "STALE") {
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return nil, ""
+	}
+	return entry, "STALE"
+}
+
+// revalidateInBackground refreshes a stale entry without holding up the
+// client. Only one refresh per entry runs at a time.
+func (c *Cache) revalidateInBackground(r *http.Request, next http.Handler, entry *Entry, primary string) {
+	c.refreshMutex.Lock()
+	if c.refreshing[entry.Key] {
+		c.refreshMutex.Unlock()
+		return
+	}
+	c.refreshing[entry.Key] = true
+	c.refreshMutex.Unlock()
+
+	// The refresh outlives the client request, so it must not be canceled with it
+	ctx := context.WithoutCancel(r.Context())
+	orig := r.Clone(ctx)
+	// Stale HEAD requests are refreshed with a GET, as the entry stores the
+	// body served to later GETs
+	orig.Method = http.MethodGet
+	req := conditionalRequest(ctx, orig, entry)
+	go func() {
+		defer func() {
+			c.refreshMutex.Lock()
+			delete(c.refreshing, entry.Key)
+			c.refreshMutex.Unlock()
+		}()
+
+		rw := &captureWriter{
+			ResponseWriter: &discardWriter{},
+			limit:          c.maxObjectSize,
+			buffer:         true,
+			intercept: func(code int) bool {
+				return code == http.StatusNotModified || code >= http.StatusInternalServerError
+			},
+		}
+		requestTime := time.Now()
+		next.ServeHTTP(rw, req)
+
+		switch {
+		case !rw.intercepted:
+			c.storeResponse(orig, primary, rw, requestTime)
+		case rw.statusCode == http.StatusNotModified:
+			c.refresh(entry, rw.Header(), requestTime, time.Now())
+			c.logger.Debug("Cache revalidated in background", "key", entry.Key)
+		default:
+			c.logger.Warn("Background revalidation failed", "key", entry.Key, "status", rw.statusCode)
+		}
+	}()
+}
+
+// refresh updates a stored entry with the headers of a 304 response (RFC 9111
+// section 4.3.4) and stores the result
+func (c *Cache) refresh(entry *Entry, header http.Header, requestTime, responseTime time.Time) *Entry {
+	updated := *entry
+	updated.Header = entry.Header.Clone()
+	for name, values := range header {
+		switch name {
+		case "Content-Length", "Content-Encoding", "Transfer-Encoding", "X-Cache":
+			continue
+		}
+		updated.Header[name] = values
+	}
+	updated.Header.Del("Age")
+	updated.Tags = parseTags(updated.Header)
+
+	cc := parseCacheControl(updated.Header)
+	lifetime, explicit := freshnessLifetime(updated.Header, cc)
+	if !explicit {
+		lifetime = c.defaultTTL
+	}
+	updated.Lifetime = lifetime
+	updated.RequestTime = requestTime
+	updated.ResponseTime = responseTime
+	updated.InitialAge = initialAge(header, requestTime, responseTime)
+	applyDirectives(&updated, cc)
+
+	c.storeEntry(&updated)
+	return &updated
+}
+
+// conditionalRequest copies r with the validators of the stored entry
+func conditionalRequest(ctx context.Context, r *http.Request, entry *Entry) *http.Request {
+	req := r.Clone(ctx)
+	if etag := entry.Header.Get("ETag"); etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lastModified := entry.Header.Get("Last-Modified"); lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+	return req
+}
+
+func isConditional(h http.Header) bool {
+	return h.Get("If-None-Match") != "" || h.Get("If-Modified-Since") != "" ||
+		h.Get("If-Match") != "" || h.Get("If-Unmodified-Since") != ""
+}
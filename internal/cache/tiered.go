@@ -0,0 +1,71 @@
+package cache
+
+// TieredStore keeps every entry on disk and the recently used entries that
+// fit in its budget in memory as well
+type TieredStore struct {
+	memory *MemoryStore
+	disk   *DiskStore
+}
+
+// NewTieredStore creates a new TieredStore
+func NewTieredStore(memory *MemoryStore, disk *DiskStore) *TieredStore {
+	return &TieredStore{memory: memory, disk: disk}
+}
+
+// Get looks in memory first and promotes entries found on disk to memory
+// when they fit
+func (t *TieredStore) Get(key string) (*Entry, bool) {
+	if entry, ok := t.memory.Get(key); ok {
+		return entry, true
+	}
+	entry, ok := t.disk.Get(key)
+	if !ok {
+		return nil, false
+	}
+	t.setMemory(entry)
+	return entry, true
+}
+
+// Set stores the entry on disk and, when it fits, in memory
+func (t *TieredStore) Set(entry *Entry) bool {
+	onDisk := t.disk.Set(entry)
+	inMemory := t.setMemory(entry)
+	return onDisk || inMemory
+}
+
+// Delete removes the entry from both tiers
+func (t *TieredStore) Delete(key string) {
+	t.memory.Delete(key)
+	t.disk.Delete(key)
+}
+
+// Close closes the disk tier
+func (t *TieredStore) Close() error {
+	return t.disk.Close()
+}
+
+// Entries returns the entries of both tiers
+func (t *TieredStore) Entries() []*Entry {
+	entries := t.disk.Entries()
+	seen := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		seen[e.Key] = true
+	}
+	for _, e := range t.memory.Entries() {
+		if !seen[e.Key] {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+func (t *TieredStore) setMemory(entry *Entry) bool {
+	if entry.Size() > t.memory.maxBytes {
+		return false
+	}
+	loaded, err := entry.withBody()
+	if err != nil {
+		return false
+	}
+	return t.memory.Set(loaded)
+}
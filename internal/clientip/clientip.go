@@ -0,0 +1,196 @@
+package clientip
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/shammianand/goproxy/internal/proxyproto"
+)
+
+type contextKey int
+
+const clientIPKey contextKey = iota
+
+// NewContext returns a context carrying the client IP
+func NewContext(ctx context.Context, ip net.IP) context.Context {
+	return context.WithValue(ctx, clientIPKey, ip)
+}
+
+// FromContext returns the client IP stored by Resolver.Handler
+func FromContext(ctx context.Context) (net.IP, bool) {
+	ip, ok := ctx.Value(clientIPKey).(net.IP)
+	return ip, ok && ip != nil
+}
+
+// FromRequest returns the client IP of a request: the one resolved by
+// Resolver.Handler, or the address of the peer when there is none
+func FromRequest(r *http.Request) string {
+	if ip, ok := FromContext(r.Context()); ok {
+		return ip.String()
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Resolver finds the real client IP of requests passing through trusted
+// proxies. Forwarding headers are read right to left and only hops added by
+// a trusted proxy are believed; the first untrusted address is the client.
+type Resolver struct {
+	trusted   []*net.IPNet
+	forwarded bool
+}
+
+// NewResolver creates a Resolver trusting the given proxy CIDRs. header is
+// the header proxies report clients in: X-Forwarded-For (the default) or
+// Forwarded.
+func NewResolver(trustedProxies []string, header string) (*Resolver, error) {
+	trusted, err := proxyproto.ParseCIDRs(trustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	r := &Resolver{trusted: trusted}
+	switch strings.ToLower(header) {
+	case "", "x-forwarded-for":
+	case "forwarded":
+		r.forwarded = true
+	default:
+		return nil, fmt.Errorf("unsupported client IP header: %s", header)
+	}
+	return r, nil
+}
+
+// Resolve returns the client IP of a request and the addresses of the
+// trusted proxies it passed through, nearest to the client first. The
+// peer itself is not included.
+func (res *Resolver) Resolve(r *http.Request) (net.IP, []net.IP) {
+	peer := parseHop(r.RemoteAddr)
+	if peer == nil || !res.isTrusted(peer) {
+		return peer, nil
+	}
+
+	var hops []net.IP
+	if res.forwarded {
+		hops = forwardedHops(r.Header.Values("Forwarded"))
+	} else {
+		for _, value := range r.Header.Values("X-Forwarded-For") {
+			for _, hop := range strings.Split(value, ",") {
+				hops = append(hops, parseHop(hop))
+			}
+		}
+	}
+
+	// Hops before one that cannot be parsed are not believed
+	client := len(hops)
+	for i := len(hops) - 1; i >= 0 && hops[i] != nil; i-- {
+		client = i
+		if !res.isTrusted(hops[i]) {
+			break
+		}
+	}
+	if client == len(hops) {
+		return peer, nil
+	}
+	return hops[client], hops[client+1:]
+}
+
+func (res *Resolver) isTrusted(ip net.IP) bool {
+	for _, n := range res.trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Handler returns a handler storing the client IP in the request context
+// and rewriting the forwarding headers so the upstream only sees the trusted
+// part of the chain. The reverse proxy appends the peer to X-Forwarded-For.
+func (res *Resolver) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client, proxies := res.Resolve(r)
+		peer := parseHop(r.RemoteAddr)
+		trustedPeer := peer != nil && res.isTrusted(peer)
+
+		r = r.Clone(NewContext(r.Context(), client))
+		r.Header.Del("X-Forwarded-For")
+		r.Header.Del("X-Real-IP")
+		if client == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !client.Equal(peer) {
+			chain := []string{client.String()}
+			for _, hop := range proxies {
+				chain = append(chain, hop.String())
+			}
+			r.Header.Set("X-Forwarded-For", strings.Join(chain, ", "))
+		}
+		r.Header.Set("X-Real-IP", client.String())
+		if !trustedPeer {
+			r.Header.Del("Forwarded")
+			r.Header.Del("X-Forwarded-Proto")
+		}
+		if r.Header.Get("X-Forwarded-Proto") == "" {
+			if r.TLS != nil {
+				r.Header.Set("X-Forwarded-Proto", "https")
+			} else {
+				r.Header.Set("X-Forwarded-Proto", "http")
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// parseHop parses an address as found in forwarding headers: an IP,
+// optionally with a port, quoted, or in brackets for IPv6
+func parseHop(hop string) net.IP {
+	hop = strings.Trim(strings.TrimSpace(hop), `"`)
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		hop = host
+	}
+	return net.ParseIP(strings.Trim(hop, "[]"))
+}
+
+// forwardedHops returns the for= addresses of Forwarded headers (RFC 7239).
+// Obfuscated and unknown identifiers yield nil hops.
+func forwardedHops(values []string) []net.IP {
+	var hops []net.IP
+	for _, value := range values {
+		for _, element := range splitQuoted(value, ',') {
+			var hop net.IP
+			for _, pair := range splitQuoted(element, ';') {
+				name, v, _ := strings.Cut(strings.TrimSpace(pair), "=")
+				if strings.EqualFold(name, "for") {
+					hop = parseHop(v)
+				}
+			}
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
+
+// splitQuoted splits s at sep outside of quoted strings
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	quoted := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			quoted = !quoted
+		case sep:
+			if !quoted {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
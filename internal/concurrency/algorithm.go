@@ -0,0 +1,99 @@
+package concurrency
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// algorithm computes a new concurrency limit from a completed request
+type algorithm interface {
+	update(limit float64, rtt time.Duration, inFlight int, dropped bool) float64
+}
+
+// newAlgorithm returns the algorithm named by the configuration
+func newAlgorithm(name string, latencyThreshold time.Duration) (algorithm, error) {
+	switch name {
+	case "", "gradient":
+		return &gradient{}, nil
+	case "aimd":
+		if latencyThreshold <= 0 {
+			return nil, fmt.Errorf("aimd concurrency limiting requires a latency threshold")
+		}
+		return &aimd{latencyThreshold: latencyThreshold}, nil
+	case "fixed":
+		return fixed{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported concurrency limit algorithm: %s", name)
+	}
+}
+
+// fixed keeps the initial limit
+type fixed struct{}
+
+func (fixed) update(limit float64, rtt time.Duration, inFlight int, dropped bool) float64 {
+	return limit
+}
+
+// backoffRatio is the factor the limit shrinks by after a dropped request
+const backoffRatio = 0.9
+
+// aimd grows the limit additively while requests complete within the
+// latency threshold and shrinks it multiplicatively otherwise
+type aimd struct {
+	latencyThreshold time.Duration
+}
+
+func (a *aimd) update(limit float64, rtt time.Duration, inFlight int, dropped bool) float64 {
+	if dropped || rtt > a.latencyThreshold {
+		return limit * backoffRatio
+	}
+	// Growing an unused limit would only allow a larger burst later
+	if float64(inFlight)*2 < limit {
+		return limit
+	}
+	return limit + 1/limit
+}
+
+// gradient compares the latency of recent requests with the long-term
+// latency: the limit grows while they match and shrinks as queueing in the
+// upstream makes recent requests slower
+type gradient struct {
+	shortRTT float64
+	longRTT  float64
+}
+
+const (
+	// longWindow and shortWindow are the number of samples the moving
+	// averages span
+	longWindow  = 600
+	shortWindow = 10
+	// tolerance is how much slower than the long-term latency recent
+	// requests may be before the limit shrinks
+	tolerance = 1.5
+	smoothing = 0.2
+)
+
+func (g *gradient) update(limit float64, rtt time.Duration, inFlight int, dropped bool) float64 {
+	if dropped {
+		return limit * backoffRatio
+	}
+	sample := float64(rtt)
+	if g.longRTT == 0 {
+		g.shortRTT, g.longRTT = sample, sample
+	}
+	g.shortRTT += (sample - g.shortRTT) * 2 / (shortWindow + 1)
+	g.longRTT += (sample - g.longRTT) * 2 / (longWindow + 1)
+
+	// Let the baseline recover faster after a long period of high latency
+	if g.longRTT/g.shortRTT > 2 {
+		g.longRTT *= 0.95
+	}
+	if float64(inFlight)*2 < limit {
+		return limit
+	}
+
+	ratio := math.Max(0.5, math.Min(1, tolerance*g.longRTT/g.shortRTT))
+	newLimit := limit*ratio + math.Sqrt(limit)
+	return limit*(1-smoothing) + newLimit*smoothing
+}
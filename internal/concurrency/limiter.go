@@ -0,0 +1,348 @@
+package concurrency
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/shammianand/goproxy/internal/config"
+	"github.com/shammianand/goproxy/pkg/logger"
+)
+
+// ErrLimitExceeded is returned when a request can neither run nor wait
+var ErrLimitExceeded = errors.New("concurrency limit exceeded")
+
+// Options configures a Limiter
+type Options struct {
+	// Algorithm is "gradient" (the default), "aimd" or "fixed"
+	Algorithm string
+	// LatencyThreshold is the latency above which AIMD shrinks the limit
+	LatencyThreshold time.Duration
+	InitialLimit     int
+	MinLimit         int
+	MaxLimit         int
+	// MaxQueue is the number of requests waiting for a slot; QueueTimeout
+	// bounds how long they wait
+	MaxQueue     int
+	QueueTimeout time.Duration
+	// Classes are the priority classes, ordered from the highest priority.
+	// Requests matching none belong to DefaultClass, or to the first class.
+	Classes      []config.PriorityClass
+	DefaultClass string
+}
+
+// ClassStats describes the load of a priority class
+type ClassStats struct {
+	Name     string `json:"name"`
+	InFlight int    `json:"in_flight"`
+	Queued   int    `json:"queued"`
+	Rejected uint64 `json:"rejected"`
+}
+
+// Stats describes the state of a Limiter
+type Stats struct {
+	Limit    int          `json:"limit"`
+	InFlight int          `json:"in_flight"`
+	Queued   int          `json:"queued"`
+	Rejected uint64       `json:"rejected"`
+	Classes  []ClassStats `json:"classes,omitempty"`
+}
+
+// waiter is a queued request, told through done whether it was granted a
+// slot or shed to make room for a request of higher priority
+type waiter struct {
+	class int
+	done  chan bool
+}
+
+// Limiter caps the number of requests in flight to an upstream pool, adapting
+// the cap to the latency and errors it observes. When the cap is reached,
+// requests wait in a queue served by priority, and requests of lower priority
+// are shed first.
+type Limiter struct {
+	opts         Options
+	algorithm    algorithm
+	classes      []*class
+	defaultClass int
+	logger       *logger.Logger
+
+	mutex         sync.Mutex
+	limit         float64
+	inFlight      int
+	classInFlight []int
+	queues        [][]*waiter
+	queued        int
+	rejected      []uint64
+}
+
+// New creates a new Limiter
+func New(opts Options, logger *logger.Logger) (*Limiter, error) {
+	alg, err := newAlgorithm(opts.Algorithm, opts.LatencyThreshold)
+	if err != nil {
+		return nil, err
+	}
+	classes, defaultClass, err := newClasses(opts.Classes, opts.DefaultClass)
+	if err != nil {
+		return nil, err
+	}
+	if opts.MinLimit < 1 {
+		opts.MinLimit = 1
+	}
+	if opts.MaxLimit < opts.MinLimit {
+		opts.MaxLimit = math.MaxInt32
+	}
+	if opts.InitialLimit < opts.MinLimit {
+		opts.InitialLimit = opts.MinLimit
+	}
+	return &Limiter{
+		opts:          opts,
+		algorithm:     alg,
+		classes:       classes,
+		defaultClass:  defaultClass,
+		logger:        logger,
+		limit:         float64(min(opts.InitialLimit, opts.MaxLimit)),
+		classInFlight: make([]int, len(classes)),
+		queues:        make([][]*waiter, len(classes)),
+		rejected:      make([]uint64, len(classes)),
+	}, nil
+}
+
+// Classify returns the priority class of a request; 0 is the highest
+func (l *Limiter) Classify(r *http.Request) int {
+	if len(l.opts.Classes) == 0 {
+		return 0
+	}
+	for i, c := range l.classes {
+		if c.matches(r) {
+			return i
+		}
+	}
+	return l.defaultClass
+}
+
+// ClassName returns the name of a priority class
+func (l *Limiter) ClassName(class int) string {
+	return l.classes[class].name
+}
+
+// Acquire takes a slot for a request of the given priority class, waiting in
+// the queue when none is free. The returned function must be called when the
+// request completes, reporting whether it was dropped by the upstream (an
+// error or timeout).
+func (l *Limiter) Acquire(ctx context.Context, class int) (func(dropped bool), error) {
+	l.mutex.Lock()
+	if len(l.queues[class]) == 0 && l.admissible(class) {
+		l.admit(class)
+		l.mutex.Unlock()
+		return l.releaser(class), nil
+	}
+	if l.opts.QueueTimeout <= 0 || !l.makeRoom(class) {
+		l.rejected[class]++
+		l.mutex.Unlock()
+		return nil, ErrLimitExceeded
+	}
+	w := &waiter{class: class, done: make(chan bool, 1)}
+	l.queues[class] = append(l.queues[class], w)
+	l.queued++
+	l.mutex.Unlock()
+
+	timer := time.NewTimer(l.opts.QueueTimeout)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case granted := <-w.done:
+		if !granted {
+			return nil, ErrLimitExceeded
+		}
+		return l.releaser(class), nil
+	case <-timer.C:
+		err = ErrLimitExceeded
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.dequeue(w) {
+		if err == ErrLimitExceeded {
+			l.rejected[class]++
+		}
+		return nil, err
+	}
+	if <-w.done {
+		// The slot was granted while giving up, so hand it on
+		if err == ErrLimitExceeded {
+			l.rejected[class]++
+		}
+		l.inFlight--
+		l.classInFlight[class]--
+		l.dispatch()
+	}
+	return nil, err
+}
+
+// admissible reports whether a request of the class may take a slot now
+func (l *Limiter) admissible(class int) bool {
+	limit := int(l.limit)
+	return l.inFlight < limit && l.classInFlight[class] < l.classes[class].capacity(limit)
+}
+
+func (l *Limiter) admit(class int) {
+	l.inFlight++
+	l.classInFlight[class]++
+}
+
+// makeRoom reports whether a request of the class can be queued, shedding the
+// newest request of the lowest priority below it when the queue is full
+func (l *Limiter) makeRoom(class int) bool {
+	if l.queued < l.opts.MaxQueue {
+		return true
+	}
+	for c := len(l.queues) - 1; c > class; c-- {
+		if n := len(l.queues[c]); n > 0 {
+			shed := l.queues[c][n-1]
+			l.queues[c] = l.queues[c][:n-1]
+			l.queued--
+			l.rejected[c]++
+			shed.done <- false
+			return true
+		}
+	}
+	return false
+}
+
+// dequeue removes a waiter that gave up, reporting whether it was still queued
+func (l *Limiter) dequeue(w *waiter) bool {
+	queue := l.queues[w.class]
+	for i, queued := range queue {
+		if queued == w {
+			l.queues[w.class] = append(queue[:i], queue[i+1:]...)
+			l.queued--
+			return true
+		}
+	}
+	return false
+}
+
+// dispatch hands free slots to waiters, highest priority first
+func (l *Limiter) dispatch() {
+	for c := range l.queues {
+		for len(l.queues[c]) > 0 && l.admissible(c) {
+			w := l.queues[c][0]
+			l.queues[c] = l.queues[c][1:]
+			l.queued--
+			l.admit(c)
+			w.done <- true
+		}
+	}
+}
+
+func (l *Limiter) releaser(class int) func(dropped bool) {
+	start := time.Now()
+	var once sync.Once
+	return func(dropped bool) {
+		once.Do(func() {
+			l.release(class, time.Since(start), dropped)
+		})
+	}
+}
+
+func (l *Limiter) release(class int, rtt time.Duration, dropped bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	inFlight := l.inFlight
+	l.inFlight--
+	l.classInFlight[class]--
+
+	previous := int(l.limit)
+	l.limit = l.algorithm.update(l.limit, rtt, inFlight, dropped)
+	l.limit = math.Max(float64(l.opts.MinLimit), math.Min(float64(l.opts.MaxLimit), l.limit))
+	if current := int(l.limit); current != previous {
+		l.logger.Debug("Concurrency limit changed",
+			"limit", current,
+			"previous", previous,
+			"rtt", rtt.String(),
+			"dropped", dropped,
+		)
+	}
+	l.dispatch()
+}
+
+// Stats returns the current limit and load
+func (l *Limiter) Stats() Stats {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	stats := Stats{
+		Limit:    int(l.limit),
+		InFlight: l.inFlight,
+		Queued:   l.queued,
+	}
+	for i, c := range l.classes {
+		stats.Rejected += l.rejected[i]
+		if len(l.opts.Classes) > 0 {
+			stats.Classes = append(stats.Classes, ClassStats{
+				Name:     c.name,
+				InFlight: l.classInFlight[i],
+				Queued:   len(l.queues[i]),
+				Rejected: l.rejected[i],
+			})
+		}
+	}
+	return stats
+}
+
+// Handler returns a handler running next within the limit and answering
+// requests over it with 503. Responses with status 502, 503 or 504 count as
+// dropped.
+func (l *Limiter) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		class := l.Classify(r)
+		release, err := l.Acquire(r.Context(), class)
+		if err != nil {
+			if errors.Is(err, ErrLimitExceeded) {
+				stats := l.Stats()
+				l.logger.Warn("Concurrency limit exceeded",
+					"method", r.Method,
+					"url", r.URL.String(),
+					"class", l.ClassName(class),
+					"limit", stats.Limit,
+					"queued", stats.Queued,
+				)
+				w.Header().Set("Retry-After", strconv.Itoa(1))
+				http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			}
+			return
+		}
+
+		rw := &statusWriter{ResponseWriter: w, statusCode: http.StatusOK}
+		defer func() {
+			release(rw.statusCode == http.StatusBadGateway ||
+				rw.statusCode == http.StatusServiceUnavailable ||
+				rw.statusCode == http.StatusGatewayTimeout)
+		}()
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// statusWriter records the status code of a response
+type statusWriter struct {
+	http.ResponseWriter
+	statusCode int
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	sw.statusCode = code
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *statusWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
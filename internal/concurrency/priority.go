@@ -0,0 +1,96 @@
+package concurrency
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+
+	"github.com/shammianand/goproxy/internal/config"
+)
+
+// class is a compiled priority class
+type class struct {
+	name       string
+	maxShare   float64
+	routes     []string
+	headers    map[string]string
+	userAgents []string
+}
+
+// newClasses compiles the priority classes, ordered from the highest
+// priority, and returns the index of the default class. Without classes every
+// request belongs to a single class.
+func newClasses(classes []config.PriorityClass, defaultClass string) ([]*class, int, error) {
+	if len(classes) == 0 {
+		return []*class{{name: "default", maxShare: 1}}, 0, nil
+	}
+
+	compiled := make([]*class, 0, len(classes))
+	defaultIndex := -1
+	for i, c := range classes {
+		if c.Name == "" {
+			return nil, 0, fmt.Errorf("priority class %d has no name", i)
+		}
+		if c.MaxShare < 0 || c.MaxShare > 1 {
+			return nil, 0, fmt.Errorf("priority class %s: max_share must be between 0 and 1", c.Name)
+		}
+		share := c.MaxShare
+		if share == 0 {
+			share = 1
+		}
+		cl := &class{
+			name:     c.Name,
+			maxShare: share,
+			routes:   c.Routes,
+			headers:  make(map[string]string, len(c.Headers)),
+		}
+		for name, value := range c.Headers {
+			cl.headers[http.CanonicalHeaderKey(name)] = value
+		}
+		for _, ua := range c.UserAgents {
+			cl.userAgents = append(cl.userAgents, strings.ToLower(ua))
+		}
+		if c.Name == defaultClass {
+			defaultIndex = i
+		}
+		compiled = append(compiled, cl)
+	}
+
+	switch {
+	case defaultClass == "":
+		// Unmatched requests get the highest priority
+		defaultIndex = 0
+	case defaultIndex < 0:
+		return nil, 0, fmt.Errorf("unknown default priority class: %s", defaultClass)
+	}
+	return compiled, defaultIndex, nil
+}
+
+// matches reports whether a request belongs to the class
+func (c *class) matches(r *http.Request) bool {
+	for _, route := range c.routes {
+		if strings.HasPrefix(r.URL.Path, route) {
+			return true
+		}
+	}
+	for name, value := range c.headers {
+		if got := r.Header.Get(name); got != "" && (value == "" || got == value) {
+			return true
+		}
+	}
+	if len(c.userAgents) > 0 {
+		ua := strings.ToLower(r.UserAgent())
+		for _, pattern := range c.userAgents {
+			if strings.Contains(ua, pattern) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// capacity returns the number of slots the class may hold within a limit
+func (c *class) capacity(limit int) int {
+	return max(1, int(math.Floor(c.maxShare*float64(limit))))
+}
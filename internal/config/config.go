@@ -6,23 +6,146 @@ import (
 	"log/slog"
 	"net/url"
 	"os"
+	"regexp"
 	"time"
 
 	"github.com/shammianand/goproxy/internal/loadbalancer"
 	"gopkg.in/yaml.v2"
 )
 
+// ACLRule matches egress destinations by host pattern ("example.com",
+// "*.example.com", "*" or a CIDR block) and an optional list of ports
+type ACLRule struct {
+	Host  string `yaml:"host"`
+	Ports []int  `yaml:"ports"`
+}
+
+// PriorityClass assigns requests to a concurrency limit priority class by
+// path prefix, request header or User-Agent substring
+type PriorityClass struct {
+	Name string `yaml:"name"`
+	// MaxShare is the fraction of the limit the class may hold; 0 means all of it
+	MaxShare   float64           `yaml:"max_share"`
+	Routes     []string          `yaml:"routes"`
+	Headers    map[string]string `yaml:"headers"`
+	UserAgents []string          `yaml:"user_agents"`
+}
+
+// JWTRule requires claims or scopes of the bearer tokens of requests under a
+// path prefix
+type JWTRule struct {
+	PathPrefix string `yaml:"path_prefix"`
+	// Claims maps claim names to a required value, which array claims must contain
+	Claims map[string]string `yaml:"claims"`
+	Scopes []string          `yaml:"scopes"`
+}
+
+// WAFRule adds Score to the anomaly score of requests where Pattern matches
+// one of the Targets, after applying the Transforms in order
+type WAFRule struct {
+	ID          string `yaml:"id"`
+	Description string `yaml:"description"`
+	// Targets are path, query, method, body, or the args, arg_names,
+	// headers and cookies collections, or one of their members as in
+	// headers:User-Agent
+	Targets    []string `yaml:"targets"`
+	Pattern    string   `yaml:"pattern"`
+	Transforms []string `yaml:"transforms"`
+	Score      int      `yaml:"score"`
+}
+
+// WAFExclusion stops the listed rules, or all rules when Rules is empty,
+// from inspecting the listed targets
+type WAFExclusion struct {
+	Rules   []string `yaml:"rules"`
+	Targets []string `yaml:"targets"`
+}
+
+// WAFRoute tunes the WAF for requests under a path prefix
+type WAFRoute struct {
+	PathPrefix string `yaml:"path_prefix"`
+	// Mode and AnomalyThreshold override the global settings when set
+	Mode             string         `yaml:"mode"`
+	AnomalyThreshold int            `yaml:"anomaly_threshold"`
+	DisabledRules    []string       `yaml:"disabled_rules"`
+	Exclusions       []WAFExclusion `yaml:"exclusions"`
+	Rules            []WAFRule      `yaml:"rules"`
+}
+
+// IPAccessRule allows or denies client IPs by CIDR, listed inline or in
+// files of one CIDR per line. On routes it applies under PathPrefix.
+type IPAccessRule struct {
+	PathPrefix string   `yaml:"path_prefix"`
+	Allow      []string `yaml:"allow"`
+	Deny       []string `yaml:"deny"`
+	AllowFile  string   `yaml:"allow_file"`
+	DenyFile   string   `yaml:"deny_file"`
+}
+
+// UpstreamSigningRule signs requests to Backends, or to every backend when
+// Backends is empty, with an HMAC or AWS SigV4 signature
+type UpstreamSigningRule struct {
+	Backends []string `yaml:"backends"`
+	// Algorithm is hmac-sha256 or aws-sigv4
+	Algorithm string `yaml:"algorithm"`
+	KeyID     string `yaml:"key_id"`
+	Secret    string `yaml:"secret"`
+	// Header carries hmac-sha256 signatures
+	Header        string   `yaml:"header"`
+	SignedHeaders []string `yaml:"signed_headers"`
+	AWS           struct {
+		Region          string `yaml:"region"`
+		Service         string `yaml:"service"`
+		AccessKeyID     string `yaml:"access_key_id"`
+		SecretAccessKey string `yaml:"secret_access_key"`
+		SessionToken    string `yaml:"session_token"`
+	} `yaml:"aws"`
+}
+
+// WebhookRule verifies the signature of webhooks under a path prefix
+type WebhookRule struct {
+	PathPrefix string `yaml:"path_prefix"`
+	// Provider is github, stripe, slack or hmac
+	Provider        string `yaml:"provider"`
+	Secret          string `yaml:"secret"`
+	Header          string `yaml:"header"`
+	TimestampHeader string `yaml:"timestamp_header"`
+	// Tolerance is how far the signed timestamp may be from now (in seconds)
+	Tolerance time.Duration `yaml:"tolerance"`
+}
+
 type Config struct {
 	Server struct {
 		ListenAddr   string        `yaml:"listen_addr"`
 		ReadTimeout  time.Duration `yaml:"read_timeout"`
 		WriteTimeout time.Duration `yaml:"write_timeout"`
 		IdleTimeout  time.Duration `yaml:"idle_timeout"`
+		// ProxyProtocol accepts PROXY protocol v1/v2 headers from trusted peers
+		ProxyProtocol struct {
+			Enabled       bool          `yaml:"enabled"`
+			TrustedCIDRs  []string      `yaml:"trusted_cidrs"`
+			HeaderTimeout time.Duration `yaml:"header_timeout"`
+		} `yaml:"proxy_protocol"`
+		// ClientIP finds the real client IP behind trusted proxies, reported
+		// in the X-Forwarded-For or Forwarded header
+		ClientIP struct {
+			TrustedProxies []string `yaml:"trusted_proxies"`
+			Header         string   `yaml:"header"`
+		} `yaml:"client_ip"`
+		// UnixSocket sets the permissions of the socket file when
+		// ListenAddr is of the form unix:/path/to.sock
+		UnixSocket struct {
+			Mode  string `yaml:"mode"`
+			Owner string `yaml:"owner"`
+			Group string `yaml:"group"`
+		} `yaml:"unix_socket"`
 	} `yaml:"server"`
 	Proxy struct {
 		TargetAddr   string        `yaml:"target_addr"`
 		MaxIdleConns int           `yaml:"max_idle_conns"`
 		DialTimeout  time.Duration `yaml:"dial_timeout"`
+		// SendProxyProtocol is the PROXY protocol version ("v1" or "v2") sent to upstreams
+		SendProxyProtocol string `yaml:"send_proxy_protocol"`
 	} `yaml:"proxy"`
 	LoadBalancing struct {
 		Enabled   bool     `yaml:"enabled"`
@@ -37,21 +160,258 @@ type Config struct {
 	Logging struct {
 		Level  string `yaml:"level"`
 		Format string `yaml:"format"`
+		// AccessLog writes one record per request, apart from the
+		// application log
+		AccessLog struct {
+			Enabled bool `yaml:"enabled"`
+			// Format is common, combined, json or template
+			Format string `yaml:"format"`
+			// Template is the line written for the template format
+			Template string `yaml:"template"`
+			// Output is stdout, stderr or a file path
+			Output          string `yaml:"output"`
+			RequestIDHeader string `yaml:"request_id_header"`
+			// RedactQueryParams are logged without their values, on top of
+			// the API key query parameter
+			RedactQueryParams []string `yaml:"redact_query_params"`
+		} `yaml:"access_log"`
 	} `yaml:"logging"`
+	// Metrics serves Prometheus metrics on a separate listener
 	Metrics struct {
 		Enabled bool   `yaml:"enabled"`
 		Address string `yaml:"address"`
+		// Path is where the metrics are served; it defaults to /metrics
+		Path string `yaml:"path"`
+		// Routes are the path prefixes requests are labeled with
+		Routes []string `yaml:"routes"`
 	} `yaml:"metrics"`
+	// Tracing exports OpenTelemetry spans of proxied requests to a collector
+	Tracing struct {
+		Enabled     bool   `yaml:"enabled"`
+		ServiceName string `yaml:"service_name"`
+		// Endpoint is the OTLP/HTTP traces URL of the collector, or its
+		// OTLP/gRPC address
+		Endpoint string `yaml:"endpoint"`
+		// Protocol is http/json or grpc
+		Protocol string            `yaml:"protocol"`
+		Headers  map[string]string `yaml:"headers"`
+		// SampleRatio is the fraction of new traces recorded; requests
+		// carrying a trace context follow the caller's decision
+		SampleRatio float64 `yaml:"sample_ratio"`
+		// Propagators are tracecontext, b3 and b3multi
+		Propagators []string `yaml:"propagators"`
+		BatchSize   int      `yaml:"batch_size"`
+		// ExportInterval is how often spans are exported
+		ExportInterval time.Duration `yaml:"export_interval"`
+		Timeout        time.Duration `yaml:"timeout"`
+	} `yaml:"tracing"`
+	// Admin serves the management API, such as cache purging
+	Admin struct {
+		Enabled    bool   `yaml:"enabled"`
+		ListenAddr string `yaml:"listen_addr"`
+		// Token is required as a bearer token when set
+		Token string `yaml:"token"`
+	} `yaml:"admin"`
+	// Auth authenticates requests before they are proxied
+	Auth struct {
+		// IdentityHeaderPrefix prefixes the headers carrying the
+		// authenticated identity upstream
+		IdentityHeaderPrefix string `yaml:"identity_header_prefix"`
+		APIKeys              struct {
+			Enabled bool   `yaml:"enabled"`
+			KeyFile string `yaml:"key_file"`
+			// Header carries the key, or QueryParam when the header is missing
+			Header     string `yaml:"header"`
+			QueryParam string `yaml:"query_param"`
+			// ReloadInterval is how often the key file is checked for changes
+			ReloadInterval time.Duration `yaml:"reload_interval"`
+			// UsageFile persists the quota counters every UsageFlushInterval
+			UsageFile          string        `yaml:"usage_file"`
+			UsageFlushInterval time.Duration `yaml:"usage_flush_interval"`
+		} `yaml:"api_keys"`
+		// JWT validates bearer tokens against a JWKS URL, a JWKS file or an
+		// HMAC secret
+		JWT struct {
+			Enabled    bool     `yaml:"enabled"`
+			Algorithms []string `yaml:"algorithms"`
+			JWKSURL    string   `yaml:"jwks_url"`
+			JWKSFile   string   `yaml:"jwks_file"`
+			HMACSecret string   `yaml:"hmac_secret"`
+			// JWKSRefreshInterval is how often keys are fetched from JWKSURL
+			JWKSRefreshInterval time.Duration `yaml:"jwks_refresh_interval"`
+			Issuer              string        `yaml:"issuer"`
+			Audiences           []string      `yaml:"audiences"`
+			// ClockSkew is the tolerance applied to exp and nbf
+			ClockSkew     time.Duration `yaml:"clock_skew"`
+			ForwardClaims []string      `yaml:"forward_claims"`
+			Rules         []JWTRule     `yaml:"rules"`
+		} `yaml:"jwt"`
+		// OIDC logs users in with an OpenID Connect provider, keeping the
+		// session in an encrypted cookie
+		OIDC struct {
+			Enabled bool `yaml:"enabled"`
+			// Issuer is used to discover the endpoints left empty
+			Issuer                string   `yaml:"issuer"`
+			AuthorizationEndpoint string   `yaml:"authorization_endpoint"`
+			TokenEndpoint         string   `yaml:"token_endpoint"`
+			JWKSURL               string   `yaml:"jwks_url"`
+			ClientID              string   `yaml:"client_id"`
+			ClientSecret          string   `yaml:"client_secret"`
+			RedirectURL           string   `yaml:"redirect_url"`
+			Scopes                []string `yaml:"scopes"`
+			CookieName            string   `yaml:"cookie_name"`
+			CookieSecret          string   `yaml:"cookie_secret"`
+			// SessionLifetime is how long a login lasts
+			SessionLifetime time.Duration `yaml:"session_lifetime"`
+			ForwardClaims   []string      `yaml:"forward_claims"`
+			LogoutPath      string        `yaml:"logout_path"`
+		} `yaml:"oidc"`
+		// Basic requires HTTP Basic credentials from an htpasswd file on
+		// Routes, or on every path when Routes is empty
+		Basic struct {
+			Enabled      bool     `yaml:"enabled"`
+			HtpasswdFile string   `yaml:"htpasswd_file"`
+			Realm        string   `yaml:"realm"`
+			Routes       []string `yaml:"routes"`
+			// StripAuthorization removes the credentials before proxying
+			StripAuthorization bool `yaml:"strip_authorization"`
+			// ReloadInterval is how often the htpasswd file is checked for changes
+			ReloadInterval time.Duration `yaml:"reload_interval"`
+		} `yaml:"basic"`
+		// ForwardAuth checks every request with an external authorization
+		// service before proxying it
+		ForwardAuth struct {
+			Enabled bool   `yaml:"enabled"`
+			URL     string `yaml:"url"`
+			// RequestHeaders are sent to the service, and ResponseHeaders
+			// copied from its allowing responses to the upstream request
+			RequestHeaders  []string `yaml:"request_headers"`
+			ResponseHeaders []string `yaml:"response_headers"`
+			// RedirectURL is where browsers denied with 401 are sent
+			RedirectURL string        `yaml:"redirect_url"`
+			Timeout     time.Duration `yaml:"timeout"`
+			// CacheTTL is how long decisions are reused
+			CacheTTL time.Duration `yaml:"cache_ttl"`
+			// FailOpen allows requests when the service is unavailable
+			FailOpen bool `yaml:"fail_open"`
+		} `yaml:"forward_auth"`
+	} `yaml:"auth"`
+	// IPAccess allows or denies clients by IP, globally and per route
+	IPAccess struct {
+		Enabled   bool     `yaml:"enabled"`
+		Allow     []string `yaml:"allow"`
+		Deny      []string `yaml:"deny"`
+		AllowFile string   `yaml:"allow_file"`
+		DenyFile  string   `yaml:"deny_file"`
+		// Routes add lists for path prefixes; the longest matching prefix applies
+		Routes []IPAccessRule `yaml:"routes"`
+		// ReloadInterval is how often the files are checked for changes
+		ReloadInterval time.Duration `yaml:"reload_interval"`
+	} `yaml:"ip_access"`
+	// WAF inspects requests for attacks before they are proxied
+	WAF struct {
+		Enabled bool `yaml:"enabled"`
+		// Mode is block, detect (log only) or off
+		Mode string `yaml:"mode"`
+		// AnomalyThreshold is the score at which a request is blocked
+		AnomalyThreshold int       `yaml:"anomaly_threshold"`
+		BuiltinRules     bool      `yaml:"builtin_rules"`
+		Rules            []WAFRule `yaml:"rules"`
+		// Routes tune the WAF per path prefix; the longest matching prefix applies
+		Routes       []WAFRoute `yaml:"routes"`
+		MaxBodyBytes int64      `yaml:"max_body_bytes"`
+		// BodyLimitAction is reject (413) or partial (inspect the first
+		// MaxBodyBytes) for larger bodies
+		BodyLimitAction string `yaml:"body_limit_action"`
+	} `yaml:"waf"`
+	// Signing signs requests to upstreams and verifies signed webhooks
+	Signing struct {
+		Enabled   bool                  `yaml:"enabled"`
+		Upstreams []UpstreamSigningRule `yaml:"upstreams"`
+		Webhooks  []WebhookRule         `yaml:"webhooks"`
+		// MaxBodyBytes bounds the bodies buffered to sign or verify them
+		MaxBodyBytes int64 `yaml:"max_body_bytes"`
+	} `yaml:"signing"`
 	RateLimiting struct {
 		Enabled           bool `yaml:"enabled"`
 		RequestsPerSecond int  `yaml:"requests_per_second"`
 		Burst             int  `yaml:"burst"`
+		// KeyBy selects what requests are limited by: ip, header, api_key or route
+		KeyBy  string   `yaml:"key_by"`
+		Header string   `yaml:"header"`
+		Routes []string `yaml:"routes"`
+		// CleanupInterval is how often idle buckets are evicted
+		CleanupInterval time.Duration `yaml:"cleanup_interval"`
+		// Redis shares the limits between replicas
+		Redis struct {
+			Enabled   bool          `yaml:"enabled"`
+			Addr      string        `yaml:"addr"`
+			Password  string        `yaml:"password"`
+			DB        int           `yaml:"db"`
+			KeyPrefix string        `yaml:"key_prefix"`
+			Timeout   time.Duration `yaml:"timeout"`
+		} `yaml:"redis"`
 	} `yaml:"rate_limiting"`
+	// ConcurrencyLimit adapts the number of requests in flight to the
+	// upstream pool to the latency it observes
+	ConcurrencyLimit struct {
+		Enabled bool `yaml:"enabled"`
+		// Algorithm is gradient, aimd or fixed
+		Algorithm string `yaml:"algorithm"`
+		// LatencyThreshold is the latency above which aimd shrinks the
+		// limit, in seconds with fractions allowed
+		LatencyThreshold float64 `yaml:"latency_threshold"`
+		InitialLimit     int     `yaml:"initial_limit"`
+		MinLimit         int     `yaml:"min_limit"`
+		MaxLimit         int     `yaml:"max_limit"`
+		// MaxQueue requests wait up to QueueTimeout seconds, with fractions
+		// allowed, for a slot before being rejected with 503
+		MaxQueue     int     `yaml:"max_queue"`
+		QueueTimeout float64 `yaml:"queue_timeout"`
+		// PriorityClasses are ordered from the highest priority; requests
+		// matching none belong to DefaultClass
+		PriorityClasses []PriorityClass `yaml:"priority_classes"`
+		DefaultClass    string          `yaml:"default_class"`
+	} `yaml:"concurrency_limit"`
 	Caching struct {
 		Enabled    bool          `yaml:"enabled"`
 		DefaultTTL time.Duration `yaml:"default_ttl"`
 		MaxSizeMB  int           `yaml:"max_size_mb"`
+		// CoalesceTimeout bounds how long concurrent misses wait for a shared
+		// upstream request; 0 disables request coalescing
+		CoalesceTimeout time.Duration `yaml:"coalesce_timeout"`
+		// Disk is a persistent second tier holding responses too large for
+		// the memory cache and keeping cached responses across restarts
+		Disk struct {
+			Enabled         bool   `yaml:"enabled"`
+			Path            string `yaml:"path"`
+			MaxSizeMB       int    `yaml:"max_size_mb"`
+			MaxObjectSizeMB int    `yaml:"max_object_size_mb"`
+		} `yaml:"disk"`
 	} `yaml:"caching"`
+	// FastCGI controls requests to fastcgi:// and fcgi+unix:// backends
+	FastCGI struct {
+		DocumentRoot   string            `yaml:"document_root"`
+		ScriptFilename string            `yaml:"script_filename"`
+		Index          string            `yaml:"index"`
+		SplitPathInfo  string            `yaml:"split_path_info"`
+		Env            map[string]string `yaml:"env"`
+		MaxIdleConns   int               `yaml:"max_idle_conns"`
+	} `yaml:"fastcgi"`
+	ForwardProxy struct {
+		Enabled     bool              `yaml:"enabled"`
+		ListenAddr  string            `yaml:"listen_addr"`
+		DialTimeout time.Duration     `yaml:"dial_timeout"`
+		Allow       []ACLRule         `yaml:"allow"`
+		Deny        []ACLRule         `yaml:"deny"`
+		Users       map[string]string `yaml:"users"`
+	} `yaml:"forward_proxy"`
+	// SOCKS5 shares the destination ACLs and users of the forward proxy
+	SOCKS5 struct {
+		Enabled      bool   `yaml:"enabled"`
+		ListenAddr   string `yaml:"listen_addr"`
+		UDPAssociate bool   `yaml:"udp_associate"`
+	} `yaml:"socks5"`
 }
 
 func Load(configPath string) (*Config, error) {
@@ -79,6 +439,9 @@ func (c *Config) CreateLoadBalancer() (loadbalancer.LoadBalancer, error) {
 		if err != nil {
 			return nil, fmt.Errorf("invalid backend URL %s: %w", backendURL, err)
 		}
+		if (u.Scheme == "unix" || u.Scheme == "fcgi+unix") && u.Path == "" {
+			return nil, fmt.Errorf("invalid backend URL %s: missing socket path", backendURL)
+		}
 		backends = append(backends, &loadbalancer.Backend{URL: u, Healthy: true})
 	}
 
@@ -122,10 +485,113 @@ func (c *Config) GetProxyDialTimeout() time.Duration {
 	return time.Duration(c.Proxy.DialTimeout) * time.Second
 }
 
+func (c *Config) GetProxyProtocolHeaderTimeout() time.Duration {
+	return time.Duration(c.Server.ProxyProtocol.HeaderTimeout) * time.Second
+}
+
+// GetSendProxyProtocolVersion returns the PROXY protocol version to send to
+// upstreams, or 0 when disabled
+func (c *Config) GetSendProxyProtocolVersion() (int, error) {
+	switch c.Proxy.SendProxyProtocol {
+	case "":
+		return 0, nil
+	case "v1", "1":
+		return 1, nil
+	case "v2", "2":
+		return 2, nil
+	default:
+		return 0, fmt.Errorf("unsupported proxy protocol version: %s", c.Proxy.SendProxyProtocol)
+	}
+}
+
+// GetFastCGISplitPathInfo compiles the FastCGI split_path_info pattern, which
+// must have two capture groups for SCRIPT_NAME and PATH_INFO
+func (c *Config) GetFastCGISplitPathInfo() (*regexp.Regexp, error) {
+	if c.FastCGI.SplitPathInfo == "" {
+		return nil, nil
+	}
+	re, err := regexp.Compile(c.FastCGI.SplitPathInfo)
+	if err != nil {
+		return nil, fmt.Errorf("invalid fastcgi split_path_info: %w", err)
+	}
+	if re.NumSubexp() < 2 {
+		return nil, fmt.Errorf("fastcgi split_path_info must have two capture groups")
+	}
+	return re, nil
+}
+
+func (c *Config) GetForwardProxyDialTimeout() time.Duration {
+	return time.Duration(c.ForwardProxy.DialTimeout) * time.Second
+}
+
+func (c *Config) GetAPIKeysReloadInterval() time.Duration {
+	return time.Duration(c.Auth.APIKeys.ReloadInterval) * time.Second
+}
+
+func (c *Config) GetAPIKeysUsageFlushInterval() time.Duration {
+	return time.Duration(c.Auth.APIKeys.UsageFlushInterval) * time.Second
+}
+
+func (c *Config) GetJWTRefreshInterval() time.Duration {
+	return time.Duration(c.Auth.JWT.JWKSRefreshInterval) * time.Second
+}
+
+func (c *Config) GetJWTClockSkew() time.Duration {
+	return time.Duration(c.Auth.JWT.ClockSkew) * time.Second
+}
+
+func (c *Config) GetOIDCSessionLifetime() time.Duration {
+	return time.Duration(c.Auth.OIDC.SessionLifetime) * time.Second
+}
+
+func (c *Config) GetIPAccessReloadInterval() time.Duration {
+	return time.Duration(c.IPAccess.ReloadInterval) * time.Second
+}
+
+func (c *Config) GetBasicAuthReloadInterval() time.Duration {
+	return time.Duration(c.Auth.Basic.ReloadInterval) * time.Second
+}
+
+func (c *Config) GetForwardAuthTimeout() time.Duration {
+	return time.Duration(c.Auth.ForwardAuth.Timeout) * time.Second
+}
+
+func (c *Config) GetForwardAuthCacheTTL() time.Duration {
+	return time.Duration(c.Auth.ForwardAuth.CacheTTL) * time.Second
+}
+
+func (c *Config) GetTracingExportInterval() time.Duration {
+	return time.Duration(c.Tracing.ExportInterval) * time.Second
+}
+
+func (c *Config) GetTracingTimeout() time.Duration {
+	return time.Duration(c.Tracing.Timeout) * time.Second
+}
+
+func (c *Config) GetRateLimitingCleanupInterval() time.Duration {
+	return time.Duration(c.RateLimiting.CleanupInterval) * time.Second
+}
+
+func (c *Config) GetRateLimitingRedisTimeout() time.Duration {
+	return time.Duration(c.RateLimiting.Redis.Timeout) * time.Second
+}
+
+func (c *Config) GetConcurrencyLimitLatencyThreshold() time.Duration {
+	return time.Duration(c.ConcurrencyLimit.LatencyThreshold * float64(time.Second))
+}
+
+func (c *Config) GetConcurrencyLimitQueueTimeout() time.Duration {
+	return time.Duration(c.ConcurrencyLimit.QueueTimeout * float64(time.Second))
+}
+
 func (c *Config) GetCachingDefaultTTL() time.Duration {
 	return time.Duration(c.Caching.DefaultTTL) * time.Second
 }
 
+func (c *Config) GetCachingCoalesceTimeout() time.Duration {
+	return time.Duration(c.Caching.CoalesceTimeout) * time.Second
+}
+
 func (c *Config) GetLogFormat(w io.Writer) slog.Handler {
 	if w == nil {
 		w = os.Stdout
@@ -0,0 +1,139 @@
+package fastcgi
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Record types from the FastCGI 1.0 specification
+const (
+	typeBeginRequest = 1
+	typeEndRequest   = 3
+	typeParams       = 4
+	typeStdin        = 5
+	typeStdout       = 6
+	typeStderr       = 7
+)
+
+const (
+	version1 = 1
+
+	roleResponder = 1
+
+	flagKeepConn = 1
+
+	statusRequestComplete = 0
+
+	headerLen = 8
+
+	// maxContent is the largest payload a single record can carry
+	maxContent = 65535
+)
+
+var ErrProtocol = errors.New("fastcgi: protocol error")
+
+type header struct {
+	Version       uint8
+	Type          uint8
+	RequestID     uint16
+	ContentLength uint16
+	PaddingLength uint8
+	Reserved      uint8
+}
+
+// writeRecord writes a single record; content must not exceed maxContent bytes
+func writeRecord(w io.Writer, recType uint8, reqID uint16, content []byte) error {
+	padding := uint8(-len(content) & 7)
+	var hdr [headerLen]byte
+	hdr[0] = version1
+	hdr[1] = recType
+	binary.BigEndian.PutUint16(hdr[2:4], reqID)
+	binary.BigEndian.PutUint16(hdr[4:6], uint16(len(content)))
+	hdr[6] = padding
+
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(content); err != nil {
+		return err
+	}
+	if padding > 0 {
+		var pad [8]byte
+		_, err := w.Write(pad[:padding])
+		return err
+	}
+	return nil
+}
+
+// writeStream writes data as a sequence of records of the given type. The
+// stream is not terminated; callers send an empty record for that.
+func writeStream(w io.Writer, recType uint8, reqID uint16, data []byte) error {
+	for len(data) > 0 {
+		n := len(data)
+		if n > maxContent {
+			n = maxContent
+		}
+		if err := writeRecord(w, recType, reqID, data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+func writeBeginRequest(w io.Writer, reqID uint16, keepConn bool) error {
+	var body [8]byte
+	binary.BigEndian.PutUint16(body[0:2], roleResponder)
+	if keepConn {
+		body[2] = flagKeepConn
+	}
+	return writeRecord(w, typeBeginRequest, reqID, body[:])
+}
+
+// encodeParams encodes name-value pairs using the FastCGI length prefixes
+func encodeParams(params map[string]string) []byte {
+	var buf []byte
+	for name, value := range params {
+		buf = appendLength(buf, len(name))
+		buf = appendLength(buf, len(value))
+		buf = append(buf, name...)
+		buf = append(buf, value...)
+	}
+	return buf
+}
+
+func appendLength(b []byte, n int) []byte {
+	if n < 128 {
+		return append(b, byte(n))
+	}
+	return binary.BigEndian.AppendUint32(b, uint32(n)|1<<31)
+}
+
+// readRecord reads the next record, returning its header and content
+func readRecord(r *bufio.Reader, buf []byte) (header, []byte, error) {
+	var hdr header
+	var raw [headerLen]byte
+	if _, err := io.ReadFull(r, raw[:]); err != nil {
+		return hdr, nil, err
+	}
+	hdr.Version = raw[0]
+	hdr.Type = raw[1]
+	hdr.RequestID = binary.BigEndian.Uint16(raw[2:4])
+	hdr.ContentLength = binary.BigEndian.Uint16(raw[4:6])
+	hdr.PaddingLength = raw[6]
+	if hdr.Version != version1 {
+		return hdr, nil, ErrProtocol
+	}
+
+	n := int(hdr.ContentLength) + int(hdr.PaddingLength)
+	if cap(buf) < n {
+		buf = make([]byte, n)
+	}
+	buf = buf[:n]
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return hdr, nil, err
+	}
+	return hdr, buf[:hdr.ContentLength], nil
+}
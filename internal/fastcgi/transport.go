@@ -0,0 +1,438 @@
+package fastcgi
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shammianand/goproxy/internal/clientip"
+	"github.com/shammianand/goproxy/internal/urlpath"
+	"github.com/shammianand/goproxy/pkg/logger"
+)
+
+// requestID is the only request ID in use; each connection carries one
+// request at a time
+const requestID = 1
+
+// Options controls how HTTP requests are mapped onto FastCGI parameters
+type Options struct {
+	// DocumentRoot is the root directory of the application on the FastCGI server
+	DocumentRoot string
+	// ScriptFilename, when set, routes every request to a single script
+	// (front controller) instead of mapping the path below DocumentRoot
+	ScriptFilename string
+	// Index is appended to request paths ending in a slash
+	Index string
+	// SplitPathInfo splits the path into SCRIPT_NAME and PATH_INFO using its
+	// first two capture groups, e.g. ^(.+\.php)(/.*)$
+	SplitPathInfo *regexp.Regexp
+	// Env holds extra parameters passed with every request
+	Env map[string]string
+	// MaxIdleConns bounds the number of kept-alive connections
+	MaxIdleConns int
+	DialTimeout  time.Duration
+}
+
+// Transport is an http.RoundTripper that speaks FastCGI to a single
+// application server, such as PHP-FPM
+type Transport struct {
+	network string
+	address string
+	opts    Options
+	logger  *logger.Logger
+	dialer  *net.Dialer
+
+	mu   sync.Mutex
+	idle []net.Conn
+}
+
+// NewTransport creates a new Transport for the server at address. network is
+// "tcp" or "unix".
+func NewTransport(network, address string, opts Options, logger *logger.Logger) *Transport {
+	if opts.Index == "" {
+		opts.Index = "index.php"
+	}
+	return &Transport{
+		network: network,
+		address: address,
+		opts:    opts,
+		logger:  logger,
+		dialer:  &net.Dialer{Timeout: opts.DialTimeout},
+	}
+}
+
+// RoundTrip sends the request as a FastCGI responder request and converts the
+// CGI response into an HTTP response
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, contentLength, err := requestBody(req)
+	if err != nil {
+		return nil, err
+	}
+
+	params, err := t.params(req, contentLength)
+	if err != nil {
+		return forbidden(req), nil
+	}
+
+	conn, reused, err := t.getConn(req.Context())
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.writeRequest(conn, params, body)
+	if err != nil && reused && body == nil {
+		// The server may have closed an idle connection; requests without a
+		// body are safe to retry once on a fresh one
+		conn.Close()
+		conn, _, err = t.dial(req.Context())
+		if err != nil {
+			return nil, err
+		}
+		err = t.writeRequest(conn, params, nil)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return t.readResponse(req, conn)
+}
+
+// CloseIdleConnections closes all kept-alive connections
+func (t *Transport) CloseIdleConnections() {
+	t.mu.Lock()
+	idle := t.idle
+	t.idle = nil
+	t.mu.Unlock()
+	for _, c := range idle {
+		c.Close()
+	}
+}
+
+func (t *Transport) getConn(ctx context.Context) (net.Conn, bool, error) {
+	t.mu.Lock()
+	if n := len(t.idle); n > 0 {
+		conn := t.idle[n-1]
+		t.idle = t.idle[:n-1]
+		t.mu.Unlock()
+		return conn, true, nil
+	}
+	t.mu.Unlock()
+	return t.dial(ctx)
+}
+
+func (t *Transport) dial(ctx context.Context) (net.Conn, bool, error) {
+	conn, err := t.dialer.DialContext(ctx, t.network, t.address)
+	return conn, false, err
+}
+
+func (t *Transport) putConn(conn net.Conn) {
+	t.mu.Lock()
+	if len(t.idle) < t.opts.MaxIdleConns {
+		t.idle = append(t.idle, conn)
+		t.mu.Unlock()
+		return
+	}
+	t.mu.Unlock()
+	conn.Close()
+}
+
+func (t *Transport) keepConn() bool {
+	return t.opts.MaxIdleConns > 0
+}
+
+func (t *Transport) writeRequest(conn net.Conn, params map[string]string, body io.Reader) error {
+	w := bufio.NewWriter(conn)
+	if err := writeBeginRequest(w, requestID, t.keepConn()); err != nil {
+		return err
+	}
+	if err := writeStream(w, typeParams, requestID, encodeParams(params)); err != nil {
+		return err
+	}
+	if err := writeRecord(w, typeParams, requestID, nil); err != nil {
+		return err
+	}
+
+	if body != nil {
+		buf := make([]byte, maxContent)
+		for {
+			n, err := body.Read(buf)
+			if n > 0 {
+				if werr := writeRecord(w, typeStdin, requestID, buf[:n]); werr != nil {
+					return werr
+				}
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if err := writeRecord(w, typeStdin, requestID, nil); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// readResponse parses the CGI headers and streams the rest of stdout as the
+// response body. The connection is recycled once the request has ended.
+func (t *Transport) readResponse(req *http.Request, conn net.Conn) (*http.Response, error) {
+	pr, pw := io.Pipe()
+
+	go func() {
+		err := t.copyStdout(conn, pw)
+		pw.CloseWithError(err)
+		if err == nil && t.keepConn() {
+			t.putConn(conn)
+		} else {
+			conn.Close()
+		}
+	}()
+
+	br := bufio.NewReader(pr)
+	mimeHeader, err := textproto.NewReader(br).ReadMIMEHeader()
+	if err != nil {
+		pr.CloseWithError(err)
+		return nil, fmt.Errorf("fastcgi: invalid response headers: %w", err)
+	}
+
+	header := http.Header(mimeHeader)
+	statusCode := http.StatusOK
+	if status := header.Get("Status"); status != "" {
+		code, _, _ := strings.Cut(status, " ")
+		statusCode, err = strconv.Atoi(code)
+		if err != nil {
+			pr.CloseWithError(err)
+			return nil, fmt.Errorf("fastcgi: invalid status %q", status)
+		}
+		header.Del("Status")
+	} else if header.Get("Location") != "" {
+		statusCode = http.StatusFound
+	}
+
+	contentLength := int64(-1)
+	if cl := header.Get("Content-Length"); cl != "" {
+		if n, err := strconv.ParseInt(cl, 10, 64); err == nil {
+			contentLength = n
+		}
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", statusCode, http.StatusText(statusCode)),
+		StatusCode:    statusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          &responseBody{Reader: br, pipe: pr},
+		ContentLength: contentLength,
+		Request:       req,
+	}, nil
+}
+
+// copyStdout reads records until the end of the request, copying stdout to w
+// and logging stderr. A closed reader does not stop the draining so that the
+// connection stays usable.
+func (t *Transport) copyStdout(conn net.Conn, w io.Writer) error {
+	r := bufio.NewReader(conn)
+	var buf []byte
+	var stderr bytes.Buffer
+	discard := false
+
+	for {
+		hdr, content, err := readRecord(r, buf)
+		if err != nil {
+			return err
+		}
+		buf = content[:cap(content)]
+		if hdr.RequestID != requestID {
+			continue
+		}
+
+		switch hdr.Type {
+		case typeStdout:
+			if !discard && len(content) > 0 {
+				if _, err := w.Write(content); err != nil {
+					discard = true
+				}
+			}
+		case typeStderr:
+			stderr.Write(content)
+		case typeEndRequest:
+			if stderr.Len() > 0 && t.logger != nil {
+				t.logger.Warn("FastCGI stderr", "address", t.address, "output", stderr.String())
+			}
+			if len(content) < 8 {
+				return ErrProtocol
+			}
+			appStatus := binary.BigEndian.Uint32(content[0:4])
+			if content[4] != statusRequestComplete {
+				return fmt.Errorf("fastcgi: request not completed (protocol status %d)", content[4])
+			}
+			if appStatus != 0 && t.logger != nil {
+				t.logger.Debug("FastCGI application exited with non-zero status", "status", appStatus)
+			}
+			return nil
+		}
+	}
+}
+
+// params builds the CGI/1.1 environment for a request
+func (t *Transport) params(req *http.Request, contentLength int64) (map[string]string, error) {
+	reqPath := urlpath.Clean(req.URL.Path)
+
+	scriptName, pathInfo := reqPath, ""
+	if t.opts.SplitPathInfo != nil {
+		if m := t.opts.SplitPathInfo.FindStringSubmatch(reqPath); len(m) >= 3 {
+			scriptName, pathInfo = m[1], m[2]
+		}
+	}
+	if strings.HasSuffix(scriptName, "/") {
+		scriptName += t.opts.Index
+	}
+
+	scriptFilename := t.opts.ScriptFilename
+	if scriptFilename == "" {
+		scriptFilename = path.Join(t.opts.DocumentRoot, scriptName)
+		if !t.inDocumentRoot(scriptFilename) {
+			return nil, errOutsideRoot
+		}
+	}
+
+	serverName, serverPort := splitHost(req.Host, req.TLS != nil)
+
+	params := map[string]string{
+		"GATEWAY_INTERFACE": "CGI/1.1",
+		"SERVER_SOFTWARE":   "goproxy",
+		"SERVER_PROTOCOL":   req.Proto,
+		"SERVER_NAME":       serverName,
+		"SERVER_PORT":       serverPort,
+		"REQUEST_METHOD":    req.Method,
+		"REQUEST_URI":       req.URL.RequestURI(),
+		"QUERY_STRING":      req.URL.RawQuery,
+		"DOCUMENT_ROOT":     t.opts.DocumentRoot,
+		"DOCUMENT_URI":      scriptName,
+		"SCRIPT_NAME":       scriptName,
+		"SCRIPT_FILENAME":   scriptFilename,
+		"PATH_INFO":         pathInfo,
+		"CONTENT_TYPE":      req.Header.Get("Content-Type"),
+		"CONTENT_LENGTH":    strconv.FormatInt(contentLength, 10),
+	}
+	if pathInfo != "" {
+		translated := path.Join(t.opts.DocumentRoot, pathInfo)
+		if !t.inDocumentRoot(translated) {
+			return nil, errOutsideRoot
+		}
+		params["PATH_TRANSLATED"] = translated
+	}
+	if req.TLS != nil || strings.EqualFold(req.Header.Get("X-Forwarded-Proto"), "https") {
+		params["HTTPS"] = "on"
+	}
+
+	// The client IP resolved from trusted proxies, or else the peer the
+	// reverse proxy appended as the last X-Forwarded-For hop
+	if ip, ok := clientip.FromContext(req.Context()); ok {
+		params["REMOTE_ADDR"] = ip.String()
+	} else if xff := req.Header.Get("X-Forwarded-For"); xff != "" {
+		hops := strings.Split(xff, ",")
+		params["REMOTE_ADDR"] = strings.TrimSpace(hops[len(hops)-1])
+	}
+
+	for name, values := range req.Header {
+		key := strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+		// Proxy is skipped to prevent httpoxy style attacks
+		if key == "PROXY" || key == "CONTENT_TYPE" || key == "CONTENT_LENGTH" {
+			continue
+		}
+		params["HTTP_"+key] = strings.Join(values, ", ")
+	}
+	if req.Host != "" {
+		params["HTTP_HOST"] = req.Host
+	}
+
+	for k, v := range t.opts.Env {
+		params[k] = v
+	}
+	return params, nil
+}
+
+var errOutsideRoot = errors.New("fastcgi: path outside the document root")
+
+// inDocumentRoot reports whether a file is the document root or below it
+func (t *Transport) inDocumentRoot(file string) bool {
+	root := path.Clean("/" + t.opts.DocumentRoot)
+	if t.opts.DocumentRoot == "" || root == "/" {
+		return true
+	}
+	file = path.Clean(file)
+	return file == root || strings.HasPrefix(file, root+"/")
+}
+
+// forbidden answers requests for paths outside the document root without
+// contacting the server
+func forbidden(req *http.Request) *http.Response {
+	body := "Forbidden\n"
+	return &http.Response{
+		Status:        "403 Forbidden",
+		StatusCode:    http.StatusForbidden,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+// requestBody returns the request body and its length. FastCGI applications
+// rely on CONTENT_LENGTH, so bodies of unknown length are buffered.
+func requestBody(req *http.Request) (io.Reader, int64, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, 0, nil
+	}
+	if req.ContentLength >= 0 {
+		return req.Body, req.ContentLength, nil
+	}
+	data, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+	return bytes.NewReader(data), int64(len(data)), nil
+}
+
+func splitHost(host string, tls bool) (string, string) {
+	name, port, err := net.SplitHostPort(host)
+	if err == nil {
+		return name, port
+	}
+	if tls {
+		return host, "443"
+	}
+	return host, "80"
+}
+
+// responseBody is the remainder of stdout after the CGI headers
+type responseBody struct {
+	io.Reader
+	pipe *io.PipeReader
+}
+
+func (b *responseBody) Close() error {
+	return b.pipe.Close()
+}
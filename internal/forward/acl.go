@@ -0,0 +1,148 @@
+package forward
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/shammianand/goproxy/internal/config"
+)
+
+// rule matches destinations by host pattern and an optional port list
+type rule struct {
+	host  string
+	cidr  *net.IPNet
+	ports map[int]bool
+}
+
+func newRule(r config.ACLRule) (*rule, error) {
+	host := strings.ToLower(strings.TrimSpace(r.Host))
+	if host == "" {
+		return nil, fmt.Errorf("acl rule has an empty host pattern")
+	}
+
+	compiled := &rule{host: host}
+	if strings.Contains(host, "/") {
+		_, n, err := net.ParseCIDR(host)
+		if err != nil {
+			return nil, fmt.Errorf("invalid acl CIDR %s: %w", host, err)
+		}
+		compiled.cidr = n
+	}
+	if len(r.Ports) > 0 {
+		compiled.ports = make(map[int]bool, len(r.Ports))
+		for _, p := range r.Ports {
+			compiled.ports[p] = true
+		}
+	}
+	return compiled, nil
+}
+
+func (r *rule) matches(host string, port int) bool {
+	if r.ports != nil && !r.ports[port] {
+		return false
+	}
+	if r.cidr != nil {
+		ip := net.ParseIP(host)
+		return ip != nil && r.cidr.Contains(ip)
+	}
+	switch {
+	case r.host == "*":
+		return true
+	case strings.HasPrefix(r.host, "*."):
+		// *.example.com matches any subdomain but not example.com itself
+		return strings.HasSuffix(host, r.host[1:])
+	default:
+		return host == r.host
+	}
+}
+
+// ACL decides which destinations egress traffic may reach. Deny rules take
+// precedence; when allow rules are present a destination must match one.
+type ACL struct {
+	allow []*rule
+	deny  []*rule
+}
+
+// NewACL creates a new ACL from the configured allow and deny rules
+func NewACL(allow, deny []config.ACLRule) (*ACL, error) {
+	acl := &ACL{}
+	for _, r := range allow {
+		compiled, err := newRule(r)
+		if err != nil {
+			return nil, err
+		}
+		acl.allow = append(acl.allow, compiled)
+	}
+	for _, r := range deny {
+		compiled, err := newRule(r)
+		if err != nil {
+			return nil, err
+		}
+		acl.deny = append(acl.deny, compiled)
+	}
+	return acl, nil
+}
+
+// Allowed reports whether a connection to host:port is permitted
+func (a *ACL) Allowed(host string, port int) bool {
+	if a == nil {
+		return true
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, r := range a.deny {
+		if r.matches(host, port) {
+			return false
+		}
+	}
+	if len(a.allow) == 0 {
+		return true
+	}
+	for _, r := range a.allow {
+		if r.matches(host, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrDenied is returned when dialing an address denied by an ACL
+var ErrDenied = errors.New("destination denied by acl")
+
+// AllowedAddr reports whether a connection to a resolved address is
+// permitted. Host names are checked by Allowed before they are resolved;
+// this checks the address they resolve to against the deny rules, so a name
+// resolving into a denied range is refused as well.
+func (a *ACL) AllowedAddr(ip net.IP, port int) bool {
+	if a == nil {
+		return true
+	}
+	host := ip.String()
+	for _, r := range a.deny {
+		if r.matches(host, port) {
+			return false
+		}
+	}
+	return true
+}
+
+// Control is a net.Dialer Control function refusing connections to addresses
+// denied by the ACL. It runs after name resolution, for every address tried.
+func (a *ACL) Control(_, address string, _ syscall.RawConn) error {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	port, err := strconv.Atoi(portStr)
+	if ip == nil || err != nil {
+		return fmt.Errorf("unexpected dial address %s", address)
+	}
+	if !a.AllowedAddr(ip, port) {
+		return ErrDenied
+	}
+	return nil
+}
@@ -0,0 +1,294 @@
+package forward
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/shammianand/goproxy/pkg/logger"
+)
+
+// Credentials maps usernames to passwords for egress proxy authentication
+type Credentials map[string]string
+
+// Valid reports whether the username and password pair is known
+func (c Credentials) Valid(username, password string) bool {
+	expected, ok := c[username]
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1
+}
+
+// Proxy is an HTTP forward proxy handling absolute-form requests and CONNECT
+// tunnels to destinations permitted by its ACL
+type Proxy struct {
+	acl         *ACL
+	credentials Credentials
+	logger      *logger.Logger
+	dialer      *net.Dialer
+	proxy       *httputil.ReverseProxy
+}
+
+// NewProxy creates a new forward Proxy. Authentication is required only when
+// credentials are provided.
+func NewProxy(acl *ACL, credentials Credentials, dialTimeout time.Duration, logger *logger.Logger) *Proxy {
+	p := &Proxy{
+		acl:         acl,
+		credentials: credentials,
+		logger:      logger,
+		dialer:      &net.Dialer{Timeout: dialTimeout, Control: acl.Control},
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// Egress traffic must never be chained through an environment proxy
+	transport.Proxy = nil
+	transport.DialContext = p.dialer.DialContext
+
+	p.proxy = &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.Out.Header.Del("Proxy-Authorization")
+			pr.Out.Header.Del("Proxy-Connection")
+		},
+		Transport: transport,
+		ErrorLog:  slog.NewLogLogger(logger.Handler(), slog.LevelError),
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			if errors.Is(err, ErrDenied) {
+				p.logger.Warn("Forward proxy destination denied after resolution", "host", r.URL.Host)
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			p.logger.Error("Forward request failed", "url", r.URL.String(), "error", err)
+			http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		},
+	}
+	return p
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := p.authenticate(r)
+	if !ok {
+		p.logger.Warn("Forward proxy authentication failed",
+			"remote_addr", r.RemoteAddr,
+			"host", r.Host,
+		)
+		w.Header().Set("Proxy-Authenticate", `Basic realm="goproxy"`)
+		http.Error(w, "Proxy Authentication Required", http.StatusProxyAuthRequired)
+		return
+	}
+
+	if r.Method == http.MethodConnect {
+		p.serveConnect(w, r, user)
+		return
+	}
+
+	if !r.URL.IsAbs() || r.URL.Host == "" {
+		http.Error(w, "Bad Request: absolute-form request required", http.StatusBadRequest)
+		return
+	}
+
+	host, port := splitHostPort(r.URL.Host, r.URL.Scheme)
+	if !p.acl.Allowed(host, port) {
+		p.logger.Warn("Forward proxy destination denied",
+			"remote_addr", r.RemoteAddr,
+			"user", user,
+			"host", host,
+			"port", port,
+		)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	start := time.Now()
+	rw := &countingResponseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+	p.proxy.ServeHTTP(rw, r)
+
+	p.logger.Info("Forward request",
+		"remote_addr", r.RemoteAddr,
+		"user", user,
+		"method", r.Method,
+		"url", r.URL.String(),
+		"status", rw.statusCode,
+		"bytes", rw.bytes,
+		"duration_ms", time.Since(start).Milliseconds(),
+	)
+}
+
+func (p *Proxy) serveConnect(w http.ResponseWriter, r *http.Request, user string) {
+	host, port := splitHostPort(r.Host, "https")
+	if !p.acl.Allowed(host, port) {
+		p.logger.Warn("Forward proxy destination denied",
+			"remote_addr", r.RemoteAddr,
+			"user", user,
+			"host", host,
+			"port", port,
+		)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	upstream, err := p.dialer.DialContext(r.Context(), "tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if errors.Is(err, ErrDenied) {
+		p.logger.Warn("Forward proxy destination denied after resolution",
+			"remote_addr", r.RemoteAddr,
+			"user", user,
+			"host", host,
+			"port", port,
+		)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		p.logger.Error("Failed to dial tunnel destination", "host", host, "port", port, "error", err)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		upstream.Close()
+		http.Error(w, "Tunneling not supported", http.StatusInternalServerError)
+		return
+	}
+	client, buffered, err := hijacker.Hijack()
+	if err != nil {
+		upstream.Close()
+		p.logger.Error("Failed to hijack connection", "error", err)
+		return
+	}
+
+	// The server's read and write timeouts do not apply to long lived tunnels
+	client.SetDeadline(time.Time{})
+
+	if _, err := client.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		client.Close()
+		upstream.Close()
+		return
+	}
+
+	// Bytes the client sent after the CONNECT request belong to the tunnel
+	var clientReader io.Reader = client
+	if n := buffered.Reader.Buffered(); n > 0 {
+		pending, _ := buffered.Reader.Peek(n)
+		clientReader = io.MultiReader(bytes.NewReader(pending), client)
+	}
+
+	start := time.Now()
+	sent, received := Tunnel(client, clientReader, upstream)
+
+	p.logger.Info("Tunnel closed",
+		"remote_addr", r.RemoteAddr,
+		"user", user,
+		"destination", net.JoinHostPort(host, strconv.Itoa(port)),
+		"bytes_sent", sent,
+		"bytes_received", received,
+		"duration_ms", time.Since(start).Milliseconds(),
+	)
+}
+
+// authenticate checks the Proxy-Authorization header and returns the user name
+func (p *Proxy) authenticate(r *http.Request) (string, bool) {
+	if len(p.credentials) == 0 {
+		return "", true
+	}
+	auth := r.Header.Get("Proxy-Authorization")
+	scheme, encoded, ok := strings.Cut(auth, " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", false
+	}
+	username, password, ok := strings.Cut(string(decoded), ":")
+	if !ok || !p.credentials.Valid(username, password) {
+		return "", false
+	}
+	return username, true
+}
+
+// Tunnel copies data in both directions until either side is done. The client
+// is read through clientReader so buffered bytes are not lost. It returns the
+// number of bytes sent upstream and received from upstream.
+func Tunnel(client net.Conn, clientReader io.Reader, upstream net.Conn) (sent, received int64) {
+	var wg sync.WaitGroup
+	var up, down atomic.Int64
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		n, _ := io.Copy(upstream, clientReader)
+		up.Store(n)
+		closeWrite(upstream)
+	}()
+	go func() {
+		defer wg.Done()
+		n, _ := io.Copy(client, upstream)
+		down.Store(n)
+		closeWrite(client)
+	}()
+	wg.Wait()
+
+	client.Close()
+	upstream.Close()
+	return up.Load(), down.Load()
+}
+
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		return
+	}
+	conn.Close()
+}
+
+func splitHostPort(hostport, scheme string) (string, int) {
+	host, portStr, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = strings.Trim(hostport, "[]")
+		if scheme == "https" {
+			return host, 443
+		}
+		return host, 80
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return host, 0
+	}
+	return host, port
+}
+
+// countingResponseWriter captures the status code and the number of body bytes
+type countingResponseWriter struct {
+	http.ResponseWriter
+	statusCode int
+	bytes      int64
+}
+
+func (rw *countingResponseWriter) WriteHeader(code int) {
+	rw.statusCode = code
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+func (rw *countingResponseWriter) Write(b []byte) (int, error) {
+	n, err := rw.ResponseWriter.Write(b)
+	rw.bytes += int64(n)
+	return n, err
+}
+
+func (rw *countingResponseWriter) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
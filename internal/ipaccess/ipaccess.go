@@ -0,0 +1,236 @@
+package ipaccess
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shammianand/goproxy/internal/clientip"
+	"github.com/shammianand/goproxy/internal/config"
+	"github.com/shammianand/goproxy/internal/proxyproto"
+	"github.com/shammianand/goproxy/internal/urlpath"
+	"github.com/shammianand/goproxy/pkg/logger"
+)
+
+// list is a set of networks listed inline and in an optional file
+type list struct {
+	static []*net.IPNet
+	file   string
+
+	nets    []*net.IPNet
+	modTime time.Time
+	size    int64
+}
+
+func newList(cidrs []string, file string) (*list, error) {
+	static, err := proxyproto.ParseCIDRs(cidrs)
+	if err != nil {
+		return nil, err
+	}
+	l := &list{static: static, file: file, nets: static}
+	if file != "" {
+		if err := l.reload(); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// configured reports whether the list was set, even if it is empty
+func (l *list) configured() bool {
+	return len(l.static) > 0 || l.file != ""
+}
+
+// changed reports whether the file was modified since it was read
+func (l *list) changed() bool {
+	if l.file == "" {
+		return false
+	}
+	info, err := os.Stat(l.file)
+	if err != nil {
+		return true
+	}
+	return !info.ModTime().Equal(l.modTime) || info.Size() != l.size
+}
+
+// reload reads the file again. The current networks are kept when it is invalid.
+func (l *list) reload() error {
+	info, err := os.Stat(l.file)
+	if err != nil {
+		return fmt.Errorf("failed to read CIDR file: %w", err)
+	}
+	data, err := os.ReadFile(l.file)
+	if err != nil {
+		return fmt.Errorf("failed to read CIDR file: %w", err)
+	}
+	var cidrs []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		cidrs = append(cidrs, line)
+	}
+	nets, err := proxyproto.ParseCIDRs(cidrs)
+	if err != nil {
+		return fmt.Errorf("invalid CIDR file %s: %w", l.file, err)
+	}
+	l.nets = append(append([]*net.IPNet{}, l.static...), nets...)
+	l.modTime = info.ModTime()
+	l.size = info.Size()
+	return nil
+}
+
+func (l *list) contains(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range l.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// rule is a compiled config.IPAccessRule
+type rule struct {
+	prefix string
+	allow  *list
+	deny   *list
+}
+
+func newRule(r config.IPAccessRule) (*rule, error) {
+	allow, err := newList(r.Allow, r.AllowFile)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := newList(r.Deny, r.DenyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &rule{prefix: r.PathPrefix, allow: allow, deny: deny}, nil
+}
+
+// allows reports whether the rule admits an IP. Deny entries take precedence;
+// when an allow list is set the IP must be in it.
+func (r *rule) allows(ip net.IP) bool {
+	if r.deny.contains(ip) {
+		return false
+	}
+	return !r.allow.configured() || r.allow.contains(ip)
+}
+
+// Filter allows or denies requests by client IP. Global lists apply to every
+// request, and the lists of the route with the longest matching prefix on
+// top of them.
+type Filter struct {
+	global *rule
+	routes []*rule
+	logger *logger.Logger
+
+	mutex sync.RWMutex
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// New creates a Filter and starts checking the CIDR files for changes every
+// reloadInterval, which defaults to ten seconds
+func New(global config.IPAccessRule, routes []config.IPAccessRule, reloadInterval time.Duration, logger *logger.Logger) (*Filter, error) {
+	f := &Filter{logger: logger, stop: make(chan struct{}), done: make(chan struct{})}
+	var err error
+	if f.global, err = newRule(global); err != nil {
+		return nil, err
+	}
+	for _, r := range routes {
+		if r.PathPrefix == "" {
+			return nil, fmt.Errorf("ip access route requires a path prefix")
+		}
+		compiled, err := newRule(r)
+		if err != nil {
+			return nil, err
+		}
+		f.routes = append(f.routes, compiled)
+	}
+	sort.SliceStable(f.routes, func(i, j int) bool {
+		return len(f.routes[i].prefix) > len(f.routes[j].prefix)
+	})
+
+	if reloadInterval <= 0 {
+		reloadInterval = 10 * time.Second
+	}
+	go f.maintain(reloadInterval)
+	return f, nil
+}
+
+// Close stops checking the CIDR files
+func (f *Filter) Close() {
+	close(f.stop)
+	<-f.done
+}
+
+func (f *Filter) maintain(interval time.Duration) {
+	defer close(f.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.stop:
+			return
+		case <-ticker.C:
+			f.reload()
+		}
+	}
+}
+
+func (f *Filter) reload() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, r := range append([]*rule{f.global}, f.routes...) {
+		for _, l := range []*list{r.allow, r.deny} {
+			if !l.changed() {
+				continue
+			}
+			if err := l.reload(); err != nil {
+				f.logger.Error("Failed to reload CIDR file, keeping the current list", "error", err)
+				continue
+			}
+			f.logger.Info("Reloaded CIDR file", "file", l.file, "entries", len(l.nets)-len(l.static))
+		}
+	}
+}
+
+// Allowed reports whether a client IP may access a path, which is matched
+// once cleaned
+func (f *Filter) Allowed(ip net.IP, path string) bool {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	if !f.global.allows(ip) {
+		return false
+	}
+	path = urlpath.Clean(path)
+	for _, r := range f.routes {
+		if strings.HasPrefix(path, r.prefix) {
+			return r.allows(ip)
+		}
+	}
+	return true
+}
+
+// Handler returns a handler rejecting requests from denied clients with 403
+func (f *Filter) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := net.ParseIP(clientip.FromRequest(r))
+		if !f.Allowed(ip, r.URL.Path) {
+			f.logger.Warn("Client IP denied", "client_ip", ip.String(), "method", r.Method, "path", r.URL.Path)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,110 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ContentType is the media type of the Prometheus text exposition format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// label is a metric label
+type label struct {
+	Name  string
+	Value string
+}
+
+// sample is a value of a metric with its labels
+type sample struct {
+	labels []label
+	value  float64
+}
+
+// histogram counts observations into cumulative buckets
+type histogram struct {
+	bounds []float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// clone copies a histogram so it can be written without holding its lock
+func (h *histogram) clone() histogram {
+	c := *h
+	c.counts = append([]uint64{}, h.counts...)
+	return c
+}
+
+// writeHeader writes the HELP and TYPE lines of a metric
+func writeHeader(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, strings.ReplaceAll(help, "\n", `\n`), name, typ)
+}
+
+// writeSamples writes a gauge or counter, sorted by labels for stable output
+func writeSamples(w io.Writer, name, help, typ string, samples []sample) {
+	writeHeader(w, name, help, typ)
+	sort.Slice(samples, func(i, j int) bool {
+		return formatLabels(samples[i].labels) < formatLabels(samples[j].labels)
+	})
+	for _, s := range samples {
+		fmt.Fprintf(w, "%s%s %s\n", name, formatLabels(s.labels), formatValue(s.value))
+	}
+}
+
+// writeHistogram writes the buckets, sum and count of a histogram series
+func writeHistogram(w io.Writer, name string, labels []label, h *histogram) {
+	for i, bound := range h.bounds {
+		le := append(append([]label{}, labels...), label{"le", formatValue(bound)})
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name, formatLabels(le), h.counts[i])
+	}
+	le := append(append([]label{}, labels...), label{"le", "+Inf"})
+	fmt.Fprintf(w, "%s_bucket%s %d\n", name, formatLabels(le), h.count)
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, formatLabels(labels), formatValue(h.sum))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, formatLabels(labels), h.count)
+}
+
+func formatLabels(labels []label) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, l := range labels {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(l.Name + `="`)
+		b.WriteString(strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(l.Value))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
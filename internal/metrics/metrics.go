@@ -0,0 +1,332 @@
+package metrics
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/shammianand/goproxy/internal/loadbalancer"
+)
+
+var (
+	// latencyBuckets are the default buckets of the Prometheus client libraries
+	latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	sizeBuckets    = []float64{100, 1000, 10000, 100000, 1e6, 1e7, 1e8}
+)
+
+// methods are the request methods used as labels; others are labeled OTHER
+// to bound the number of series
+var methods = map[string]bool{
+	http.MethodGet: true, http.MethodHead: true, http.MethodPost: true, http.MethodPut: true,
+	http.MethodPatch: true, http.MethodDelete: true, http.MethodOptions: true,
+	http.MethodConnect: true, http.MethodTrace: true,
+}
+
+// Options configures Metrics
+type Options struct {
+	// Routes are the path prefixes requests are labeled with, by longest
+	// match; other requests are labeled "/"
+	Routes []string
+	// LoadBalancer reports the health of its backends
+	LoadBalancer loadbalancer.LoadBalancer
+}
+
+type seriesKey struct {
+	route   string
+	method  string
+	status  string
+	backend string
+}
+
+func (k seriesKey) labels() []label {
+	return []label{{"route", k.route}, {"method", k.method}, {"status", k.status}, {"backend", k.backend}}
+}
+
+// series holds the request metrics of a set of labels
+type series struct {
+	mu           sync.Mutex
+	requests     uint64
+	duration     *histogram
+	requestSize  *histogram
+	responseSize *histogram
+}
+
+type gauge struct {
+	name string
+	help string
+	fn   func() float64
+}
+
+// Metrics collects the metrics of proxied requests and serves them in the
+// Prometheus text exposition format
+type Metrics struct {
+	routes      []string
+	lb          loadbalancer.LoadBalancer
+	connections atomic.Int64
+
+	mu       sync.RWMutex
+	series   map[seriesKey]*series
+	inFlight map[string]*atomic.Int64
+	gauges   []gauge
+}
+
+// New creates Metrics
+func New(opts Options) *Metrics {
+	routes := append([]string{}, opts.Routes...)
+	sort.SliceStable(routes, func(i, j int) bool { return len(routes[i]) > len(routes[j]) })
+	return &Metrics{
+		routes:   routes,
+		lb:       opts.LoadBalancer,
+		series:   make(map[seriesKey]*series),
+		inFlight: make(map[string]*atomic.Int64),
+	}
+}
+
+// AddGauge exposes the value returned by fn, read on every scrape
+func (m *Metrics) AddGauge(name, help string, fn func() float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.gauges = append(m.gauges, gauge{name, help, fn})
+}
+
+// ConnState counts the active client connections; set it as the ConnState
+// hook of the server
+func (m *Metrics) ConnState(_ net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		m.connections.Add(1)
+	case http.StateHijacked, http.StateClosed:
+		m.connections.Add(-1)
+	}
+}
+
+type contextKey int
+
+const observationKey contextKey = iota
+
+// observation is what handlers down the chain report about a request
+type observation struct {
+	backend string
+}
+
+// TrackBackend labels a request with the backend it is proxied to and counts
+// it in flight for that backend until the returned function is called
+func (m *Metrics) TrackBackend(r *http.Request, backend string) func() {
+	if obs, ok := r.Context().Value(observationKey).(*observation); ok {
+		obs.backend = backend
+	}
+	m.mu.RLock()
+	gauge, ok := m.inFlight[backend]
+	m.mu.RUnlock()
+	if !ok {
+		m.mu.Lock()
+		if gauge, ok = m.inFlight[backend]; !ok {
+			gauge = new(atomic.Int64)
+			m.inFlight[backend] = gauge
+		}
+		m.mu.Unlock()
+	}
+	gauge.Add(1)
+	return func() { gauge.Add(-1) }
+}
+
+// Handler returns a handler recording the count, latency and sizes of the
+// requests passed to next
+func (m *Metrics) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		obs := &observation{}
+		r = r.WithContext(context.WithValue(r.Context(), observationKey, obs))
+		var body *countingBody
+		if r.Body != nil && r.Body != http.NoBody {
+			body = &countingBody{ReadCloser: r.Body}
+			r.Body = body
+		}
+		rw := &responseWriter{ResponseWriter: w}
+		next.ServeHTTP(rw, r)
+
+		requestSize := r.ContentLength
+		if body != nil && body.n > requestSize {
+			requestSize = body.n
+		}
+		if requestSize < 0 {
+			requestSize = 0
+		}
+		status := rw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		key := seriesKey{
+			route:   m.route(r.URL.Path),
+			method:  r.Method,
+			status:  strconv.Itoa(status/100) + "xx",
+			backend: obs.backend,
+		}
+		if !methods[key.method] {
+			key.method = "OTHER"
+		}
+		m.observe(key, time.Since(start), requestSize, rw.written)
+	})
+}
+
+func (m *Metrics) route(path string) string {
+	for _, route := range m.routes {
+		if strings.HasPrefix(path, route) {
+			return route
+		}
+	}
+	return "/"
+}
+
+func (m *Metrics) observe(key seriesKey, duration time.Duration, requestSize, responseSize int64) {
+	m.mu.RLock()
+	s, ok := m.series[key]
+	m.mu.RUnlock()
+	if !ok {
+		m.mu.Lock()
+		if s, ok = m.series[key]; !ok {
+			s = &series{
+				duration:     newHistogram(latencyBuckets),
+				requestSize:  newHistogram(sizeBuckets),
+				responseSize: newHistogram(sizeBuckets),
+			}
+			m.series[key] = s
+		}
+		m.mu.Unlock()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	s.duration.observe(duration.Seconds())
+	s.requestSize.observe(float64(requestSize))
+	s.responseSize.observe(float64(responseSize))
+}
+
+// ServeHTTP serves the metrics in the Prometheus text exposition format
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	m.WriteText(w)
+}
+
+// WriteText writes the metrics in the Prometheus text exposition format
+func (m *Metrics) WriteText(w io.Writer) {
+	type snapshot struct {
+		labels       []label
+		requests     uint64
+		duration     histogram
+		requestSize  histogram
+		responseSize histogram
+	}
+	m.mu.RLock()
+	snapshots := make([]snapshot, 0, len(m.series))
+	for key, s := range m.series {
+		s.mu.Lock()
+		snapshots = append(snapshots, snapshot{
+			labels:       key.labels(),
+			requests:     s.requests,
+			duration:     s.duration.clone(),
+			requestSize:  s.requestSize.clone(),
+			responseSize: s.responseSize.clone(),
+		})
+		s.mu.Unlock()
+	}
+	var inFlight []sample
+	for backend, gauge := range m.inFlight {
+		inFlight = append(inFlight, sample{[]label{{"backend", backend}}, float64(gauge.Load())})
+	}
+	gauges := append([]gauge{}, m.gauges...)
+	m.mu.RUnlock()
+	sort.Slice(snapshots, func(i, j int) bool {
+		return formatLabels(snapshots[i].labels) < formatLabels(snapshots[j].labels)
+	})
+
+	requests := make([]sample, len(snapshots))
+	for i, s := range snapshots {
+		requests[i] = sample{s.labels, float64(s.requests)}
+	}
+	writeSamples(w, "goproxy_http_requests_total", "Requests handled, by route, method, status class and backend.", "counter", requests)
+
+	histograms := []struct {
+		name string
+		help string
+		get  func(*snapshot) *histogram
+	}{
+		{"goproxy_http_request_duration_seconds", "Time to serve requests, in seconds.", func(s *snapshot) *histogram { return &s.duration }},
+		{"goproxy_http_request_size_bytes", "Size of request bodies, in bytes.", func(s *snapshot) *histogram { return &s.requestSize }},
+		{"goproxy_http_response_size_bytes", "Size of response bodies, in bytes.", func(s *snapshot) *histogram { return &s.responseSize }},
+	}
+	for _, h := range histograms {
+		writeHeader(w, h.name, h.help, "histogram")
+		for i := range snapshots {
+			writeHistogram(w, h.name, snapshots[i].labels, h.get(&snapshots[i]))
+		}
+	}
+
+	writeSamples(w, "goproxy_active_connections", "Open client connections.", "gauge",
+		[]sample{{nil, float64(m.connections.Load())}})
+	if m.lb != nil {
+		var up []sample
+		for _, b := range m.lb.Backends() {
+			value := 0.0
+			if b.Healthy {
+				value = 1
+			}
+			up = append(up, sample{[]label{{"backend", b.URL.String()}}, value})
+		}
+		writeSamples(w, "goproxy_backend_up", "Whether a load balanced backend is healthy.", "gauge", up)
+	}
+	writeSamples(w, "goproxy_backend_in_flight_requests", "Requests being proxied to a backend.", "gauge", inFlight)
+	for _, g := range gauges {
+		writeSamples(w, g.name, g.help, "gauge", []sample{{nil, g.fn()}})
+	}
+}
+
+// countingBody counts the bytes read from a request body
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+// responseWriter captures the status code and counts the bytes written
+type responseWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (rw *responseWriter) WriteHeader(code int) {
+	// Informational responses precede the final one, except for upgrades
+	if rw.status == 0 && (code >= 200 || code == http.StatusSwitchingProtocols) {
+		rw.status = code
+	}
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+func (rw *responseWriter) Write(p []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	n, err := rw.ResponseWriter.Write(p)
+	rw.written += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the flushing and hijacking of
+// the underlying writer
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
@@ -5,9 +5,15 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"sync"
 	"time"
 
+	"github.com/shammianand/goproxy/internal/accesslog"
+	"github.com/shammianand/goproxy/internal/fastcgi"
 	"github.com/shammianand/goproxy/internal/loadbalancer"
+	"github.com/shammianand/goproxy/internal/metrics"
+	"github.com/shammianand/goproxy/internal/signing"
+	"github.com/shammianand/goproxy/internal/tracing"
 	"github.com/shammianand/goproxy/pkg/logger"
 )
 
@@ -16,9 +22,72 @@ type Proxy struct {
 	proxy        *httputil.ReverseProxy
 	logger       *logger.Logger
 	loadBalancer loadbalancer.LoadBalancer
+	transport    http.RoundTripper
+	unixSockets  unixSockets
+
+	proxyProtocolVersion int
+	signers              []*signing.Signer
+	metrics              *metrics.Metrics
+	tracer               *tracing.Tracer
+	accessLog            *accesslog.Logger
+
+	fastcgiOptions    fastcgi.Options
+	fastcgiMu         sync.Mutex
+	fastcgiTransports map[string]*fastcgi.Transport
 }
 
-func NewProxy(target string, lb loadbalancer.LoadBalancer, logger *logger.Logger) (http.Handler, error) {
+// Option configures optional Proxy behaviour
+type Option func(*Proxy)
+
+// WithProxyProtocol makes the proxy prefix every upstream connection with a
+// PROXY protocol header of the given version (1 or 2) carrying the client address
+func WithProxyProtocol(version int) Option {
+	return func(p *Proxy) {
+		p.proxyProtocolVersion = version
+	}
+}
+
+// WithFastCGI sets how requests are mapped onto FastCGI parameters for
+// fastcgi:// and fcgi+unix:// backends
+func WithFastCGI(opts fastcgi.Options) Option {
+	return func(p *Proxy) {
+		p.fastcgiOptions = opts
+	}
+}
+
+// WithSigners signs requests to the backends matched by the signers; the
+// first matching signer applies
+func WithSigners(signers ...*signing.Signer) Option {
+	return func(p *Proxy) {
+		p.signers = append(p.signers, signers...)
+	}
+}
+
+// WithMetrics labels requests with their backend and counts the requests in
+// flight to each backend
+func WithMetrics(m *metrics.Metrics) Option {
+	return func(p *Proxy) {
+		p.metrics = m
+	}
+}
+
+// WithTracer records a server span for every request and a client span for
+// every upstream attempt
+func WithTracer(t *tracing.Tracer) Option {
+	return func(p *Proxy) {
+		p.tracer = t
+	}
+}
+
+// WithAccessLog records the backend, status and response time of every
+// upstream attempt in the access log
+func WithAccessLog(l *accesslog.Logger) Option {
+	return func(p *Proxy) {
+		p.accessLog = l
+	}
+}
+
+func NewProxy(target string, lb loadbalancer.LoadBalancer, logger *logger.Logger, opts ...Option) (http.Handler, error) {
 	var targetURL *url.URL
 	var err error
 	if target != "" {
@@ -33,10 +102,15 @@ func NewProxy(target string, lb loadbalancer.LoadBalancer, logger *logger.Logger
 		loadBalancer: lb,
 		logger:       logger,
 	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	p.transport = p.newTransport()
 
 	if lb == nil && targetURL != nil {
-		p.proxy = httputil.NewSingleHostReverseProxy(targetURL)
+		p.proxy = httputil.NewSingleHostReverseProxy(p.upstreamURL(targetURL))
 		p.proxy.ErrorLog = slog.NewLogLogger(logger.Handler(), slog.LevelError)
+		p.proxy.Transport = p.transportFor(targetURL)
 	}
 
 	return p, nil
@@ -44,52 +118,84 @@ func NewProxy(target string, lb loadbalancer.LoadBalancer, logger *logger.Logger
 
 func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	var proxyToUse *httputil.ReverseProxy
-	var backendURL *url.URL
+	var backendURL, upstreamURL *url.URL
+
+	// Capture the response
+	rw := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+	var span *tracing.Span
+	if p.tracer != nil {
+		span = p.tracer.StartServer(r)
+		r = r.WithContext(tracing.NewContext(r.Context(), span))
+		defer endServerSpan(span, rw)
+	}
 
 	if p.loadBalancer != nil {
 		backend, err := p.loadBalancer.NextBackend()
 		if err != nil {
 			p.logger.Error("Failed to get next backend", "error", err)
-			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			http.Error(rw, "Service Unavailable", http.StatusServiceUnavailable)
 			return
 		}
 		backendURL = backend.URL
-		proxyToUse = httputil.NewSingleHostReverseProxy(backendURL)
+		upstreamURL = p.upstreamURL(backendURL)
+		proxyToUse = httputil.NewSingleHostReverseProxy(upstreamURL)
+		proxyToUse.Transport = p.transportFor(backendURL)
 	} else if p.proxy != nil {
 		proxyToUse = p.proxy
 		backendURL = p.target
+		upstreamURL = p.upstreamURL(backendURL)
 	} else {
 		p.logger.Error("No backend or load balancer configured")
-		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		http.Error(rw, "Service Unavailable", http.StatusServiceUnavailable)
 		return
 	}
 
+	if p.metrics != nil {
+		defer p.metrics.TrackBackend(r, backendURL.String())()
+	}
+	if span != nil {
+		span.SetAttribute("goproxy.backend", backendURL.String())
+	}
+	if p.accessLog != nil {
+		r = accesslog.SetUpstreamAddr(r, upstreamAddr(backendURL))
+	}
+
 	proxyToUse.ErrorLog = slog.NewLogLogger(p.logger.Handler(), slog.LevelError)
 
-	// Modify the request to match the backend URL
-	r.URL.Host = backendURL.Host
-	r.URL.Scheme = backendURL.Scheme
-	r.Header.Set("X-Forwarded-Host", r.Header.Get("Host"))
-	r.Host = backendURL.Host
+	// Modify the request to match the backend URL. Requests to unix socket
+	// and FastCGI backends keep the client's Host header.
+	r.URL.Host = upstreamURL.Host
+	r.URL.Scheme = upstreamURL.Scheme
+	r.Header.Set("X-Forwarded-Host", r.Host)
+	if !keepsClientHost(backendURL) {
+		r.Host = backendURL.Host
+	}
+	r = r.WithContext(withClientAddr(r.Context(), r.RemoteAddr))
 
-	// Log the incoming request
-	p.logger.Info("Incoming request",
+	// Requests are recorded by the access log; these are for debugging
+	p.logger.Debug("Incoming request",
 		"method", r.Method,
 		"url", r.URL.String(),
 		"backend", backendURL.String(),
 	)
 
-	// Capture the response
-	rw := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
 	proxyToUse.ServeHTTP(rw, r)
 
-	// Log the response
-	p.logger.Info("Response received",
+	p.logger.Debug("Response received",
 		"status", rw.statusCode,
 		"backend", backendURL.String(),
 	)
 }
 
+// endServerSpan records the response status on the span of a request
+func endServerSpan(span *tracing.Span, rw *responseWriter) {
+	span.SetAttribute("http.response.status_code", rw.statusCode)
+	if rw.statusCode >= 500 {
+		span.SetError(http.StatusText(rw.statusCode))
+	}
+	span.End()
+}
+
 // responseWriter is a custom ResponseWriter that captures the status code
 type responseWriter struct {
 	http.ResponseWriter
@@ -0,0 +1,200 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/shammianand/goproxy/internal/fastcgi"
+	"github.com/shammianand/goproxy/internal/proxyproto"
+)
+
+type contextKey int
+
+const clientAddrKey contextKey = iota
+
+// withClientAddr stores the downstream client address so that the transport
+// can reference it when dialing upstream
+func withClientAddr(ctx context.Context, addr string) context.Context {
+	return context.WithValue(ctx, clientAddrKey, addr)
+}
+
+func clientAddrFromContext(ctx context.Context) (net.Addr, bool) {
+	addr, ok := ctx.Value(clientAddrKey).(string)
+	if !ok {
+		return nil, false
+	}
+	tcp, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, false
+	}
+	return tcp, true
+}
+
+// unixSockets maps the synthetic host names used for unix:// backends to the
+// socket paths they stand for
+type unixSockets struct {
+	mu    sync.RWMutex
+	paths map[string]string
+}
+
+// register returns the synthetic host name for a socket path. Each socket gets
+// its own host so the transport keeps a separate connection pool per socket.
+func (u *unixSockets) register(path string) string {
+	h := fnv.New64a()
+	h.Write([]byte(path))
+	host := fmt.Sprintf("unix-%x.sock", h.Sum64())
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.paths == nil {
+		u.paths = make(map[string]string)
+	}
+	u.paths[host] = path
+	return host
+}
+
+func (u *unixSockets) lookup(addr string) (string, bool) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	path, ok := u.paths[host]
+	return path, ok
+}
+
+// isFastCGI reports whether a backend speaks FastCGI rather than HTTP
+func isFastCGI(backend *url.URL) bool {
+	return backend.Scheme == "fastcgi" || backend.Scheme == "fcgi+unix"
+}
+
+// keepsClientHost reports whether requests to a backend keep the client's Host
+// header. Socket and FastCGI backends have no meaningful host of their own.
+func keepsClientHost(backend *url.URL) bool {
+	return backend.Scheme == "unix" || isFastCGI(backend)
+}
+
+// upstreamURL maps a backend URL to the URL requests are sent to. unix://
+// backends are addressed through a synthetic host that the transport dials
+// over the socket.
+func (p *Proxy) upstreamURL(backend *url.URL) *url.URL {
+	switch {
+	case backend.Scheme == "unix":
+		return &url.URL{Scheme: "http", Host: p.unixSockets.register(backend.Path)}
+	case isFastCGI(backend):
+		// The FastCGI transport dials the backend itself and only uses the
+		// path and query of the request
+		host := backend.Host
+		if host == "" {
+			host = "localhost"
+		}
+		return &url.URL{Scheme: "http", Host: host}
+	default:
+		return backend
+	}
+}
+
+// upstreamAddr names a backend in the access log: its host and port, or the
+// path of its socket
+func upstreamAddr(backend *url.URL) string {
+	if backend.Scheme == "unix" || backend.Scheme == "fcgi+unix" {
+		return "unix:" + backend.Path
+	}
+	return backend.Host
+}
+
+// transportFor returns the RoundTripper used to reach a backend, tracing
+// requests and signing them when a signer matches the backend
+func (p *Proxy) transportFor(backend *url.URL) http.RoundTripper {
+	t := p.backendTransport(backend)
+	if p.accessLog != nil {
+		t = p.accessLog.Transport(t)
+	}
+	for _, s := range p.signers {
+		if s.Matches(backend) {
+			t = s.Transport(t)
+			break
+		}
+	}
+	// Trace context headers are added before signing, so signatures may
+	// cover them
+	if p.tracer != nil {
+		t = p.tracer.Transport(t)
+	}
+	return t
+}
+
+// backendTransport returns the RoundTripper speaking the protocol of a backend
+func (p *Proxy) backendTransport(backend *url.URL) http.RoundTripper {
+	if !isFastCGI(backend) {
+		return p.transport
+	}
+
+	key := backend.String()
+	p.fastcgiMu.Lock()
+	defer p.fastcgiMu.Unlock()
+	if t, ok := p.fastcgiTransports[key]; ok {
+		return t
+	}
+
+	network, address := "tcp", backend.Host
+	if backend.Scheme == "fcgi+unix" {
+		network, address = "unix", backend.Path
+	}
+	t := fastcgi.NewTransport(network, address, p.fastcgiOptions, p.logger.Named("fastcgi"))
+	if p.fastcgiTransports == nil {
+		p.fastcgiTransports = make(map[string]*fastcgi.Transport)
+	}
+	p.fastcgiTransports[key] = t
+	return t
+}
+
+// newTransport builds the RoundTripper used for all upstream requests
+func (p *Proxy) newTransport() http.RoundTripper {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+
+	envProxy := t.Proxy
+	t.Proxy = func(req *http.Request) (*url.URL, error) {
+		if _, ok := p.unixSockets.lookup(req.URL.Host); ok {
+			return nil, nil
+		}
+		return envProxy(req)
+	}
+	t.DialContext = p.dialContext
+
+	if p.proxyProtocolVersion != 0 {
+		// Every upstream connection announces a single client, so connections
+		// cannot be shared between clients
+		t.DisableKeepAlives = true
+	}
+
+	return t
+}
+
+func (p *Proxy) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if path, ok := p.unixSockets.lookup(addr); ok {
+		network, addr = "unix", path
+	}
+
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.proxyProtocolVersion != 0 {
+		src, _ := clientAddrFromContext(ctx)
+		if err := proxyproto.WriteHeader(conn, p.proxyProtocolVersion, src, conn.RemoteAddr()); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
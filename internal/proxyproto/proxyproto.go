@@ -0,0 +1,268 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// v2Signature is the fixed 12 byte prefix of every PROXY protocol v2 header
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// v1Prefix is the prefix of every PROXY protocol v1 header
+var v1Prefix = []byte("PROXY ")
+
+const (
+	// v1MaxLength is the longest header allowed by the v1 specification, including CRLF
+	v1MaxLength = 107
+
+	v2CmdLocal = 0x0
+	v2CmdProxy = 0x1
+
+	v2FamInet4 = 0x11
+	v2FamInet6 = 0x21
+)
+
+var (
+	ErrInvalidHeader     = errors.New("proxyproto: invalid header")
+	ErrUnsupportedFamily = errors.New("proxyproto: unsupported address family")
+)
+
+// Header represents a decoded PROXY protocol header
+type Header struct {
+	Version     int
+	Local       bool
+	Source      *net.TCPAddr
+	Destination *net.TCPAddr
+}
+
+// Format encodes the header in its wire format
+func (h *Header) Format() ([]byte, error) {
+	switch h.Version {
+	case 1:
+		return h.formatV1()
+	case 2:
+		return h.formatV2()
+	default:
+		return nil, fmt.Errorf("proxyproto: unsupported version %d", h.Version)
+	}
+}
+
+func (h *Header) formatV1() ([]byte, error) {
+	if h.Local || h.Source == nil || h.Destination == nil {
+		return []byte("PROXY UNKNOWN\r\n"), nil
+	}
+	proto := "TCP4"
+	if h.Source.IP.To4() == nil {
+		proto = "TCP6"
+	}
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n",
+		proto, h.Source.IP.String(), h.Destination.IP.String(), h.Source.Port, h.Destination.Port)), nil
+}
+
+func (h *Header) formatV2() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write(v2Signature)
+
+	if h.Local || h.Source == nil || h.Destination == nil {
+		buf.WriteByte(0x20 | v2CmdLocal)
+		buf.WriteByte(0x00)
+		buf.Write([]byte{0x00, 0x00})
+		return buf.Bytes(), nil
+	}
+
+	buf.WriteByte(0x20 | v2CmdProxy)
+	src4, dst4 := h.Source.IP.To4(), h.Destination.IP.To4()
+	if src4 != nil && dst4 != nil {
+		buf.WriteByte(v2FamInet4)
+		binary.Write(&buf, binary.BigEndian, uint16(12))
+		buf.Write(src4)
+		buf.Write(dst4)
+	} else {
+		buf.WriteByte(v2FamInet6)
+		binary.Write(&buf, binary.BigEndian, uint16(36))
+		buf.Write(h.Source.IP.To16())
+		buf.Write(h.Destination.IP.To16())
+	}
+	binary.Write(&buf, binary.BigEndian, uint16(h.Source.Port))
+	binary.Write(&buf, binary.BigEndian, uint16(h.Destination.Port))
+	return buf.Bytes(), nil
+}
+
+// WriteHeader writes a PROXY protocol header of the given version describing
+// a connection from src to dst
+func WriteHeader(w io.Writer, version int, src, dst net.Addr) error {
+	h := &Header{Version: version}
+	srcTCP, srcOK := toTCPAddr(src)
+	dstTCP, dstOK := toTCPAddr(dst)
+	if srcOK && dstOK {
+		h.Source, h.Destination = srcTCP, dstTCP
+	} else {
+		h.Local = true
+	}
+
+	data, err := h.Format()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// ReadHeader reads a PROXY protocol header from r. It returns a nil header
+// and no error when the stream does not start with a PROXY protocol header.
+func ReadHeader(r *bufio.Reader) (*Header, error) {
+	peek, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	switch peek[0] {
+	case v1Prefix[0]:
+		peek, err = r.Peek(len(v1Prefix))
+		if err != nil || !bytes.Equal(peek, v1Prefix) {
+			return nil, nil
+		}
+		return readV1(r)
+	case v2Signature[0]:
+		peek, err = r.Peek(len(v2Signature))
+		if err != nil || !bytes.Equal(peek, v2Signature) {
+			return nil, nil
+		}
+		return readV2(r)
+	default:
+		return nil, nil
+	}
+}
+
+func readV1(r *bufio.Reader) (*Header, error) {
+	var line []byte
+	for len(line) < v1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, ErrInvalidHeader
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, ErrInvalidHeader
+	}
+
+	h := &Header{Version: 1}
+	switch fields[1] {
+	case "UNKNOWN":
+		h.Local = true
+		return h, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, ErrUnsupportedFamily
+	}
+	if len(fields) != 6 {
+		return nil, ErrInvalidHeader
+	}
+
+	srcIP, dstIP := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	if srcIP == nil || dstIP == nil {
+		return nil, ErrInvalidHeader
+	}
+	srcPort, err := parsePort(fields[4])
+	if err != nil {
+		return nil, err
+	}
+	dstPort, err := parsePort(fields[5])
+	if err != nil {
+		return nil, err
+	}
+
+	h.Source = &net.TCPAddr{IP: srcIP, Port: srcPort}
+	h.Destination = &net.TCPAddr{IP: dstIP, Port: dstPort}
+	return h, nil
+}
+
+func readV2(r *bufio.Reader) (*Header, error) {
+	var fixed [16]byte
+	if _, err := io.ReadFull(r, fixed[:]); err != nil {
+		return nil, err
+	}
+
+	verCmd, fam := fixed[12], fixed[13]
+	length := int(binary.BigEndian.Uint16(fixed[14:16]))
+	if verCmd>>4 != 2 {
+		return nil, ErrInvalidHeader
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	h := &Header{Version: 2}
+	switch verCmd & 0x0f {
+	case v2CmdLocal:
+		h.Local = true
+		return h, nil
+	case v2CmdProxy:
+	default:
+		return nil, ErrInvalidHeader
+	}
+
+	switch fam {
+	case v2FamInet4:
+		if length < 12 {
+			return nil, ErrInvalidHeader
+		}
+		h.Source = &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}
+		h.Destination = &net.TCPAddr{IP: net.IP(payload[4:8]), Port: int(binary.BigEndian.Uint16(payload[10:12]))}
+	case v2FamInet6:
+		if length < 36 {
+			return nil, ErrInvalidHeader
+		}
+		h.Source = &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}
+		h.Destination = &net.TCPAddr{IP: net.IP(payload[16:32]), Port: int(binary.BigEndian.Uint16(payload[34:36]))}
+	default:
+		// Unix sockets and unspecified families carry no usable client address
+		h.Local = true
+	}
+	return h, nil
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port < 0 || port > 65535 {
+		return 0, ErrInvalidHeader
+	}
+	return port, nil
+}
+
+func toTCPAddr(addr net.Addr) (*net.TCPAddr, bool) {
+	if addr == nil {
+		return nil, false
+	}
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp, true
+	}
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil, false
+	}
+	ip := net.ParseIP(host)
+	p, err := strconv.Atoi(port)
+	if ip == nil || err != nil {
+		return nil, false
+	}
+	return &net.TCPAddr{IP: ip, Port: p}, true
+}
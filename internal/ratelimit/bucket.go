@@ -0,0 +1,98 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Decision is the outcome of taking a token
+type Decision struct {
+	Allowed bool
+	// Limit is the bucket capacity
+	Limit int
+	// Remaining is the number of whole tokens left
+	Remaining int
+	// RetryAfter is how long until a token is available when not allowed
+	RetryAfter time.Duration
+	// Reset is how long until the bucket is full again
+	Reset time.Duration
+}
+
+// bucket is a token bucket refilled continuously at the limiter rate
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// buckets holds one token bucket per key
+type buckets struct {
+	rate  float64
+	burst int
+
+	mutex   sync.Mutex
+	buckets map[string]*bucket
+}
+
+func newBuckets(rate float64, burst int) *buckets {
+	return &buckets{
+		rate:    rate,
+		burst:   burst,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// take removes a token from the bucket of key if one is available
+func (b *buckets) take(key string, now time.Time) Decision {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	bk, ok := b.buckets[key]
+	if !ok {
+		bk = &bucket{tokens: float64(b.burst), last: now}
+		b.buckets[key] = bk
+	}
+	if elapsed := now.Sub(bk.last); elapsed > 0 {
+		bk.tokens = math.Min(float64(b.burst), bk.tokens+elapsed.Seconds()*b.rate)
+		bk.last = now
+	}
+
+	d := Decision{Limit: b.burst}
+	if bk.tokens >= 1 {
+		bk.tokens--
+		d.Allowed = true
+	} else {
+		d.RetryAfter = b.refillTime(1 - bk.tokens)
+	}
+	d.Remaining = int(bk.tokens)
+	d.Reset = b.refillTime(float64(b.burst) - bk.tokens)
+	return d
+}
+
+// evictIdle removes the buckets that have refilled completely. Forgetting
+// them loses nothing, since a new bucket starts full.
+func (b *buckets) evictIdle(now time.Time) int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	evicted := 0
+	for key, bk := range b.buckets {
+		if bk.tokens+now.Sub(bk.last).Seconds()*b.rate >= float64(b.burst) {
+			delete(b.buckets, key)
+			evicted++
+		}
+	}
+	return evicted
+}
+
+func (b *buckets) len() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return len(b.buckets)
+}
+
+func (b *buckets) refillTime(tokens float64) time.Duration {
+	if tokens <= 0 {
+		return 0
+	}
+	return time.Duration(tokens / b.rate * float64(time.Second))
+}
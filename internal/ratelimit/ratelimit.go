@@ -0,0 +1,225 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/shammianand/goproxy/internal/auth"
+	"github.com/shammianand/goproxy/internal/clientip"
+	"github.com/shammianand/goproxy/internal/redis"
+	"github.com/shammianand/goproxy/pkg/logger"
+)
+
+// KeyFunc returns the key a request is rate limited by
+type KeyFunc func(r *http.Request) string
+
+// NewKeyFunc returns the KeyFunc for a key_by setting: "ip" (the default),
+// "header", "api_key" or "route". header names the request header used by
+// "header"; routes are the path prefixes used by "route".
+func NewKeyFunc(keyBy, header string, routes []string) (KeyFunc, error) {
+	switch keyBy {
+	case "", "ip":
+		return KeyByIP, nil
+	case "header":
+		if header == "" {
+			return nil, fmt.Errorf("rate limiting by header requires a header name")
+		}
+		return KeyByHeader(header), nil
+	case "api_key":
+		return KeyByAPIKey, nil
+	case "route":
+		return KeyByRoute(routes), nil
+	default:
+		return nil, fmt.Errorf("unsupported rate limit key: %s", keyBy)
+	}
+}
+
+// KeyByIP keys requests by client IP address, as resolved behind trusted
+// proxies
+func KeyByIP(r *http.Request) string {
+	return "ip:" + clientip.FromRequest(r)
+}
+
+// KeyByHeader keys requests by the value of a request header, falling back to
+// the client IP when the header is missing
+func KeyByHeader(name string) KeyFunc {
+	return func(r *http.Request) string {
+		if value := r.Header.Get(name); value != "" {
+			return "header:" + value
+		}
+		return KeyByIP(r)
+	}
+}
+
+// KeyByAPIKey keys requests by the authenticated identity, such as the ID of
+// the API key, falling back to the client IP for anonymous requests. The
+// limiter has to run inside the authentication middlewares; keys presented
+// by the client are never trusted, so random keys cannot get fresh buckets.
+func KeyByAPIKey(r *http.Request) string {
+	if id, ok := auth.FromContext(r.Context()); ok && id.Subject != "" {
+		return "key:" + id.Method + ":" + id.Subject
+	}
+	return KeyByIP(r)
+}
+
+// KeyByRoute keys requests by the longest matching route prefix, or by the
+// first path segment when no route matches, so every client shares the
+// limit of a route
+func KeyByRoute(routes []string) KeyFunc {
+	return func(r *http.Request) string {
+		path := r.URL.Path
+		best := ""
+		for _, route := range routes {
+			if strings.HasPrefix(path, route) && len(route) > len(best) {
+				best = route
+			}
+		}
+		if best == "" {
+			best = "/" + strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)[0]
+		}
+		return "route:" + best
+	}
+}
+
+// redisRetryInterval is how long the limiter relies on local buckets after
+// the shared store failed
+const redisRetryInterval = 5 * time.Second
+
+// Limiter enforces a token bucket rate limit per key
+type Limiter struct {
+	buckets *buckets
+	keyFunc KeyFunc
+	logger  *logger.Logger
+	stop    chan struct{}
+
+	redis *redisBackend
+	// redisDownUntil is the UnixNano time before which the shared store is
+	// not tried again
+	redisDownUntil atomic.Int64
+}
+
+// Option configures optional Limiter behavior
+type Option func(*Limiter)
+
+// WithRedis shares the limits of every key between all replicas using the
+// same Redis server. While the server is unreachable, each replica falls
+// back to its local buckets.
+func WithRedis(client *redis.Client, keyPrefix string) Option {
+	return func(l *Limiter) {
+		l.redis = &redisBackend{
+			client:   client,
+			prefix:   keyPrefix,
+			emission: int64(math.Ceil(1e6 / l.buckets.rate)),
+			burst:    l.buckets.burst,
+		}
+	}
+}
+
+// New creates a Limiter allowing rate requests per second per key with bursts
+// of up to burst requests. Buckets of idle keys are evicted every
+// cleanupInterval.
+func New(rate float64, burst int, keyFunc KeyFunc, cleanupInterval time.Duration, logger *logger.Logger, opts ...Option) *Limiter {
+	if burst < 1 {
+		burst = int(math.Max(1, math.Ceil(rate)))
+	}
+	l := &Limiter{
+		buckets: newBuckets(rate, burst),
+		keyFunc: keyFunc,
+		logger:  logger,
+		stop:    make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	go l.janitor(cleanupInterval)
+	return l
+}
+
+// Close stops evicting idle buckets
+func (l *Limiter) Close() {
+	close(l.stop)
+}
+
+// Allow takes a token for key
+func (l *Limiter) Allow(key string) Decision {
+	return l.allow(context.Background(), key)
+}
+
+func (l *Limiter) allow(ctx context.Context, key string) Decision {
+	if l.redis == nil || time.Now().UnixNano() < l.redisDownUntil.Load() {
+		return l.buckets.take(key, time.Now())
+	}
+	d, err := l.redis.take(ctx, key)
+	if err != nil {
+		if l.redisDownUntil.Swap(time.Now().Add(redisRetryInterval).UnixNano()) == 0 {
+			l.logger.Error("Shared rate limit store failed, using local limits", "error", err)
+		}
+		return l.buckets.take(key, time.Now())
+	}
+	if l.redisDownUntil.Swap(0) != 0 {
+		l.logger.Info("Shared rate limit store recovered")
+	}
+	return d
+}
+
+// Size returns the number of keys currently tracked
+func (l *Limiter) Size() int {
+	return l.buckets.len()
+}
+
+// Handler returns a handler rejecting requests over the limit with 429 and
+// forwarding the rest to next
+func (l *Limiter) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := l.keyFunc(r)
+		d := l.allow(r.Context(), key)
+		setHeaders(w.Header(), d)
+		if !d.Allowed {
+			l.logger.Warn("Rate limit exceeded",
+				"key", key,
+				"method", r.Method,
+				"url", r.URL.String(),
+				"retry_after", d.RetryAfter.String(),
+			)
+			w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(d.RetryAfter)))
+			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (l *Limiter) janitor(interval time.Duration) {
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case now := <-ticker.C:
+			if evicted := l.buckets.evictIdle(now); evicted > 0 {
+				l.logger.Debug("Evicted idle rate limit buckets", "evicted", evicted, "remaining", l.buckets.len())
+			}
+		}
+	}
+}
+
+// setHeaders adds the RateLimit header fields of the IETF httpapi draft
+func setHeaders(h http.Header, d Decision) {
+	h.Set("RateLimit-Limit", strconv.Itoa(d.Limit))
+	h.Set("RateLimit-Remaining", strconv.Itoa(d.Remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(d.Reset)))
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
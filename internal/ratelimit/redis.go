@@ -0,0 +1,68 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/shammianand/goproxy/internal/redis"
+)
+
+// gcraScript implements the generic cell rate algorithm. The key holds the
+// theoretical arrival time (TAT) in microseconds of the server clock, so
+// replicas with skewed clocks still agree, and expires once the bucket has
+// refilled completely.
+var gcraScript = redis.NewScript(`
+local emission = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+local tolerance = emission * burst
+local tat = tonumber(redis.call('GET', KEYS[1]) or now)
+if tat < now then
+  tat = now
+end
+local new_tat = tat + emission
+if new_tat - tolerance > now then
+  return {0, 0, new_tat - tolerance - now, tat - now}
+end
+-- Numbers are formatted explicitly, since Redis would round them to 14 digits
+redis.call('SET', KEYS[1], string.format('%d', new_tat), 'PX', math.ceil((new_tat - now) / 1000))
+return {1, math.floor((now - (new_tat - tolerance)) / emission), 0, new_tat - now}
+`)
+
+// redisBackend shares rate limits between replicas through a Redis server
+type redisBackend struct {
+	client *redis.Client
+	prefix string
+	// emission is the interval between tokens in microseconds
+	emission int64
+	burst    int
+}
+
+// take runs the GCRA script for key
+func (b *redisBackend) take(ctx context.Context, key string) (Decision, error) {
+	reply, err := b.client.EvalScript(ctx, gcraScript, []string{b.prefix + key}, b.emission, b.burst)
+	if err != nil {
+		return Decision{}, err
+	}
+	values, ok := reply.([]any)
+	if !ok || len(values) != 4 {
+		return Decision{}, fmt.Errorf("unexpected rate limit script reply: %v", reply)
+	}
+	ints := make([]int64, len(values))
+	for i, v := range values {
+		n, ok := v.(int64)
+		if !ok {
+			return Decision{}, fmt.Errorf("unexpected rate limit script reply: %v", reply)
+		}
+		ints[i] = n
+	}
+	return Decision{
+		Allowed:    ints[0] == 1,
+		Limit:      b.burst,
+		Remaining:  int(ints[1]),
+		RetryAfter: time.Duration(ints[2]) * time.Microsecond,
+		Reset:      time.Duration(ints[3]) * time.Microsecond,
+	}, nil
+}
@@ -0,0 +1,23 @@
+package redis
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+)
+
+// Script is a Lua script run with EVALSHA
+type Script struct {
+	src string
+	sha string
+}
+
+// NewScript creates a new Script
+func NewScript(src string) *Script {
+	sum := sha1.Sum([]byte(src))
+	return &Script{src: src, sha: hex.EncodeToString(sum[:])}
+}
+
+// SHA returns the SHA1 the server knows the script by
+func (s *Script) SHA() string {
+	return s.sha
+}
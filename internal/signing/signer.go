@@ -0,0 +1,273 @@
+package signing
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Algorithms of a Signer
+const (
+	// AlgorithmHMAC signs a canonical request with HMAC-SHA256
+	AlgorithmHMAC = "hmac-sha256"
+	// AlgorithmSigV4 signs requests the way AWS Signature Version 4 does
+	AlgorithmSigV4 = "aws-sigv4"
+)
+
+// Headers set on requests signed with AlgorithmHMAC
+const (
+	TimestampHeader = "X-Signature-Timestamp"
+	DigestHeader    = "X-Content-SHA256"
+)
+
+// ErrBodyTooLarge is returned for bodies beyond the size that can be buffered
+// for signing or verification
+var ErrBodyTooLarge = errors.New("request body too large to sign")
+
+// SignerOptions configures a Signer
+type SignerOptions struct {
+	// Algorithm is hmac-sha256 (the default) or aws-sigv4
+	Algorithm string
+	// Backends are the upstream URLs whose requests are signed; empty signs
+	// requests to every backend
+	Backends []string
+	// KeyID and Secret sign hmac-sha256 requests; the signature is sent in
+	// Header, which defaults to X-Signature
+	KeyID  string
+	Secret string
+	Header string
+	// SignedHeaders are covered by the signature besides the host
+	SignedHeaders []string
+	// Region, Service and the credentials sign aws-sigv4 requests
+	Region          string
+	Service         string
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	// MaxBodyBytes bounds the bodies buffered to compute their digest; it
+	// defaults to 10 MiB
+	MaxBodyBytes int64
+}
+
+// Signer signs requests to upstreams over their method, path, query, selected
+// headers and body digest
+type Signer struct {
+	opts     SignerOptions
+	backends []*url.URL
+	headers  []string
+}
+
+// NewSigner validates the options of a Signer
+func NewSigner(opts SignerOptions) (*Signer, error) {
+	if opts.Algorithm == "" {
+		opts.Algorithm = AlgorithmHMAC
+	}
+	switch opts.Algorithm {
+	case AlgorithmHMAC:
+		if opts.Secret == "" {
+			return nil, fmt.Errorf("hmac-sha256 signing requires a secret")
+		}
+	case AlgorithmSigV4:
+		if opts.Region == "" || opts.Service == "" || opts.AccessKeyID == "" || opts.SecretAccessKey == "" {
+			return nil, fmt.Errorf("aws-sigv4 signing requires a region, service, access key ID and secret access key")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm: %s", opts.Algorithm)
+	}
+	if opts.Header == "" {
+		opts.Header = "X-Signature"
+	}
+	if opts.MaxBodyBytes <= 0 {
+		opts.MaxBodyBytes = 10 << 20
+	}
+
+	s := &Signer{opts: opts}
+	for _, backend := range opts.Backends {
+		u, err := url.Parse(backend)
+		if err != nil || u.Scheme == "" || u.Host == "" && u.Path == "" {
+			return nil, fmt.Errorf("invalid signing backend %q", backend)
+		}
+		s.backends = append(s.backends, u)
+	}
+	seen := map[string]bool{"host": true}
+	s.headers = []string{"host"}
+	for _, name := range opts.SignedHeaders {
+		name = strings.ToLower(name)
+		if !seen[name] {
+			seen[name] = true
+			s.headers = append(s.headers, name)
+		}
+	}
+	return s, nil
+}
+
+// Matches reports whether requests to a backend are signed
+func (s *Signer) Matches(backend *url.URL) bool {
+	if len(s.backends) == 0 {
+		return true
+	}
+	for _, u := range s.backends {
+		if u.Scheme == backend.Scheme && u.Host == backend.Host && strings.TrimSuffix(u.Path, "/") == strings.TrimSuffix(backend.Path, "/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Transport returns a RoundTripper signing requests before passing them to
+// next
+func (s *Signer) Transport(next http.RoundTripper) http.RoundTripper {
+	return &signingTransport{signer: s, next: next}
+}
+
+type signingTransport struct {
+	signer *Signer
+	next   http.RoundTripper
+}
+
+func (t *signingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	if err := t.signer.Sign(req, time.Now()); err != nil {
+		return nil, err
+	}
+	return t.next.RoundTrip(req)
+}
+
+// Sign signs a request as of t, buffering its body to compute the digest
+func (s *Signer) Sign(r *http.Request, t time.Time) error {
+	body, err := readBody(r, s.opts.MaxBodyBytes)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(body)
+	digest := hex.EncodeToString(sum[:])
+	if s.opts.Algorithm == AlgorithmSigV4 {
+		s.signV4(r, digest, t.UTC())
+		return nil
+	}
+
+	timestamp := strconv.FormatInt(t.Unix(), 10)
+	r.Header.Set(TimestampHeader, timestamp)
+	r.Header.Set(DigestHeader, digest)
+
+	var b strings.Builder
+	b.WriteString(r.Method + "\n")
+	b.WriteString(canonicalPath(r.URL.Path, false) + "\n")
+	b.WriteString(canonicalQuery(r.URL.RawQuery) + "\n")
+	b.WriteString(timestamp + "\n")
+	for _, name := range s.headers {
+		b.WriteString(name + ":" + headerValue(r, name) + "\n")
+	}
+	b.WriteString(digest)
+
+	mac := hmac.New(sha256.New, []byte(s.opts.Secret))
+	mac.Write([]byte(b.String()))
+	r.Header.Set(s.opts.Header, fmt.Sprintf("keyId=%s,algorithm=%q,headers=%s,signature=%q",
+		strconv.Quote(s.opts.KeyID), AlgorithmHMAC, strconv.Quote(strings.Join(s.headers, " ")),
+		base64.StdEncoding.EncodeToString(mac.Sum(nil))))
+	return nil
+}
+
+// readBody buffers the body of a request up to limit bytes and puts it back
+func readBody(r *http.Request, limit int64) ([]byte, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil
+	}
+	defer r.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > limit {
+		return nil, ErrBodyTooLarge
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	r.ContentLength = int64(len(body))
+	return body, nil
+}
+
+// headerValue returns the canonical value of a signed header: its values
+// joined by commas with runs of whitespace collapsed
+func headerValue(r *http.Request, name string) string {
+	switch name {
+	case "host":
+		if r.Host != "" {
+			return r.Host
+		}
+		return r.URL.Host
+	case "content-length":
+		return strconv.FormatInt(r.ContentLength, 10)
+	}
+	var values []string
+	for _, v := range r.Header.Values(name) {
+		values = append(values, strings.Join(strings.Fields(v), " "))
+	}
+	return strings.Join(values, ",")
+}
+
+// canonicalPath escapes every segment of a path, twice when double is set
+func canonicalPath(path string, double bool) string {
+	if path == "" {
+		return "/"
+	}
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = escape(segment)
+		if double {
+			segments[i] = escape(segments[i])
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// canonicalQuery escapes the parameters of a query and sorts them by name,
+// then value
+func canonicalQuery(rawQuery string) string {
+	query, _ := url.ParseQuery(rawQuery)
+	var params [][2]string
+	for name, values := range query {
+		for _, v := range values {
+			params = append(params, [2]string{escape(name), escape(v)})
+		}
+	}
+	sort.Slice(params, func(i, j int) bool {
+		if params[i][0] != params[j][0] {
+			return params[i][0] < params[j][0]
+		}
+		return params[i][1] < params[j][1]
+	})
+	pairs := make([]string, len(params))
+	for i, p := range params {
+		pairs[i] = p[0] + "=" + p[1]
+	}
+	return strings.Join(pairs, "&")
+}
+
+// escape percent-encodes everything but unreserved characters, as RFC 3986
+// and SigV4 require
+func escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,70 @@
+package signing
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// signV4 signs a request with AWS Signature Version 4, setting X-Amz-Date
+// and Authorization. S3 also receives the payload hash in
+// X-Amz-Content-Sha256, which it requires.
+func (s *Signer) signV4(r *http.Request, payloadHash string, t time.Time) {
+	amzDate := t.Format("20060102T150405Z")
+	date := t.Format("20060102")
+	r.Header.Set("X-Amz-Date", amzDate)
+	r.Header.Del("X-Amz-Security-Token")
+	if s.opts.SessionToken != "" {
+		r.Header.Set("X-Amz-Security-Token", s.opts.SessionToken)
+	}
+	r.Header.Del("X-Amz-Content-Sha256")
+	if s.opts.Service == "s3" {
+		r.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	}
+
+	names := append([]string{}, s.headers...)
+	for _, name := range []string{"x-amz-date", "x-amz-security-token", "x-amz-content-sha256"} {
+		if r.Header.Get(name) != "" {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	names = slices.Compact(names)
+
+	var headers strings.Builder
+	for _, name := range names {
+		headers.WriteString(name + ":" + headerValue(r, name) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		canonicalPath(r.URL.Path, s.opts.Service != "s3"),
+		canonicalQuery(r.URL.RawQuery),
+		headers.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + s.opts.Region + "/" + s.opts.Service + "/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.opts.SecretAccessKey), date)
+	key = hmacSHA256(key, s.opts.Region)
+	key = hmacSHA256(key, s.opts.Service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	r.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.opts.AccessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
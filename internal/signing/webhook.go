@@ -0,0 +1,212 @@
+package signing
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shammianand/goproxy/internal/clientip"
+	"github.com/shammianand/goproxy/internal/urlpath"
+	"github.com/shammianand/goproxy/pkg/logger"
+)
+
+// Providers of signed webhooks
+const (
+	// ProviderGitHub verifies X-Hub-Signature-256 over the body
+	ProviderGitHub = "github"
+	// ProviderStripe verifies the v1 signatures of Stripe-Signature over the
+	// timestamp and body
+	ProviderStripe = "stripe"
+	// ProviderSlack verifies X-Slack-Signature over the timestamp and body
+	ProviderSlack = "slack"
+	// ProviderHMAC verifies a hex HMAC-SHA256 of the body, preceded by a
+	// timestamp and a dot when a timestamp header is set
+	ProviderHMAC = "hmac"
+)
+
+var (
+	errMissingSignature = errors.New("missing signature")
+	errMissingTimestamp = errors.New("missing timestamp")
+	errExpired          = errors.New("timestamp outside the tolerance")
+	errMismatch         = errors.New("signature mismatch")
+)
+
+// WebhookOptions configures the verification of webhooks under a path prefix
+type WebhookOptions struct {
+	PathPrefix string
+	// Provider is github, stripe, slack or hmac
+	Provider string
+	Secret   string
+	// Header and TimestampHeader override the headers of the provider; hmac
+	// webhooks default to X-Signature and no timestamp
+	Header          string
+	TimestampHeader string
+	// Tolerance is how far the signed timestamp may be from now; it defaults
+	// to five minutes
+	Tolerance time.Duration
+}
+
+// WebhookVerifier rejects webhooks whose signature does not match their body
+type WebhookVerifier struct {
+	webhooks []WebhookOptions
+	maxBody  int64
+	logger   *logger.Logger
+}
+
+// NewWebhookVerifier validates the webhooks to verify. Bodies beyond
+// maxBodyBytes, 10 MiB by default, are rejected.
+func NewWebhookVerifier(webhooks []WebhookOptions, maxBodyBytes int64, logger *logger.Logger) (*WebhookVerifier, error) {
+	if maxBodyBytes <= 0 {
+		maxBodyBytes = 10 << 20
+	}
+	v := &WebhookVerifier{maxBody: maxBodyBytes, logger: logger}
+	for _, w := range webhooks {
+		if w.PathPrefix == "" {
+			return nil, fmt.Errorf("webhook requires a path prefix")
+		}
+		if w.Secret == "" {
+			return nil, fmt.Errorf("webhook %s requires a secret", w.PathPrefix)
+		}
+		switch w.Provider {
+		case ProviderGitHub:
+			setDefault(&w.Header, "X-Hub-Signature-256")
+		case ProviderStripe:
+			setDefault(&w.Header, "Stripe-Signature")
+		case ProviderSlack:
+			setDefault(&w.Header, "X-Slack-Signature")
+			setDefault(&w.TimestampHeader, "X-Slack-Request-Timestamp")
+		case ProviderHMAC:
+			setDefault(&w.Header, "X-Signature")
+		default:
+			return nil, fmt.Errorf("unsupported webhook provider: %s", w.Provider)
+		}
+		if w.Tolerance <= 0 {
+			w.Tolerance = 5 * time.Minute
+		}
+		v.webhooks = append(v.webhooks, w)
+	}
+	sort.SliceStable(v.webhooks, func(i, j int) bool {
+		return len(v.webhooks[i].PathPrefix) > len(v.webhooks[j].PathPrefix)
+	})
+	return v, nil
+}
+
+func setDefault(s *string, value string) {
+	if *s == "" {
+		*s = value
+	}
+}
+
+// Handler returns a handler passing webhooks with a valid signature, and
+// requests to other paths, to next
+func (v *WebhookVerifier) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		webhook, ok := v.webhookFor(r.URL.Path)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		body, err := readBody(r, v.maxBody)
+		if errors.Is(err, ErrBodyTooLarge) {
+			http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		if err := verify(webhook, r.Header, body, time.Now()); err != nil {
+			v.logger.Warn("Rejected webhook with an invalid signature",
+				"path", r.URL.Path,
+				"provider", webhook.Provider,
+				"client_ip", clientip.FromRequest(r),
+				"error", err,
+			)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// webhookFor returns the webhook of a path, which is matched once cleaned so
+// //hooks or /x/../hooks cannot skip verification
+func (v *WebhookVerifier) webhookFor(path string) (WebhookOptions, bool) {
+	path = urlpath.Clean(path)
+	for _, w := range v.webhooks {
+		if strings.HasPrefix(path, w.PathPrefix) {
+			return w, true
+		}
+	}
+	return WebhookOptions{}, false
+}
+
+// verify checks the signature of a webhook as of now
+func verify(w WebhookOptions, header http.Header, body []byte, now time.Time) error {
+	value := header.Get(w.Header)
+	if value == "" {
+		return errMissingSignature
+	}
+
+	var timestamp string
+	var signatures []string
+	switch w.Provider {
+	case ProviderStripe:
+		for _, item := range strings.Split(value, ",") {
+			key, v, _ := strings.Cut(strings.TrimSpace(item), "=")
+			switch key {
+			case "t":
+				timestamp = v
+			case "v1":
+				signatures = append(signatures, v)
+			}
+		}
+		if timestamp == "" {
+			return errMissingTimestamp
+		}
+	case ProviderSlack:
+		signatures = []string{strings.TrimPrefix(value, "v0=")}
+	default:
+		signatures = []string{strings.TrimPrefix(value, "sha256=")}
+	}
+	if w.TimestampHeader != "" {
+		if timestamp = header.Get(w.TimestampHeader); timestamp == "" {
+			return errMissingTimestamp
+		}
+	}
+
+	var payload []byte
+	if timestamp != "" {
+		seconds, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid timestamp %q", timestamp)
+		}
+		if age := now.Sub(time.Unix(seconds, 0)); age > w.Tolerance || age < -w.Tolerance {
+			return errExpired
+		}
+		if w.Provider == ProviderSlack {
+			payload = []byte("v0:" + timestamp + ":")
+		} else {
+			payload = []byte(timestamp + ".")
+		}
+	}
+	mac := hmac.New(sha256.New, []byte(w.Secret))
+	mac.Write(payload)
+	mac.Write(body)
+	expected := mac.Sum(nil)
+
+	for _, signature := range signatures {
+		decoded, err := hex.DecodeString(signature)
+		if err == nil && hmac.Equal(decoded, expected) {
+			return nil
+		}
+	}
+	return errMismatch
+}
@@ -0,0 +1,372 @@
+package socks5
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/shammianand/goproxy/internal/forward"
+	"github.com/shammianand/goproxy/pkg/logger"
+)
+
+const (
+	version5 = 0x05
+
+	methodNoAuth       = 0x00
+	methodUserPass     = 0x02
+	methodNoAcceptable = 0xff
+
+	userPassVersion = 0x01
+
+	cmdConnect      = 0x01
+	cmdUDPAssociate = 0x03
+
+	atypIPv4   = 0x01
+	atypDomain = 0x03
+	atypIPv6   = 0x04
+)
+
+// Reply codes defined by RFC 1928
+const (
+	replySucceeded           = 0x00
+	replyGeneralFailure      = 0x01
+	replyNotAllowed          = 0x02
+	replyNetworkUnreachable  = 0x03
+	replyHostUnreachable     = 0x04
+	replyConnectionRefused   = 0x05
+	replyCommandNotSupported = 0x07
+	replyAddressNotSupported = 0x08
+)
+
+var (
+	ErrUnsupportedVersion = errors.New("socks5: unsupported protocol version")
+	ErrAuthFailed         = errors.New("socks5: authentication failed")
+)
+
+// Server is a SOCKS5 server for egress traffic. It shares the destination ACL,
+// credentials and logging of the HTTP forward proxy.
+type Server struct {
+	acl              *forward.ACL
+	credentials      forward.Credentials
+	logger           *logger.Logger
+	dialer           *net.Dialer
+	handshakeTimeout time.Duration
+	allowUDP         bool
+}
+
+// NewServer creates a new SOCKS5 Server. Username/password authentication is
+// required only when credentials are provided.
+func NewServer(acl *forward.ACL, credentials forward.Credentials, dialTimeout, handshakeTimeout time.Duration, allowUDP bool, logger *logger.Logger) *Server {
+	return &Server{
+		acl:              acl,
+		credentials:      credentials,
+		logger:           logger,
+		dialer:           &net.Dialer{Timeout: dialTimeout, Control: acl.Control},
+		handshakeTimeout: handshakeTimeout,
+		allowUDP:         allowUDP,
+	}
+}
+
+// ListenAndServe listens on the TCP address addr and serves SOCKS5 clients
+func (s *Server) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+// Serve accepts connections on the listener and handles each in a goroutine
+func (s *Server) Serve(ln net.Listener) error {
+	defer ln.Close()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go s.handleConn(conn)
+	}
+}
+
+// request is a decoded SOCKS5 request
+type request struct {
+	command byte
+	host    string
+	port    int
+}
+
+func (r *request) destination() string {
+	return net.JoinHostPort(r.host, strconv.Itoa(r.port))
+}
+
+func (s *Server) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	if s.handshakeTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(s.handshakeTimeout))
+	}
+
+	reader := bufio.NewReader(conn)
+	user, err := s.negotiate(reader, conn)
+	if err != nil {
+		s.logger.Warn("SOCKS5 handshake failed", "remote_addr", conn.RemoteAddr().String(), "error", err)
+		return
+	}
+
+	req, err := readRequest(reader)
+	if err != nil {
+		if errors.Is(err, errAddressType) {
+			writeReply(conn, replyAddressNotSupported, nil)
+		}
+		s.logger.Warn("Invalid SOCKS5 request", "remote_addr", conn.RemoteAddr().String(), "error", err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	switch {
+	case req.command == cmdConnect:
+		s.handleConnect(conn, reader, req, user)
+	case req.command == cmdUDPAssociate && s.allowUDP:
+		s.handleUDPAssociate(conn, reader, user)
+	default:
+		writeReply(conn, replyCommandNotSupported, nil)
+	}
+}
+
+// negotiate performs method selection and, when required, RFC 1929
+// username/password authentication. It returns the authenticated user.
+func (s *Server) negotiate(r *bufio.Reader, w io.Writer) (string, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return "", err
+	}
+	if header[0] != version5 {
+		return "", ErrUnsupportedVersion
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return "", err
+	}
+
+	wanted := byte(methodNoAuth)
+	if len(s.credentials) > 0 {
+		wanted = methodUserPass
+	}
+	offered := false
+	for _, m := range methods {
+		if m == wanted {
+			offered = true
+			break
+		}
+	}
+	if !offered {
+		w.Write([]byte{version5, methodNoAcceptable})
+		return "", fmt.Errorf("socks5: client did not offer method %d", wanted)
+	}
+	if _, err := w.Write([]byte{version5, wanted}); err != nil {
+		return "", err
+	}
+	if wanted == methodNoAuth {
+		return "", nil
+	}
+
+	// RFC 1929: VER ULEN UNAME PLEN PASSWD
+	ver, err := r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	if ver != userPassVersion {
+		return "", ErrUnsupportedVersion
+	}
+	username, err := readString(r)
+	if err != nil {
+		return "", err
+	}
+	password, err := readString(r)
+	if err != nil {
+		return "", err
+	}
+	if !s.credentials.Valid(username, password) {
+		w.Write([]byte{userPassVersion, 0x01})
+		return "", ErrAuthFailed
+	}
+	if _, err := w.Write([]byte{userPassVersion, 0x00}); err != nil {
+		return "", err
+	}
+	return username, nil
+}
+
+func (s *Server) handleConnect(conn net.Conn, reader *bufio.Reader, req *request, user string) {
+	if !s.acl.Allowed(req.host, req.port) {
+		s.logger.Warn("SOCKS5 destination denied",
+			"remote_addr", conn.RemoteAddr().String(),
+			"user", user,
+			"host", req.host,
+			"port", req.port,
+		)
+		writeReply(conn, replyNotAllowed, nil)
+		return
+	}
+
+	upstream, err := s.dialer.Dial("tcp", req.destination())
+	if errors.Is(err, forward.ErrDenied) {
+		s.logger.Warn("SOCKS5 destination denied after resolution",
+			"remote_addr", conn.RemoteAddr().String(),
+			"user", user,
+			"host", req.host,
+			"port", req.port,
+		)
+		writeReply(conn, replyNotAllowed, nil)
+		return
+	}
+	if err != nil {
+		s.logger.Error("Failed to dial SOCKS5 destination", "destination", req.destination(), "error", err)
+		writeReply(conn, dialErrorReply(err), nil)
+		return
+	}
+
+	if err := writeReply(conn, replySucceeded, upstream.LocalAddr()); err != nil {
+		upstream.Close()
+		return
+	}
+
+	start := time.Now()
+	sent, received := forward.Tunnel(conn, reader, upstream)
+
+	s.logger.Info("Tunnel closed",
+		"protocol", "socks5",
+		"remote_addr", conn.RemoteAddr().String(),
+		"user", user,
+		"destination", req.destination(),
+		"bytes_sent", sent,
+		"bytes_received", received,
+		"duration_ms", time.Since(start).Milliseconds(),
+	)
+}
+
+var errAddressType = errors.New("socks5: unsupported address type")
+
+func readRequest(r *bufio.Reader) (*request, error) {
+	var header [3]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	if header[0] != version5 {
+		return nil, ErrUnsupportedVersion
+	}
+	host, port, err := readAddr(r)
+	if err != nil {
+		return nil, err
+	}
+	return &request{command: header[1], host: host, port: port}, nil
+}
+
+// readAddr reads an ATYP-prefixed address and port
+func readAddr(r io.Reader) (string, int, error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return "", 0, err
+	}
+
+	var host string
+	switch atyp[0] {
+	case atypIPv4:
+		ip := make(net.IP, net.IPv4len)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", 0, err
+		}
+		host = ip.String()
+	case atypIPv6:
+		ip := make(net.IP, net.IPv6len)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", 0, err
+		}
+		host = ip.String()
+	case atypDomain:
+		var length [1]byte
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			return "", 0, err
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return "", 0, err
+		}
+		host = string(domain)
+	default:
+		return "", 0, errAddressType
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", 0, err
+	}
+	return host, int(binary.BigEndian.Uint16(port[:])), nil
+}
+
+// appendAddr encodes addr in ATYP-prefixed form
+func appendAddr(b []byte, addr net.Addr) []byte {
+	var ip net.IP
+	var port int
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	}
+
+	switch {
+	case ip == nil:
+		b = append(b, atypIPv4, 0, 0, 0, 0)
+	case ip.To4() != nil:
+		b = append(b, atypIPv4)
+		b = append(b, ip.To4()...)
+	default:
+		b = append(b, atypIPv6)
+		b = append(b, ip.To16()...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port))
+}
+
+func writeReply(w io.Writer, code byte, bound net.Addr) error {
+	reply := appendAddr([]byte{version5, code, 0x00}, bound)
+	_, err := w.Write(reply)
+	return err
+}
+
+func readString(r *bufio.Reader) (string, error) {
+	length, err := r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, length)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func dialErrorReply(err error) byte {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		var dnsErr *net.DNSError
+		switch {
+		case errors.As(err, &dnsErr):
+			return replyHostUnreachable
+		case opErr.Timeout():
+			return replyHostUnreachable
+		case opErr.Op == "dial":
+			return replyConnectionRefused
+		}
+	}
+	return replyNetworkUnreachable
+}
@@ -0,0 +1,172 @@
+package socks5
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxUDPPacket is the largest datagram relayed in either direction
+const maxUDPPacket = 64 * 1024
+
+// udpRelay forwards datagrams between a single client and the destinations it
+// addresses for as long as the controlling TCP connection stays open
+type udpRelay struct {
+	server *Server
+	conn   *net.UDPConn
+	client net.IP
+	user   string
+
+	mu         sync.Mutex
+	clientAddr *net.UDPAddr
+	// peers are the destinations the client sent to, the only sources whose
+	// datagrams are relayed back
+	peers map[netip.AddrPort]bool
+
+	sent, received atomic.Int64
+}
+
+func (s *Server) handleUDPAssociate(conn net.Conn, reader *bufio.Reader, user string) {
+	local, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		writeReply(conn, replyGeneralFailure, nil)
+		return
+	}
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP})
+	if err != nil {
+		s.logger.Error("Failed to open UDP relay", "error", err)
+		writeReply(conn, replyGeneralFailure, nil)
+		return
+	}
+	defer udpConn.Close()
+
+	clientIP := net.IP(nil)
+	if remote, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		clientIP = remote.IP
+	}
+	relay := &udpRelay{server: s, conn: udpConn, client: clientIP, user: user, peers: make(map[netip.AddrPort]bool)}
+
+	if err := writeReply(conn, replySucceeded, udpConn.LocalAddr()); err != nil {
+		return
+	}
+
+	start := time.Now()
+	go relay.run()
+
+	// The association ends when the client closes the TCP connection
+	io.Copy(io.Discard, reader)
+	udpConn.Close()
+
+	s.logger.Info("UDP association closed",
+		"protocol", "socks5",
+		"remote_addr", conn.RemoteAddr().String(),
+		"user", user,
+		"bytes_sent", relay.sent.Load(),
+		"bytes_received", relay.received.Load(),
+		"duration_ms", time.Since(start).Milliseconds(),
+	)
+}
+
+func (r *udpRelay) run() {
+	buf := make([]byte, maxUDPPacket)
+	for {
+		n, from, err := r.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		if r.isClient(from) {
+			r.forwardToDestination(buf[:n])
+			continue
+		}
+
+		r.mu.Lock()
+		clientAddr, peer := r.clientAddr, r.peers[peerKey(from)]
+		r.mu.Unlock()
+		if clientAddr == nil || !peer {
+			// Datagrams from hosts the client never addressed are dropped
+			continue
+		}
+
+		// Wrap the response with the address it came from
+		packet := appendAddr([]byte{0x00, 0x00, 0x00}, from)
+		packet = append(packet, buf[:n]...)
+		if _, err := r.conn.WriteToUDP(packet, clientAddr); err == nil {
+			r.received.Add(int64(n))
+		}
+	}
+}
+
+// isClient reports whether a datagram came from the associated client. The
+// first datagram from the client's IP fixes the client port.
+func (r *udpRelay) isClient(from *net.UDPAddr) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.clientAddr != nil {
+		return r.clientAddr.IP.Equal(from.IP) && r.clientAddr.Port == from.Port
+	}
+	if r.client != nil && !r.client.Equal(from.IP) {
+		return false
+	}
+	r.clientAddr = from
+	return true
+}
+
+func (r *udpRelay) forwardToDestination(packet []byte) {
+	// RSV(2) FRAG(1) ATYP DST.ADDR DST.PORT DATA
+	if len(packet) < 4 || packet[2] != 0x00 {
+		// Fragmentation is not supported, so fragments are dropped
+		return
+	}
+	reader := bytes.NewReader(packet[3:])
+	host, port, err := readAddr(reader)
+	if err != nil {
+		return
+	}
+	if !r.server.acl.Allowed(host, port) {
+		r.server.logger.Warn("SOCKS5 destination denied",
+			"protocol", "udp",
+			"user", r.user,
+			"host", host,
+			"port", port,
+		)
+		return
+	}
+
+	dst, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return
+	}
+	if !r.server.acl.AllowedAddr(dst.IP, port) {
+		r.server.logger.Warn("SOCKS5 destination denied after resolution",
+			"protocol", "udp",
+			"user", r.user,
+			"host", host,
+			"address", dst.IP.String(),
+			"port", port,
+		)
+		return
+	}
+
+	r.mu.Lock()
+	r.peers[peerKey(dst)] = true
+	r.mu.Unlock()
+
+	payload := packet[len(packet)-reader.Len():]
+	if _, err := r.conn.WriteToUDP(payload, dst); err == nil {
+		r.sent.Add(int64(len(payload)))
+	}
+}
+
+// peerKey identifies a destination, with IPv4-mapped addresses unmapped so
+// replies match the address sent to
+func peerKey(addr *net.UDPAddr) netip.AddrPort {
+	ap := addr.AddrPort()
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+}
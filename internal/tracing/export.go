@@ -0,0 +1,172 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// OTLP/JSON messages, as mapped from the protobuf definitions: IDs are hex
+// and 64-bit integers are strings
+type (
+	exportRequest struct {
+		ResourceSpans []resourceSpans `json:"resourceSpans"`
+	}
+	resourceSpans struct {
+		Resource   resource     `json:"resource"`
+		ScopeSpans []scopeSpans `json:"scopeSpans"`
+	}
+	resource struct {
+		Attributes []keyValue `json:"attributes"`
+	}
+	scopeSpans struct {
+		Scope scope      `json:"scope"`
+		Spans []spanJSON `json:"spans"`
+	}
+	scope struct {
+		Name string `json:"name"`
+	}
+	spanJSON struct {
+		TraceID           string     `json:"traceId"`
+		SpanID            string     `json:"spanId"`
+		ParentSpanID      string     `json:"parentSpanId,omitempty"`
+		TraceState        string     `json:"traceState,omitempty"`
+		Name              string     `json:"name"`
+		Kind              int        `json:"kind"`
+		StartTimeUnixNano string     `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+		Attributes        []keyValue `json:"attributes,omitempty"`
+		Status            status     `json:"status"`
+	}
+	keyValue struct {
+		Key   string   `json:"key"`
+		Value anyValue `json:"value"`
+	}
+	anyValue struct {
+		StringValue *string  `json:"stringValue,omitempty"`
+		IntValue    *string  `json:"intValue,omitempty"`
+		DoubleValue *float64 `json:"doubleValue,omitempty"`
+		BoolValue   *bool    `json:"boolValue,omitempty"`
+	}
+	status struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	}
+)
+
+// statusError is the OTLP status code of failed spans
+const statusError = 2
+
+func newKeyValue(key string, value any) keyValue {
+	kv := keyValue{Key: key}
+	switch v := value.(type) {
+	case string:
+		kv.Value.StringValue = &v
+	case int:
+		s := strconv.Itoa(v)
+		kv.Value.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		kv.Value.IntValue = &s
+	case float64:
+		kv.Value.DoubleValue = &v
+	case bool:
+		kv.Value.BoolValue = &v
+	default:
+		s := fmt.Sprint(v)
+		kv.Value.StringValue = &s
+	}
+	return kv
+}
+
+func (s *Span) toJSON() spanJSON {
+	out := spanJSON{
+		TraceID:           s.ctx.TraceID.String(),
+		SpanID:            s.ctx.SpanID.String(),
+		TraceState:        s.ctx.TraceState,
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+	}
+	if s.parent.IsValid() {
+		out.ParentSpanID = s.parent.String()
+	}
+	for _, a := range s.attrs {
+		out.Attributes = append(out.Attributes, newKeyValue(a.key, a.value))
+	}
+	if s.err != "" {
+		out.Status = status{Code: statusError, Message: s.err}
+	}
+	return out
+}
+
+// export sends a batch of queued spans to the collector, and reports whether
+// more are waiting. Batches that fail are dropped.
+func (t *Tracer) export() bool {
+	t.mu.Lock()
+	n := min(len(t.queue), t.opts.BatchSize)
+	batch := t.queue[:n:n]
+	t.queue = t.queue[n:]
+	dropped := t.dropped
+	t.dropped = 0
+	more := len(t.queue) > 0
+	t.mu.Unlock()
+
+	if dropped > 0 {
+		t.logger.Warn("Dropped spans while the export queue was full", "spans", dropped)
+	}
+	if len(batch) == 0 {
+		return false
+	}
+	if err := t.send(batch); err != nil {
+		t.logger.Warn("Failed to export spans", "endpoint", t.opts.Endpoint, "spans", len(batch), "error", err)
+		return false
+	}
+	return more
+}
+
+func (t *Tracer) send(batch []*Span) error {
+	ctx, cancel := context.WithTimeout(context.Background(), t.opts.Timeout)
+	defer cancel()
+	if t.opts.Protocol == ProtocolGRPC {
+		return t.sendGRPC(ctx, batch)
+	}
+
+	spans := make([]spanJSON, len(batch))
+	for i, s := range batch {
+		spans[i] = s.toJSON()
+	}
+	body, err := json.Marshal(exportRequest{ResourceSpans: []resourceSpans{{
+		Resource: resource{Attributes: []keyValue{newKeyValue("service.name", t.opts.ServiceName)}},
+		ScopeSpans: []scopeSpans{{
+			Scope: scope{Name: "github.com/shammianand/goproxy"},
+			Spans: spans,
+		}},
+	}}})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.opts.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range t.opts.Headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+)
+
+// grpcExportPath is the method of the OTLP trace service
+const grpcExportPath = "/opentelemetry.proto.collector.trace.v1.TraceService/Export"
+
+// newGRPCClient returns a client speaking HTTP/2 only, over TLS for https
+// endpoints and with prior knowledge (h2c) for http ones, as gRPC requires
+func newGRPCClient() *http.Client {
+	var protocols http.Protocols
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(true)
+	return &http.Client{Transport: &http.Transport{Protocols: &protocols}}
+}
+
+// grpcEndpoint returns the base URL of a gRPC endpoint, which may be given as
+// host:port for a plaintext collector
+func grpcEndpoint(endpoint string) (string, error) {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "http://" + endpoint
+	}
+	if !strings.HasPrefix(endpoint, "http://") && !strings.HasPrefix(endpoint, "https://") {
+		return "", fmt.Errorf("tracing endpoint for grpc must be host:port or an http or https URL: %s", endpoint)
+	}
+	return strings.TrimSuffix(endpoint, "/"), nil
+}
+
+// sendGRPC exports a batch with the Export method of the OTLP trace service
+func (t *Tracer) sendGRPC(ctx context.Context, batch []*Span) error {
+	msg := t.marshalProto(batch)
+	// A gRPC message is prefixed by its compression flag and length
+	body := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(body[1:], uint32(len(msg)))
+	body = append(body, msg...)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.opts.Endpoint+grpcExportPath, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for name, value := range t.opts.Headers {
+		req.Header.Set(name, value)
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// Trailers are only available once the body is read
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("collector returned %s", resp.Status)
+	}
+	// Errors without a message come as headers alone
+	code, message := resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message")
+	if code == "" {
+		code, message = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+	}
+	if code != "0" {
+		return fmt.Errorf("collector returned gRPC status %q: %s", code, message)
+	}
+	return nil
+}
+
+// marshalProto encodes an ExportTraceServiceRequest in the protobuf wire
+// format, with the field numbers of the OTLP definitions
+func (t *Tracer) marshalProto(batch []*Span) []byte {
+	var scopeSpans []byte
+	scopeSpans = appendMessage(scopeSpans, 1, appendString(nil, 1, "github.com/shammianand/goproxy"))
+	for _, s := range batch {
+		scopeSpans = appendMessage(scopeSpans, 2, s.marshalProto())
+	}
+
+	var res []byte
+	res = appendMessage(res, 1, marshalKeyValue("service.name", t.opts.ServiceName))
+
+	var resourceSpans []byte
+	resourceSpans = appendMessage(resourceSpans, 1, res)
+	resourceSpans = appendMessage(resourceSpans, 2, scopeSpans)
+	return appendMessage(nil, 1, resourceSpans)
+}
+
+func (s *Span) marshalProto() []byte {
+	b := appendBytes(nil, 1, s.ctx.TraceID[:])
+	b = appendBytes(b, 2, s.ctx.SpanID[:])
+	if s.ctx.TraceState != "" {
+		b = appendString(b, 3, s.ctx.TraceState)
+	}
+	if s.parent.IsValid() {
+		b = appendBytes(b, 4, s.parent[:])
+	}
+	b = appendString(b, 5, s.name)
+	b = appendVarintField(b, 6, uint64(s.kind))
+	b = appendFixed64(b, 7, uint64(s.start.UnixNano()))
+	b = appendFixed64(b, 8, uint64(s.end.UnixNano()))
+	for _, a := range s.attrs {
+		b = appendMessage(b, 9, marshalKeyValue(a.key, a.value))
+	}
+	var st []byte
+	if s.err != "" {
+		st = appendString(st, 2, s.err)
+		st = appendVarintField(st, 3, statusError)
+	}
+	return appendMessage(b, 15, st)
+}
+
+// marshalKeyValue encodes a KeyValue, typing the AnyValue as newKeyValue does
+func marshalKeyValue(key string, value any) []byte {
+	var v []byte
+	switch val := value.(type) {
+	case string:
+		v = appendString(v, 1, val)
+	case bool:
+		var n uint64
+		if val {
+			n = 1
+		}
+		v = appendVarintField(v, 2, n)
+	case int:
+		v = appendVarintField(v, 3, uint64(val))
+	case int64:
+		v = appendVarintField(v, 3, uint64(val))
+	case float64:
+		v = appendFixed64(v, 4, math.Float64bits(val))
+	default:
+		v = appendString(v, 1, fmt.Sprint(val))
+	}
+	b := appendString(nil, 1, key)
+	return appendMessage(b, 2, v)
+}
+
+// Protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+)
+
+func appendTag(b []byte, field, wire int) []byte {
+	return binary.AppendUvarint(b, uint64(field)<<3|uint64(wire))
+}
+
+func appendVarintField(b []byte, field int, v uint64) []byte {
+	return binary.AppendUvarint(appendTag(b, field, wireVarint), v)
+}
+
+func appendFixed64(b []byte, field int, v uint64) []byte {
+	return binary.LittleEndian.AppendUint64(appendTag(b, field, wireFixed64), v)
+}
+
+func appendBytes(b []byte, field int, v []byte) []byte {
+	b = binary.AppendUvarint(appendTag(b, field, wireBytes), uint64(len(v)))
+	return append(b, v...)
+}
+
+func appendString(b []byte, field int, v string) []byte {
+	b = binary.AppendUvarint(appendTag(b, field, wireBytes), uint64(len(v)))
+	return append(b, v...)
+}
+
+func appendMessage(b []byte, field int, msg []byte) []byte {
+	return appendBytes(b, field, msg)
+}
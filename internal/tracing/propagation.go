@@ -0,0 +1,172 @@
+package tracing
+
+import (
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// Propagators of a Tracer
+const (
+	// PropagatorTraceContext reads and writes the W3C traceparent and
+	// tracestate headers
+	PropagatorTraceContext = "tracecontext"
+	// PropagatorB3 reads and writes the single b3 header of Zipkin
+	PropagatorB3 = "b3"
+	// PropagatorB3Multi reads and writes the X-B3-* headers of Zipkin
+	PropagatorB3Multi = "b3multi"
+)
+
+var errInvalidID = errors.New("invalid trace or span ID")
+
+// TraceID identifies a trace
+type TraceID [16]byte
+
+// SpanID identifies a span
+type SpanID [8]byte
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+func (id SpanID) String() string  { return hex.EncodeToString(id[:]) }
+
+// IsValid reports whether the ID is not all zeros
+func (id TraceID) IsValid() bool { return id != TraceID{} }
+
+// IsValid reports whether the ID is not all zeros
+func (id SpanID) IsValid() bool { return id != SpanID{} }
+
+// SpanContext is the part of a span propagated to other services
+type SpanContext struct {
+	TraceID    TraceID
+	SpanID     SpanID
+	Sampled    bool
+	TraceState string
+}
+
+// IsValid reports whether both IDs are set
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+// Traceparent formats the context as a W3C traceparent header
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-" + flags
+}
+
+// extract reads the span context of a request with the first propagator
+// finding a valid one
+func extract(h http.Header, propagators []string) (SpanContext, bool) {
+	for _, p := range propagators {
+		var sc SpanContext
+		var ok bool
+		switch p {
+		case PropagatorTraceContext:
+			sc, ok = parseTraceparent(h.Get("Traceparent"))
+			if ok {
+				sc.TraceState = strings.Join(h.Values("Tracestate"), ",")
+			}
+		case PropagatorB3:
+			sc, ok = parseB3(h.Get("B3"))
+		case PropagatorB3Multi:
+			sc, ok = parseB3Multi(h)
+		}
+		if ok {
+			return sc, true
+		}
+	}
+	return SpanContext{}, false
+}
+
+// inject writes the span context into the headers of every propagator,
+// replacing the values received from the client
+func inject(h http.Header, sc SpanContext, propagators []string) {
+	sampled := "0"
+	if sc.Sampled {
+		sampled = "1"
+	}
+	for _, p := range propagators {
+		switch p {
+		case PropagatorTraceContext:
+			h.Set("Traceparent", sc.Traceparent())
+			h.Del("Tracestate")
+			if sc.TraceState != "" {
+				h.Set("Tracestate", sc.TraceState)
+			}
+		case PropagatorB3:
+			h.Set("B3", sc.TraceID.String()+"-"+sc.SpanID.String()+"-"+sampled)
+		case PropagatorB3Multi:
+			h.Del("X-B3-ParentSpanId")
+			h.Del("X-B3-Flags")
+			h.Set("X-B3-TraceId", sc.TraceID.String())
+			h.Set("X-B3-SpanId", sc.SpanID.String())
+			h.Set("X-B3-Sampled", sampled)
+		}
+	}
+}
+
+// parseTraceparent parses a traceparent header. Versions after 00 are read
+// as 00, as the specification requires.
+func parseTraceparent(value string) (SpanContext, bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || parts[0] == "00" && len(parts) != 4 {
+		return SpanContext{}, false
+	}
+	var sc SpanContext
+	_, err1 := hex.DecodeString(parts[0])
+	err2 := decodeID(sc.TraceID[:], parts[1])
+	err3 := decodeID(sc.SpanID[:], parts[2])
+	flags, err4 := hex.DecodeString(parts[3])
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil || len(flags) != 1 || !sc.IsValid() {
+		return SpanContext{}, false
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, true
+}
+
+// parseB3 parses a b3 header of the form traceid-spanid[-sampled[-parent]]
+func parseB3(value string) (SpanContext, bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 2 {
+		return SpanContext{}, false
+	}
+	sampled := ""
+	if len(parts) > 2 {
+		sampled = parts[2]
+	}
+	return b3Context(parts[0], parts[1], sampled)
+}
+
+func parseB3Multi(h http.Header) (SpanContext, bool) {
+	sampled := h.Get("X-B3-Sampled")
+	if h.Get("X-B3-Flags") == "1" {
+		sampled = "d"
+	}
+	return b3Context(h.Get("X-B3-TraceId"), h.Get("X-B3-SpanId"), sampled)
+}
+
+// b3Context builds a span context from B3 fields. 64-bit trace IDs are
+// padded to 128 bits, and debug requests are sampled.
+func b3Context(traceID, spanID, sampled string) (SpanContext, bool) {
+	if len(traceID) == 16 {
+		traceID = strings.Repeat("0", 16) + traceID
+	}
+	var sc SpanContext
+	if decodeID(sc.TraceID[:], traceID) != nil || decodeID(sc.SpanID[:], spanID) != nil || !sc.IsValid() {
+		return SpanContext{}, false
+	}
+	sc.Sampled = sampled == "1" || sampled == "d" || sampled == "true"
+	return sc, true
+}
+
+// decodeID decodes lowercase hex into an ID of exactly its size
+func decodeID(dst []byte, s string) error {
+	if len(s) != 2*len(dst) || strings.ToLower(s) != s {
+		return errInvalidID
+	}
+	_, err := hex.Decode(dst, []byte(s))
+	return err
+}
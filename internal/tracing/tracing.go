@@ -0,0 +1,321 @@
+package tracing
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/shammianand/goproxy/internal/clientip"
+	"github.com/shammianand/goproxy/pkg/logger"
+)
+
+// Kinds of spans, numbered as in OTLP
+const (
+	KindServer = 2
+	KindClient = 3
+)
+
+// Protocols of the exporter
+const (
+	// ProtocolHTTP exports OTLP/HTTP with JSON encoding
+	ProtocolHTTP = "http/json"
+	// ProtocolGRPC exports OTLP over gRPC with protobuf encoding
+	ProtocolGRPC = "grpc"
+)
+
+// Options configures a Tracer
+type Options struct {
+	// ServiceName is the service.name of the exported spans; it defaults to
+	// goproxy
+	ServiceName string
+	// Endpoint is the OTLP/HTTP traces URL of the collector, such as
+	// http://localhost:4318/v1/traces, or for grpc its address, such as
+	// localhost:4317 or https://collector.example.com:4317
+	Endpoint string
+	// Protocol is http/json, the default, or grpc
+	Protocol string
+	// Headers are sent with every export, for example to authenticate
+	Headers map[string]string
+	// SampleRatio is the fraction of new traces that are sampled. Requests
+	// carrying a trace context follow the decision of the caller.
+	SampleRatio float64
+	// Propagators are read in order and all written; they default to
+	// tracecontext
+	Propagators []string
+	// BatchSize is the number of spans exported at once; it defaults to 512
+	BatchSize int
+	// ExportInterval is how often spans are exported; it defaults to five
+	// seconds
+	ExportInterval time.Duration
+	// Timeout bounds each export; it defaults to ten seconds
+	Timeout time.Duration
+}
+
+// Tracer records spans of proxied requests and exports the sampled ones to
+// an OpenTelemetry collector
+type Tracer struct {
+	opts   Options
+	client *http.Client
+	logger *logger.Logger
+
+	mu      sync.Mutex
+	queue   []*Span
+	dropped int
+
+	flush chan struct{}
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// New creates a Tracer and starts exporting spans in the background
+func New(opts Options, logger *logger.Logger) (*Tracer, error) {
+	if opts.Endpoint == "" {
+		return nil, fmt.Errorf("tracing requires an endpoint")
+	}
+	client := &http.Client{}
+	switch opts.Protocol {
+	case "", "http", ProtocolHTTP:
+		opts.Protocol = ProtocolHTTP
+	case ProtocolGRPC:
+		endpoint, err := grpcEndpoint(opts.Endpoint)
+		if err != nil {
+			return nil, err
+		}
+		opts.Endpoint = endpoint
+		client = newGRPCClient()
+	default:
+		return nil, fmt.Errorf("unsupported tracing protocol: %s", opts.Protocol)
+	}
+	if opts.SampleRatio < 0 || opts.SampleRatio > 1 {
+		return nil, fmt.Errorf("tracing sample ratio must be between 0 and 1")
+	}
+	if len(opts.Propagators) == 0 {
+		opts.Propagators = []string{PropagatorTraceContext}
+	}
+	for _, p := range opts.Propagators {
+		if p != PropagatorTraceContext && p != PropagatorB3 && p != PropagatorB3Multi {
+			return nil, fmt.Errorf("unsupported trace propagator: %s", p)
+		}
+	}
+	if opts.ServiceName == "" {
+		opts.ServiceName = "goproxy"
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 512
+	}
+	if opts.ExportInterval <= 0 {
+		opts.ExportInterval = 5 * time.Second
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+
+	t := &Tracer{
+		opts:   opts,
+		client: client,
+		logger: logger,
+		flush:  make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go t.maintain()
+	return t, nil
+}
+
+// Close exports the remaining spans and stops the Tracer
+func (t *Tracer) Close() {
+	close(t.stop)
+	<-t.done
+}
+
+func (t *Tracer) maintain() {
+	defer close(t.done)
+	ticker := time.NewTicker(t.opts.ExportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.stop:
+			for t.export() {
+			}
+			return
+		case <-ticker.C:
+			for t.export() {
+			}
+		case <-t.flush:
+			t.export()
+		}
+	}
+}
+
+// sample decides whether a new trace is recorded, comparing the random low
+// half of its ID with the ratio as OpenTelemetry's ratio sampler does
+func (t *Tracer) sample(id TraceID) bool {
+	if t.opts.SampleRatio >= 1 {
+		return true
+	}
+	bound := uint64(t.opts.SampleRatio * (1 << 63))
+	return binary.BigEndian.Uint64(id[8:])>>1 < bound
+}
+
+// Span is a timed operation of a trace
+type Span struct {
+	tracer *Tracer
+	name   string
+	kind   int
+	ctx    SpanContext
+	parent SpanID
+	start  time.Time
+	end    time.Time
+	attrs  []attribute
+	err    string
+	once   sync.Once
+}
+
+type attribute struct {
+	key   string
+	value any
+}
+
+// Start starts a span, as a child of parent when it is valid
+func (t *Tracer) Start(name string, kind int, parent SpanContext) *Span {
+	s := &Span{tracer: t, name: name, kind: kind, start: time.Now()}
+	if parent.IsValid() {
+		s.ctx = parent
+		s.parent = parent.SpanID
+	} else {
+		binary.BigEndian.PutUint64(s.ctx.TraceID[:8], rand.Uint64())
+		binary.BigEndian.PutUint64(s.ctx.TraceID[8:], rand.Uint64()|1)
+		s.ctx.Sampled = t.sample(s.ctx.TraceID)
+	}
+	binary.BigEndian.PutUint64(s.ctx.SpanID[:], rand.Uint64()|1)
+	return s
+}
+
+// StartServer starts the span of an incoming request, continuing the trace
+// of the caller when the request carries one
+func (t *Tracer) StartServer(r *http.Request) *Span {
+	parent, _ := extract(r.Header, t.opts.Propagators)
+	s := t.Start(r.Method, KindServer, parent)
+	s.SetAttribute("http.request.method", r.Method)
+	s.SetAttribute("url.path", r.URL.Path)
+	s.SetAttribute("server.address", r.Host)
+	s.SetAttribute("client.address", clientip.FromRequest(r))
+	if ua := r.UserAgent(); ua != "" {
+		s.SetAttribute("user_agent.original", ua)
+	}
+	return s
+}
+
+// Context returns the span context propagated to children of the span
+func (s *Span) Context() SpanContext {
+	return s.ctx
+}
+
+// SetAttribute records an attribute of the span; values are strings, ints,
+// int64s, float64s or bools
+func (s *Span) SetAttribute(key string, value any) {
+	s.attrs = append(s.attrs, attribute{key, value})
+}
+
+// SetError marks the span as failed
+func (s *Span) SetError(message string) {
+	s.err = message
+}
+
+// End ends the span and queues it for export when it is sampled
+func (s *Span) End() {
+	s.once.Do(func() {
+		s.end = time.Now()
+		if s.ctx.Sampled {
+			s.tracer.enqueue(s)
+		}
+	})
+}
+
+func (t *Tracer) enqueue(s *Span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// Spans are dropped rather than buffered without bound while the
+	// collector is slow or down
+	if len(t.queue) >= 4*t.opts.BatchSize {
+		t.dropped++
+		return
+	}
+	t.queue = append(t.queue, s)
+	if len(t.queue) >= t.opts.BatchSize {
+		select {
+		case t.flush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+type contextKey int
+
+const spanKey contextKey = iota
+
+// NewContext returns a context carrying a span
+func NewContext(ctx context.Context, s *Span) context.Context {
+	return context.WithValue(ctx, spanKey, s)
+}
+
+// FromContext returns the span carried by a context
+func FromContext(ctx context.Context) (*Span, bool) {
+	s, ok := ctx.Value(spanKey).(*Span)
+	return s, ok
+}
+
+// Transport returns a RoundTripper recording a client span for every
+// upstream attempt and propagating its context to the upstream
+func (t *Tracer) Transport(next http.RoundTripper) http.RoundTripper {
+	return &tracingTransport{tracer: t, next: next}
+}
+
+type tracingTransport struct {
+	tracer *Tracer
+	next   http.RoundTripper
+}
+
+func (tt *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var parent SpanContext
+	if s, ok := FromContext(req.Context()); ok {
+		parent = s.Context()
+	}
+	span := tt.tracer.Start(req.Method, KindClient, parent)
+	span.SetAttribute("http.request.method", req.Method)
+	span.SetAttribute("url.full", req.URL.String())
+	span.SetAttribute("server.address", req.URL.Host)
+
+	req = req.Clone(req.Context())
+	inject(req.Header, span.Context(), tt.tracer.opts.Propagators)
+	resp, err := tt.next.RoundTrip(req)
+	if err != nil {
+		span.SetAttribute("error.type", fmt.Sprintf("%T", err))
+		span.SetError(err.Error())
+		span.End()
+		return nil, err
+	}
+	span.SetAttribute("http.response.status_code", resp.StatusCode)
+	if resp.StatusCode >= 400 {
+		span.SetError(http.StatusText(resp.StatusCode))
+	}
+	// The attempt lasts until the response body is consumed
+	resp.Body = &spanBody{ReadCloser: resp.Body, span: span}
+	return resp, nil
+}
+
+type spanBody struct {
+	io.ReadCloser
+	span *Span
+}
+
+func (b *spanBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.span.End()
+	return err
+}
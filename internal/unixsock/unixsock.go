@@ -0,0 +1,129 @@
+package unixsock
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// addrPrefix marks listen addresses that refer to a unix domain socket
+const addrPrefix = "unix:"
+
+// ParseAddr reports whether addr is a unix socket address ("unix:/path" or
+// "unix:///path") and returns the socket path
+func ParseAddr(addr string) (string, bool) {
+	if !strings.HasPrefix(addr, addrPrefix) {
+		return "", false
+	}
+	path := strings.TrimPrefix(addr, addrPrefix)
+	path = strings.TrimPrefix(path, "//")
+	return path, path != ""
+}
+
+// Options controls the permissions of a listening socket file
+type Options struct {
+	// Mode is the octal file mode, e.g. "0660". Empty keeps the umask default.
+	Mode string
+	// Owner and Group are user and group names or numeric IDs. Empty keeps the
+	// current process identity.
+	Owner string
+	Group string
+}
+
+// Listen creates a unix domain socket listener at path. A stale socket file
+// left behind by a previous process is removed first.
+func Listen(path string, opts Options) (net.Listener, error) {
+	if err := removeStale(path); err != nil {
+		return nil, err
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := applyOptions(path, opts); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+func removeStale(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+
+	// A socket that still accepts connections belongs to a live process
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return fmt.Errorf("socket %s is already in use", path)
+	}
+	return os.Remove(path)
+}
+
+func applyOptions(path string, opts Options) error {
+	if opts.Mode != "" {
+		mode, err := strconv.ParseUint(opts.Mode, 8, 32)
+		if err != nil {
+			return fmt.Errorf("invalid socket mode %s: %w", opts.Mode, err)
+		}
+		if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+			return err
+		}
+	}
+
+	if opts.Owner == "" && opts.Group == "" {
+		return nil
+	}
+	uid, gid := -1, -1
+	if opts.Owner != "" {
+		id, err := lookupID(opts.Owner, func(name string) (string, error) {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+			return u.Uid, nil
+		})
+		if err != nil {
+			return fmt.Errorf("invalid socket owner %s: %w", opts.Owner, err)
+		}
+		uid = id
+	}
+	if opts.Group != "" {
+		id, err := lookupID(opts.Group, func(name string) (string, error) {
+			g, err := user.LookupGroup(name)
+			if err != nil {
+				return "", err
+			}
+			return g.Gid, nil
+		})
+		if err != nil {
+			return fmt.Errorf("invalid socket group %s: %w", opts.Group, err)
+		}
+		gid = id
+	}
+	return os.Chown(path, uid, gid)
+}
+
+func lookupID(nameOrID string, lookup func(string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(nameOrID); err == nil {
+		return id, nil
+	}
+	id, err := lookup(nameOrID)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(id)
+}
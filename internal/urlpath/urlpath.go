@@ -0,0 +1,19 @@
+package urlpath
+
+import (
+	"path"
+	"strings"
+)
+
+// Clean resolves the dot segments and repeated slashes of a request path,
+// keeping a trailing slash, so it cannot climb above the root. Route prefixes
+// are matched against the cleaned path: net/http and the reverse proxy pass
+// the path through as sent, and backends that clean it themselves would
+// otherwise serve /admin for //admin or /x/../admin.
+func Clean(p string) string {
+	cleaned := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
@@ -0,0 +1,119 @@
+package waf
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// value is an inspected part of a request, named by its target
+type value struct {
+	name string
+	data string
+}
+
+// collect returns the inspected values of a request, and whether the body was
+// longer than maxBody. Up to maxBody bytes of the body are inspected, and all
+// bytes read are put back for the upstream; URL-encoded forms and JSON
+// documents add their fields to args.
+func collect(r *http.Request, maxBody int64) ([]value, bool, error) {
+	values := []value{
+		{"method", r.Method},
+		{"path", r.URL.Path},
+		{"query", r.URL.RawQuery},
+	}
+	values = appendArgs(values, r.URL.Query())
+
+	names := make([]string, 0, len(r.Header))
+	for name := range r.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, v := range r.Header[name] {
+			values = append(values, value{"headers:" + name, v})
+		}
+	}
+	for _, c := range r.Cookies() {
+		values = append(values, value{"cookies:" + c.Name, c.Value})
+	}
+
+	if r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0 {
+		return values, false, nil
+	}
+	// One more byte tells whether the body goes on
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBody+1))
+	if err != nil {
+		return nil, false, err
+	}
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+	truncated := int64(len(body)) > maxBody
+	if truncated {
+		body = body[:maxBody]
+	}
+	values = append(values, value{"body", string(body)})
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch {
+	case mediaType == "application/x-www-form-urlencoded":
+		// Malformed fields are skipped, the others are still inspected
+		form, _ := url.ParseQuery(string(body))
+		values = appendArgs(values, form)
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		var doc any
+		if json.Unmarshal(body, &doc) == nil {
+			values = appendJSON(values, "json", doc)
+		}
+	}
+	return values, truncated, nil
+}
+
+func appendArgs(values []value, args url.Values) []value {
+	names := make([]string, 0, len(args))
+	for name := range args {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		values = append(values, value{"arg_names:" + name, name})
+		for _, v := range args[name] {
+			values = append(values, value{"args:" + name, v})
+		}
+	}
+	return values
+}
+
+// appendJSON adds the strings, numbers and keys of a JSON document to args,
+// named by their path such as json.items.0.name
+func appendJSON(values []value, path string, doc any) []value {
+	switch v := doc.(type) {
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			values = append(values, value{"arg_names:" + path + "." + key, key})
+			values = appendJSON(values, path+"."+key, v[key])
+		}
+	case []any:
+		for i, item := range v {
+			values = appendJSON(values, path+"."+strconv.Itoa(i), item)
+		}
+	case string:
+		values = append(values, value{"args:" + path, v})
+	case float64:
+		values = append(values, value{"args:" + path, strconv.FormatFloat(v, 'f', -1, 64)})
+	}
+	return values
+}
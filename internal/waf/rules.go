@@ -0,0 +1,231 @@
+package waf
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+
+	"github.com/shammianand/goproxy/internal/config"
+)
+
+// defaultScore is the score of rules that do not set one, enough on its own
+// to reach the default anomaly threshold
+const defaultScore = 5
+
+// collections are the targets holding several named values
+var collections = map[string]bool{"args": true, "arg_names": true, "headers": true, "cookies": true}
+
+// scalars are the targets holding a single value
+var scalars = map[string]bool{"path": true, "query": true, "method": true, "body": true}
+
+// transforms normalize values before rules match them
+var transforms = map[string]func(string) string{
+	"lowercase":           strings.ToLower,
+	"url_decode":          urlDecode,
+	"html_decode":         html.UnescapeString,
+	"compress_whitespace": compressWhitespace,
+	"normalize_path":      func(s string) string { return strings.ReplaceAll(s, `\`, "/") },
+}
+
+// rule is a compiled config.WAFRule
+type rule struct {
+	id         string
+	targets    []string
+	pattern    *regexp.Regexp
+	transforms []func(string) string
+	score      int
+}
+
+func newRule(r config.WAFRule) (*rule, error) {
+	if r.ID == "" {
+		return nil, fmt.Errorf("waf rule requires an id")
+	}
+	if len(r.Targets) == 0 {
+		return nil, fmt.Errorf("waf rule %s has no targets", r.ID)
+	}
+	for _, target := range r.Targets {
+		if err := validateTarget(target); err != nil {
+			return nil, fmt.Errorf("waf rule %s: %w", r.ID, err)
+		}
+	}
+	pattern, err := regexp.Compile(r.Pattern)
+	if err != nil || r.Pattern == "" {
+		return nil, fmt.Errorf("waf rule %s has an invalid pattern: %v", r.ID, err)
+	}
+	compiled := &rule{id: r.ID, targets: r.Targets, pattern: pattern, score: r.Score}
+	for _, name := range r.Transforms {
+		t, ok := transforms[name]
+		if !ok {
+			return nil, fmt.Errorf("waf rule %s has an unknown transform %s", r.ID, name)
+		}
+		compiled.transforms = append(compiled.transforms, t)
+	}
+	if compiled.score == 0 {
+		compiled.score = defaultScore
+	}
+	return compiled, nil
+}
+
+// validateTarget checks a target or exclusion: a scalar, a collection, or a
+// member of a collection
+func validateTarget(target string) error {
+	collection, member, ok := strings.Cut(target, ":")
+	if scalars[target] || collections[collection] && (!ok || member != "") {
+		return nil
+	}
+	return fmt.Errorf("invalid target %s", target)
+}
+
+// targetMatches reports whether a target selects a value. Collections select
+// all of their members; member names are matched case-insensitively.
+func targetMatches(target, name string) bool {
+	if strings.EqualFold(target, name) {
+		return true
+	}
+	return collections[target] && strings.HasPrefix(name, target+":")
+}
+
+func (r *rule) selects(name string) bool {
+	for _, target := range r.targets {
+		if targetMatches(target, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *rule) transform(value string) string {
+	for _, t := range r.transforms {
+		value = t(value)
+	}
+	return value
+}
+
+// urlDecode decodes %XX escapes and plus signs, leaving malformed escapes as
+// they are
+func urlDecode(s string) string {
+	if !strings.ContainsAny(s, "%+") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '+':
+			b.WriteByte(' ')
+		case s[i] == '%' && i+2 < len(s) && isHex(s[i+1]) && isHex(s[i+2]):
+			b.WriteByte(unhex(s[i+1])<<4 | unhex(s[i+2]))
+			i += 2
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
+
+func compressWhitespace(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// standardTransforms decode and normalize values the way attacks are
+// commonly obfuscated
+var standardTransforms = []string{"url_decode", "html_decode", "lowercase", "compress_whitespace"}
+
+// BuiltinRules is the rule set enabled by builtin_rules, covering common
+// path traversal, cross-site scripting, SQL injection and command injection
+// attempts. Rule IDs follow the numbering of the OWASP Core Rule Set
+// categories without claiming to be compatible with it.
+var BuiltinRules = []config.WAFRule{
+	{
+		ID:          "930100",
+		Description: "Path traversal",
+		Targets:     []string{"path", "args"},
+		Pattern:     `(?:^|[/;])\.\.(?:[/;]|$)`,
+		Transforms:  []string{"url_decode", "normalize_path"},
+	},
+	{
+		ID:          "930120",
+		Description: "Access to sensitive files",
+		Targets:     []string{"path", "args"},
+		Pattern:     `(?:/etc/(?:passwd|shadow|hosts)|/proc/self/|\.ht(?:access|passwd)|(?:^|/)\.git/|(?:^|/)web\.config$|boot\.ini)`,
+		Transforms:  []string{"url_decode", "normalize_path", "lowercase"},
+	},
+	{
+		ID:          "932100",
+		Description: "Unix command injection",
+		Targets:     []string{"args", "cookies"},
+		Pattern:     "(?:[;|`]|&&|\\$\\()\\s*(?:cat|ls|id|whoami|uname|wget|curl|nc|bash|sh|rm|chmod|python|perl)\\b",
+		Transforms:  standardTransforms,
+	},
+	{
+		ID:          "941100",
+		Description: "XSS script tag",
+		Targets:     []string{"args", "cookies", "headers:Referer"},
+		Pattern:     `<\s*script\b`,
+		Transforms:  standardTransforms,
+	},
+	{
+		ID:          "941110",
+		Description: "XSS event handler attribute",
+		Targets:     []string{"args", "cookies"},
+		Pattern:     `<[^>]*\bon[a-z]+\s*=`,
+		Transforms:  standardTransforms,
+	},
+	{
+		ID:          "941120",
+		Description: "XSS script URI",
+		Targets:     []string{"args", "cookies"},
+		Pattern:     `(?:javascript|vbscript)\s*:|data\s*:\s*text/html`,
+		Transforms:  standardTransforms,
+	},
+	{
+		ID:          "942100",
+		Description: "SQL injection tautology",
+		Targets:     []string{"args", "cookies"},
+		Pattern:     `['"]\s*(?:or|and|\|\||&&)\s*(?:'[^']*'|"[^"]*"|\d+|true|false)\s*(?:=|<|>|like\b|is\b)`,
+		Transforms:  standardTransforms,
+	},
+	{
+		ID:          "942110",
+		Description: "SQL injection UNION SELECT",
+		Targets:     []string{"args", "cookies"},
+		Pattern:     `\bunion\b(?:\s|/\*.*?\*/)*(?:all\b|distinct\b)?(?:\s|/\*.*?\*/)*select\b`,
+		Transforms:  standardTransforms,
+	},
+	{
+		ID:          "942120",
+		Description: "SQL injection stacked query or comment",
+		Targets:     []string{"args", "cookies"},
+		Pattern:     `;\s*(?:drop|truncate|delete|insert|update|alter|exec|shutdown)\s|'\s*(?:--|#|/\*)`,
+		Transforms:  standardTransforms,
+	},
+	{
+		ID:          "942130",
+		Description: "SQL injection function",
+		Targets:     []string{"args", "cookies"},
+		Pattern:     `\b(?:sleep|benchmark|pg_sleep|load_file|extractvalue|updatexml)\s*\(|\bwaitfor\s+delay\b|\binto\s+(?:out|dump)file\b`,
+		Transforms:  standardTransforms,
+	},
+	{
+		ID:          "913100",
+		Description: "Security scanner",
+		Targets:     []string{"headers:User-Agent"},
+		Pattern:     `(?:sqlmap|nikto|nmap|masscan|acunetix|nessus|wpscan|dirbuster|gobuster)`,
+		Transforms:  []string{"lowercase"},
+	},
+}
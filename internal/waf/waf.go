@@ -0,0 +1,351 @@
+package waf
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/shammianand/goproxy/internal/clientip"
+	"github.com/shammianand/goproxy/internal/config"
+	"github.com/shammianand/goproxy/internal/urlpath"
+	"github.com/shammianand/goproxy/pkg/logger"
+)
+
+// Modes of the firewall
+const (
+	// ModeBlock rejects requests reaching the anomaly threshold
+	ModeBlock = "block"
+	// ModeDetect only logs them, to tune rules before blocking
+	ModeDetect = "detect"
+	// ModeOff skips inspection
+	ModeOff = "off"
+)
+
+// Actions on bodies larger than MaxBodyBytes
+const (
+	// BodyLimitReject rejects them with 413, so no part of a body escapes
+	// inspection
+	BodyLimitReject = "reject"
+	// BodyLimitPartial inspects their first MaxBodyBytes and forwards the
+	// rest unchecked
+	BodyLimitPartial = "partial"
+)
+
+// ErrBodyTooLarge is returned by Inspect for bodies larger than MaxBodyBytes
+// when they are rejected
+var ErrBodyTooLarge = errors.New("request body exceeds the inspection limit")
+
+// Options configures a Firewall
+type Options struct {
+	// Mode is block (the default), detect or off
+	Mode string
+	// AnomalyThreshold is the score at which requests are blocked; it
+	// defaults to 5
+	AnomalyThreshold int
+	// BuiltinRules enables BuiltinRules, to which Rules are added
+	BuiltinRules bool
+	Rules        []config.WAFRule
+	// Routes tune the firewall per path prefix; the longest matching prefix
+	// applies
+	Routes []config.WAFRoute
+	// MaxBodyBytes bounds how much of a body is inspected; it defaults to
+	// 128 KiB
+	MaxBodyBytes int64
+	// BodyLimitAction is what happens to larger bodies: reject (the default)
+	// or partial
+	BodyLimitAction string
+}
+
+// Match is a rule matching a request
+type Match struct {
+	RuleID string
+	Target string
+	Score  int
+}
+
+// Result is the outcome of inspecting a request
+type Result struct {
+	Mode    string
+	Score   int
+	Matches []Match
+	Blocked bool
+}
+
+// exclusion stops rules from inspecting targets
+type exclusion struct {
+	rules   map[string]bool
+	targets []string
+}
+
+// policy is the rules and settings applying under a path prefix
+type policy struct {
+	prefix     string
+	mode       string
+	threshold  int
+	rules      []*rule
+	exclusions []exclusion
+}
+
+// excludes reports whether a rule must skip a value
+func (p *policy) excludes(ruleID, name string) bool {
+	for _, e := range p.exclusions {
+		if len(e.rules) > 0 && !e.rules[ruleID] {
+			continue
+		}
+		for _, target := range e.targets {
+			if targetMatches(target, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Firewall inspects requests with anomaly scoring rules: every matching rule
+// adds its score, and requests reaching the threshold are blocked
+type Firewall struct {
+	global         *policy
+	routes         []*policy
+	maxBody        int64
+	rejectOversize bool
+	logger         *logger.Logger
+}
+
+// New compiles the rules of a Firewall
+func New(opts Options, logger *logger.Logger) (*Firewall, error) {
+	if opts.Mode == "" {
+		opts.Mode = ModeBlock
+	}
+	if err := validateMode(opts.Mode); err != nil {
+		return nil, err
+	}
+	if opts.AnomalyThreshold <= 0 {
+		opts.AnomalyThreshold = 5
+	}
+	if opts.MaxBodyBytes <= 0 {
+		opts.MaxBodyBytes = 128 << 10
+	}
+	switch opts.BodyLimitAction {
+	case "", BodyLimitReject, BodyLimitPartial:
+	default:
+		return nil, fmt.Errorf("unsupported waf body limit action: %s", opts.BodyLimitAction)
+	}
+
+	var rules []config.WAFRule
+	if opts.BuiltinRules {
+		rules = append(rules, BuiltinRules...)
+	}
+	global, err := compileRules(append(rules, opts.Rules...))
+	if err != nil {
+		return nil, err
+	}
+	f := &Firewall{
+		global:         &policy{mode: opts.Mode, threshold: opts.AnomalyThreshold, rules: global},
+		maxBody:        opts.MaxBodyBytes,
+		rejectOversize: opts.BodyLimitAction != BodyLimitPartial,
+		logger:         logger,
+	}
+
+	for _, route := range opts.Routes {
+		p, err := f.routePolicy(route)
+		if err != nil {
+			return nil, err
+		}
+		f.routes = append(f.routes, p)
+	}
+	sort.SliceStable(f.routes, func(i, j int) bool {
+		return len(f.routes[i].prefix) > len(f.routes[j].prefix)
+	})
+	return f, nil
+}
+
+func validateMode(mode string) error {
+	switch mode {
+	case ModeBlock, ModeDetect, ModeOff:
+		return nil
+	default:
+		return fmt.Errorf("unsupported waf mode: %s", mode)
+	}
+}
+
+func compileRules(rules []config.WAFRule) ([]*rule, error) {
+	seen := make(map[string]bool)
+	var compiled []*rule
+	for _, r := range rules {
+		if seen[r.ID] {
+			return nil, fmt.Errorf("duplicate waf rule id %s", r.ID)
+		}
+		seen[r.ID] = true
+		c, err := newRule(r)
+		if err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, c)
+	}
+	return compiled, nil
+}
+
+// routePolicy derives the policy of a route from the global one
+func (f *Firewall) routePolicy(route config.WAFRoute) (*policy, error) {
+	if route.PathPrefix == "" {
+		return nil, fmt.Errorf("waf route requires a path prefix")
+	}
+	p := &policy{prefix: route.PathPrefix, mode: route.Mode, threshold: route.AnomalyThreshold}
+	if p.mode == "" {
+		p.mode = f.global.mode
+	}
+	if err := validateMode(p.mode); err != nil {
+		return nil, err
+	}
+	if p.threshold <= 0 {
+		p.threshold = f.global.threshold
+	}
+
+	known := make(map[string]bool)
+	for _, r := range f.global.rules {
+		known[r.id] = true
+	}
+	for _, r := range route.Rules {
+		if known[r.ID] {
+			return nil, fmt.Errorf("duplicate waf rule id %s", r.ID)
+		}
+		known[r.ID] = true
+	}
+	disabled := make(map[string]bool)
+	for _, id := range route.DisabledRules {
+		if !known[id] {
+			return nil, fmt.Errorf("waf route %s disables unknown rule %s", route.PathPrefix, id)
+		}
+		disabled[id] = true
+	}
+
+	for _, r := range f.global.rules {
+		if !disabled[r.id] {
+			p.rules = append(p.rules, r)
+		}
+	}
+	extra, err := compileRules(route.Rules)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range extra {
+		if !disabled[r.id] {
+			p.rules = append(p.rules, r)
+		}
+	}
+
+	for _, e := range route.Exclusions {
+		if len(e.Targets) == 0 {
+			return nil, fmt.Errorf("waf exclusion on %s has no targets", route.PathPrefix)
+		}
+		compiled := exclusion{rules: make(map[string]bool), targets: e.Targets}
+		for _, id := range e.Rules {
+			if !known[id] {
+				return nil, fmt.Errorf("waf exclusion on %s names unknown rule %s", route.PathPrefix, id)
+			}
+			compiled.rules[id] = true
+		}
+		for _, target := range e.Targets {
+			if err := validateTarget(target); err != nil {
+				return nil, fmt.Errorf("waf exclusion on %s: %w", route.PathPrefix, err)
+			}
+		}
+		p.exclusions = append(p.exclusions, compiled)
+	}
+	return p, nil
+}
+
+// policyFor returns the policy of a path, which is matched once cleaned so
+// //api or /x/../api cannot skip the rules of a route
+func (f *Firewall) policyFor(path string) *policy {
+	path = urlpath.Clean(path)
+	for _, p := range f.routes {
+		if strings.HasPrefix(path, p.prefix) {
+			return p
+		}
+	}
+	return f.global
+}
+
+// Inspect matches a request against the rules applying to its path. Each rule
+// counts once, on the first value it matches. Bodies larger than the limit
+// return ErrBodyTooLarge in block mode unless partial inspection is enabled.
+func (f *Firewall) Inspect(r *http.Request) (*Result, error) {
+	p := f.policyFor(r.URL.Path)
+	result := &Result{Mode: p.mode}
+	if p.mode == ModeOff {
+		return result, nil
+	}
+	values, truncated, err := collect(r, f.maxBody)
+	if err != nil {
+		return nil, err
+	}
+	if truncated && f.rejectOversize {
+		if p.mode == ModeBlock {
+			return nil, ErrBodyTooLarge
+		}
+		f.logger.Warn("Request body exceeds the WAF inspection limit, not blocked in detect mode", "method", r.Method, "path", r.URL.Path, "client_ip", clientip.FromRequest(r))
+	}
+	for _, rule := range p.rules {
+		for _, v := range values {
+			if !rule.selects(v.name) || p.excludes(rule.id, v.name) {
+				continue
+			}
+			if rule.pattern.MatchString(rule.transform(v.data)) {
+				result.Score += rule.score
+				result.Matches = append(result.Matches, Match{RuleID: rule.id, Target: v.name, Score: rule.score})
+				break
+			}
+		}
+	}
+	result.Blocked = p.mode == ModeBlock && result.Score >= p.threshold
+	if p.mode == ModeDetect && result.Score >= p.threshold {
+		f.logger.Warn("Request exceeds the WAF anomaly threshold, not blocked in detect mode", logAttrs(r, result)...)
+	} else if len(result.Matches) > 0 && !result.Blocked {
+		f.logger.Debug("WAF rules matched below the anomaly threshold", logAttrs(r, result)...)
+	}
+	return result, nil
+}
+
+func logAttrs(r *http.Request, result *Result) []any {
+	rules := make([]string, len(result.Matches))
+	targets := make([]string, len(result.Matches))
+	for i, m := range result.Matches {
+		rules[i] = m.RuleID
+		targets[i] = m.Target
+	}
+	return []any{
+		"method", r.Method,
+		"path", r.URL.Path,
+		"client_ip", clientip.FromRequest(r),
+		"score", result.Score,
+		"rules", rules,
+		"targets", targets,
+	}
+}
+
+// Handler returns a handler rejecting blocked requests with 403 and passing
+// the others to next
+func (f *Firewall) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		result, err := f.Inspect(r)
+		if errors.Is(err, ErrBodyTooLarge) {
+			f.logger.Warn("Request body too large for WAF inspection", "method", r.Method, "path", r.URL.Path, "client_ip", clientip.FromRequest(r))
+			http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			f.logger.Warn("Failed to read request body for inspection", "path", r.URL.Path, "error", err)
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		if result.Blocked {
+			f.logger.Warn("Request blocked by WAF", logAttrs(r, result)...)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,191 @@
+package unit
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/shammianand/goproxy/internal/accesslog"
+	"github.com/shammianand/goproxy/internal/proxy"
+)
+
+// newAccessLog returns an access logged proxy to backend and a function
+// reading the records written
+func newAccessLog(t *testing.T, backend string, opts accesslog.Options) (http.Handler, func() []string) {
+	opts.Output = filepath.Join(t.TempDir(), "access.log")
+	l, err := accesslog.New(opts)
+	if err != nil {
+		t.Fatalf("Failed to create access log: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	p, err := proxy.NewProxy(backend, nil, newTestLogger(nil), proxy.WithAccessLog(l))
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	h := l.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Stands in for the middlewares rejecting requests before the proxy
+		if r.URL.Path == "/blocked" {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		p.ServeHTTP(w, r)
+	}))
+	return h, func() []string {
+		data, err := os.ReadFile(opts.Output)
+		if err != nil {
+			t.Fatalf("Failed to read access log: %v", err)
+		}
+		return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	}
+}
+
+func accessLogBackend() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Upstream-Request-Id", r.Header.Get("X-Request-Id"))
+		w.Write([]byte("hello"))
+	}))
+}
+
+func TestAccessLogCombined(t *testing.T) {
+	backend := accessLogBackend()
+	defer backend.Close()
+	h, records := newAccessLog(t, backend.URL, accesslog.Options{Format: accesslog.FormatCombined})
+
+	req := httptest.NewRequest("GET", "/items?page=2", nil)
+	req.RemoteAddr = "198.51.100.7:41234"
+	req.SetBasicAuth("alice", "secret")
+	req.Header.Set("Referer", "https://example.com/")
+	req.Header.Set("User-Agent", `evil"agent`)
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("DELETE", "/blocked", nil))
+
+	lines := records()
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 records, got %q", lines)
+	}
+	expected := regexp.MustCompile(`^198\.51\.100\.7 - alice \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "GET /items\?page=2 HTTP/1\.1" 200 5 "https://example\.com/" "evil\\x22agent"$`)
+	if !expected.MatchString(lines[0]) {
+		t.Errorf("Unexpected combined record: %s", lines[0])
+	}
+	if !strings.Contains(lines[1], ` - - [`) || !strings.Contains(lines[1], `"DELETE /blocked HTTP/1.1" 403 10 "-" "-"`) {
+		t.Errorf("Unexpected record of a rejected request: %s", lines[1])
+	}
+}
+
+func TestAccessLogTemplate(t *testing.T) {
+	backend := accessLogBackend()
+	defer backend.Close()
+	h, records := newAccessLog(t, backend.URL, accesslog.Options{
+		Format:   accesslog.FormatTemplate,
+		Template: `$request_id ${remote_addr} up=$upstream_addr/$upstream_status rt=$request_time urt=$upstream_response_time sent=$bytes_sent body=$body_bytes_sent tenant=$http_x_tenant`,
+	})
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Request-Id", "req-42")
+	req.Header.Set("X-Tenant", "acme")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if got := rec.Header().Get("Upstream-Request-Id"); got != "req-42" {
+		t.Errorf("Expected the client request ID forwarded, got %q", got)
+	}
+
+	// Requests without an ID get one, which the backend sees too
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	generated := rec.Header().Get("Upstream-Request-Id")
+	if len(generated) != 32 {
+		t.Errorf("Expected a generated request ID, got %q", generated)
+	}
+
+	lines := records()
+	host := strings.TrimPrefix(backend.URL, "http://")
+	expected := regexp.MustCompile(`^req-42 192\.0\.2\.1 up=` + regexp.QuoteMeta(host) + `/200 rt=\d+\.\d{3} urt=\d+\.\d{3} sent=(\d+) body=5 tenant=acme$`)
+	m := expected.FindStringSubmatch(lines[0])
+	if m == nil {
+		t.Fatalf("Unexpected template record: %s", lines[0])
+	}
+	if m[1] == "5" {
+		t.Errorf("Expected bytes_sent to include the header, got %s", m[1])
+	}
+	if !strings.HasPrefix(lines[1], generated+" ") || !strings.HasSuffix(lines[1], "tenant=-") {
+		t.Errorf("Unexpected template record: %s", lines[1])
+	}
+}
+
+func TestAccessLogJSON(t *testing.T) {
+	h, records := newAccessLog(t, "http://127.0.0.1:1", accesslog.Options{Format: accesslog.FormatJSON})
+	req := httptest.NewRequest("POST", "/orders", strings.NewReader("{}"))
+	req.Header.Set("User-Agent", "client/1.0")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	var record map[string]any
+	if err := json.Unmarshal([]byte(records()[0]), &record); err != nil {
+		t.Fatalf("Failed to decode record: %v", err)
+	}
+	expected := map[string]any{
+		"remote_addr":     "192.0.2.1",
+		"method":          "POST",
+		"uri":             "/orders",
+		"protocol":        "HTTP/1.1",
+		"status":          float64(http.StatusBadGateway),
+		"body_bytes_sent": float64(0),
+		"upstream_addr":   "127.0.0.1:1",
+		"upstream_status": "502",
+		"user_agent":      "client/1.0",
+	}
+	for key, value := range expected {
+		if record[key] != value {
+			t.Errorf("Expected %s %v, got %v", key, value, record[key])
+		}
+	}
+	for _, key := range []string{"time", "request_id", "request_time", "upstream_response_time"} {
+		if _, ok := record[key]; !ok {
+			t.Errorf("Expected %s in %v", key, record)
+		}
+	}
+}
+
+func TestAccessLogRedact(t *testing.T) {
+	backend := accessLogBackend()
+	defer backend.Close()
+	h, records := newAccessLog(t, backend.URL, accesslog.Options{
+		Format:            accesslog.FormatTemplate,
+		Template:          `"$request" $request_uri $args`,
+		RedactQueryParams: []string{"api_key"},
+	})
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/orders?id=7&api_key=secret&api%5Fkey=other", nil))
+	expected := `"GET /orders?id=7&api_key=REDACTED&api%5Fkey=REDACTED HTTP/1.1" /orders?id=7&api_key=REDACTED&api%5Fkey=REDACTED id=7&api_key=REDACTED&api%5Fkey=REDACTED`
+	if got := records()[0]; got != expected {
+		t.Errorf("Expected %s, got %s", expected, got)
+	}
+
+	h, records = newAccessLog(t, backend.URL, accesslog.Options{Format: accesslog.FormatJSON, RedactQueryParams: []string{"api_key"}})
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/orders?api_key=secret", nil))
+	var record map[string]any
+	if err := json.Unmarshal([]byte(records()[0]), &record); err != nil {
+		t.Fatalf("Failed to decode record: %v", err)
+	}
+	if record["uri"] != "/orders?api_key=REDACTED" {
+		t.Errorf("Expected the key redacted, got %v", record["uri"])
+	}
+}
+
+func TestAccessLogConfigErrors(t *testing.T) {
+	tests := []accesslog.Options{
+		{Format: "apache"},
+		{Format: accesslog.FormatTemplate},
+		{Format: accesslog.FormatTemplate, Template: "$remote_addr $upstream_bytes"},
+		{Format: accesslog.FormatTemplate, Template: "${remote_addr"},
+		{Output: filepath.Join(t.TempDir(), "missing", "access.log")},
+	}
+	for _, opts := range tests {
+		if _, err := accesslog.New(opts); err == nil {
+			t.Errorf("Expected error for %+v", opts)
+		}
+	}
+}
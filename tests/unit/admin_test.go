@@ -0,0 +1,121 @@
+package unit
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/shammianand/goproxy/internal/admin"
+	"github.com/shammianand/goproxy/internal/cache"
+	"github.com/shammianand/goproxy/internal/concurrency"
+)
+
+func adminRequest(t *testing.T, h http.Handler, method, target, token string) (*httptest.ResponseRecorder, map[string]any) {
+	t.Helper()
+	req := httptest.NewRequest(method, target, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	var body map[string]any
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Invalid JSON response %q: %v", rr.Body.String(), err)
+	}
+	return rr, body
+}
+
+func TestAdminCachePurge(t *testing.T) {
+	origin := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=600")
+		switch r.URL.Path {
+		case "/products/1", "/products/2":
+			w.Header().Set("Surrogate-Key", "products "+r.URL.Path[len("/products/"):])
+		case "/home":
+			w.Header().Set("Cache-Tag", "homepage, products")
+			w.Header().Set("Vary", "Accept-Language")
+		}
+		fmt.Fprint(w, r.URL.Path)
+	})
+	responseCache := cache.New(cache.NewMemoryStore(1<<20), 0, 1<<20, newTestLogger(nil))
+	h := responseCache.Handler(origin)
+	fill := func() {
+		for _, path := range []string{"/products/1", "/products/2", "/static/app.js", "/static/app.css"} {
+			cacheGet(t, h, path, nil)
+		}
+		cacheGet(t, h, "/home", http.Header{"Accept-Language": {"en"}})
+		cacheGet(t, h, "/home", http.Header{"Accept-Language": {"de"}})
+	}
+	api := admin.NewServer("secret", newTestLogger(nil), admin.WithCache(responseCache))
+
+	if rr, _ := adminRequest(t, api, "GET", "/cache/entries", "wrong"); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for a wrong token, got %d", rr.Code)
+	}
+
+	fill()
+	_, body := adminRequest(t, api, "GET", "/cache/entries", "secret")
+	if count := body["count"].(float64); count != 6 {
+		t.Errorf("Expected 6 entries, got %v", count)
+	}
+
+	_, body = adminRequest(t, api, "GET", "/cache/entry?url=http://example.com/home", "secret")
+	entries := body["entries"].([]any)
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 variants of /home, got %d", len(entries))
+	}
+	first := entries[0].(map[string]any)
+	if first["ttl_seconds"].(float64) <= 0 || first["size"].(float64) <= 0 {
+		t.Errorf("Expected TTL and size in entry info, got %v", first)
+	}
+	if _, ok := first["variant"].(map[string]any)["Accept-Language"]; !ok {
+		t.Errorf("Expected Accept-Language variant in entry info, got %v", first["variant"])
+	}
+
+	tests := []struct {
+		name   string
+		query  string
+		purged float64
+	}{
+		{"exact URL purges every variant", "url=http://example.com/home", 2},
+		{"path prefix", "prefix=/static/", 2},
+		{"surrogate key", "tag=products", 4},
+		{"any of several tags", "tag=1&tag=homepage", 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fill()
+			rr, body := adminRequest(t, api, "POST", "/cache/purge?"+tt.query, "secret")
+			if rr.Code != http.StatusOK || body["purged"].(float64) != tt.purged {
+				t.Errorf("Expected %v purged entries, got %d %v", tt.purged, rr.Code, body)
+			}
+			// Purged responses are fetched again
+			if rr := cacheGet(t, h, "/products/1", nil); tt.query == "tag=products" && rr.Header().Get("X-Cache") != "MISS" {
+				t.Errorf("Expected purged entry to miss, got X-Cache %q", rr.Header().Get("X-Cache"))
+			}
+		})
+	}
+
+	if rr, _ := adminRequest(t, api, "POST", "/cache/purge", "secret"); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 without a filter, got %d", rr.Code)
+	}
+}
+
+func TestAdminConcurrency(t *testing.T) {
+	limiter, err := concurrency.New(concurrency.Options{InitialLimit: 8, MinLimit: 1, MaxLimit: 10}, newTestLogger(nil))
+	if err != nil {
+		t.Fatalf("Failed to create limiter: %v", err)
+	}
+	api := admin.NewServer("", newTestLogger(nil), admin.WithConcurrencyLimiter(limiter))
+
+	rr, body := adminRequest(t, api, "GET", "/concurrency", "")
+	if rr.Code != http.StatusOK || body["limit"].(float64) != 8 {
+		t.Errorf("Expected limit 8, got %d %v", rr.Code, body)
+	}
+	rr = httptest.NewRecorder()
+	api.ServeHTTP(rr, httptest.NewRequest("GET", "/cache/entries", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for cache endpoints without a cache, got %d", rr.Code)
+	}
+}
@@ -0,0 +1,234 @@
+package unit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shammianand/goproxy/internal/auth"
+)
+
+func writeKeyFile(t *testing.T, path, content string) {
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("Failed to write key file: %v", err)
+	}
+}
+
+// echoIdentity answers with the request as seen upstream
+func echoIdentity() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for name, values := range r.Header {
+			w.Header()["Upstream-"+name] = values
+		}
+		w.Header().Set("Upstream-Query", r.URL.RawQuery)
+		if id, ok := auth.FromContext(r.Context()); ok {
+			w.Header().Set("Upstream-Context-Subject", id.Subject)
+		}
+	})
+}
+
+func TestAPIKeyAuth(t *testing.T) {
+	dir := t.TempDir()
+	digest := sha256.Sum256([]byte("hashed-key"))
+	keyFile := filepath.Join(dir, "keys.yaml")
+	writeKeyFile(t, keyFile, `
+keys:
+  - id: acme
+    key: acme-key
+    owner: Acme Corp
+    routes: ["/partners/"]
+    metadata:
+      tier: gold
+  - id: globex
+    key_sha256: `+hex.EncodeToString(digest[:])+`
+  - id: retired
+    key: retired-key
+    disabled: true
+`)
+	keys, err := auth.NewKeyStore(keyFile)
+	if err != nil {
+		t.Fatalf("Failed to load keys: %v", err)
+	}
+	quotas, _ := auth.NewQuotas("")
+	var logs syncBuffer
+	a := auth.NewAPIKeyAuth(keys, quotas, auth.APIKeyOptions{QueryParam: "api_key"}, newTestLogger(&logs))
+	defer a.Close()
+	h := a.Handler(echoIdentity())
+
+	request := func(target string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := request("/partners/orders", http.Header{"X-Api-Key": {"acme-key"}, "X-Auth-Subject": {"admin"}, "X-Auth-Role": {"root"}})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected 200 for a valid key, got %d", rr.Code)
+	}
+	expected := map[string]string{
+		"Upstream-X-Auth-Subject":  "acme",
+		"Upstream-X-Auth-Owner":    "Acme Corp",
+		"Upstream-X-Auth-Method":   "api_key",
+		"Upstream-X-Auth-Tier":     "gold",
+		"Upstream-X-Auth-Role":     "",
+		"Upstream-X-Api-Key":       "",
+		"Upstream-Context-Subject": "acme",
+	}
+	for name, value := range expected {
+		if got := rr.Header().Get(name); got != value {
+			t.Errorf("Expected %s %q, got %q", name, value, got)
+		}
+	}
+
+	// Keys in the query string are removed before forwarding
+	rr = request("/orders?api_key=hashed-key&page=2", nil)
+	if rr.Code != http.StatusOK || rr.Header().Get("Upstream-Query") != "page=2" {
+		t.Errorf("Expected 200 without the key in the query, got %d %q", rr.Code, rr.Header().Get("Upstream-Query"))
+	}
+
+	tests := []struct {
+		target string
+		key    string
+		code   int
+	}{
+		{"/partners/orders", "", http.StatusUnauthorized},
+		{"/partners/orders", "wrong", http.StatusUnauthorized},
+		{"/partners/orders", "retired-key", http.StatusUnauthorized},
+		{"/internal/stats", "acme-key", http.StatusForbidden},
+		{"/partners/../internal/stats", "acme-key", http.StatusForbidden},
+		{"//internal/stats", "acme-key", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		rr := request(tt.target, http.Header{"X-Api-Key": {tt.key}})
+		if rr.Code != tt.code {
+			t.Errorf("%s with key %q: expected %d, got %d", tt.target, tt.key, tt.code, rr.Code)
+		}
+	}
+
+	// Keys in the query string are not logged
+	if rr = request("/orders?api_key=leaked-secret", nil); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for an invalid key, got %d", rr.Code)
+	}
+	if !strings.Contains(logs.String(), "Invalid API key") || strings.Contains(logs.String(), "leaked-secret") {
+		t.Errorf("Expected the key to be kept out of the log, got %q", logs.String())
+	}
+}
+
+func TestAPIKeyReload(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "keys.yaml")
+	writeKeyFile(t, keyFile, "keys:\n  - id: old\n    key: old-key\n")
+	keys, err := auth.NewKeyStore(keyFile)
+	if err != nil {
+		t.Fatalf("Failed to load keys: %v", err)
+	}
+	quotas, _ := auth.NewQuotas("")
+	a := auth.NewAPIKeyAuth(keys, quotas, auth.APIKeyOptions{ReloadInterval: 10 * time.Millisecond}, newTestLogger(nil))
+	defer a.Close()
+
+	writeKeyFile(t, keyFile, "keys:\n  - id: new\n    key: new-key-with-a-longer-value\n")
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, ok := keys.Lookup("new-key-with-a-longer-value"); ok {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, ok := keys.Lookup("new-key-with-a-longer-value"); !ok {
+		t.Fatal("Expected the new key after reloading")
+	}
+	if _, ok := keys.Lookup("old-key"); ok {
+		t.Error("Expected the old key to be removed")
+	}
+
+	// An invalid file keeps the current keys
+	writeKeyFile(t, keyFile, "keys:\n  - id: broken\n")
+	if err := keys.Reload(); err == nil {
+		t.Error("Expected error for a key without a value")
+	}
+	if _, ok := keys.Lookup("new-key-with-a-longer-value"); !ok {
+		t.Error("Expected the current keys to be kept")
+	}
+
+	// So does a file read while it is being rewritten
+	writeKeyFile(t, keyFile, "")
+	if err := keys.Reload(); err == nil {
+		t.Error("Expected error for an empty key file")
+	}
+	if _, ok := keys.Lookup("new-key-with-a-longer-value"); !ok {
+		t.Error("Expected the current keys to be kept")
+	}
+}
+
+func TestAPIKeyQuotas(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "keys.yaml")
+	usageFile := filepath.Join(dir, "usage.json")
+	writeKeyFile(t, keyFile, "keys:\n  - id: trial\n    key: trial-key\n    daily_quota: 3\n    monthly_quota: 100\n")
+
+	keys, err := auth.NewKeyStore(keyFile)
+	if err != nil {
+		t.Fatalf("Failed to load keys: %v", err)
+	}
+	quotas, err := auth.NewQuotas(usageFile)
+	if err != nil {
+		t.Fatalf("Failed to load usage: %v", err)
+	}
+	a := auth.NewAPIKeyAuth(keys, quotas, auth.APIKeyOptions{}, newTestLogger(nil))
+	h := a.Handler(echoIdentity())
+	request := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-API-Key", "trial-key")
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+
+	for i := 0; i < 2; i++ {
+		if rr := request(); rr.Code != http.StatusOK {
+			t.Fatalf("Request %d: expected 200 within quota, got %d", i, rr.Code)
+		}
+	}
+	// Counters are persisted on close and restored on startup
+	if err := a.Close(); err != nil {
+		t.Fatalf("Failed to flush usage: %v", err)
+	}
+	quotas, err = auth.NewQuotas(usageFile)
+	if err != nil {
+		t.Fatalf("Failed to reload usage: %v", err)
+	}
+	if u := quotas.Usage("trial", time.Now()); u.DayCount != 2 || u.MonthCount != 2 {
+		t.Errorf("Expected 2 requests counted, got %+v", u)
+	}
+
+	a = auth.NewAPIKeyAuth(keys, quotas, auth.APIKeyOptions{}, newTestLogger(nil))
+	defer a.Close()
+	h = a.Handler(echoIdentity())
+	if rr := request(); rr.Code != http.StatusOK {
+		t.Errorf("Expected the last request within quota to pass, got %d", rr.Code)
+	}
+	rr := request()
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected 429 over the daily quota, got %d", rr.Code)
+	}
+	retryAfter, _ := strconv.Atoi(rr.Header().Get("Retry-After"))
+	if retryAfter <= 0 || retryAfter > 86400 {
+		t.Errorf("Expected Retry-After until midnight UTC, got %q", rr.Header().Get("Retry-After"))
+	}
+
+	// Counters reset with the day
+	k, _ := keys.Lookup("trial-key")
+	if ok, _ := quotas.Take(k, time.Now().Add(24*time.Hour)); !ok {
+		t.Error("Expected the daily quota to reset the next day")
+	}
+}
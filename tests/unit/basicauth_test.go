@@ -0,0 +1,167 @@
+package unit
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/shammianand/goproxy/internal/auth"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func writeHtpasswd(t *testing.T, path string, lines ...string) {
+	var data []byte
+	for _, line := range lines {
+		data = append(data, line+"\n"...)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("Failed to write htpasswd file: %v", err)
+	}
+}
+
+func bcryptLine(t *testing.T, user, password string) string {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Failed to hash password: %v", err)
+	}
+	// htpasswd writes $2y$, which is the same algorithm as Go's $2a$
+	return user + ":$2y" + string(hash[3:])
+}
+
+func shaLine(user, password string) string {
+	sum := sha1.Sum([]byte(password))
+	return user + ":{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func TestHtpasswdFormats(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	writeHtpasswd(t, path,
+		"# staging users",
+		bcryptLine(t, "ada", "bcrypt-pass"),
+		shaLine("grace", "sha-pass"),
+		// Generated with openssl passwd -apr1
+		"linus:$apr1$saltsalt$LrttParrLPdxvgutaSXWJ0",
+		"empty:$apr1$ab$S8K6Sgp3W8c9Jb6LxgywZ.",
+		"ken:abJnggxhB/yWI",
+		"",
+	)
+	users, err := auth.NewHtpasswd(path)
+	if err != nil {
+		t.Fatalf("Failed to load htpasswd file: %v", err)
+	}
+
+	tests := []struct {
+		user     string
+		password string
+		valid    bool
+	}{
+		{"ada", "bcrypt-pass", true},
+		{"ada", "bcrypt-pass", true},
+		{"ada", "wrong", false},
+		{"grace", "sha-pass", true},
+		{"grace", "wrong", false},
+		{"linus", "secret", true},
+		{"linus", "Secret", false},
+		{"empty", "", true},
+		{"ken", "anything", false},
+		{"nobody", "", false},
+	}
+	for _, tt := range tests {
+		if got := users.Verify(tt.user, tt.password); got != tt.valid {
+			t.Errorf("Verify(%s, %s) = %v, expected %v", tt.user, tt.password, got, tt.valid)
+		}
+	}
+	if users.Len() != 4 || len(users.Skipped()) != 1 || users.Skipped()[0] != "ken" {
+		t.Errorf("Expected 4 users and ken skipped for DES crypt, got %d and %v", users.Len(), users.Skipped())
+	}
+
+	writeHtpasswd(t, path, "no separator")
+	if err := users.Reload(); err == nil {
+		t.Error("Expected error for a malformed line")
+	}
+	if !users.Verify("grace", "sha-pass") {
+		t.Error("Expected the current users to be kept")
+	}
+	if _, err := auth.NewHtpasswd(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("Expected error for a missing file")
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	writeHtpasswd(t, path, shaLine("ada", "secret"))
+	users, _ := auth.NewHtpasswd(path)
+	a := auth.NewBasicAuth(users, auth.BasicAuthOptions{
+		Realm:              "Staging",
+		Routes:             []string{"/app/"},
+		StripAuthorization: true,
+		ReloadInterval:     20 * time.Millisecond,
+	}, newTestLogger(nil))
+	defer a.Close()
+	h := auth.StripIdentityHeaders("", a.Handler(echoIdentity()))
+
+	request := func(path, user, password string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if user != "" {
+			req.SetBasicAuth(user, password)
+		}
+		req.Header.Set("X-Auth-Subject", "spoofed")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := request("/app/", "", "")
+	if rec.Code != http.StatusUnauthorized || rec.Header().Get("WWW-Authenticate") != `Basic realm="Staging", charset="UTF-8"` {
+		t.Errorf("Expected a 401 challenge, got %d %q", rec.Code, rec.Header().Get("WWW-Authenticate"))
+	}
+	if rec = request("/app/", "ada", "wrong"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for a wrong password, got %d", rec.Code)
+	}
+	for _, path := range []string{"//app/", "/x/../app/"} {
+		if rec = request(path, "", ""); rec.Code != http.StatusUnauthorized {
+			t.Errorf("Expected 401 for %s, got %d", path, rec.Code)
+		}
+	}
+
+	rec = request("/app/", "ada", "secret")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", rec.Code)
+	}
+	expected := map[string]string{
+		"Upstream-X-Auth-Subject": "ada",
+		"Upstream-X-Auth-Method":  "basic",
+		"Upstream-Authorization":  "",
+	}
+	for name, value := range expected {
+		if got := rec.Header().Get(name); got != value {
+			t.Errorf("Expected %s %q, got %q", name, value, got)
+		}
+	}
+
+	// Other routes are not guarded, but clients cannot pose as an identity
+	if rec = request("/health", "", ""); rec.Code != http.StatusOK {
+		t.Errorf("Expected unguarded route to pass, got %d", rec.Code)
+	}
+	if got := rec.Header().Get("Upstream-X-Auth-Subject"); got != "" {
+		t.Errorf("Expected the client identity header to be stripped, got %q", got)
+	}
+
+	// Changes to the file are picked up
+	writeHtpasswd(t, path, shaLine("ada", "rotated"), shaLine("grace", "hopper"))
+	deadline := time.Now().Add(2 * time.Second)
+	for request("/app/", "grace", "hopper").Code != http.StatusOK && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if rec = request("/app/", "grace", "hopper"); rec.Code != http.StatusOK {
+		t.Errorf("Expected the added user to pass, got %d", rec.Code)
+	}
+	if rec = request("/app/", "ada", "secret"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected the old password to be rejected, got %d", rec.Code)
+	}
+}
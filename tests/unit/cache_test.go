@@ -0,0 +1,583 @@
+package unit
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/shammianand/goproxy/internal/auth"
+	"github.com/shammianand/goproxy/internal/cache"
+	"github.com/shammianand/goproxy/internal/config"
+	"github.com/shammianand/goproxy/internal/proxy"
+)
+
+// countingOrigin returns a handler that counts its requests and lets the test
+// choose the response headers per path
+func countingOrigin(calls *atomic.Int32, headers map[string]http.Header) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		for name, values := range headers[r.URL.Path] {
+			w.Header()[name] = values
+		}
+		if r.Method == http.MethodPost {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		fmt.Fprintf(w, "%s %s #%d", r.URL.Path, r.Header.Get("Accept-Encoding"), n)
+	})
+}
+
+func cacheGet(t *testing.T, h http.Handler, path string, header http.Header) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest("GET", "http://example.com"+path, nil)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestCacheHitAndMiss(t *testing.T) {
+	var calls atomic.Int32
+	origin := countingOrigin(&calls, map[string]http.Header{
+		"/fresh": {"Cache-Control": {"public, max-age=60"}},
+	})
+	h := cache.New(cache.NewMemoryStore(1<<20), 0, 1<<20, newTestLogger(nil)).Handler(origin)
+
+	first := cacheGet(t, h, "/fresh", nil)
+	if got := first.Header().Get("X-Cache"); got != "MISS" {
+		t.Errorf("Expected X-Cache MISS, got %q", got)
+	}
+	second := cacheGet(t, h, "/fresh", nil)
+	if got := second.Header().Get("X-Cache"); got != "HIT" {
+		t.Errorf("Expected X-Cache HIT, got %q", got)
+	}
+	if second.Body.String() != first.Body.String() {
+		t.Errorf("Expected cached body %q, got %q", first.Body.String(), second.Body.String())
+	}
+	if second.Header().Get("Age") == "" {
+		t.Error("Expected Age header on cache hit")
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("Expected 1 origin request, got %d", n)
+	}
+
+	// The client may insist on a fresh response
+	cacheGet(t, h, "/fresh", http.Header{"Cache-Control": {"no-cache"}})
+	if n := calls.Load(); n != 2 {
+		t.Errorf("Expected request no-cache to reach the origin, got %d origin requests", n)
+	}
+}
+
+func TestCacheFreshness(t *testing.T) {
+	var calls atomic.Int32
+	origin := countingOrigin(&calls, map[string]http.Header{
+		"/expired":   {"Cache-Control": {"max-age=0"}},
+		"/expires":   {"Expires": {time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)}},
+		"/no-store":  {"Cache-Control": {"no-store"}},
+		"/private":   {"Cache-Control": {"private, max-age=60"}},
+		"/cookie":    {"Cache-Control": {"max-age=60"}, "Set-Cookie": {"session=1"}},
+		"/heuristic": {},
+	})
+
+	tests := []struct {
+		name       string
+		path       string
+		defaultTTL time.Duration
+		cached     bool
+	}{
+		{"max-age=0 overrides default TTL", "/expired", time.Minute, false},
+		{"Expires in the future", "/expires", 0, true},
+		{"no-store", "/no-store", time.Minute, false},
+		{"private", "/private", time.Minute, false},
+		{"Set-Cookie", "/cookie", time.Minute, false},
+		{"default TTL without freshness", "/heuristic", time.Minute, true},
+		{"no default TTL without freshness", "/heuristic", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := cache.New(cache.NewMemoryStore(1<<20), tt.defaultTTL, 1<<20, newTestLogger(nil)).Handler(origin)
+			cacheGet(t, h, tt.path, nil)
+			rr := cacheGet(t, h, tt.path, nil)
+			if hit := rr.Header().Get("X-Cache") == "HIT"; hit != tt.cached {
+				t.Errorf("Expected cached=%v, got X-Cache %q", tt.cached, rr.Header().Get("X-Cache"))
+			}
+		})
+	}
+}
+
+func TestCacheVary(t *testing.T) {
+	var calls atomic.Int32
+	origin := countingOrigin(&calls, map[string]http.Header{
+		"/vary": {"Cache-Control": {"max-age=60"}, "Vary": {"Accept-Encoding"}},
+	})
+	h := cache.New(cache.NewMemoryStore(1<<20), 0, 1<<20, newTestLogger(nil)).Handler(origin)
+
+	gzip := http.Header{"Accept-Encoding": {"gzip"}}
+	identity := http.Header{"Accept-Encoding": {"identity"}}
+
+	cacheGet(t, h, "/vary", gzip)
+	cacheGet(t, h, "/vary", identity)
+	hitGzip := cacheGet(t, h, "/vary", gzip)
+	hitIdentity := cacheGet(t, h, "/vary", identity)
+
+	if n := calls.Load(); n != 2 {
+		t.Errorf("Expected one origin request per variant, got %d", n)
+	}
+	if !strings.Contains(hitGzip.Body.String(), "gzip") || hitGzip.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("Expected cached gzip variant, got %q (%s)", hitGzip.Body.String(), hitGzip.Header().Get("X-Cache"))
+	}
+	if !strings.Contains(hitIdentity.Body.String(), "identity") || hitIdentity.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("Expected cached identity variant, got %q (%s)", hitIdentity.Body.String(), hitIdentity.Header().Get("X-Cache"))
+	}
+}
+
+func TestCacheInvalidation(t *testing.T) {
+	var calls atomic.Int32
+	origin := countingOrigin(&calls, map[string]http.Header{
+		"/item": {"Cache-Control": {"max-age=60"}},
+	})
+	h := cache.New(cache.NewMemoryStore(1<<20), 0, 1<<20, newTestLogger(nil)).Handler(origin)
+
+	cacheGet(t, h, "/item", nil)
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "http://example.com/item", nil))
+	if rr := cacheGet(t, h, "/item", nil); rr.Header().Get("X-Cache") != "MISS" {
+		t.Errorf("Expected POST to invalidate the cached response, got X-Cache %q", rr.Header().Get("X-Cache"))
+	}
+}
+
+func TestMemoryStoreEviction(t *testing.T) {
+	store := cache.NewMemoryStore(300)
+	newEntry := func(key string) *cache.Entry {
+		return &cache.Entry{Key: key, PrimaryKey: key, Body: make([]byte, 100)}
+	}
+
+	store.Set(newEntry("a"))
+	store.Set(newEntry("b"))
+	// Touch a so b becomes the least recently used entry
+	store.Get("a")
+	store.Set(newEntry("c"))
+
+	if _, ok := store.Get("b"); ok {
+		t.Error("Expected least recently used entry to be evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok := store.Get(key); !ok {
+			t.Errorf("Expected entry %s to be kept", key)
+		}
+	}
+	if store.Size() > 300 {
+		t.Errorf("Expected size within budget, got %d", store.Size())
+	}
+	if store.Set(&cache.Entry{Key: "huge", Body: make([]byte, 400)}) {
+		t.Error("Expected entry larger than the budget to be rejected")
+	}
+}
+
+// validatingOrigin serves a versioned resource with an ETag and answers
+// matching conditional requests with 304
+type validatingOrigin struct {
+	cacheControl string
+	failing      atomic.Bool
+	calls        atomic.Int32
+	conditional  atomic.Int32
+}
+
+func (o *validatingOrigin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	o.calls.Add(1)
+	if o.failing.Load() {
+		http.Error(w, "backend down", http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Cache-Control", o.cacheControl)
+	w.Header().Set("ETag", `"v1"`)
+	if r.Header.Get("If-None-Match") == `"v1"` {
+		o.conditional.Add(1)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	fmt.Fprint(w, "version 1")
+}
+
+func TestCacheAuthenticatedRequests(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	writeHtpasswd(t, path, shaLine("ada", "ada-pass"), shaLine("grace", "grace-pass"))
+	users, err := auth.NewHtpasswd(path)
+	if err != nil {
+		t.Fatalf("Failed to load htpasswd file: %v", err)
+	}
+	basic := auth.NewBasicAuth(users, auth.BasicAuthOptions{StripAuthorization: true}, newTestLogger(nil))
+	defer basic.Close()
+
+	origin := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/public" {
+			w.Header().Set("Cache-Control", "public, max-age=60")
+		}
+		fmt.Fprintf(w, "hello %s", r.Header.Get("X-Auth-Subject"))
+	})
+	// The cache runs inside authentication, which strips the credentials
+	h := basic.Handler(cache.New(cache.NewMemoryStore(1<<20), 300*time.Second, 1<<20, newTestLogger(nil)).Handler(origin))
+
+	get := func(path, user, password string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://example.com"+path, nil)
+		req.SetBasicAuth(user, password)
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+
+	get("/account", "ada", "ada-pass")
+	if rr := get("/account", "grace", "grace-pass"); rr.Body.String() != "hello grace" {
+		t.Errorf("Expected a per-user response not to be shared, got %q", rr.Body.String())
+	}
+
+	get("/public", "ada", "ada-pass")
+	if rr := get("/public", "grace", "grace-pass"); rr.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("Expected a public response to be shared, got X-Cache %q", rr.Header().Get("X-Cache"))
+	}
+}
+
+func TestCacheRevalidation(t *testing.T) {
+	origin := &validatingOrigin{cacheControl: "max-age=0"}
+	h := cache.New(cache.NewMemoryStore(1<<20), 0, 1<<20, newTestLogger(nil)).Handler(origin)
+
+	cacheGet(t, h, "/page", nil)
+	rr := cacheGet(t, h, "/page", nil)
+
+	if got := rr.Header().Get("X-Cache"); got != "REVALIDATED" {
+		t.Errorf("Expected X-Cache REVALIDATED, got %q", got)
+	}
+	if rr.Code != http.StatusOK || rr.Body.String() != "version 1" {
+		t.Errorf("Expected stored response after 304, got %d %q", rr.Code, rr.Body.String())
+	}
+	if n := origin.conditional.Load(); n != 1 {
+		t.Errorf("Expected 1 conditional request, got %d", n)
+	}
+}
+
+func TestCacheStaleWhileRevalidate(t *testing.T) {
+	origin := &validatingOrigin{cacheControl: "max-age=0, stale-while-revalidate=60"}
+	h := cache.New(cache.NewMemoryStore(1<<20), 0, 1<<20, newTestLogger(nil)).Handler(origin)
+
+	cacheGet(t, h, "/page", nil)
+	rr := cacheGet(t, h, "/page", nil)
+	if got := rr.Header().Get("X-Cache"); got != "STALE" {
+		t.Errorf("Expected X-Cache STALE, got %q", got)
+	}
+	if rr.Body.String() != "version 1" {
+		t.Errorf("Expected stale body, got %q", rr.Body.String())
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for origin.conditional.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := origin.conditional.Load(); n != 1 {
+		t.Errorf("Expected background revalidation, got %d conditional requests", n)
+	}
+}
+
+func TestCacheStaleWhileRevalidateHead(t *testing.T) {
+	var calls atomic.Int32
+	origin := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		w.Header().Set("ETag", fmt.Sprintf(`"v%d"`, n))
+		if n == 1 {
+			w.Header().Set("Cache-Control", "max-age=0, stale-while-revalidate=60")
+		} else {
+			w.Header().Set("Cache-Control", "max-age=60")
+		}
+		if r.Method != http.MethodHead {
+			fmt.Fprintf(w, "version %d", n)
+		}
+	})
+	h := cache.New(cache.NewMemoryStore(1<<20), 0, 1<<20, newTestLogger(nil)).Handler(origin)
+
+	cacheGet(t, h, "/page", nil)
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("HEAD", "http://example.com/page", nil))
+	if got := rr.Header().Get("X-Cache"); got != "STALE" {
+		t.Errorf("Expected X-Cache STALE, got %q", got)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for calls.Load() < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// The refresh is stored after the origin answers
+	for time.Now().Before(deadline) {
+		rr = cacheGet(t, h, "/page", nil)
+		if rr.Header().Get("X-Cache") == "HIT" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if rr.Header().Get("X-Cache") != "HIT" || rr.Body.String() != "version 2" {
+		t.Errorf("Expected the refreshed body, got %s %q", rr.Header().Get("X-Cache"), rr.Body.String())
+	}
+}
+
+func TestCacheStaleIfError(t *testing.T) {
+	tests := []struct {
+		name         string
+		cacheControl string
+		stale        bool
+	}{
+		{"stale-if-error", "max-age=0, stale-if-error=60", true},
+		{"must-revalidate", "max-age=0, stale-if-error=60, must-revalidate", false},
+		{"no stale-if-error", "max-age=0", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			origin := &validatingOrigin{cacheControl: tt.cacheControl}
+			h := cache.New(cache.NewMemoryStore(1<<20), 0, 1<<20, newTestLogger(nil)).Handler(origin)
+
+			cacheGet(t, h, "/page", nil)
+			origin.failing.Store(true)
+			rr := cacheGet(t, h, "/page", nil)
+
+			if tt.stale {
+				if rr.Code != http.StatusOK || rr.Header().Get("X-Cache") != "STALE" || rr.Body.String() != "version 1" {
+					t.Errorf("Expected stale response, got %d %s %q", rr.Code, rr.Header().Get("X-Cache"), rr.Body.String())
+				}
+			} else if rr.Code != http.StatusBadGateway {
+				t.Errorf("Expected upstream error to be passed through, got %d", rr.Code)
+			}
+		})
+	}
+}
+
+func TestCacheStaleIfErrorWithoutHealthyBackends(t *testing.T) {
+	origin := &validatingOrigin{cacheControl: "max-age=0, stale-if-error=60"}
+	backend := httptest.NewServer(origin)
+	defer backend.Close()
+
+	cfg := &config.Config{}
+	cfg.LoadBalancing.Enabled = true
+	cfg.LoadBalancing.Algorithm = "round_robin"
+	cfg.LoadBalancing.Backends = []string{backend.URL}
+	lb, err := cfg.CreateLoadBalancer()
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	p, err := proxy.NewProxy("", lb, newTestLogger(nil))
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	h := cache.New(cache.NewMemoryStore(1<<20), 0, 1<<20, newTestLogger(nil)).Handler(p)
+
+	cacheGet(t, h, "/page", nil)
+	for _, b := range lb.Backends() {
+		lb.HealthCheck(b, false)
+	}
+	rr := cacheGet(t, h, "/page", nil)
+	if rr.Code != http.StatusOK || rr.Body.String() != "version 1" {
+		t.Errorf("Expected stale response with no healthy backends, got %d %q", rr.Code, rr.Body.String())
+	}
+}
+
+// blockingOrigin holds every request until released
+type blockingOrigin struct {
+	cacheControl string
+	release      chan struct{}
+	calls        atomic.Int32
+}
+
+func (o *blockingOrigin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n := o.calls.Add(1)
+	<-o.release
+	w.Header().Set("Cache-Control", o.cacheControl)
+	fmt.Fprintf(w, "response #%d", n)
+}
+
+func TestCacheCoalescing(t *testing.T) {
+	tests := []struct {
+		name          string
+		cacheControl  string
+		timeout       time.Duration
+		holdFor       time.Duration
+		expectedCalls int32
+	}{
+		{"shared response", "max-age=60", time.Second, 50 * time.Millisecond, 1},
+		{"private response fetched independently", "private", time.Second, 50 * time.Millisecond, 5},
+		{"wait timeout falls back to independent fetch", "max-age=60", 10 * time.Millisecond, 200 * time.Millisecond, 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			origin := &blockingOrigin{cacheControl: tt.cacheControl, release: make(chan struct{})}
+			h := cache.New(cache.NewMemoryStore(1<<20), 0, 1<<20, newTestLogger(nil), cache.WithCoalescing(tt.timeout)).Handler(origin)
+
+			var wg sync.WaitGroup
+			bodies := make([]string, 5)
+			for i := range bodies {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					bodies[i] = cacheGet(t, h, "/hot", nil).Body.String()
+				}()
+			}
+			time.Sleep(tt.holdFor)
+			close(origin.release)
+			wg.Wait()
+
+			if n := origin.calls.Load(); n != tt.expectedCalls {
+				t.Errorf("Expected %d origin requests, got %d", tt.expectedCalls, n)
+			}
+			if tt.expectedCalls == 1 {
+				for _, body := range bodies {
+					if body != "response #1" {
+						t.Errorf("Expected shared response, got %q", body)
+					}
+				}
+			}
+		})
+	}
+}
+
+func readEntryBody(t *testing.T, e *cache.Entry) string {
+	t.Helper()
+	body, err := e.Open()
+	if err != nil {
+		t.Fatalf("Failed to open entry body: %v", err)
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatalf("Failed to read entry body: %v", err)
+	}
+	return string(data)
+}
+
+func TestDiskStorePersistence(t *testing.T) {
+	dir := t.TempDir()
+	store, err := cache.NewDiskStore(dir, 1<<20)
+	if err != nil {
+		t.Fatalf("Failed to create disk store: %v", err)
+	}
+	store.Set(&cache.Entry{Key: "a", PrimaryKey: "a", StatusCode: 200, Body: []byte("shared body")})
+	store.Set(&cache.Entry{Key: "b", PrimaryKey: "b", StatusCode: 200, Body: []byte("shared body")})
+	if store.Size() != int64(len("shared body")) {
+		t.Errorf("Expected identical bodies to be stored once, got size %d", store.Size())
+	}
+
+	// The index is written on a timer rather than on every change, and on Close
+	if data, _ := os.ReadFile(filepath.Join(dir, "index.json")); string(data) != "[]" {
+		t.Errorf("Expected the index not to be rewritten on every change, got %s", data)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("Failed to close disk store: %v", err)
+	}
+
+	// Files no entry refers to are removed on startup
+	orphan := filepath.Join(dir, "objects", "ff", strings.Repeat("f", 64))
+	os.MkdirAll(filepath.Dir(orphan), 0o755)
+	os.WriteFile(orphan, []byte("orphan"), 0o644)
+
+	reopened, err := cache.NewDiskStore(dir, 1<<20)
+	if err != nil {
+		t.Fatalf("Failed to reopen disk store: %v", err)
+	}
+	defer reopened.Close()
+	for _, key := range []string{"a", "b"} {
+		e, ok := reopened.Get(key)
+		if !ok {
+			t.Fatalf("Expected entry %s to survive a restart", key)
+		}
+		if body := readEntryBody(t, e); body != "shared body" {
+			t.Errorf("Unexpected body for %s: %q", key, body)
+		}
+	}
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Error("Expected orphaned body to be removed")
+	}
+
+	// Removing the last reference removes the body
+	reopened.Delete("a")
+	reopened.Delete("b")
+	if reopened.Size() != 0 {
+		t.Errorf("Expected empty store, got size %d", reopened.Size())
+	}
+}
+
+func TestDiskStoreEviction(t *testing.T) {
+	store, err := cache.NewDiskStore(t.TempDir(), 250)
+	if err != nil {
+		t.Fatalf("Failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	for _, key := range []string{"a", "b", "c"} {
+		store.Set(&cache.Entry{Key: key, PrimaryKey: key, Body: []byte(strings.Repeat(key, 100))})
+	}
+	if _, ok := store.Get("a"); ok {
+		t.Error("Expected least recently used entry to be evicted")
+	}
+	if store.Size() > 250 {
+		t.Errorf("Expected size within budget, got %d", store.Size())
+	}
+	if store.Set(&cache.Entry{Key: "huge", Body: make([]byte, 300)}) {
+		t.Error("Expected entry larger than the budget to be rejected")
+	}
+}
+
+func TestTieredCacheSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	asset := strings.Repeat("0123456789", 100)
+	var calls atomic.Int32
+	origin := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.Header().Set("Vary", "Accept-Language")
+		w.Header().Set("Content-Type", "application/octet-stream")
+		fmt.Fprint(w, asset)
+	})
+
+	newCache := func() *cache.Cache {
+		disk, err := cache.NewDiskStore(dir, 1<<20)
+		if err != nil {
+			t.Fatalf("Failed to create disk store: %v", err)
+		}
+		// The asset does not fit in the memory tier
+		store := cache.NewTieredStore(cache.NewMemoryStore(512), disk)
+		return cache.New(store, 0, 1<<20, newTestLogger(nil))
+	}
+
+	english := http.Header{"Accept-Language": {"en"}}
+	first := newCache()
+	cacheGet(t, first.Handler(origin), "/asset.bin", english)
+	first.Close()
+
+	second := newCache()
+	defer second.Close()
+	h := second.Handler(origin)
+	rr := cacheGet(t, h, "/asset.bin", english)
+	if rr.Header().Get("X-Cache") != "HIT" || rr.Body.String() != asset {
+		t.Errorf("Expected asset served from disk after restart, got X-Cache %q", rr.Header().Get("X-Cache"))
+	}
+
+	// Ranges are served from the cached full object
+	rr = cacheGet(t, h, "/asset.bin", http.Header{"Accept-Language": {"en"}, "Range": {"bytes=10-19"}})
+	if rr.Code != http.StatusPartialContent || rr.Body.String() != "0123456789" {
+		t.Errorf("Expected 206 with the requested range, got %d %q", rr.Code, rr.Body.String())
+	}
+	if got := rr.Header().Get("Content-Range"); got != "bytes 10-19/1000" {
+		t.Errorf("Unexpected Content-Range: %s", got)
+	}
+
+	// Other variants are still fetched separately
+	cacheGet(t, h, "/asset.bin", http.Header{"Accept-Language": {"de"}})
+	if n := calls.Load(); n != 2 {
+		t.Errorf("Expected 2 origin requests, got %d", n)
+	}
+}
@@ -0,0 +1,135 @@
+package unit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"testing"
+
+	"github.com/shammianand/goproxy/internal/clientip"
+)
+
+func TestClientIPResolve(t *testing.T) {
+	resolver, err := clientip.NewResolver([]string{"10.0.0.0/8", "2001:db8::/32"}, "")
+	if err != nil {
+		t.Fatalf("Failed to create resolver: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		xff        []string
+		expected   string
+	}{
+		{"untrusted peer ignores headers", "203.0.113.9:4000", []string{"198.51.100.1"}, "203.0.113.9"},
+		{"trusted peer", "10.0.0.2:4000", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"spoofed hop before the client", "10.0.0.2:4000", []string{"1.1.1.1, 198.51.100.1"}, "198.51.100.1"},
+		{"chain of trusted proxies", "10.0.0.2:4000", []string{"198.51.100.1, 10.0.0.7", "10.0.0.5"}, "198.51.100.1"},
+		{"all hops trusted", "10.0.0.2:4000", []string{"10.0.0.9"}, "10.0.0.9"},
+		{"invalid hop stops the chain", "10.0.0.2:4000", []string{"198.51.100.1, garbage, 10.0.0.7"}, "10.0.0.7"},
+		{"no header", "10.0.0.2:4000", nil, "10.0.0.2"},
+		{"hop with port", "10.0.0.2:4000", []string{"198.51.100.1:5555"}, "198.51.100.1"},
+		{"IPv6", "[2001:db8::1]:4000", []string{"2001:db8:ffff::1, [2a00:1450::5]"}, "2a00:1450::5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for _, value := range tt.xff {
+				req.Header.Add("X-Forwarded-For", value)
+			}
+			if ip, _ := resolver.Resolve(req); ip.String() != tt.expected {
+				t.Errorf("Expected client IP %s, got %s", tt.expected, ip)
+			}
+		})
+	}
+}
+
+func TestClientIPForwarded(t *testing.T) {
+	resolver, err := clientip.NewResolver([]string{"10.0.0.0/8"}, "Forwarded")
+	if err != nil {
+		t.Fatalf("Failed to create resolver: %v", err)
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.2:4000"
+	req.Header.Set("X-Forwarded-For", "1.1.1.1")
+	req.Header.Set("Forwarded", `for=192.0.2.60;proto=https;by="a,b", for="[2001:db8:cafe::17]:4711", for=10.0.0.3`)
+	if ip, _ := resolver.Resolve(req); ip.String() != "2001:db8:cafe::17" {
+		t.Errorf("Expected the Forwarded client, got %s", ip)
+	}
+
+	req.Header.Set("Forwarded", "for=192.0.2.60, for=_hidden")
+	if ip, _ := resolver.Resolve(req); ip.String() != "10.0.0.2" {
+		t.Errorf("Expected an obfuscated hop to stop the chain, got %s", ip)
+	}
+
+	if _, err := clientip.NewResolver(nil, "X-Real-IP"); err == nil {
+		t.Error("Expected error for an unsupported header")
+	}
+	if _, err := clientip.NewResolver([]string{"10.0.0.0/33"}, ""); err == nil {
+		t.Error("Expected error for an invalid CIDR")
+	}
+}
+
+func TestClientIPHandler(t *testing.T) {
+	resolver, _ := clientip.NewResolver([]string{"127.0.0.1"}, "")
+	var upstream http.Header
+	var resolved string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream = r.Header.Clone()
+	}))
+	defer backend.Close()
+	reverseProxy := httputil.NewSingleHostReverseProxy(mustParseURL(backend.URL))
+	h := resolver.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resolved = clientip.FromRequest(r)
+		reverseProxy.ServeHTTP(w, r)
+	}))
+
+	// Headers from a trusted proxy are kept, without hops before the client
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "127.0.0.1:4000"
+	req.Header.Set("X-Forwarded-For", "1.1.1.1, 198.51.100.1")
+	req.Header.Set("X-Forwarded-Proto", "https")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if resolved != "198.51.100.1" {
+		t.Errorf("Expected client IP 198.51.100.1, got %s", resolved)
+	}
+	expected := map[string]string{
+		"X-Forwarded-For":   "198.51.100.1, 127.0.0.1",
+		"X-Real-Ip":         "198.51.100.1",
+		"X-Forwarded-Proto": "https",
+	}
+	for name, value := range expected {
+		if got := upstream.Get(name); got != value {
+			t.Errorf("Expected upstream %s %q, got %q", name, value, got)
+		}
+	}
+
+	// Headers from anyone else are replaced
+	req = httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "203.0.113.9:4000"
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("X-Real-IP", "198.51.100.1")
+	req.Header.Set("Forwarded", "for=198.51.100.1")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	expected = map[string]string{
+		"X-Forwarded-For":   "203.0.113.9",
+		"X-Real-Ip":         "203.0.113.9",
+		"X-Forwarded-Proto": "http",
+		"Forwarded":         "",
+	}
+	for name, value := range expected {
+		if got := upstream.Get(name); got != value {
+			t.Errorf("Expected upstream %s %q, got %q", name, value, got)
+		}
+	}
+}
+
+func TestClientIPFromRequest(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	if ip := clientip.FromRequest(req); ip != "192.0.2.1" {
+		t.Errorf("Expected the peer address without a resolver, got %s", ip)
+	}
+}
@@ -0,0 +1,370 @@
+package unit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shammianand/goproxy/internal/concurrency"
+	"github.com/shammianand/goproxy/internal/config"
+)
+
+func TestConcurrencyLimiterQueue(t *testing.T) {
+	limiter, err := concurrency.New(concurrency.Options{
+		InitialLimit: 2,
+		MinLimit:     2,
+		MaxLimit:     2,
+		MaxQueue:     1,
+		QueueTimeout: 2 * time.Second,
+	}, newTestLogger(nil))
+	if err != nil {
+		t.Fatalf("Failed to create limiter: %v", err)
+	}
+
+	unblock := make(chan struct{})
+	started := make(chan struct{}, 3)
+	h := limiter.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-unblock
+	}))
+
+	var wg sync.WaitGroup
+	codes := make(chan int, 3)
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+			codes <- rr.Code
+		}()
+	}
+	<-started
+	<-started
+	deadline := time.Now().Add(2 * time.Second)
+	for limiter.Stats().Queued != 1 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// The queue is full
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	if rr.Code != http.StatusServiceUnavailable || rr.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected 503 with Retry-After over the queue, got %d", rr.Code)
+	}
+	if stats := limiter.Stats(); stats.InFlight != 2 || stats.Rejected != 1 {
+		t.Errorf("Expected 2 in flight and 1 rejected, got %+v", stats)
+	}
+
+	// The queued request runs once a slot frees up
+	close(unblock)
+	wg.Wait()
+	close(codes)
+	for code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("Expected 200 for admitted requests, got %d", code)
+		}
+	}
+	if stats := limiter.Stats(); stats.InFlight != 0 || stats.Queued != 0 {
+		t.Errorf("Expected an idle limiter, got %+v", stats)
+	}
+}
+
+func TestConcurrencyLimiterQueueTimeout(t *testing.T) {
+	limiter, err := concurrency.New(concurrency.Options{
+		InitialLimit: 1,
+		MinLimit:     1,
+		MaxLimit:     1,
+		MaxQueue:     10,
+		QueueTimeout: 50 * time.Millisecond,
+	}, newTestLogger(nil))
+	if err != nil {
+		t.Fatalf("Failed to create limiter: %v", err)
+	}
+
+	release, err := limiter.Acquire(context.Background(), 0)
+	if err != nil {
+		t.Fatalf("Expected a free slot, got %v", err)
+	}
+	start := time.Now()
+	if _, err := limiter.Acquire(context.Background(), 0); err != concurrency.ErrLimitExceeded {
+		t.Errorf("Expected ErrLimitExceeded after the queue timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Expected to wait for the queue timeout, waited %v", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := limiter.Acquire(ctx, 0); err != context.Canceled {
+		t.Errorf("Expected the cancellation error, got %v", err)
+	}
+	if stats := limiter.Stats(); stats.Queued != 0 || stats.Rejected != 1 {
+		t.Errorf("Expected an empty queue and 1 rejection, got %+v", stats)
+	}
+	release(false)
+}
+
+func TestConcurrencyLimiterAIMD(t *testing.T) {
+	limiter, err := concurrency.New(concurrency.Options{
+		Algorithm:        "aimd",
+		LatencyThreshold: 20 * time.Millisecond,
+		InitialLimit:     10,
+		MinLimit:         1,
+		MaxLimit:         100,
+	}, newTestLogger(nil))
+	if err != nil {
+		t.Fatalf("Failed to create limiter: %v", err)
+	}
+
+	// Upstream errors shrink the limit
+	h := limiter.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	for i := 0; i < 5; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+	if limit := limiter.Stats().Limit; limit >= 10 {
+		t.Errorf("Expected the limit to shrink after errors, got %d", limit)
+	}
+
+	// Slow responses shrink it to the minimum
+	slow := limiter.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(25 * time.Millisecond)
+	}))
+	for i := 0; i < 20; i++ {
+		slow.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+	if limit := limiter.Stats().Limit; limit != 1 {
+		t.Errorf("Expected the minimum limit after slow responses, got %d", limit)
+	}
+
+	// Fast responses at full load grow it again
+	for i := 0; i < 10; i++ {
+		release, err := limiter.Acquire(context.Background(), 0)
+		if err != nil {
+			t.Fatalf("Expected a free slot, got %v", err)
+		}
+		release(false)
+	}
+	if limit := limiter.Stats().Limit; limit < 2 {
+		t.Errorf("Expected the limit to grow, got %d", limit)
+	}
+}
+
+func TestConcurrencyLimiterGradient(t *testing.T) {
+	limiter, err := concurrency.New(concurrency.Options{
+		InitialLimit: 4,
+		MinLimit:     2,
+		MaxLimit:     1000,
+	}, newTestLogger(nil))
+	if err != nil {
+		t.Fatalf("Failed to create limiter: %v", err)
+	}
+
+	// Steady latency at full load grows the limit
+	run := func(latency time.Duration, rounds int) {
+		for i := 0; i < rounds; i++ {
+			n := limiter.Stats().Limit
+			var releases []func(bool)
+			for j := 0; j < n; j++ {
+				release, err := limiter.Acquire(context.Background(), 0)
+				if err != nil {
+					t.Fatalf("Expected a free slot, got %v", err)
+				}
+				releases = append(releases, release)
+			}
+			time.Sleep(latency)
+			for _, release := range releases {
+				release(false)
+			}
+		}
+	}
+	run(2*time.Millisecond, 10)
+	grown := limiter.Stats().Limit
+	if grown <= 4 {
+		t.Fatalf("Expected the limit to grow under steady latency, got %d", grown)
+	}
+
+	// Latency rising well above the baseline shrinks it
+	run(30*time.Millisecond, 5)
+	if limit := limiter.Stats().Limit; limit >= grown {
+		t.Errorf("Expected the limit to shrink as latency rises, got %d (was %d)", limit, grown)
+	}
+}
+
+func TestConcurrencyLimiterAlgorithm(t *testing.T) {
+	if _, err := concurrency.New(concurrency.Options{Algorithm: "vegas"}, newTestLogger(nil)); err == nil {
+		t.Error("Expected error for unsupported algorithm")
+	}
+	if _, err := concurrency.New(concurrency.Options{Algorithm: "aimd"}, newTestLogger(nil)); err == nil {
+		t.Error("Expected error for aimd without a latency threshold")
+	}
+}
+
+func newPriorityLimiter(t *testing.T, limit, maxQueue int) *concurrency.Limiter {
+	limiter, err := concurrency.New(concurrency.Options{
+		Algorithm:    "fixed",
+		InitialLimit: limit,
+		MaxQueue:     maxQueue,
+		QueueTimeout: 2 * time.Second,
+		Classes: []config.PriorityClass{
+			{Name: "interactive"},
+			{Name: "batch", MaxShare: 0.5, Routes: []string{"/export/"}, Headers: map[string]string{"X-Request-Class": "batch"}},
+			{Name: "crawler", MaxShare: 0.25, UserAgents: []string{"bot", "spider"}},
+		},
+		DefaultClass: "interactive",
+	}, newTestLogger(nil))
+	if err != nil {
+		t.Fatalf("Failed to create limiter: %v", err)
+	}
+	return limiter
+}
+
+// acquireAsync queues a request and reports its outcome on the returned channel
+func acquireAsync(limiter *concurrency.Limiter, class int) <-chan error {
+	result := make(chan error, 1)
+	go func() {
+		release, err := limiter.Acquire(context.Background(), class)
+		if err == nil {
+			defer release(false)
+		}
+		result <- err
+	}()
+	return result
+}
+
+func waitQueued(t *testing.T, limiter *concurrency.Limiter, n int) {
+	deadline := time.Now().Add(2 * time.Second)
+	for limiter.Stats().Queued != n && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if queued := limiter.Stats().Queued; queued != n {
+		t.Fatalf("Expected %d queued requests, got %d", n, queued)
+	}
+}
+
+func TestConcurrencyLimiterClassify(t *testing.T) {
+	limiter := newPriorityLimiter(t, 4, 0)
+	tests := []struct {
+		path, userAgent, header string
+		expected                string
+	}{
+		{"/products/1", "Mozilla/5.0", "", "interactive"},
+		{"/export/orders.csv", "Mozilla/5.0", "", "batch"},
+		{"/products/1", "curl/8.0", "batch", "batch"},
+		{"/products/1", "Mozilla/5.0 (compatible; Googlebot/2.1)", "", "crawler"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.path, nil)
+		req.Header.Set("User-Agent", tt.userAgent)
+		if tt.header != "" {
+			req.Header.Set("X-Request-Class", tt.header)
+		}
+		if got := limiter.ClassName(limiter.Classify(req)); got != tt.expected {
+			t.Errorf("%s %q: expected class %s, got %s", tt.path, tt.userAgent, tt.expected, got)
+		}
+	}
+
+	if _, err := concurrency.New(concurrency.Options{
+		Classes:      []config.PriorityClass{{Name: "interactive"}},
+		DefaultClass: "missing",
+	}, newTestLogger(nil)); err == nil {
+		t.Error("Expected error for unknown default class")
+	}
+}
+
+func TestConcurrencyLimiterShare(t *testing.T) {
+	limiter := newPriorityLimiter(t, 4, 0)
+
+	// Batch traffic may hold half of the limit
+	for i := 0; i < 2; i++ {
+		if _, err := limiter.Acquire(context.Background(), 1); err != nil {
+			t.Fatalf("Expected batch request %d to run, got %v", i, err)
+		}
+	}
+	if _, err := limiter.Acquire(context.Background(), 1); err != concurrency.ErrLimitExceeded {
+		t.Errorf("Expected batch request over its share to be rejected, got %v", err)
+	}
+
+	// The rest stays available to interactive traffic
+	for i := 0; i < 2; i++ {
+		if _, err := limiter.Acquire(context.Background(), 0); err != nil {
+			t.Fatalf("Expected interactive request %d to run, got %v", i, err)
+		}
+	}
+	stats := limiter.Stats()
+	if stats.InFlight != 4 || stats.Classes[1].Rejected != 1 {
+		t.Errorf("Expected 4 in flight and 1 batch rejection, got %+v", stats)
+	}
+}
+
+func TestConcurrencyLimiterPriorityQueue(t *testing.T) {
+	limiter := newPriorityLimiter(t, 1, 2)
+	release, err := limiter.Acquire(context.Background(), 0)
+	if err != nil {
+		t.Fatalf("Expected a free slot, got %v", err)
+	}
+
+	batch := acquireAsync(limiter, 1)
+	waitQueued(t, limiter, 1)
+	interactive := acquireAsync(limiter, 0)
+	waitQueued(t, limiter, 2)
+
+	// The freed slot goes to the interactive request queued last
+	release(false)
+	select {
+	case err := <-interactive:
+		if err != nil {
+			t.Errorf("Expected interactive request to run, got %v", err)
+		}
+	case <-batch:
+		t.Fatal("Expected interactive request to run before batch")
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for the queued requests")
+	}
+	if err := <-batch; err != nil {
+		t.Errorf("Expected batch request to run after interactive, got %v", err)
+	}
+}
+
+func TestConcurrencyLimiterShedding(t *testing.T) {
+	limiter := newPriorityLimiter(t, 1, 1)
+	release, err := limiter.Acquire(context.Background(), 0)
+	if err != nil {
+		t.Fatalf("Expected a free slot, got %v", err)
+	}
+	defer release(false)
+
+	crawler := acquireAsync(limiter, 2)
+	waitQueued(t, limiter, 1)
+
+	// A full queue sheds the lower priority request
+	interactive := acquireAsync(limiter, 0)
+	select {
+	case err := <-crawler:
+		if err != concurrency.ErrLimitExceeded {
+			t.Errorf("Expected crawler request to be shed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected crawler request to be shed right away")
+	}
+	waitQueued(t, limiter, 1)
+
+	// But never a request of higher priority
+	if _, err := limiter.Acquire(context.Background(), 2); err != concurrency.ErrLimitExceeded {
+		t.Errorf("Expected crawler request to be rejected with a full queue, got %v", err)
+	}
+	stats := limiter.Stats()
+	if stats.Classes[0].Queued != 1 || stats.Classes[2].Rejected != 2 {
+		t.Errorf("Expected 1 interactive request queued and 2 crawler rejections, got %+v", stats)
+	}
+
+	release(false)
+	if err := <-interactive; err != nil {
+		t.Errorf("Expected interactive request to run, got %v", err)
+	}
+}
@@ -43,6 +43,9 @@ func TestLoadConfig(t *testing.T) {
       enabled: false
       default_ttl: 300
       max_size_mb: 100
+    concurrency_limit:
+      latency_threshold: 0.25
+      queue_timeout: 2
   `)
 	tmpfile, err := os.CreateTemp("", "config*.yaml")
 	if err != nil {
@@ -136,6 +139,14 @@ func TestLoadConfig(t *testing.T) {
 		t.Errorf("Expected Caching.MaxSizeMB to be 100, got '%d'", cfg.Caching.MaxSizeMB)
 	}
 
+	// Check concurrency limit settings, in seconds like every other duration
+	if cfg.GetConcurrencyLimitLatencyThreshold() != 250*time.Millisecond {
+		t.Errorf("Expected ConcurrencyLimit.LatencyThreshold to be 250ms, got '%s'", cfg.GetConcurrencyLimitLatencyThreshold())
+	}
+	if cfg.GetConcurrencyLimitQueueTimeout() != 2*time.Second {
+		t.Errorf("Expected ConcurrencyLimit.QueueTimeout to be 2s, got '%s'", cfg.GetConcurrencyLimitQueueTimeout())
+	}
+
 	// Test JSON log format
 	var buf bytes.Buffer
 	handler := cfg.GetLogFormat(&buf)
@@ -0,0 +1,227 @@
+package unit
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/shammianand/goproxy/internal/clientip"
+	"github.com/shammianand/goproxy/internal/config"
+	"github.com/shammianand/goproxy/internal/fastcgi"
+	"github.com/shammianand/goproxy/internal/proxy"
+)
+
+// countingListener counts accepted connections
+type countingListener struct {
+	net.Listener
+	accepted atomic.Int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.accepted.Add(1)
+	}
+	return conn, err
+}
+
+// startFastCGIApp starts a FastCGI responder that reports its CGI environment
+func startFastCGIApp(t *testing.T, network, address string) *countingListener {
+	inner, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	ln := &countingListener{Listener: inner}
+	t.Cleanup(func() { ln.Close() })
+
+	go fcgi.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env := fcgi.ProcessEnv(r)
+		if r.URL.Path == "/redirect.php" {
+			http.Redirect(w, r, "/elsewhere", http.StatusMovedPermanently)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Script-Filename", env["SCRIPT_FILENAME"])
+		w.Header().Set("X-Path-Translated", env["PATH_TRANSLATED"])
+		w.Header().Set("X-App-Env", env["APP_ENV"])
+		// REMOTE_ADDR comes with a zero port, as REMOTE_PORT is not passed
+		remoteIP, _, _ := net.SplitHostPort(r.RemoteAddr)
+		w.Header().Set("X-Remote-Addr", remoteIP)
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "%s %s body=%s", r.Method, r.Host, body)
+	}))
+	return ln
+}
+
+func TestFastCGIBackend(t *testing.T) {
+	app := startFastCGIApp(t, "tcp", "127.0.0.1:0")
+
+	cfg := &config.Config{}
+	cfg.LoadBalancing.Enabled = true
+	cfg.LoadBalancing.Algorithm = "round_robin"
+	cfg.LoadBalancing.Backends = []string{"fastcgi://" + app.Addr().String()}
+	lb, err := cfg.CreateLoadBalancer()
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+
+	opts := fastcgi.Options{
+		DocumentRoot:  "/var/www/html",
+		SplitPathInfo: regexp.MustCompile(`^(.+\.php)(/.*)$`),
+		Env:           map[string]string{"APP_ENV": "testing"},
+		MaxIdleConns:  4,
+	}
+	handler, err := proxy.NewProxy("", lb, newTestLogger(nil), proxy.WithFastCGI(opts))
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest("POST", server.URL+"/app/index.php/users/42?x=1", strings.NewReader("payload"))
+		req.Host = "php.example.com"
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Expected status 201, got %v", resp.Status)
+		}
+		if string(body) != "POST php.example.com body=payload" {
+			t.Errorf("Unexpected response body: %s", body)
+		}
+		if got := resp.Header.Get("X-Script-Filename"); got != "/var/www/html/app/index.php" {
+			t.Errorf("Expected SCRIPT_FILENAME /var/www/html/app/index.php, got %s", got)
+		}
+		if got := resp.Header.Get("X-Path-Translated"); got != "/var/www/html/users/42" {
+			t.Errorf("Expected PATH_TRANSLATED /var/www/html/users/42, got %s", got)
+		}
+		if got := resp.Header.Get("X-App-Env"); got != "testing" {
+			t.Errorf("Expected APP_ENV testing, got %s", got)
+		}
+	}
+
+	if n := app.accepted.Load(); n != 1 {
+		t.Errorf("Expected connection to be reused, got %d connections", n)
+	}
+
+	// Redirects keep their status and Location header
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(server.URL + "/redirect.php")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMovedPermanently || resp.Header.Get("Location") != "/elsewhere" {
+		t.Errorf("Unexpected redirect response: %v %s", resp.Status, resp.Header.Get("Location"))
+	}
+	// REMOTE_ADDR is the resolved client IP, not a hop the client can forge
+	for _, c := range []struct {
+		name     string
+		clientIP net.IP
+		expected string
+	}{
+		{"peer", nil, "192.0.2.1"},
+		{"resolved", net.ParseIP("198.51.100.4"), "198.51.100.4"},
+	} {
+		req := httptest.NewRequest("GET", "/index.php", nil)
+		req.Header.Set("X-Forwarded-For", "203.0.113.9")
+		if c.clientIP != nil {
+			req = req.WithContext(clientip.NewContext(req.Context(), c.clientIP))
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if got := rec.Header().Get("X-Remote-Addr"); got != c.expected {
+			t.Errorf("%s: expected REMOTE_ADDR %s, got %s", c.name, c.expected, got)
+		}
+	}
+}
+
+func TestFastCGIUnixSocketBackend(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "php-fpm.sock")
+	startFastCGIApp(t, "unix", path)
+
+	opts := fastcgi.Options{
+		DocumentRoot:   "/srv/app",
+		ScriptFilename: "/srv/app/public/index.php",
+	}
+	handler, err := proxy.NewProxy("fcgi+unix://"+path, nil, newTestLogger(nil), proxy.WithFastCGI(opts))
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "http://example.com/any/route", nil))
+
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d", rr.Code)
+	}
+	if got := rr.Header().Get("X-Script-Filename"); got != "/srv/app/public/index.php" {
+		t.Errorf("Expected front controller script, got %s", got)
+	}
+	if rr.Body.String() != "GET example.com body=" {
+		t.Errorf("Unexpected response body: %s", rr.Body.String())
+	}
+}
+
+func TestFastCGISplitPathInfoConfig(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.FastCGI.SplitPathInfo = `^(.+\.php)$`
+	if _, err := cfg.GetFastCGISplitPathInfo(); err == nil {
+		t.Error("Expected error for pattern with a single capture group")
+	}
+
+	cfg.FastCGI.SplitPathInfo = `^(.+\.php)(/.*)$`
+	re, err := cfg.GetFastCGISplitPathInfo()
+	if err != nil || re == nil {
+		t.Errorf("Expected valid pattern, got %v", err)
+	}
+}
+
+func TestFastCGIPathTraversal(t *testing.T) {
+	app := startFastCGIApp(t, "tcp", "127.0.0.1:0")
+	transport := fastcgi.NewTransport("tcp", app.Addr().String(), fastcgi.Options{
+		DocumentRoot:  "/var/www/html",
+		SplitPathInfo: regexp.MustCompile(`^(.+\.php)(/.*)$`),
+	}, newTestLogger(nil))
+	defer transport.CloseIdleConnections()
+
+	tests := []struct {
+		path           string
+		scriptFilename string
+		pathTranslated string
+	}{
+		{"/../../../usr/share/php/pearcmd.php", "/var/www/html/usr/share/php/pearcmd.php", ""},
+		{"/app/../../index.php", "/var/www/html/index.php", ""},
+		{"/index.php/../../../etc/passwd", "/var/www/html/etc/passwd", ""},
+		{"/index.php/a/../../../../etc/passwd", "/var/www/html/etc/passwd", ""},
+		{"/app/index.php/users/./42", "/var/www/html/app/index.php", "/var/www/html/users/42"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "http://php.example.com/", nil)
+		req.URL.Path = tt.path
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("Request for %s failed: %v", tt.path, err)
+		}
+		resp.Body.Close()
+		if got := resp.Header.Get("X-Script-Filename"); got != tt.scriptFilename {
+			t.Errorf("Expected SCRIPT_FILENAME %s for %s, got %s", tt.scriptFilename, tt.path, got)
+		}
+		if got := resp.Header.Get("X-Path-Translated"); got != tt.pathTranslated {
+			t.Errorf("Expected PATH_TRANSLATED %q for %s, got %q", tt.pathTranslated, tt.path, got)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package unit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shammianand/goproxy/internal/config"
+	"github.com/shammianand/goproxy/internal/forward"
+	"github.com/shammianand/goproxy/pkg/logger"
+)
+
+// syncBuffer is a bytes.Buffer that is safe to share with background loggers
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func newTestLogger(w io.Writer) *logger.Logger {
+	cfg := &config.Config{}
+	cfg.Logging.Level = "debug"
+	cfg.Logging.Format = "json"
+
+	log := logger.New(cfg)
+	if w == nil {
+		w = io.Discard
+	}
+	log.Logger = slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	return log
+}
+
+func TestForwardACL(t *testing.T) {
+	acl, err := forward.NewACL(
+		[]config.ACLRule{
+			{Host: "*.example.com", Ports: []int{443}},
+			{Host: "api.partner.io"},
+			{Host: "192.168.0.0/16", Ports: []int{80}},
+		},
+		[]config.ACLRule{
+			{Host: "admin.example.com"},
+		},
+	)
+	if err != nil {
+		t.Fatalf("Failed to create ACL: %v", err)
+	}
+
+	testCases := []struct {
+		host    string
+		port    int
+		allowed bool
+	}{
+		{"www.example.com", 443, true},
+		{"WWW.Example.com.", 443, true},
+		{"www.example.com", 80, false},
+		{"example.com", 443, false},
+		{"admin.example.com", 443, false},
+		{"api.partner.io", 8443, true},
+		{"192.168.1.20", 80, true},
+		{"192.168.1.20", 22, false},
+		{"evil.com", 443, false},
+	}
+	for _, tc := range testCases {
+		if got := acl.Allowed(tc.host, tc.port); got != tc.allowed {
+			t.Errorf("Allowed(%s, %d) = %v, expected %v", tc.host, tc.port, got, tc.allowed)
+		}
+	}
+
+	// An empty allow list permits anything that is not denied
+	acl, err = forward.NewACL(nil, []config.ACLRule{{Host: "*", Ports: []int{25}}})
+	if err != nil {
+		t.Fatalf("Failed to create ACL: %v", err)
+	}
+	if !acl.Allowed("mail.example.com", 587) || acl.Allowed("mail.example.com", 25) {
+		t.Error("Expected only port 25 to be denied")
+	}
+}
+
+func TestForwardACLResolvedAddress(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Denied destination was reached")
+	}))
+	defer backend.Close()
+	port := mustParseURL(backend.URL).Port()
+
+	// localhost passes the name check but resolves into a denied range
+	acl, err := forward.NewACL(nil, []config.ACLRule{{Host: "127.0.0.0/8"}, {Host: "::1/128"}, {Host: "169.254.169.254"}})
+	if err != nil {
+		t.Fatalf("Failed to create ACL: %v", err)
+	}
+	if !acl.Allowed("localhost", 80) {
+		t.Fatal("Expected the name check to pass")
+	}
+	if acl.AllowedAddr(net.ParseIP("169.254.169.254"), 80) || !acl.AllowedAddr(net.ParseIP("93.184.215.14"), 80) {
+		t.Error("Expected resolved addresses to be checked against the deny rules")
+	}
+
+	fp := forward.NewProxy(acl, nil, time.Second, newTestLogger(nil))
+	proxyServer := httptest.NewServer(fp)
+	defer proxyServer.Close()
+
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(mustParseURL(proxyServer.URL))}}
+	resp, err := client.Get("http://localhost:" + port)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected 403 for a name resolving to a denied address, got %v", resp.Status)
+	}
+
+	conn, err := net.Dial("tcp", mustParseURL(proxyServer.URL).Host)
+	if err != nil {
+		t.Fatalf("Failed to dial proxy: %v", err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "CONNECT localhost:%s HTTP/1.1\r\nHost: localhost:%s\r\n\r\n", port, port)
+	resp, err = http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("Failed to read CONNECT response: %v", err)
+	}
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected 403 for CONNECT to a name resolving to a denied address, got %v", resp.Status)
+	}
+}
+
+func TestForwardProxyAbsoluteForm(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Authorization") != "" {
+			t.Error("Proxy-Authorization leaked to destination")
+		}
+		w.Write([]byte("Hello from destination"))
+	}))
+	defer backend.Close()
+
+	acl, _ := forward.NewACL([]config.ACLRule{{Host: "127.0.0.1"}}, nil)
+	var logBuf syncBuffer
+	fp := forward.NewProxy(acl, forward.Credentials{"alice": "s3cret"}, time.Second, newTestLogger(&logBuf))
+	proxyServer := httptest.NewServer(fp)
+	defer proxyServer.Close()
+
+	proxyURL := mustParseURL(proxyServer.URL)
+
+	// Without credentials the proxy asks for authentication
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := client.Get(backend.URL)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusProxyAuthRequired {
+		t.Errorf("Expected 407, got %v", resp.Status)
+	}
+
+	authedURL := *proxyURL
+	authedURL.User = url.UserPassword("alice", "s3cret")
+	client = &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(&authedURL)}}
+	resp, err = client.Get(backend.URL)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "Hello from destination" {
+		t.Errorf("Unexpected response: %v %s", resp.Status, body)
+	}
+
+	// Destinations outside the allow list are rejected
+	resp, err = client.Get("http://localhost:" + mustParseURL(backend.URL).Port())
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected 403 for denied destination, got %v", resp.Status)
+	}
+
+	if !strings.Contains(logBuf.String(), "Forward request") {
+		t.Error("Log output doesn't contain 'Forward request'")
+	}
+}
+
+func TestForwardProxyConnect(t *testing.T) {
+	echo := startTCPEcho(t)
+	acl, _ := forward.NewACL([]config.ACLRule{{Host: "127.0.0.1", Ports: []int{echo.Port}}}, nil)
+
+	var logBuf syncBuffer
+	fp := forward.NewProxy(acl, forward.Credentials{"alice": "s3cret"}, time.Second, newTestLogger(&logBuf))
+	proxyServer := httptest.NewServer(fp)
+	defer proxyServer.Close()
+
+	conn, err := net.Dial("tcp", mustParseURL(proxyServer.URL).Host)
+	if err != nil {
+		t.Fatalf("Failed to dial proxy: %v", err)
+	}
+	defer conn.Close()
+
+	auth := base64.StdEncoding.EncodeToString([]byte("alice:s3cret"))
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\nProxy-Authorization: Basic %s\r\n\r\n",
+		echo, echo, auth)
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("Failed to read CONNECT response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200 for CONNECT, got %v", resp.Status)
+	}
+
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		t.Fatalf("Failed to read through tunnel: %v", err)
+	}
+	if string(buf) != "ping" {
+		t.Errorf("Expected echo of 'ping', got %q", buf)
+	}
+	conn.(*net.TCPConn).CloseWrite()
+	io.Copy(io.Discard, reader)
+
+	// The tunnel is logged once both directions are closed
+	deadline := time.Now().Add(time.Second)
+	for !strings.Contains(logBuf.String(), "Tunnel closed") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !strings.Contains(logBuf.String(), `"bytes_sent":4`) {
+		t.Errorf("Expected tunnel log with bytes_sent, got %s", logBuf.String())
+	}
+}
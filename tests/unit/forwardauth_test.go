@@ -0,0 +1,231 @@
+package unit
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/shammianand/goproxy/internal/auth"
+)
+
+// authService allows requests carrying the session cookie "valid"
+type authService struct {
+	*httptest.Server
+	calls  atomic.Int32
+	status atomic.Int32
+	last   atomic.Pointer[http.Request]
+}
+
+func startAuthService(t *testing.T) *authService {
+	s := &authService{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.calls.Add(1)
+		s.last.Store(r)
+		if status := s.status.Load(); status != 0 {
+			w.WriteHeader(int(status))
+			return
+		}
+		if c, err := r.Cookie("session"); err != nil || c.Value != "valid" {
+			w.Header().Set("WWW-Authenticate", `Cookie realm="sso"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			io.WriteString(w, "login required")
+			return
+		}
+		if r.Header.Get("X-Forwarded-Uri") == "/admin" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Header().Set("X-User", "ada")
+		w.Header().Set("X-Ignored", "yes")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func newForwardAuth(t *testing.T, opts auth.ForwardAuthOptions) http.Handler {
+	opts.RequestHeaders = []string{"Cookie"}
+	opts.ResponseHeaders = []string{"X-User"}
+	a, err := auth.NewForwardAuth(opts, newTestLogger(nil))
+	if err != nil {
+		t.Fatalf("Failed to create forward auth: %v", err)
+	}
+	return a.Handler(echoIdentity())
+}
+
+func forwardAuthRequest(h http.Handler, method, target, session string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	req.Header.Set("X-User", "spoofed")
+	if session != "" {
+		req.AddCookie(&http.Cookie{Name: "session", Value: session})
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestForwardAuth(t *testing.T) {
+	service := startAuthService(t)
+	h := newForwardAuth(t, auth.ForwardAuthOptions{URL: service.URL + "/verify"})
+
+	rec := forwardAuthRequest(h, "POST", "http://app.example.com/orders?id=7", "valid")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected the request to be allowed, got %d", rec.Code)
+	}
+	if rec.Header().Get("Upstream-X-User") != "ada" || rec.Header().Get("Upstream-X-Ignored") != "" {
+		t.Errorf("Expected only the configured headers upstream, got X-User %q, X-Ignored %q",
+			rec.Header().Get("Upstream-X-User"), rec.Header().Get("Upstream-X-Ignored"))
+	}
+	sub := service.last.Load()
+	expected := map[string]string{
+		"X-Forwarded-Method": "POST",
+		"X-Forwarded-Host":   "app.example.com",
+		"X-Forwarded-Uri":    "/orders?id=7",
+		"X-Forwarded-Proto":  "http",
+		"Cookie":             "session=valid",
+	}
+	for name, value := range expected {
+		if got := sub.Header.Get(name); got != value {
+			t.Errorf("Expected subrequest %s %q, got %q", name, value, got)
+		}
+	}
+	if sub.Method != "GET" || sub.URL.Path != "/verify" {
+		t.Errorf("Expected GET /verify, got %s %s", sub.Method, sub.URL.Path)
+	}
+
+	// Denials are returned to the client
+	rec = forwardAuthRequest(h, "GET", "http://app.example.com/orders", "")
+	if rec.Code != http.StatusUnauthorized || rec.Body.String() != "login required" ||
+		rec.Header().Get("WWW-Authenticate") != `Cookie realm="sso"` {
+		t.Errorf("Expected the 401 of the service, got %d %q", rec.Code, rec.Body.String())
+	}
+	rec = forwardAuthRequest(h, "GET", "http://app.example.com/admin", "valid")
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("Expected 403, got %d", rec.Code)
+	}
+}
+
+func TestForwardAuthRedirect(t *testing.T) {
+	service := startAuthService(t)
+	h := newForwardAuth(t, auth.ForwardAuthOptions{
+		URL:         service.URL,
+		RedirectURL: "https://sso.example.com/login?app=shop",
+	})
+
+	rec := forwardAuthRequest(h, "GET", "http://app.example.com/cart?step=2", "")
+	location, _ := url.Parse(rec.Header().Get("Location"))
+	if rec.Code != http.StatusFound || location.Host != "sso.example.com" ||
+		location.Query().Get("app") != "shop" || location.Query().Get("rd") != "http://app.example.com/cart?step=2" {
+		t.Errorf("Expected a redirect to log in, got %d %s", rec.Code, location)
+	}
+
+	// Only browsers are redirected, and only to log in
+	if rec = forwardAuthRequest(h, "POST", "http://app.example.com/cart", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for POST, got %d", rec.Code)
+	}
+	if rec = forwardAuthRequest(h, "GET", "http://app.example.com/admin", "valid"); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 to be returned, got %d", rec.Code)
+	}
+}
+
+func TestForwardAuthCache(t *testing.T) {
+	service := startAuthService(t)
+	h := newForwardAuth(t, auth.ForwardAuthOptions{URL: service.URL, CacheTTL: 200 * time.Millisecond})
+
+	for i := 0; i < 3; i++ {
+		if rec := forwardAuthRequest(h, "GET", "http://app.example.com/", "valid"); rec.Header().Get("Upstream-X-User") != "ada" {
+			t.Fatalf("Expected cached decisions to copy headers, got %q", rec.Header().Get("Upstream-X-User"))
+		}
+	}
+	forwardAuthRequest(h, "GET", "http://app.example.com/", "other")
+	forwardAuthRequest(h, "GET", "http://app.example.com/other", "valid")
+	if calls := service.calls.Load(); calls != 3 {
+		t.Errorf("Expected 3 subrequests, got %d", calls)
+	}
+
+	time.Sleep(250 * time.Millisecond)
+	forwardAuthRequest(h, "GET", "http://app.example.com/", "valid")
+	if calls := service.calls.Load(); calls != 4 {
+		t.Errorf("Expected an expired decision to be checked again, got %d subrequests", calls)
+	}
+
+	// Failures are not cached
+	service.status.Store(http.StatusBadGateway)
+	forwardAuthRequest(h, "GET", "http://app.example.com/failing", "valid")
+	service.status.Store(0)
+	if rec := forwardAuthRequest(h, "GET", "http://app.example.com/failing", "valid"); rec.Code != http.StatusOK {
+		t.Errorf("Expected the request to pass once the service recovers, got %d", rec.Code)
+	}
+}
+
+func TestForwardAuthCacheClientIP(t *testing.T) {
+	var calls atomic.Int32
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if r.Header.Get("X-Forwarded-For") != "192.0.2.1" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(service.Close)
+	h := newForwardAuth(t, auth.ForwardAuthOptions{URL: service.URL, CacheTTL: time.Minute})
+
+	// Decisions are cached per client, not shared with other addresses
+	for _, c := range []struct {
+		remoteAddr string
+		status     int
+	}{
+		{"192.0.2.1:1234", http.StatusOK},
+		{"192.0.2.1:5678", http.StatusOK},
+		{"198.51.100.7:1234", http.StatusForbidden},
+	} {
+		req := httptest.NewRequest("GET", "http://app.example.com/internal", nil)
+		req.RemoteAddr = c.remoteAddr
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != c.status {
+			t.Errorf("Expected %d for %s, got %d", c.status, c.remoteAddr, rec.Code)
+		}
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("Expected one subrequest per client, got %d", n)
+	}
+}
+
+func TestForwardAuthFailure(t *testing.T) {
+	service := startAuthService(t)
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	closed := newForwardAuth(t, auth.ForwardAuthOptions{URL: down.URL})
+	if rec := forwardAuthRequest(closed, "GET", "http://app.example.com/", "valid"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 when failing closed, got %d", rec.Code)
+	}
+
+	open := newForwardAuth(t, auth.ForwardAuthOptions{URL: down.URL, FailOpen: true})
+	rec := forwardAuthRequest(open, "GET", "http://app.example.com/", "")
+	if rec.Code != http.StatusOK || rec.Header().Get("Upstream-X-User") != "" {
+		t.Errorf("Expected the request to pass without client headers when failing open, got %d X-User %q",
+			rec.Code, rec.Header().Get("Upstream-X-User"))
+	}
+
+	service.status.Store(http.StatusInternalServerError)
+	open = newForwardAuth(t, auth.ForwardAuthOptions{URL: service.URL, FailOpen: true})
+	if rec := forwardAuthRequest(open, "GET", "http://app.example.com/", ""); rec.Code != http.StatusOK {
+		t.Errorf("Expected a 5xx to be a failure, got %d", rec.Code)
+	}
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer slow.Close()
+	closed = newForwardAuth(t, auth.ForwardAuthOptions{URL: slow.URL, Timeout: 50 * time.Millisecond})
+	if rec := forwardAuthRequest(closed, "GET", "http://app.example.com/", "valid"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 after a timeout, got %d", rec.Code)
+	}
+}
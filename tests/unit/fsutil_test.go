@@ -0,0 +1,35 @@
+package unit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/shammianand/goproxy/internal/fsutil"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+	for _, data := range []string{"first", "second"} {
+		if err := fsutil.WriteFileAtomic(path, []byte(data)); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+		if got, _ := os.ReadFile(path); string(got) != data {
+			t.Errorf("Expected %q, got %q", data, got)
+		}
+	}
+
+	// Temporary files are renamed or removed, even when the write fails
+	if err := fsutil.WriteFileAtomic(filepath.Join(dir, "missing", "state.json"), nil); err == nil {
+		t.Error("Expected error for a missing directory")
+	}
+	os.Mkdir(filepath.Join(dir, "sub"), 0o755)
+	if err := fsutil.WriteFileAtomic(filepath.Join(dir, "sub"), []byte("over a directory")); err == nil {
+		t.Error("Expected error when replacing a directory")
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 2 {
+		t.Errorf("Expected no temporary files left, got %v", entries)
+	}
+}
@@ -0,0 +1,139 @@
+package unit
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/shammianand/goproxy/internal/clientip"
+	"github.com/shammianand/goproxy/internal/config"
+	"github.com/shammianand/goproxy/internal/ipaccess"
+)
+
+func newIPFilter(t *testing.T, global config.IPAccessRule, routes []config.IPAccessRule, reload time.Duration) *ipaccess.Filter {
+	f, err := ipaccess.New(global, routes, reload, newTestLogger(nil))
+	if err != nil {
+		t.Fatalf("Failed to create IP filter: %v", err)
+	}
+	t.Cleanup(f.Close)
+	return f
+}
+
+func TestIPAccessRules(t *testing.T) {
+	f := newIPFilter(t, config.IPAccessRule{
+		Deny: []string{"192.0.2.0/24", "2001:db8:bad::/48"},
+	}, []config.IPAccessRule{
+		{PathPrefix: "/admin/", Allow: []string{"10.0.0.0/8", "2001:db8::/32"}, Deny: []string{"10.6.6.6"}},
+		{PathPrefix: "/admin/public/"},
+	}, 0)
+
+	tests := []struct {
+		ip      string
+		path    string
+		allowed bool
+	}{
+		{"203.0.113.1", "/", true},
+		{"192.0.2.7", "/", false},
+		{"2001:db8:bad::1", "/", false},
+		{"10.1.2.3", "/admin/users", true},
+		{"2001:db8::1", "/admin/users", true},
+		{"203.0.113.1", "/admin/users", false},
+		{"10.6.6.6", "/admin/users", false},
+		{"192.0.2.7", "/admin/users", false},
+		{"203.0.113.1", "/admin/public/logo.png", true},
+		{"192.0.2.7", "/admin/public/logo.png", false},
+		// Paths are matched once cleaned, as backends may clean them
+		{"203.0.113.1", "//admin/x", false},
+		{"203.0.113.1", "/./admin/x", false},
+		{"203.0.113.1", "/x/../admin/x", false},
+	}
+	for _, tt := range tests {
+		if got := f.Allowed(net.ParseIP(tt.ip), tt.path); got != tt.allowed {
+			t.Errorf("Allowed(%s, %s) = %v, expected %v", tt.ip, tt.path, got, tt.allowed)
+		}
+	}
+
+	if _, err := ipaccess.New(config.IPAccessRule{Allow: []string{"not-an-ip"}}, nil, 0, newTestLogger(nil)); err == nil {
+		t.Error("Expected error for an invalid CIDR")
+	}
+	if _, err := ipaccess.New(config.IPAccessRule{}, []config.IPAccessRule{{Allow: []string{"10.0.0.0/8"}}}, 0, newTestLogger(nil)); err == nil {
+		t.Error("Expected error for a route without a path prefix")
+	}
+}
+
+func TestIPAccessFileReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "allow.txt")
+	os.WriteFile(path, []byte("# office\n198.51.100.0/24\n\n2001:db8::1 # vpn\n"), 0644)
+	f := newIPFilter(t, config.IPAccessRule{Allow: []string{"10.0.0.1"}, AllowFile: path}, nil, 20*time.Millisecond)
+
+	for _, ip := range []string{"10.0.0.1", "198.51.100.4", "2001:db8::1"} {
+		if !f.Allowed(net.ParseIP(ip), "/") {
+			t.Errorf("Expected %s to be allowed", ip)
+		}
+	}
+	if f.Allowed(net.ParseIP("203.0.113.1"), "/") {
+		t.Error("Expected an unlisted IP to be denied")
+	}
+
+	// An invalid file keeps the current list
+	os.WriteFile(path, []byte("198.51.100.0/24\nbogus\n"), 0644)
+	time.Sleep(100 * time.Millisecond)
+	if !f.Allowed(net.ParseIP("2001:db8::1"), "/") {
+		t.Error("Expected the current list to be kept")
+	}
+
+	os.WriteFile(path, []byte("203.0.113.0/24\n"), 0644)
+	deadline := time.Now().Add(2 * time.Second)
+	for !f.Allowed(net.ParseIP("203.0.113.1"), "/") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !f.Allowed(net.ParseIP("203.0.113.1"), "/") || f.Allowed(net.ParseIP("198.51.100.4"), "/") {
+		t.Error("Expected the reloaded list to apply")
+	}
+	if !f.Allowed(net.ParseIP("10.0.0.1"), "/") {
+		t.Error("Expected inline entries to be kept")
+	}
+
+	// An empty allow file denies everyone it does not list
+	os.WriteFile(path, nil, 0644)
+	deadline = time.Now().Add(2 * time.Second)
+	for f.Allowed(net.ParseIP("203.0.113.1"), "/") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if f.Allowed(net.ParseIP("203.0.113.1"), "/") {
+		t.Error("Expected an emptied allow file to deny")
+	}
+}
+
+func TestIPAccessHandler(t *testing.T) {
+	f := newIPFilter(t, config.IPAccessRule{Allow: []string{"198.51.100.0/24"}}, nil, 0)
+	resolver, _ := clientip.NewResolver([]string{"10.0.0.0/8"}, "")
+	h := resolver.Handler(f.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+
+	tests := []struct {
+		remoteAddr string
+		xff        string
+		expected   int
+	}{
+		{"198.51.100.1:4000", "", http.StatusOK},
+		{"203.0.113.1:4000", "198.51.100.1", http.StatusForbidden},
+		{"10.0.0.2:4000", "198.51.100.1", http.StatusOK},
+		{"10.0.0.2:4000", "203.0.113.1", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tt.remoteAddr
+		if tt.xff != "" {
+			req.Header.Set("X-Forwarded-For", tt.xff)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tt.expected {
+			t.Errorf("Expected %d for %s via %s, got %d", tt.expected, tt.xff, tt.remoteAddr, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,366 @@
+package unit
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/shammianand/goproxy/internal/auth"
+	"github.com/shammianand/goproxy/internal/config"
+)
+
+var b64 = base64.RawURLEncoding
+
+// signJWT creates a compact JWS signed with key
+func signJWT(t *testing.T, alg, kid string, key any, claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	input := b64.EncodeToString(header) + "." + b64.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(input))
+
+	var sig []byte
+	var err error
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k, digest[:])
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(k, []byte(input))
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(input))
+		sig = mac.Sum(nil)
+	}
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+	return input + "." + b64.EncodeToString(sig)
+}
+
+// jwkFor returns the public JWK of a private key
+func jwkFor(kid string, key any) map[string]string {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return map[string]string{"kty": "RSA", "kid": kid, "alg": "RS256", "n": b64.EncodeToString(k.N.Bytes()), "e": b64.EncodeToString(big.NewInt(int64(k.E)).Bytes())}
+	case *ecdsa.PrivateKey:
+		return map[string]string{"kty": "EC", "kid": kid, "crv": "P-256", "x": b64.EncodeToString(k.X.FillBytes(make([]byte, 32))), "y": b64.EncodeToString(k.Y.FillBytes(make([]byte, 32)))}
+	case ed25519.PrivateKey:
+		return map[string]string{"kty": "OKP", "kid": kid, "crv": "Ed25519", "x": b64.EncodeToString(k.Public().(ed25519.PublicKey))}
+	}
+	return nil
+}
+
+// jwksServer is a local stand-in for an identity provider's JWKS endpoint
+type jwksServer struct {
+	*httptest.Server
+	mutex   sync.Mutex
+	keys    []map[string]string
+	fetches atomic.Int32
+	// stall, when set, holds fetches until it is closed
+	stall chan struct{}
+}
+
+func startJWKSServer(t *testing.T, keys ...map[string]string) *jwksServer {
+	s := &jwksServer{keys: keys}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.fetches.Add(1)
+		s.mutex.Lock()
+		stall, keys := s.stall, s.keys
+		s.mutex.Unlock()
+		if stall != nil {
+			<-stall
+		}
+		json.NewEncoder(w).Encode(map[string]any{"keys": keys})
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *jwksServer) setKeys(keys ...map[string]string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.keys = keys
+}
+
+func validClaims() map[string]any {
+	return map[string]any{
+		"sub": "user-1",
+		"iss": "https://idp.example.com",
+		"aud": []string{"goproxy", "other"},
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+func TestJWTAlgorithms(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	jwks := startJWKSServer(t, jwkFor("rsa", rsaKey), jwkFor("ec", ecKey), jwkFor("ed", edKey))
+
+	a, err := auth.NewJWTAuth(auth.NewRemoteKeySet(jwks.URL, time.Hour, newTestLogger(nil)), auth.JWTOptions{
+		Issuer:    "https://idp.example.com",
+		Audiences: []string{"goproxy"},
+	}, newTestLogger(nil))
+	if err != nil {
+		t.Fatalf("Failed to create JWT auth: %v", err)
+	}
+	for _, tt := range []struct {
+		alg, kid string
+		key      any
+	}{
+		{"RS256", "rsa", rsaKey},
+		{"ES256", "ec", ecKey},
+		{"EdDSA", "ed", edKey},
+	} {
+		claims, err := a.Verify(context.Background(), signJWT(t, tt.alg, tt.kid, tt.key, validClaims()))
+		if err != nil || claims.String("sub") != "user-1" {
+			t.Errorf("%s: expected a valid token, got %v", tt.alg, err)
+		}
+	}
+
+	// An RSA public key must not be accepted as an HMAC secret
+	pub, _ := json.Marshal(jwkFor("rsa", rsaKey))
+	if _, err := a.Verify(context.Background(), signJWT(t, "HS256", "rsa", pub, validClaims())); err == nil {
+		t.Error("Expected HS256 token signed with the public key to be rejected")
+	}
+	if _, err := a.Verify(context.Background(), signJWT(t, "ES256", "rsa", ecKey, validClaims())); err == nil {
+		t.Error("Expected token with mismatched key to be rejected")
+	}
+	unsigned := b64.EncodeToString([]byte(`{"alg":"none"}`)) + "." + b64.EncodeToString([]byte(`{"sub":"x"}`)) + "."
+	if _, err := a.Verify(context.Background(), unsigned); err == nil {
+		t.Error("Expected unsigned token to be rejected")
+	}
+}
+
+func TestJWTClaims(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	keys, err := auth.NewStaticKeySet("", string(secret))
+	if err != nil {
+		t.Fatalf("Failed to create key set: %v", err)
+	}
+	a, _ := auth.NewJWTAuth(keys, auth.JWTOptions{
+		Algorithms: []string{"HS256"},
+		Issuer:     "https://idp.example.com",
+		Audiences:  []string{"goproxy"},
+		ClockSkew:  30 * time.Second,
+	}, newTestLogger(nil))
+
+	tests := []struct {
+		name   string
+		modify func(map[string]any)
+		valid  bool
+	}{
+		{"valid", func(c map[string]any) {}, true},
+		{"expired", func(c map[string]any) { c["exp"] = time.Now().Add(-time.Minute).Unix() }, false},
+		{"expired within skew", func(c map[string]any) { c["exp"] = time.Now().Add(-10 * time.Second).Unix() }, true},
+		{"no expiry", func(c map[string]any) { delete(c, "exp") }, false},
+		{"not yet valid", func(c map[string]any) { c["nbf"] = time.Now().Add(time.Minute).Unix() }, false},
+		{"not yet valid within skew", func(c map[string]any) { c["nbf"] = time.Now().Add(10 * time.Second).Unix() }, true},
+		{"wrong issuer", func(c map[string]any) { c["iss"] = "https://evil.example.com" }, false},
+		{"wrong audience", func(c map[string]any) { c["aud"] = "other" }, false},
+		{"single audience", func(c map[string]any) { c["aud"] = "goproxy" }, true},
+	}
+	for _, tt := range tests {
+		claims := validClaims()
+		tt.modify(claims)
+		_, err := a.Verify(context.Background(), signJWT(t, "HS256", "", secret, claims))
+		if (err == nil) != tt.valid {
+			t.Errorf("%s: expected valid %v, got error %v", tt.name, tt.valid, err)
+		}
+	}
+
+	if _, err := a.Verify(context.Background(), signJWT(t, "HS256", "", []byte("wrong-secret"), validClaims())); err == nil {
+		t.Error("Expected token with a wrong secret to be rejected")
+	}
+}
+
+func TestJWTKeyRotation(t *testing.T) {
+	oldKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	newKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	jwks := startJWKSServer(t, jwkFor("old", oldKey))
+	keys := auth.NewRemoteKeySet(jwks.URL, time.Hour, newTestLogger(nil))
+	a, _ := auth.NewJWTAuth(keys, auth.JWTOptions{}, newTestLogger(nil))
+
+	// Keys are cached between requests
+	for i := 0; i < 3; i++ {
+		if _, err := a.Verify(context.Background(), signJWT(t, "ES256", "old", oldKey, validClaims())); err != nil {
+			t.Fatalf("Expected a valid token, got %v", err)
+		}
+	}
+	if n := jwks.fetches.Load(); n != 1 {
+		t.Errorf("Expected the JWKS to be fetched once, got %d", n)
+	}
+
+	// Tokens signed with unknown keys are rejected until the provider
+	// publishes them; refetches are rate limited
+	jwks.setKeys(jwkFor("old", oldKey), jwkFor("new", newKey))
+	if _, err := a.Verify(context.Background(), signJWT(t, "ES256", "new", newKey, validClaims())); err == nil {
+		t.Error("Expected the new key to be unknown within the refetch interval")
+	}
+	if n := jwks.fetches.Load(); n != 1 {
+		t.Errorf("Expected no refetch within the refetch interval, got %d fetches", n)
+	}
+
+	// Past the refresh interval, an unknown key ID fetches the new keys
+	jwks.setKeys(jwkFor("old", oldKey))
+	keys = auth.NewRemoteKeySet(jwks.URL, 50*time.Millisecond, newTestLogger(nil))
+	a, _ = auth.NewJWTAuth(keys, auth.JWTOptions{}, newTestLogger(nil))
+	jwks.setKeys(jwkFor("new", newKey))
+	time.Sleep(60 * time.Millisecond)
+	if _, err := a.Verify(context.Background(), signJWT(t, "ES256", "new", newKey, validClaims())); err != nil {
+		t.Errorf("Expected the rotated key to be fetched, got %v", err)
+	}
+	if _, err := a.Verify(context.Background(), signJWT(t, "ES256", "old", oldKey, validClaims())); err == nil {
+		t.Error("Expected the retired key to be rejected")
+	}
+}
+
+func TestJWTSlowJWKS(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	jwks := startJWKSServer(t, jwkFor("current", key))
+	keys := auth.NewRemoteKeySet(jwks.URL, 50*time.Millisecond, newTestLogger(nil))
+	a, _ := auth.NewJWTAuth(keys, auth.JWTOptions{}, newTestLogger(nil))
+
+	// The provider stops answering once the keys have expired
+	stall := make(chan struct{})
+	defer close(stall)
+	jwks.mutex.Lock()
+	jwks.stall = stall
+	jwks.mutex.Unlock()
+	time.Sleep(60 * time.Millisecond)
+
+	// A token naming an unknown key waits for the fetch until it gives up
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	unknown := make(chan error, 1)
+	go func() {
+		_, err := a.Verify(ctx, signJWT(t, "ES256", "unknown", key, validClaims()))
+		unknown <- err
+	}()
+
+	// Meanwhile tokens signed with the current keys are still verified
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if _, err := a.Verify(context.Background(), signJWT(t, "ES256", "current", key, validClaims())); err != nil {
+			t.Fatalf("Expected the current key to be used during the refresh, got %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("Expected verification not to wait for the JWKS, took %v", elapsed)
+	}
+	if err := <-unknown; err == nil {
+		t.Error("Expected the token naming an unknown key to be rejected")
+	}
+	if n := jwks.fetches.Load(); n != 2 {
+		t.Errorf("Expected a single refetch in flight, got %d fetches", n)
+	}
+}
+
+func TestJWTStaticJWKSFile(t *testing.T) {
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	data, _ := json.Marshal(map[string]any{"keys": []any{jwkFor("ed", edKey)}})
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	os.WriteFile(path, data, 0o600)
+
+	keys, err := auth.NewStaticKeySet(path, "")
+	if err != nil {
+		t.Fatalf("Failed to load JWKS file: %v", err)
+	}
+	a, _ := auth.NewJWTAuth(keys, auth.JWTOptions{Algorithms: []string{"EdDSA"}}, newTestLogger(nil))
+	if _, err := a.Verify(context.Background(), signJWT(t, "EdDSA", "ed", edKey, validClaims())); err != nil {
+		t.Errorf("Expected a valid token, got %v", err)
+	}
+	if _, err := auth.NewStaticKeySet("", ""); err == nil {
+		t.Error("Expected error without keys")
+	}
+}
+
+func TestJWTHandler(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	keys, _ := auth.NewStaticKeySet("", string(secret))
+	a, _ := auth.NewJWTAuth(keys, auth.JWTOptions{
+		ForwardClaims: []string{"email", "org_id", "groups"},
+		Rules: []config.JWTRule{
+			{PathPrefix: "/admin/", Claims: map[string]string{"groups": "admins"}},
+			{PathPrefix: "/admin/reports/", Scopes: []string{"reports:read"}},
+		},
+	}, newTestLogger(nil))
+	h := a.Handler(echoIdentity())
+
+	request := func(path string, claims map[string]any) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if claims != nil {
+			req.Header.Set("Authorization", "Bearer "+signJWT(t, "HS256", "", secret, claims))
+		}
+		req.Header.Set("X-Auth-Subject", "spoofed")
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+
+	claims := validClaims()
+	claims["email"] = "ada@example.com"
+	claims["org_id"] = "42"
+	claims["groups"] = []string{"staff", "admins"}
+	rr := request("/orders", claims)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", rr.Code)
+	}
+	expected := map[string]string{
+		"Upstream-X-Auth-Subject": "user-1",
+		"Upstream-X-Auth-Method":  "jwt",
+		"Upstream-X-Auth-Email":   "ada@example.com",
+		"Upstream-X-Auth-Org-Id":  "42",
+		"Upstream-X-Auth-Groups":  "staff,admins",
+	}
+	for name, value := range expected {
+		if got := rr.Header().Get(name); got != value {
+			t.Errorf("Expected %s %q, got %q", name, value, got)
+		}
+	}
+
+	if rr := request("/orders", nil); rr.Code != http.StatusUnauthorized || rr.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("Expected 401 with WWW-Authenticate without a token, got %d", rr.Code)
+	}
+	if rr := request("/admin/users", claims); rr.Code != http.StatusOK {
+		t.Errorf("Expected 200 with the required group, got %d", rr.Code)
+	}
+	claims["groups"] = []string{"staff"}
+	if rr := request("/admin/users", claims); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 without the required group, got %d", rr.Code)
+	}
+	// Rules apply to the cleaned path
+	for _, path := range []string{"//admin/users", "/orders/../admin/users"} {
+		if rr := request(path, claims); rr.Code != http.StatusForbidden {
+			t.Errorf("Expected 403 for %s without the required group, got %d", path, rr.Code)
+		}
+	}
+	// The longest prefix applies
+	if rr := request("/admin/reports/daily", claims); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 without the required scope, got %d", rr.Code)
+	}
+	claims["scope"] = "openid reports:read"
+	if rr := request("/admin/reports/daily", claims); rr.Code != http.StatusOK {
+		t.Errorf("Expected 200 with the required scope, got %d", rr.Code)
+	}
+}
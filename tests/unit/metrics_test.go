@@ -0,0 +1,131 @@
+package unit
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shammianand/goproxy/internal/config"
+	"github.com/shammianand/goproxy/internal/loadbalancer"
+	"github.com/shammianand/goproxy/internal/metrics"
+	"github.com/shammianand/goproxy/internal/proxy"
+)
+
+func scrape(t *testing.T, collector *metrics.Metrics) string {
+	rec := httptest.NewRecorder()
+	collector.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != metrics.ContentType {
+		t.Errorf("Expected content type %q, got %q", metrics.ContentType, ct)
+	}
+	return rec.Body.String()
+}
+
+func TestMetrics(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("created"))
+	}))
+	defer backend.Close()
+
+	cfg := &config.Config{}
+	cfg.LoadBalancing.Enabled = true
+	cfg.LoadBalancing.Algorithm = "round_robin"
+	cfg.LoadBalancing.Backends = []string{backend.URL, "http://127.0.0.1:1"}
+	lb, err := cfg.CreateLoadBalancer()
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	down := lb.Backends()[1]
+	lb.HealthCheck(&loadbalancer.Backend{URL: down.URL}, false)
+
+	collector := metrics.New(metrics.Options{Routes: []string{"/api/", "/api/v2/"}, LoadBalancer: lb})
+	p, err := proxy.NewProxy("", lb, newTestLogger(nil), proxy.WithMetrics(collector))
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	// Stands in for the middlewares rejecting requests before the proxy
+	h := collector.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/blocked" {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		p.ServeHTTP(w, r)
+	}))
+
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("POST", "/api/items", strings.NewReader("hello")))
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("Expected 201, got %d", rec.Code)
+		}
+	}
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("PURGE", "/blocked", nil))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/slow", nil))
+	}()
+	inFlight := `goproxy_backend_in_flight_requests{backend="` + backend.URL + `"} 1`
+	deadline := time.Now().Add(2 * time.Second)
+	for !strings.Contains(scrape(t, collector), inFlight) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if out := scrape(t, collector); !strings.Contains(out, inFlight) {
+		t.Errorf("Expected a request in flight, got:\n%s", out)
+	}
+	close(release)
+	<-done
+
+	collector.ConnState(nil, http.StateNew)
+	collector.ConnState(nil, http.StateNew)
+	collector.ConnState(nil, http.StateClosed)
+	collector.AddGauge("goproxy_test_value", "A test gauge.", func() float64 { return 42 })
+
+	out := scrape(t, collector)
+	labels := `{route="/api/",method="POST",status="2xx",backend="` + backend.URL + `"}`
+	expected := []string{
+		"# TYPE goproxy_http_requests_total counter",
+		"goproxy_http_requests_total" + labels + " 2",
+		`goproxy_http_requests_total{route="/",method="OTHER",status="4xx",backend=""} 1`,
+		`goproxy_http_requests_total{route="/",method="GET",status="2xx",backend="` + backend.URL + `"} 1`,
+		"# TYPE goproxy_http_request_duration_seconds histogram",
+		"goproxy_http_request_duration_seconds_count" + labels + " 2",
+		`goproxy_http_request_size_bytes_bucket{route="/api/",method="POST",status="2xx",backend="` + backend.URL + `",le="100"} 2`,
+		"goproxy_http_request_size_bytes_sum" + labels + " 10",
+		"goproxy_http_response_size_bytes_sum" + labels + " 14",
+		`goproxy_http_response_size_bytes_bucket{route="/api/",method="POST",status="2xx",backend="` + backend.URL + `",le="+Inf"} 2`,
+		"goproxy_active_connections 1",
+		`goproxy_backend_up{backend="` + backend.URL + `"} 1`,
+		`goproxy_backend_up{backend="http://127.0.0.1:1"} 0`,
+		`goproxy_backend_in_flight_requests{backend="` + backend.URL + `"} 0`,
+		"# TYPE goproxy_test_value gauge",
+		"goproxy_test_value 42",
+	}
+	for _, line := range expected {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("Expected line %q in:\n%s", line, out)
+		}
+	}
+}
+
+func TestMetricsLabelEscaping(t *testing.T) {
+	collector := metrics.New(metrics.Options{Routes: []string{`/say"hi"\`}})
+	h := collector.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", `/say"hi"\there`, nil))
+
+	var buf bytes.Buffer
+	collector.WriteText(&buf)
+	if !strings.Contains(buf.String(), `route="/say\"hi\"\\"`) {
+		t.Errorf("Expected the route label escaped, got:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,264 @@
+package unit
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/shammianand/goproxy/internal/auth"
+)
+
+// mockIdP is a local OpenID Connect provider that logs every user in as
+// user-1 without asking
+type mockIdP struct {
+	*httptest.Server
+	key       *rsa.PrivateKey
+	expiresIn int64
+
+	mutex     sync.Mutex
+	codes     map[string]url.Values
+	refreshes atomic.Int32
+	logins    atomic.Int32
+}
+
+func startMockIdP(t *testing.T) *mockIdP {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	idp := &mockIdP{key: key, expiresIn: 3600, codes: make(map[string]url.Values)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.URL,
+			"authorization_endpoint": idp.URL + "/authorize",
+			"token_endpoint":         idp.URL + "/token",
+			"jwks_uri":               idp.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []any{jwkFor("idp", key)}})
+	})
+	mux.HandleFunc("GET /authorize", func(w http.ResponseWriter, r *http.Request) {
+		idp.logins.Add(1)
+		query := r.URL.Query()
+		code := fmt.Sprintf("code-%d", idp.logins.Load())
+		idp.mutex.Lock()
+		idp.codes[code] = query
+		idp.mutex.Unlock()
+		http.Redirect(w, r, query.Get("redirect_uri")+"?code="+code+"&state="+url.QueryEscape(query.Get("state")), http.StatusFound)
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		if id, secret, ok := r.BasicAuth(); !ok || id != "goproxy" || secret != "client-secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+			return
+		}
+		r.ParseForm()
+		var nonce string
+		switch r.Form.Get("grant_type") {
+		case "authorization_code":
+			idp.mutex.Lock()
+			authorize, ok := idp.codes[r.Form.Get("code")]
+			delete(idp.codes, r.Form.Get("code"))
+			idp.mutex.Unlock()
+			challenge := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+			if !ok || authorize.Get("code_challenge") != base64.RawURLEncoding.EncodeToString(challenge[:]) ||
+				authorize.Get("redirect_uri") != r.Form.Get("redirect_uri") {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+				return
+			}
+			nonce = authorize.Get("nonce")
+		case "refresh_token":
+			if !strings.HasPrefix(r.Form.Get("refresh_token"), "rt-") {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+				return
+			}
+			idp.refreshes.Add(1)
+		}
+		claims := map[string]any{
+			"iss":   idp.URL,
+			"aud":   "goproxy",
+			"sub":   "user-1",
+			"email": "ada@example.com",
+			"exp":   time.Now().Add(time.Hour).Unix(),
+		}
+		if nonce != "" {
+			claims["nonce"] = nonce
+		}
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token":  "at",
+			"id_token":      signJWT(t, "RS256", "idp", key, claims),
+			"refresh_token": fmt.Sprintf("rt-%d", idp.refreshes.Load()),
+			"expires_in":    idp.expiresIn,
+		})
+	})
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+// startOIDCProxy serves an upstream echoing the identity behind OIDCAuth
+func startOIDCProxy(t *testing.T, idp *mockIdP) *httptest.Server {
+	var a *auth.OIDCAuth
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a.Handler(echoIdentity()).ServeHTTP(w, r)
+	}))
+	t.Cleanup(proxy.Close)
+
+	var err error
+	a, err = auth.NewOIDCAuth(auth.OIDCOptions{
+		Issuer:        idp.URL,
+		ClientID:      "goproxy",
+		ClientSecret:  "client-secret",
+		RedirectURL:   proxy.URL + "/oauth2/callback",
+		CookieSecret:  "an-example-cookie-secret-of-32-chars!",
+		ForwardClaims: []string{"email"},
+		LogoutPath:    "/oauth2/logout",
+	}, newTestLogger(nil))
+	if err != nil {
+		t.Fatalf("Failed to create OIDC auth: %v", err)
+	}
+	return proxy
+}
+
+func newBrowser() *http.Client {
+	jar, _ := cookiejar.New(nil)
+	return &http.Client{Jar: jar}
+}
+
+func TestOIDCLogin(t *testing.T) {
+	idp := startMockIdP(t)
+	proxy := startOIDCProxy(t, idp)
+	browser := newBrowser()
+
+	resp, err := browser.Get(proxy.URL + "/app/page?tab=1")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Request.URL.RequestURI() != "/app/page?tab=1" {
+		t.Fatalf("Expected to land on the original page after login, got %d %s", resp.StatusCode, resp.Request.URL)
+	}
+	expected := map[string]string{
+		"Upstream-X-Auth-Subject": "user-1",
+		"Upstream-X-Auth-Method":  "oidc",
+		"Upstream-X-Auth-Email":   "ada@example.com",
+		"Upstream-Cookie":         "",
+	}
+	for name, value := range expected {
+		if got := resp.Header.Get(name); got != value {
+			t.Errorf("Expected %s %q, got %q", name, value, got)
+		}
+	}
+
+	// The session cookie is encrypted
+	u, _ := url.Parse(proxy.URL)
+	for _, c := range browser.Jar.Cookies(u) {
+		if strings.Contains(c.Value, "user-1") || strings.Contains(c.Value, "rt-") {
+			t.Errorf("Expected cookie %s to be encrypted, got %q", c.Name, c.Value)
+		}
+	}
+
+	// The session is reused without the provider
+	resp, _ = browser.Get(proxy.URL + "/app/other")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || idp.logins.Load() != 1 {
+		t.Errorf("Expected the session to be reused, got %d after %d logins", resp.StatusCode, idp.logins.Load())
+	}
+
+	// Logging out clears the session
+	resp, _ = browser.Get(proxy.URL + "/oauth2/logout")
+	resp.Body.Close()
+	if idp.logins.Load() != 2 {
+		t.Errorf("Expected a new login after logging out, got %d logins", idp.logins.Load())
+	}
+}
+
+func TestOIDCRefresh(t *testing.T) {
+	idp := startMockIdP(t)
+	idp.expiresIn = 1
+	proxy := startOIDCProxy(t, idp)
+	browser := newBrowser()
+
+	resp, _ := browser.Get(proxy.URL + "/")
+	resp.Body.Close()
+	time.Sleep(1100 * time.Millisecond)
+
+	resp, err := browser.Get(proxy.URL + "/")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Upstream-X-Auth-Subject") != "user-1" {
+		t.Errorf("Expected the refreshed session to pass, got %d", resp.StatusCode)
+	}
+	if idp.refreshes.Load() != 1 || idp.logins.Load() != 1 {
+		t.Errorf("Expected 1 refresh and no new login, got %d refreshes and %d logins", idp.refreshes.Load(), idp.logins.Load())
+	}
+}
+
+func TestOIDCRejections(t *testing.T) {
+	idp := startMockIdP(t)
+	proxy := startOIDCProxy(t, idp)
+	noRedirect := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+	// Browsers are sent to the provider with PKCE
+	resp, _ := noRedirect.Get(proxy.URL + "/app")
+	resp.Body.Close()
+	location, _ := url.Parse(resp.Header.Get("Location"))
+	if resp.StatusCode != http.StatusFound || !strings.HasPrefix(location.String(), idp.URL+"/authorize") ||
+		location.Query().Get("code_challenge_method") != "S256" || location.Query().Get("code_challenge") == "" {
+		t.Errorf("Expected a PKCE redirect to the provider, got %d %s", resp.StatusCode, location)
+	}
+
+	// Other requests are rejected
+	resp, _ = noRedirect.Post(proxy.URL+"/app", "text/plain", nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for POST without a session, got %d", resp.StatusCode)
+	}
+
+	// A forged session cookie is ignored
+	req, _ := http.NewRequest("GET", proxy.URL+"/app", nil)
+	req.AddCookie(&http.Cookie{Name: "goproxy_session", Value: base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"admin"}`))})
+	resp, _ = noRedirect.Do(req)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Errorf("Expected a forged cookie to lead to login, got %d", resp.StatusCode)
+	}
+
+	// A callback without the matching login state is rejected
+	resp, _ = noRedirect.Get(proxy.URL + "/oauth2/callback?code=code-1&state=guess")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a callback without login state, got %d", resp.StatusCode)
+	}
+}
+
+func TestOIDCConfig(t *testing.T) {
+	if _, err := auth.NewOIDCAuth(auth.OIDCOptions{
+		ClientID:              "goproxy",
+		RedirectURL:           "https://app.example.com/callback",
+		CookieSecret:          "too-short",
+		AuthorizationEndpoint: "https://idp.example.com/authorize",
+		TokenEndpoint:         "https://idp.example.com/token",
+		JWKSURL:               "https://idp.example.com/jwks",
+	}, newTestLogger(nil)); err == nil {
+		t.Error("Expected error for a short cookie secret")
+	}
+	if _, err := auth.NewOIDCAuth(auth.OIDCOptions{ClientID: "goproxy"}, newTestLogger(nil)); err == nil {
+		t.Error("Expected error without a redirect URL")
+	}
+}
@@ -0,0 +1,180 @@
+package unit
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shammianand/goproxy/internal/loadbalancer"
+	"github.com/shammianand/goproxy/internal/proxy"
+	"github.com/shammianand/goproxy/internal/proxyproto"
+)
+
+func TestProxyProtocolHeaderRoundTrip(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 51234}
+	dst := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 8080}
+	src6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 4000}
+	dst6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}
+
+	testCases := []struct {
+		name     string
+		version  int
+		src, dst net.Addr
+	}{
+		{"V1IPv4", 1, src, dst},
+		{"V1IPv6", 1, src6, dst6},
+		{"V2IPv4", 2, src, dst},
+		{"V2IPv6", 2, src6, dst6},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := proxyproto.WriteHeader(&buf, tc.version, tc.src, tc.dst); err != nil {
+				t.Fatalf("Failed to write header: %v", err)
+			}
+			buf.WriteString("GET / HTTP/1.1\r\n")
+
+			r := bufio.NewReader(&buf)
+			h, err := proxyproto.ReadHeader(r)
+			if err != nil {
+				t.Fatalf("Failed to read header: %v", err)
+			}
+			if h == nil {
+				t.Fatal("Expected a header, got nil")
+			}
+			if h.Version != tc.version {
+				t.Errorf("Expected version %d, got %d", tc.version, h.Version)
+			}
+			if h.Source.String() != tc.src.String() {
+				t.Errorf("Expected source %s, got %s", tc.src, h.Source)
+			}
+			if h.Destination.String() != tc.dst.String() {
+				t.Errorf("Expected destination %s, got %s", tc.dst, h.Destination)
+			}
+
+			rest, _ := io.ReadAll(r)
+			if string(rest) != "GET / HTTP/1.1\r\n" {
+				t.Errorf("Unexpected remaining data: %q", rest)
+			}
+		})
+	}
+
+	// A stream without a header is left untouched
+	r := bufio.NewReader(strings.NewReader("GET / HTTP/1.1\r\n"))
+	h, err := proxyproto.ReadHeader(r)
+	if err != nil || h != nil {
+		t.Errorf("Expected no header and no error, got %v, %v", h, err)
+	}
+
+	// Malformed v1 header
+	r = bufio.NewReader(strings.NewReader("PROXY TCP4 nonsense\r\n"))
+	if _, err := proxyproto.ReadHeader(r); err == nil {
+		t.Error("Expected error for malformed v1 header")
+	}
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	testCases := []struct {
+		name         string
+		trusted      []string
+		expectedAddr string
+	}{
+		{"TrustedPeer", []string{"127.0.0.0/8"}, "198.51.100.10"},
+		{"UntrustedPeer", []string{"10.0.0.0/8"}, ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			inner, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("Failed to listen: %v", err)
+			}
+			ln, err := proxyproto.NewListener(inner, tc.trusted, time.Second)
+			if err != nil {
+				t.Fatalf("Failed to create listener: %v", err)
+			}
+
+			server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(r.RemoteAddr))
+			})}
+			go server.Serve(ln)
+			defer server.Close()
+
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatalf("Failed to dial: %v", err)
+			}
+			defer conn.Close()
+
+			src := &net.TCPAddr{IP: net.ParseIP("198.51.100.10"), Port: 40000}
+			if err := proxyproto.WriteHeader(conn, 2, src, ln.Addr()); err != nil {
+				t.Fatalf("Failed to write header: %v", err)
+			}
+			conn.Write([]byte("GET / HTTP/1.1\r\nHost: test\r\nConnection: close\r\n\r\n"))
+
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatalf("Failed to read response: %v", err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+
+			if tc.expectedAddr != "" {
+				if resp.StatusCode != http.StatusOK {
+					t.Fatalf("Expected status OK, got %v", resp.Status)
+				}
+				if !strings.HasPrefix(string(body), tc.expectedAddr+":") {
+					t.Errorf("Expected remote address %s, got %s", tc.expectedAddr, body)
+				}
+			} else if resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("Expected header from untrusted peer to be rejected, got %v", resp.Status)
+			}
+		})
+	}
+}
+
+func TestProxySendsProxyProtocol(t *testing.T) {
+	log := newTestLogger(nil)
+
+	// The backend only understands PROXY protocol from loopback peers
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	ln, err := proxyproto.NewListener(inner, []string{"127.0.0.1"}, time.Second)
+	if err != nil {
+		t.Fatalf("Failed to create listener: %v", err)
+	}
+	backend := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.RemoteAddr))
+	})}
+	go backend.Serve(ln)
+	defer backend.Close()
+
+	backends := []*loadbalancer.Backend{
+		{URL: mustParseURL("http://" + ln.Addr().String()), Healthy: true},
+	}
+	p, err := proxy.NewProxy("", loadbalancer.NewRoundRobinBalancer(backends), log, proxy.WithProxyProtocol(1))
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	req.RemoteAddr = "192.0.2.55:12345"
+	rr := httptest.NewRecorder()
+	p.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status OK, got %d", rr.Code)
+	}
+	if rr.Body.String() != "192.0.2.55:12345" {
+		t.Errorf("Expected backend to see client address 192.0.2.55:12345, got %s", rr.Body.String())
+	}
+}
@@ -0,0 +1,127 @@
+package unit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/shammianand/goproxy/internal/auth"
+	"github.com/shammianand/goproxy/internal/ratelimit"
+)
+
+func limitedRequest(h http.Handler, remoteAddr string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "http://example.com/api/items", nil)
+	req.RemoteAddr = remoteAddr
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestRateLimiter(t *testing.T) {
+	limiter := ratelimit.New(1, 3, ratelimit.KeyByIP, time.Minute, newTestLogger(nil))
+	defer limiter.Close()
+	h := limiter.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	for i := 0; i < 3; i++ {
+		rr := limitedRequest(h, "10.0.0.1:1234", nil)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Request %d: expected 200 within burst, got %d", i, rr.Code)
+		}
+		if got := rr.Header().Get("RateLimit-Remaining"); got != strconv.Itoa(2-i) {
+			t.Errorf("Request %d: expected RateLimit-Remaining %d, got %s", i, 2-i, got)
+		}
+	}
+
+	rr := limitedRequest(h, "10.0.0.1:5678", nil)
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected 429 after burst, got %d", rr.Code)
+	}
+	if got := rr.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("Expected Retry-After 1, got %q", got)
+	}
+	if rr.Header().Get("RateLimit-Limit") != "3" || rr.Header().Get("RateLimit-Reset") == "" {
+		t.Errorf("Expected RateLimit headers, got %v", rr.Header())
+	}
+
+	// Other clients have their own bucket
+	if rr := limitedRequest(h, "10.0.0.2:1234", nil); rr.Code != http.StatusOK {
+		t.Errorf("Expected other client to be allowed, got %d", rr.Code)
+	}
+}
+
+func TestRateLimitKeys(t *testing.T) {
+	newRequest := func(path string, header http.Header) *http.Request {
+		req := httptest.NewRequest("GET", "http://example.com"+path, nil)
+		req.RemoteAddr = "192.0.2.1:4000"
+		req.Header = header
+		return req
+	}
+	authenticated := func(r *http.Request, method, subject string) *http.Request {
+		return r.WithContext(auth.NewContext(r.Context(), &auth.Identity{Subject: subject, Method: method}))
+	}
+
+	tests := []struct {
+		name     string
+		keyBy    string
+		header   string
+		routes   []string
+		request  *http.Request
+		expected string
+	}{
+		{"ip", "", "", nil, newRequest("/", http.Header{}), "ip:192.0.2.1"},
+		{"header", "header", "X-Tenant", nil, newRequest("/", http.Header{"X-Tenant": {"acme"}}), "header:acme"},
+		{"missing header falls back to ip", "header", "X-Tenant", nil, newRequest("/", http.Header{}), "ip:192.0.2.1"},
+		{"api key identity", "api_key", "", nil, authenticated(newRequest("/", http.Header{"X-Api-Key": {"secret"}}), "api_key", "k1"), "key:api_key:k1"},
+		{"jwt identity", "api_key", "", nil, authenticated(newRequest("/", http.Header{}), "jwt", "alice"), "key:jwt:alice"},
+		{"unverified key falls back to ip", "api_key", "", nil, newRequest("/", http.Header{"X-Api-Key": {"random"}, "Authorization": {"Bearer t1"}}), "ip:192.0.2.1"},
+		{"longest route", "route", "", []string{"/api/", "/api/search"}, newRequest("/api/search?q=x", http.Header{}), "route:/api/search"},
+		{"unmatched route uses first segment", "route", "", []string{"/api/"}, newRequest("/static/app.js", http.Header{}), "route:/static"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keyFunc, err := ratelimit.NewKeyFunc(tt.keyBy, tt.header, tt.routes)
+			if err != nil {
+				t.Fatalf("Failed to create key func: %v", err)
+			}
+			if got := keyFunc(tt.request); got != tt.expected {
+				t.Errorf("Expected key %q, got %q", tt.expected, got)
+			}
+		})
+	}
+
+	if _, err := ratelimit.NewKeyFunc("header", "", nil); err == nil {
+		t.Error("Expected error for header key without header name")
+	}
+	if _, err := ratelimit.NewKeyFunc("cookie", "", nil); err == nil {
+		t.Error("Expected error for unsupported key")
+	}
+}
+
+func TestRateLimiterRefill(t *testing.T) {
+	limiter := ratelimit.New(100, 1, ratelimit.KeyByIP, 10*time.Millisecond, newTestLogger(nil))
+	defer limiter.Close()
+
+	if !limiter.Allow("client").Allowed {
+		t.Fatal("Expected first request to be allowed")
+	}
+	if limiter.Allow("client").Allowed {
+		t.Fatal("Expected second request to be limited")
+	}
+	// The bucket refills after 10ms and is then evicted as idle; a new
+	// bucket starts full
+	time.Sleep(50 * time.Millisecond)
+	if n := limiter.Size(); n != 0 {
+		t.Errorf("Expected idle bucket to be evicted, got %d buckets", n)
+	}
+	if d := limiter.Allow("client"); !d.Allowed || d.Remaining != 0 {
+		t.Errorf("Expected refilled bucket, got %+v", d)
+	}
+}
@@ -0,0 +1,240 @@
+package unit
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shammianand/goproxy/internal/ratelimit"
+	"github.com/shammianand/goproxy/internal/redis"
+)
+
+// fakeRedis is an in-process stand-in for a Redis server. Lua scripts cannot
+// run here, so EVAL and EVALSHA of any script apply the GCRA rate limit the
+// limiter's script implements.
+type fakeRedis struct {
+	ln       net.Listener
+	password string
+
+	mutex   sync.Mutex
+	values  map[string]string
+	scripts map[string]bool
+	evals   int
+}
+
+func startFakeRedis(t *testing.T, password string) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	f := &fakeRedis{ln: ln, password: password, values: make(map[string]string), scripts: make(map[string]bool)}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	authed := f.password == ""
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(args[0])
+		if !authed && cmd != "AUTH" {
+			io.WriteString(conn, "-NOAUTH Authentication required.\r\n")
+			continue
+		}
+		switch cmd {
+		case "AUTH":
+			if args[1] != f.password {
+				io.WriteString(conn, "-WRONGPASS invalid password\r\n")
+				continue
+			}
+			authed = true
+			io.WriteString(conn, "+OK\r\n")
+		case "PING":
+			io.WriteString(conn, "+PONG\r\n")
+		case "GET":
+			f.mutex.Lock()
+			v, ok := f.values[args[1]]
+			f.mutex.Unlock()
+			if !ok {
+				io.WriteString(conn, "$-1\r\n")
+			} else {
+				fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(v), v)
+			}
+		case "EVAL", "EVALSHA":
+			f.mutex.Lock()
+			sha := args[1]
+			if cmd == "EVAL" {
+				sum := sha1.Sum([]byte(args[1]))
+				sha = hex.EncodeToString(sum[:])
+				f.scripts[sha] = true
+				f.evals++
+			}
+			if !f.scripts[sha] {
+				f.mutex.Unlock()
+				io.WriteString(conn, "-NOSCRIPT No matching script. Please use EVAL.\r\n")
+				continue
+			}
+			reply := f.gcra(args[3], args[4], args[5])
+			f.mutex.Unlock()
+			fmt.Fprintf(conn, "*4\r\n:%d\r\n:%d\r\n:%d\r\n:%d\r\n", reply[0], reply[1], reply[2], reply[3])
+		default:
+			fmt.Fprintf(conn, "-ERR unknown command '%s'\r\n", args[0])
+		}
+	}
+}
+
+// gcra mirrors the limiter's Lua script
+func (f *fakeRedis) gcra(key, emissionArg, burstArg string) [4]int64 {
+	emission, _ := strconv.ParseInt(emissionArg, 10, 64)
+	burst, _ := strconv.ParseInt(burstArg, 10, 64)
+	now := time.Now().UnixMicro()
+	tolerance := emission * burst
+	tat, err := strconv.ParseInt(f.values[key], 10, 64)
+	if err != nil || tat < now {
+		tat = now
+	}
+	newTAT := tat + emission
+	if newTAT-tolerance > now {
+		return [4]int64{0, 0, newTAT - tolerance - now, tat - now}
+	}
+	f.values[key] = strconv.FormatInt(newTAT, 10)
+	return [4]int64{1, (now - (newTAT - tolerance)) / emission, 0, newTAT - now}
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func TestRedisClient(t *testing.T) {
+	server := startFakeRedis(t, "s3cret")
+
+	client := redis.NewClient(redis.Options{Addr: server.ln.Addr().String(), Password: "s3cret"})
+	defer client.Close()
+	reply, err := client.Do(context.Background(), "PING")
+	if err != nil || reply != "PONG" {
+		t.Errorf("Expected PONG, got %v %v", reply, err)
+	}
+	reply, err = client.Do(context.Background(), "GET", "missing")
+	if err != nil || reply != nil {
+		t.Errorf("Expected nil reply, got %v %v", reply, err)
+	}
+	if _, err := client.Do(context.Background(), "FLUSHALL"); err == nil {
+		t.Error("Expected error reply for unknown command")
+	}
+
+	wrong := redis.NewClient(redis.Options{Addr: server.ln.Addr().String(), Password: "wrong"})
+	defer wrong.Close()
+	if _, err := wrong.Do(context.Background(), "PING"); err == nil {
+		t.Error("Expected authentication error")
+	}
+}
+
+func TestSharedRateLimit(t *testing.T) {
+	server := startFakeRedis(t, "")
+
+	// Two replicas sharing one server enforce a single limit
+	var replicas []*ratelimit.Limiter
+	for i := 0; i < 2; i++ {
+		client := redis.NewClient(redis.Options{Addr: server.ln.Addr().String()})
+		defer client.Close()
+		limiter := ratelimit.New(1, 4, ratelimit.KeyByIP, time.Minute, newTestLogger(nil), ratelimit.WithRedis(client, "test:"))
+		defer limiter.Close()
+		replicas = append(replicas, limiter)
+	}
+
+	allowed := 0
+	for i := 0; i < 10; i++ {
+		d := replicas[i%2].Allow("key:global")
+		if d.Allowed {
+			allowed++
+		} else if d.RetryAfter <= 0 || d.RetryAfter > time.Second {
+			t.Errorf("Expected Retry-After within one token interval, got %v", d.RetryAfter)
+		}
+	}
+	if allowed != 4 {
+		t.Errorf("Expected 4 requests allowed across replicas, got %d", allowed)
+	}
+
+	// The script is loaded once per server, then run by its SHA1
+	server.mutex.Lock()
+	evals := server.evals
+	server.mutex.Unlock()
+	if evals != 1 {
+		t.Errorf("Expected script to be loaded once, got %d EVAL calls", evals)
+	}
+
+	// Other keys have their own limit
+	if !replicas[0].Allow("key:other").Allowed {
+		t.Error("Expected other key to be allowed")
+	}
+}
+
+func TestSharedRateLimitFallback(t *testing.T) {
+	// Nothing listens on this address
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	client := redis.NewClient(redis.Options{Addr: addr, DialTimeout: 100 * time.Millisecond})
+	buf := &syncBuffer{}
+	limiter := ratelimit.New(1, 2, ratelimit.KeyByIP, time.Minute, newTestLogger(buf), ratelimit.WithRedis(client, "test:"))
+	defer limiter.Close()
+
+	results := []bool{limiter.Allow("k").Allowed, limiter.Allow("k").Allowed, limiter.Allow("k").Allowed}
+	if !results[0] || !results[1] || results[2] {
+		t.Errorf("Expected local limits while the store is down, got %v", results)
+	}
+	if n := strings.Count(buf.String(), "using local limits"); n != 1 {
+		t.Errorf("Expected the failure to be logged once, got %d times", n)
+	}
+}
@@ -0,0 +1,215 @@
+package unit
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shammianand/goproxy/internal/proxy"
+	"github.com/shammianand/goproxy/internal/signing"
+)
+
+// Vectors from the AWS Signature Version 4 test suite
+func TestSigV4(t *testing.T) {
+	signer, err := signing.NewSigner(signing.SignerOptions{
+		Algorithm:       signing.AlgorithmSigV4,
+		Region:          "us-east-1",
+		Service:         "service",
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create signer: %v", err)
+	}
+	at := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+
+	tests := []struct {
+		target    string
+		signature string
+	}{
+		{"http://example.amazonaws.com/", "5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"},
+		{"http://example.amazonaws.com/?Param2=value2&Param1=value1", "b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.target, nil)
+		req.Header = http.Header{}
+		if err := signer.Sign(req, at); err != nil {
+			t.Fatalf("Failed to sign request: %v", err)
+		}
+		expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+			"SignedHeaders=host;x-amz-date, Signature=" + tt.signature
+		if got := req.Header.Get("Authorization"); got != expected {
+			t.Errorf("%s: expected %q, got %q", tt.target, expected, got)
+		}
+		if got := req.Header.Get("X-Amz-Date"); got != "20150830T123600Z" {
+			t.Errorf("Expected X-Amz-Date 20150830T123600Z, got %q", got)
+		}
+	}
+}
+
+// verifyHMAC checks an hmac-sha256 signature the way a backend would, from
+// the canonical string in the documentation
+func verifyHMAC(r *http.Request, body []byte, secret string) error {
+	params := regexp.MustCompile(`(\w+)="([^"]*)"`).FindAllStringSubmatch(r.Header.Get("X-Signature"), -1)
+	fields := make(map[string]string)
+	for _, p := range params {
+		fields[p[1]] = p[2]
+	}
+	sum := sha256.Sum256(body)
+	digest := hex.EncodeToString(sum[:])
+	if r.Header.Get("X-Content-SHA256") != digest {
+		return fmt.Errorf("digest mismatch")
+	}
+
+	canonical := r.Method + "\n" + r.URL.EscapedPath() + "\n" + r.URL.RawQuery + "\n" + r.Header.Get("X-Signature-Timestamp") + "\n"
+	for _, name := range strings.Fields(fields["headers"]) {
+		value := r.Header.Get(name)
+		if name == "host" {
+			value = r.Host
+		}
+		canonical += name + ":" + value + "\n"
+	}
+	canonical += digest
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(canonical))
+	if fields["keyId"] != "billing" || fields["signature"] != base64.StdEncoding.EncodeToString(mac.Sum(nil)) {
+		return fmt.Errorf("signature mismatch for %+v", fields)
+	}
+	return nil
+}
+
+func TestUpstreamSigning(t *testing.T) {
+	verified := make(chan error, 1)
+	signed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		verified <- verifyHMAC(r, body, "s3cret")
+		w.Write(body)
+	}))
+	defer signed.Close()
+	unsigned := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Upstream-Signature", r.Header.Get("X-Signature"))
+	}))
+	defer unsigned.Close()
+
+	signer, err := signing.NewSigner(signing.SignerOptions{
+		Backends:      []string{signed.URL},
+		KeyID:         "billing",
+		Secret:        "s3cret",
+		SignedHeaders: []string{"Content-Type", "X-Tenant"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create signer: %v", err)
+	}
+
+	// The query is already in canonical form, so the backend can use it as is
+	p, _ := proxy.NewProxy(signed.URL, nil, newTestLogger(nil), proxy.WithSigners(signer))
+	body := `{"amount": 100}`
+	req := httptest.NewRequest("POST", "/v1/charges?a=1&b=x%20y", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Tenant", "acme")
+	req.Header.Set("X-Signature", "spoofed")
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.String() != body {
+		t.Fatalf("Expected the body forwarded, got %d %q", rec.Code, rec.Body.String())
+	}
+	if err := <-verified; err != nil {
+		t.Errorf("Expected a valid signature: %v", err)
+	}
+
+	p, _ = proxy.NewProxy(unsigned.URL, nil, newTestLogger(nil), proxy.WithSigners(signer))
+	rec = httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if got := rec.Header().Get("Upstream-Signature"); got != "" {
+		t.Errorf("Expected requests to other backends unsigned, got %q", got)
+	}
+}
+
+func TestSignerConfigErrors(t *testing.T) {
+	tests := []signing.SignerOptions{
+		{Algorithm: "rsa"},
+		{Algorithm: signing.AlgorithmHMAC},
+		{Algorithm: signing.AlgorithmSigV4, Region: "us-east-1", AccessKeyID: "AKID", SecretAccessKey: "key"},
+		{Secret: "s3cret", Backends: []string{"localhost:8080"}},
+	}
+	for _, opts := range tests {
+		if _, err := signing.NewSigner(opts); err == nil {
+			t.Errorf("Expected error for %+v", opts)
+		}
+	}
+}
+
+func hexHMAC(secret, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestWebhookVerification(t *testing.T) {
+	verifier, err := signing.NewWebhookVerifier([]signing.WebhookOptions{
+		{PathPrefix: "/hooks/github", Provider: signing.ProviderGitHub, Secret: "gh"},
+		{PathPrefix: "/hooks/stripe", Provider: signing.ProviderStripe, Secret: "whsec"},
+		{PathPrefix: "/hooks/slack", Provider: signing.ProviderSlack, Secret: "sl"},
+		{PathPrefix: "/hooks/", Provider: signing.ProviderHMAC, Secret: "generic", TimestampHeader: "X-Timestamp", Tolerance: time.Minute},
+	}, 64, newTestLogger(nil))
+	if err != nil {
+		t.Fatalf("Failed to create verifier: %v", err)
+	}
+	h := verifier.Handler(wafUpstream())
+
+	body := `{"event":"push"}`
+	now := fmt.Sprint(time.Now().Unix())
+	old := fmt.Sprint(time.Now().Add(-10 * time.Minute).Unix())
+	tests := []struct {
+		name    string
+		path    string
+		headers map[string]string
+		body    string
+		code    int
+	}{
+		{"github", "/hooks/github", map[string]string{"X-Hub-Signature-256": "sha256=" + hexHMAC("gh", body)}, body, http.StatusOK},
+		{"github wrong secret", "/hooks/github", map[string]string{"X-Hub-Signature-256": "sha256=" + hexHMAC("other", body)}, body, http.StatusUnauthorized},
+		{"github missing", "/hooks/github", nil, body, http.StatusUnauthorized},
+		{"stripe", "/hooks/stripe", map[string]string{"Stripe-Signature": "t=" + now + ",v1=" + hexHMAC("old", now+"."+body) + ",v1=" + hexHMAC("whsec", now+"."+body)}, body, http.StatusOK},
+		{"stripe tampered", "/hooks/stripe", map[string]string{"Stripe-Signature": "t=" + now + ",v1=" + hexHMAC("whsec", now+"."+body)}, body + " ", http.StatusUnauthorized},
+		{"stripe replayed", "/hooks/stripe", map[string]string{"Stripe-Signature": "t=" + old + ",v1=" + hexHMAC("whsec", old+"."+body)}, body, http.StatusUnauthorized},
+		{"slack", "/hooks/slack", map[string]string{"X-Slack-Request-Timestamp": now, "X-Slack-Signature": "v0=" + hexHMAC("sl", "v0:"+now+":"+body)}, body, http.StatusOK},
+		{"hmac", "/hooks/orders", map[string]string{"X-Timestamp": now, "X-Signature": hexHMAC("generic", now+"."+body)}, body, http.StatusOK},
+		{"hmac no timestamp", "/hooks/orders", map[string]string{"X-Signature": hexHMAC("generic", body)}, body, http.StatusUnauthorized},
+		{"too large", "/hooks/github", map[string]string{"X-Hub-Signature-256": "sha256=" + hexHMAC("gh", strings.Repeat("x", 65))}, strings.Repeat("x", 65), http.StatusRequestEntityTooLarge},
+		{"other path", "/api", nil, body, http.StatusOK},
+		{"unsigned with repeated slashes", "//hooks/github", nil, body, http.StatusUnauthorized},
+		{"unsigned with dot segments", "/x/../hooks/github", nil, body, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", tt.path, strings.NewReader(tt.body))
+		for name, value := range tt.headers {
+			req.Header.Set(name, value)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tt.code {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.code, rec.Code)
+		}
+		if tt.code == http.StatusOK && rec.Body.String() != tt.body {
+			t.Errorf("%s: expected the body forwarded, got %q", tt.name, rec.Body.String())
+		}
+	}
+
+	if _, err := signing.NewWebhookVerifier([]signing.WebhookOptions{{PathPrefix: "/hooks", Provider: "gitlab", Secret: "x"}}, 0, newTestLogger(nil)); err == nil {
+		t.Error("Expected error for an unsupported provider")
+	}
+	if _, err := signing.NewWebhookVerifier([]signing.WebhookOptions{{PathPrefix: "/hooks", Provider: signing.ProviderGitHub}}, 0, newTestLogger(nil)); err == nil {
+		t.Error("Expected error for a missing secret")
+	}
+}
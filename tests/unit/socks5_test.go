@@ -0,0 +1,238 @@
+package unit
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/shammianand/goproxy/internal/config"
+	"github.com/shammianand/goproxy/internal/forward"
+	"github.com/shammianand/goproxy/internal/socks5"
+)
+
+// startTCPEcho starts a TCP server that echoes everything it receives
+func startTCPEcho(t *testing.T) *net.TCPAddr {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr)
+}
+
+func startSOCKS5(t *testing.T, acl *forward.ACL, creds forward.Credentials, allowUDP bool, logBuf *syncBuffer) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	var w io.Writer
+	if logBuf != nil {
+		w = logBuf
+	}
+	server := socks5.NewServer(acl, creds, time.Second, time.Second, allowUDP, newTestLogger(w))
+	go server.Serve(ln)
+	return ln.Addr().String()
+}
+
+// socksHandshake authenticates and sends a request, returning the reply code
+// and the bound address port
+func socksHandshake(t *testing.T, conn net.Conn, user, pass string, cmd byte, dst *net.TCPAddr) (byte, int) {
+	conn.Write([]byte{0x05, 0x01, 0x02})
+	resp := make([]byte, 2)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		t.Fatalf("Failed to read method selection: %v", err)
+	}
+	if resp[1] != 0x02 {
+		t.Fatalf("Expected username/password method, got %d", resp[1])
+	}
+
+	auth := []byte{0x01, byte(len(user))}
+	auth = append(auth, user...)
+	auth = append(auth, byte(len(pass)))
+	auth = append(auth, pass...)
+	conn.Write(auth)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		t.Fatalf("Failed to read auth status: %v", err)
+	}
+	if resp[1] != 0x00 {
+		return 0xff, 0
+	}
+
+	req := []byte{0x05, cmd, 0x00, 0x01}
+	req = append(req, dst.IP.To4()...)
+	req = binary.BigEndian.AppendUint16(req, uint16(dst.Port))
+	conn.Write(req)
+
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("Failed to read reply: %v", err)
+	}
+	return reply[1], int(binary.BigEndian.Uint16(reply[8:10]))
+}
+
+func TestSOCKS5Connect(t *testing.T) {
+	echo := startTCPEcho(t)
+	acl, _ := forward.NewACL([]config.ACLRule{{Host: "127.0.0.1", Ports: []int{echo.Port}}}, nil)
+
+	var logBuf syncBuffer
+	addr := startSOCKS5(t, acl, forward.Credentials{"bob": "hunter2"}, false, &logBuf)
+
+	// Successful tunnel
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	if code, _ := socksHandshake(t, conn, "bob", "hunter2", 0x01, echo); code != 0x00 {
+		t.Fatalf("Expected success reply, got %d", code)
+	}
+	conn.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Errorf("Expected echo of 'hello', got %q (%v)", buf, err)
+	}
+	conn.Close()
+
+	// Wrong password
+	conn, _ = net.Dial("tcp", addr)
+	if code, _ := socksHandshake(t, conn, "bob", "wrong", 0x01, echo); code != 0xff {
+		t.Errorf("Expected authentication failure, got reply %d", code)
+	}
+	conn.Close()
+
+	// Destination not in the allow list
+	conn, _ = net.Dial("tcp", addr)
+	denied := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: echo.Port + 1}
+	if code, _ := socksHandshake(t, conn, "bob", "hunter2", 0x01, denied); code != 0x02 {
+		t.Errorf("Expected 'not allowed by ruleset' reply, got %d", code)
+	}
+	conn.Close()
+
+	// UDP ASSOCIATE is disabled
+	conn, _ = net.Dial("tcp", addr)
+	if code, _ := socksHandshake(t, conn, "bob", "hunter2", 0x03, echo); code != 0x07 {
+		t.Errorf("Expected 'command not supported' reply, got %d", code)
+	}
+	conn.Close()
+}
+
+func TestSOCKS5ResolvedAddressDenied(t *testing.T) {
+	echo := startTCPEcho(t)
+	acl, _ := forward.NewACL(nil, []config.ACLRule{{Host: "127.0.0.0/8"}, {Host: "::1/128"}})
+	addr := startSOCKS5(t, acl, nil, false, nil)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte{0x05, 0x01, 0x00})
+	resp := make([]byte, 2)
+	if _, err := io.ReadFull(conn, resp); err != nil || resp[1] != 0x00 {
+		t.Fatalf("Expected no authentication, got %v (%v)", resp, err)
+	}
+
+	// CONNECT to a domain name resolving into the denied range
+	req := []byte{0x05, 0x01, 0x00, 0x03, byte(len("localhost"))}
+	req = append(req, "localhost"...)
+	req = binary.BigEndian.AppendUint16(req, uint16(echo.Port))
+	conn.Write(req)
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("Failed to read reply: %v", err)
+	}
+	if reply[1] != 0x02 {
+		t.Errorf("Expected 'not allowed by ruleset' reply, got %d", reply[1])
+	}
+}
+
+func TestSOCKS5UDPAssociate(t *testing.T) {
+	udpEcho, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer udpEcho.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, from, err := udpEcho.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			udpEcho.WriteToUDP(buf[:n], from)
+		}
+	}()
+	echoAddr := udpEcho.LocalAddr().(*net.UDPAddr)
+
+	acl, _ := forward.NewACL([]config.ACLRule{{Host: "127.0.0.1"}}, nil)
+	addr := startSOCKS5(t, acl, forward.Credentials{"bob": "hunter2"}, true, nil)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+
+	code, relayPort := socksHandshake(t, conn, "bob", "hunter2", 0x03, &net.TCPAddr{IP: net.IPv4zero.To4()})
+	if code != 0x00 {
+		t.Fatalf("Expected success reply, got %d", code)
+	}
+
+	client, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: relayPort})
+	if err != nil {
+		t.Fatalf("Failed to dial relay: %v", err)
+	}
+	defer client.Close()
+
+	packet := []byte{0x00, 0x00, 0x00, 0x01}
+	packet = append(packet, echoAddr.IP.To4()...)
+	packet = binary.BigEndian.AppendUint16(packet, uint16(echoAddr.Port))
+	packet = append(packet, "datagram"...)
+	client.Write(packet)
+
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1024)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatalf("Failed to read relayed datagram: %v", err)
+	}
+	if !bytes.HasSuffix(buf[:n], []byte("datagram")) {
+		t.Errorf("Unexpected relayed datagram: %q", buf[:n])
+	}
+	if port := int(binary.BigEndian.Uint16(buf[8:10])); port != echoAddr.Port {
+		t.Errorf("Expected response header with source port %d, got %d", echoAddr.Port, port)
+	}
+
+	// Datagrams from hosts the client did not address are not relayed
+	stranger, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: relayPort})
+	if err != nil {
+		t.Fatalf("Failed to dial relay: %v", err)
+	}
+	defer stranger.Close()
+	stranger.Write([]byte("spoofed"))
+	time.Sleep(50 * time.Millisecond)
+	client.Write(packet)
+	n, err = client.Read(buf)
+	if err != nil {
+		t.Fatalf("Failed to read relayed datagram: %v", err)
+	}
+	if !bytes.HasSuffix(buf[:n], []byte("datagram")) {
+		t.Errorf("Expected only the echo to be relayed, got %q", buf[:n])
+	}
+}
@@ -0,0 +1,517 @@
+package unit
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/shammianand/goproxy/internal/proxy"
+	"github.com/shammianand/goproxy/internal/tracing"
+)
+
+type otlpSpan struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId"`
+	TraceState   string          `json:"traceState"`
+	Name         string          `json:"name"`
+	Kind         int             `json:"kind"`
+	Attributes   []otlpAttribute `json:"attributes"`
+	Status       struct {
+		Code int `json:"code"`
+	} `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+		IntValue    string `json:"intValue"`
+	} `json:"value"`
+}
+
+func (s otlpSpan) attr(key string) string {
+	for _, a := range s.Attributes {
+		if a.Key == key {
+			return a.Value.StringValue + a.Value.IntValue
+		}
+	}
+	return ""
+}
+
+// collector stands in for an OpenTelemetry collector receiving OTLP/HTTP
+type collector struct {
+	*httptest.Server
+	mu      sync.Mutex
+	service string
+	spans   []otlpSpan
+}
+
+func newCollector(t *testing.T) *collector {
+	c := &collector{}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" || r.Header.Get("Authorization") != "Bearer collector-token" {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		var req struct {
+			ResourceSpans []struct {
+				Resource struct {
+					Attributes []struct {
+						Key   string `json:"key"`
+						Value struct {
+							StringValue string `json:"stringValue"`
+						} `json:"value"`
+					} `json:"attributes"`
+				} `json:"resource"`
+				ScopeSpans []struct {
+					Spans []otlpSpan `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("Failed to decode export: %v", err)
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for _, rs := range req.ResourceSpans {
+			c.service = rs.Resource.Attributes[0].Value.StringValue
+			for _, ss := range rs.ScopeSpans {
+				c.spans = append(c.spans, ss.Spans...)
+			}
+		}
+	}))
+	return c
+}
+
+// newGRPCCollector stands in for an OpenTelemetry collector receiving
+// OTLP/gRPC over cleartext HTTP/2
+func newGRPCCollector(t *testing.T) *collector {
+	c := &collector{}
+	c.Server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 || r.URL.Path != "/opentelemetry.proto.collector.trace.v1.TraceService/Export" || r.Header.Get("Content-Type") != "application/grpc" {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		if r.Header.Get("Authorization") != "Bearer collector-token" {
+			// Errors without a message are sent as headers alone
+			w.Header().Set("Grpc-Status", "16")
+			w.Header().Set("Grpc-Message", "unauthenticated")
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		if len(body) < 5 || body[0] != 0 || int(binary.BigEndian.Uint32(body[1:5])) != len(body)-5 {
+			t.Errorf("Invalid gRPC message framing: %x", body)
+			return
+		}
+		service, spans, err := decodeExportRequest(body[5:])
+		if err != nil {
+			t.Errorf("Failed to decode export: %v", err)
+			return
+		}
+		c.mu.Lock()
+		c.service = service
+		c.spans = append(c.spans, spans...)
+		c.mu.Unlock()
+
+		// An empty ExportTraceServiceResponse
+		w.Write([]byte{0, 0, 0, 0, 0})
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+	}))
+	c.Config.Protocols = new(http.Protocols)
+	c.Config.Protocols.SetUnencryptedHTTP2(true)
+	c.Start()
+	return c
+}
+
+// protoField is a field of a protobuf message
+type protoField struct {
+	num   int
+	value uint64
+	bytes []byte
+}
+
+func decodeProto(b []byte) ([]protoField, error) {
+	var fields []protoField
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, fmt.Errorf("invalid tag")
+		}
+		b = b[n:]
+		f := protoField{num: int(tag >> 3)}
+		switch tag & 7 {
+		case 0:
+			if f.value, n = binary.Uvarint(b); n <= 0 {
+				return nil, fmt.Errorf("invalid varint of field %d", f.num)
+			}
+			b = b[n:]
+		case 1:
+			if len(b) < 8 {
+				return nil, fmt.Errorf("short fixed64 of field %d", f.num)
+			}
+			f.value, b = binary.LittleEndian.Uint64(b), b[8:]
+		case 2:
+			size, n := binary.Uvarint(b)
+			if n <= 0 || size > uint64(len(b)-n) {
+				return nil, fmt.Errorf("invalid length of field %d", f.num)
+			}
+			f.bytes, b = b[n:n+int(size)], b[n+int(size):]
+		default:
+			return nil, fmt.Errorf("unexpected wire type of field %d", f.num)
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+// decodeExportRequest reads the service name and spans of an
+// ExportTraceServiceRequest
+func decodeExportRequest(b []byte) (string, []otlpSpan, error) {
+	var service string
+	var spans []otlpSpan
+	resourceSpans, err := decodeProto(b)
+	if err != nil {
+		return "", nil, err
+	}
+	for _, rs := range resourceSpans {
+		fields, err := decodeProto(rs.bytes)
+		if err != nil {
+			return "", nil, err
+		}
+		for _, f := range fields {
+			switch f.num {
+			case 1:
+				resource, err := decodeProto(f.bytes)
+				if err != nil || len(resource) == 0 {
+					return "", nil, fmt.Errorf("invalid resource")
+				}
+				attr, err := decodeAttribute(resource[0].bytes)
+				if err != nil {
+					return "", nil, err
+				}
+				service = attr.Value.StringValue
+			case 2:
+				scopeSpans, err := decodeProto(f.bytes)
+				if err != nil {
+					return "", nil, err
+				}
+				for _, ss := range scopeSpans {
+					if ss.num != 2 {
+						continue
+					}
+					span, err := decodeSpan(ss.bytes)
+					if err != nil {
+						return "", nil, err
+					}
+					spans = append(spans, span)
+				}
+			}
+		}
+	}
+	return service, spans, nil
+}
+
+func decodeSpan(b []byte) (otlpSpan, error) {
+	var span otlpSpan
+	fields, err := decodeProto(b)
+	if err != nil {
+		return span, err
+	}
+	for _, f := range fields {
+		switch f.num {
+		case 1:
+			span.TraceID = hex.EncodeToString(f.bytes)
+		case 2:
+			span.SpanID = hex.EncodeToString(f.bytes)
+		case 3:
+			span.TraceState = string(f.bytes)
+		case 4:
+			span.ParentSpanID = hex.EncodeToString(f.bytes)
+		case 5:
+			span.Name = string(f.bytes)
+		case 6:
+			span.Kind = int(f.value)
+		case 9:
+			attr, err := decodeAttribute(f.bytes)
+			if err != nil {
+				return span, err
+			}
+			span.Attributes = append(span.Attributes, attr)
+		case 15:
+			status, err := decodeProto(f.bytes)
+			if err != nil {
+				return span, err
+			}
+			for _, sf := range status {
+				if sf.num == 3 {
+					span.Status.Code = int(sf.value)
+				}
+			}
+		}
+	}
+	return span, nil
+}
+
+func decodeAttribute(b []byte) (otlpAttribute, error) {
+	var attr otlpAttribute
+	fields, err := decodeProto(b)
+	if err != nil {
+		return attr, err
+	}
+	for _, f := range fields {
+		switch f.num {
+		case 1:
+			attr.Key = string(f.bytes)
+		case 2:
+			value, err := decodeProto(f.bytes)
+			if err != nil || len(value) != 1 {
+				return attr, fmt.Errorf("invalid value of %s", attr.Key)
+			}
+			switch value[0].num {
+			case 1:
+				attr.Value.StringValue = string(value[0].bytes)
+			case 3:
+				attr.Value.IntValue = strconv.FormatInt(int64(value[0].value), 10)
+			}
+		}
+	}
+	return attr, nil
+}
+
+func (c *collector) exported() []otlpSpan {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]otlpSpan{}, c.spans...)
+}
+
+func newTracer(t *testing.T, c *collector, ratio float64, propagators ...string) *tracing.Tracer {
+	tracer, err := tracing.New(tracing.Options{
+		ServiceName: "edge",
+		Endpoint:    c.URL + "/v1/traces",
+		Headers:     map[string]string{"Authorization": "Bearer collector-token"},
+		SampleRatio: ratio,
+		Propagators: propagators,
+	}, newTestLogger(nil))
+	if err != nil {
+		t.Fatalf("Failed to create tracer: %v", err)
+	}
+	return tracer
+}
+
+// traceHeaders echoes the trace headers received upstream
+func traceHeaders() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, name := range []string{"Traceparent", "Tracestate", "X-B3-Traceid", "X-B3-Spanid", "X-B3-Sampled"} {
+			w.Header().Set("Upstream-"+name, r.Header.Get(name))
+		}
+	}))
+}
+
+func TestTracingPropagation(t *testing.T) {
+	c := newCollector(t)
+	defer c.Close()
+	backend := traceHeaders()
+	defer backend.Close()
+	tracer := newTracer(t, c, 1)
+	p, _ := proxy.NewProxy(backend.URL, nil, newTestLogger(nil), proxy.WithTracer(tracer))
+
+	req := httptest.NewRequest("GET", "/orders", nil)
+	req.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	req.Header.Set("Tracestate", "congo=t61rcWkgMzE")
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+	tracer.Close()
+
+	spans := c.exported()
+	if len(spans) != 2 || c.service != "edge" {
+		t.Fatalf("Expected 2 spans of edge, got %d of %q", len(spans), c.service)
+	}
+	client, server := spans[0], spans[1]
+	if server.Kind != tracing.KindServer || client.Kind != tracing.KindClient {
+		t.Fatalf("Expected a client then a server span, got kinds %d and %d", client.Kind, server.Kind)
+	}
+	if server.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || server.ParentSpanID != "00f067aa0ba902b7" || server.TraceState != "congo=t61rcWkgMzE" {
+		t.Errorf("Expected the server span to continue the caller's trace, got %+v", server)
+	}
+	if client.TraceID != server.TraceID || client.ParentSpanID != server.SpanID {
+		t.Errorf("Expected the client span to be a child of the server span, got %+v", client)
+	}
+	if server.attr("http.response.status_code") != "200" || server.attr("goproxy.backend") != backend.URL || server.attr("url.path") != "/orders" {
+		t.Errorf("Expected the server span attributes, got %+v", server.Attributes)
+	}
+	if client.attr("http.response.status_code") != "200" || client.attr("url.full") != backend.URL+"/orders" {
+		t.Errorf("Expected the client span attributes, got %+v", client.Attributes)
+	}
+
+	expected := "00-4bf92f3577b34da6a3ce929d0e0e4736-" + client.SpanID + "-01"
+	if got := rec.Header().Get("Upstream-Traceparent"); got != expected {
+		t.Errorf("Expected upstream traceparent %q, got %q", expected, got)
+	}
+	if got := rec.Header().Get("Upstream-Tracestate"); got != "congo=t61rcWkgMzE" {
+		t.Errorf("Expected the tracestate forwarded, got %q", got)
+	}
+}
+
+func TestTracingSampling(t *testing.T) {
+	c := newCollector(t)
+	defer c.Close()
+	backend := traceHeaders()
+	defer backend.Close()
+	tracer := newTracer(t, c, 0)
+	p, _ := proxy.NewProxy(backend.URL, nil, newTestLogger(nil), proxy.WithTracer(tracer))
+
+	// New traces are not sampled, but still propagated
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	traceparent := rec.Header().Get("Upstream-Traceparent")
+	if len(traceparent) != 55 || traceparent[53:] != "00" {
+		t.Errorf("Expected an unsampled traceparent, got %q", traceparent)
+	}
+
+	// Sampled callers are followed
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	p.ServeHTTP(httptest.NewRecorder(), req)
+	tracer.Close()
+
+	spans := c.exported()
+	if len(spans) != 2 || spans[0].TraceID != "0af7651916cd43dd8448eb211c80319c" {
+		t.Errorf("Expected only the spans of the sampled caller, got %+v", spans)
+	}
+}
+
+func TestTracingB3(t *testing.T) {
+	c := newCollector(t)
+	defer c.Close()
+	backend := traceHeaders()
+	defer backend.Close()
+	tracer := newTracer(t, c, 1, tracing.PropagatorTraceContext, tracing.PropagatorB3Multi)
+	defer tracer.Close()
+	p, _ := proxy.NewProxy(backend.URL, nil, newTestLogger(nil), proxy.WithTracer(tracer))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-B3-TraceId", "463ac35c9f6413ad")
+	req.Header.Set("X-B3-SpanId", "a2fb4a1d1a96d312")
+	req.Header.Set("X-B3-Sampled", "1")
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+
+	traceID := "0000000000000000463ac35c9f6413ad"
+	if got := rec.Header().Get("Upstream-X-B3-Traceid"); got != traceID {
+		t.Errorf("Expected the padded B3 trace ID, got %q", got)
+	}
+	if got := rec.Header().Get("Upstream-Traceparent"); len(got) != 55 || got[3:35] != traceID || got[53:] != "01" {
+		t.Errorf("Expected a traceparent of the B3 trace, got %q", got)
+	}
+	if rec.Header().Get("Upstream-X-B3-Spanid") == "a2fb4a1d1a96d312" || rec.Header().Get("Upstream-X-B3-Sampled") != "1" {
+		t.Errorf("Expected a new B3 span ID, got %q", rec.Header().Get("Upstream-X-B3-Spanid"))
+	}
+}
+
+func TestTracingUpstreamError(t *testing.T) {
+	c := newCollector(t)
+	defer c.Close()
+	tracer := newTracer(t, c, 1)
+	p, _ := proxy.NewProxy("http://127.0.0.1:1", nil, newTestLogger(nil), proxy.WithTracer(tracer))
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	tracer.Close()
+
+	spans := c.exported()
+	if rec.Code != http.StatusBadGateway || len(spans) != 2 {
+		t.Fatalf("Expected 502 and 2 spans, got %d and %d", rec.Code, len(spans))
+	}
+	if spans[0].Status.Code != 2 || spans[0].attr("error.type") == "" {
+		t.Errorf("Expected the client span to fail, got %+v", spans[0])
+	}
+	if spans[1].Status.Code != 2 || spans[1].attr("http.response.status_code") != "502" {
+		t.Errorf("Expected the server span to fail with 502, got %+v", spans[1])
+	}
+}
+
+func TestTracingGRPC(t *testing.T) {
+	c := newGRPCCollector(t)
+	defer c.Close()
+	backend := traceHeaders()
+	defer backend.Close()
+	newGRPCTracer := func(token string, logs io.Writer) *tracing.Tracer {
+		tracer, err := tracing.New(tracing.Options{
+			ServiceName: "edge",
+			Endpoint:    strings.TrimPrefix(c.URL, "http://"),
+			Protocol:    tracing.ProtocolGRPC,
+			Headers:     map[string]string{"Authorization": "Bearer " + token},
+			SampleRatio: 1,
+		}, newTestLogger(logs))
+		if err != nil {
+			t.Fatalf("Failed to create tracer: %v", err)
+		}
+		return tracer
+	}
+
+	tracer := newGRPCTracer("collector-token", nil)
+	p, _ := proxy.NewProxy(backend.URL, nil, newTestLogger(nil), proxy.WithTracer(tracer))
+	failing, _ := proxy.NewProxy("http://127.0.0.1:1", nil, newTestLogger(nil), proxy.WithTracer(tracer))
+	req := httptest.NewRequest("GET", "/orders", nil)
+	req.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	req.Header.Set("Tracestate", "congo=t61rcWkgMzE")
+	p.ServeHTTP(httptest.NewRecorder(), req)
+	failing.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	tracer.Close()
+
+	spans := c.exported()
+	if len(spans) != 4 || c.service != "edge" {
+		t.Fatalf("Expected 4 spans of edge, got %d of %q", len(spans), c.service)
+	}
+	client, server := spans[0], spans[1]
+	if server.Kind != tracing.KindServer || client.Kind != tracing.KindClient {
+		t.Fatalf("Expected a client then a server span, got kinds %d and %d", client.Kind, server.Kind)
+	}
+	if server.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || server.ParentSpanID != "00f067aa0ba902b7" || server.TraceState != "congo=t61rcWkgMzE" {
+		t.Errorf("Expected the server span to continue the caller's trace, got %+v", server)
+	}
+	if client.TraceID != server.TraceID || client.ParentSpanID != server.SpanID {
+		t.Errorf("Expected the client span to be a child of the server span, got %+v", client)
+	}
+	if server.attr("http.response.status_code") != "200" || server.attr("url.path") != "/orders" || client.attr("url.full") != backend.URL+"/orders" {
+		t.Errorf("Expected the span attributes, got %+v and %+v", server.Attributes, client.Attributes)
+	}
+	if spans[2].Status.Code != 2 || spans[3].Status.Code != 2 || spans[3].attr("http.response.status_code") != "502" {
+		t.Errorf("Expected the spans of the failed request to fail, got %+v", spans[2:])
+	}
+
+	// Errors returned by the collector are logged
+	var logs syncBuffer
+	tracer = newGRPCTracer("wrong-token", &logs)
+	p, _ = proxy.NewProxy(backend.URL, nil, newTestLogger(nil), proxy.WithTracer(tracer))
+	p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	tracer.Close()
+	if !strings.Contains(logs.String(), "unauthenticated") {
+		t.Errorf("Expected the rejected export to be logged, got %q", logs.String())
+	}
+}
+
+func TestTracingConfigErrors(t *testing.T) {
+	tests := []tracing.Options{
+		{Endpoint: "grpc://localhost:4317", Protocol: tracing.ProtocolGRPC},
+		{Endpoint: "localhost:4317", Protocol: "http/protobuf"},
+		{},
+		{Endpoint: "http://localhost:4318/v1/traces", SampleRatio: 2},
+		{Endpoint: "http://localhost:4318/v1/traces", Propagators: []string{"jaeger"}},
+	}
+	for _, opts := range tests {
+		if _, err := tracing.New(opts, newTestLogger(nil)); err == nil {
+			t.Errorf("Expected error for %+v", opts)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package unit
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/shammianand/goproxy/internal/config"
+	"github.com/shammianand/goproxy/internal/proxy"
+	"github.com/shammianand/goproxy/internal/unixsock"
+)
+
+func TestUnixSocketParseAddr(t *testing.T) {
+	testCases := []struct {
+		addr string
+		path string
+		ok   bool
+	}{
+		{"unix:/run/goproxy.sock", "/run/goproxy.sock", true},
+		{"unix:///run/goproxy.sock", "/run/goproxy.sock", true},
+		{":8080", "", false},
+		{"unix:", "", false},
+	}
+	for _, tc := range testCases {
+		path, ok := unixsock.ParseAddr(tc.addr)
+		if path != tc.path || ok != tc.ok {
+			t.Errorf("ParseAddr(%q) = %q, %v; expected %q, %v", tc.addr, path, ok, tc.path, tc.ok)
+		}
+	}
+}
+
+func TestUnixSocketListen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "goproxy.sock")
+
+	ln, err := unixsock.Listen(path, unixsock.Options{Mode: "0600"})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Failed to stat socket: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Expected mode 0600, got %v", info.Mode().Perm())
+	}
+
+	// A live socket must not be replaced
+	if _, err := unixsock.Listen(path, unixsock.Options{}); err == nil {
+		t.Error("Expected error when socket is in use")
+	}
+
+	// A stale socket file is removed. Unlinking is disabled so closing the
+	// listener leaves the file behind, as after a crash.
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+	ln, err = unixsock.Listen(path, unixsock.Options{})
+	if err != nil {
+		t.Fatalf("Failed to replace stale socket: %v", err)
+	}
+	ln.Close()
+
+	// Regular files are never removed
+	regular := filepath.Join(t.TempDir(), "not-a-socket")
+	os.WriteFile(regular, []byte("data"), 0644)
+	if _, err := unixsock.Listen(regular, unixsock.Options{}); err == nil {
+		t.Error("Expected error for existing regular file")
+	}
+}
+
+func TestProxyUnixSocketBackend(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	backend := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hello from socket " + r.Host + r.URL.Path))
+	})}
+	go backend.Serve(ln)
+	defer backend.Close()
+
+	cfg := &config.Config{}
+	cfg.LoadBalancing.Enabled = true
+	cfg.LoadBalancing.Algorithm = "round_robin"
+	cfg.LoadBalancing.Backends = []string{"unix://" + path}
+
+	lb, err := cfg.CreateLoadBalancer()
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+
+	handler, err := proxy.NewProxy("", lb, newTestLogger(nil))
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL+"/test", nil)
+	req.Host = "app.example.com"
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status OK, got %v", resp.Status)
+	}
+	if string(body) != "Hello from socket app.example.com/test" {
+		t.Errorf("Unexpected response body: %s", body)
+	}
+
+	// Single target mode supports sockets as well
+	handler, err = proxy.NewProxy("unix://"+path, nil, newTestLogger(nil))
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "http://example.com/single", nil))
+	if rr.Body.String() != "Hello from socket example.com/single" {
+		t.Errorf("Unexpected response body: %s", rr.Body.String())
+	}
+
+	cfg.LoadBalancing.Backends = []string{"unix://"}
+	if _, err := cfg.CreateLoadBalancer(); err == nil {
+		t.Error("Expected error for unix backend without a socket path")
+	}
+}
@@ -0,0 +1,238 @@
+package unit
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/shammianand/goproxy/internal/config"
+	"github.com/shammianand/goproxy/internal/waf"
+)
+
+// wafUpstream echoes the request body so tests can check it survives
+// inspection
+func wafUpstream() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	})
+}
+
+func wafRequest(h http.Handler, method, target, contentType, body string) *httptest.ResponseRecorder {
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	req := httptest.NewRequest(method, target, reader)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestWAFBuiltinRules(t *testing.T) {
+	firewall, err := waf.New(waf.Options{BuiltinRules: true}, newTestLogger(nil))
+	if err != nil {
+		t.Fatalf("Failed to create firewall: %v", err)
+	}
+	h := firewall.Handler(wafUpstream())
+
+	tests := []struct {
+		name        string
+		method      string
+		target      string
+		contentType string
+		body        string
+		blocked     bool
+	}{
+		{"benign query", "GET", "/search?q=" + url.QueryEscape("o'reilly books"), "", "", false},
+		{"benign json", "POST", "/api", "application/json", `{"comment": "I said \"hi\" #1"}`, false},
+		{"sqli tautology", "GET", "/items?id=" + url.QueryEscape("1' OR '1'='1"), "", "", true},
+		{"sqli union", "GET", "/items?id=1%20UNION/**/SELECT%20password", "", "", true},
+		{"sqli double encoded", "GET", "/items?id=%2527%2520or%25201%253D1", "", "", true},
+		{"xss form", "POST", "/comment", "application/x-www-form-urlencoded", "text=" + url.QueryEscape("<ScRiPt>alert(1)</script>"), true},
+		{"xss entity encoded", "GET", "/?next=" + url.QueryEscape("&#106;avascript:alert(1)"), "", "", true},
+		{"xss json", "POST", "/api", "application/json", `{"user": {"bio": ["<img src=x onerror=alert(1)>"]}}`, true},
+		{"traversal path", "GET", "/static/..%2f..%2fetc/passwd", "", "", true},
+		{"traversal arg", "GET", "/download?file=" + url.QueryEscape(`..\..\boot.ini`), "", "", true},
+		{"command injection", "GET", "/ping?host=" + url.QueryEscape("127.0.0.1; cat /etc/hosts"), "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := wafRequest(h, tt.method, tt.target, tt.contentType, tt.body)
+			if tt.blocked && rec.Code != http.StatusForbidden {
+				t.Errorf("Expected 403, got %d", rec.Code)
+			}
+			if !tt.blocked && rec.Code != http.StatusOK {
+				t.Errorf("Expected 200, got %d", rec.Code)
+			}
+		})
+	}
+}
+
+func TestWAFBodyForwarded(t *testing.T) {
+	firewall, _ := waf.New(waf.Options{BuiltinRules: true, MaxBodyBytes: 16, BodyLimitAction: waf.BodyLimitPartial}, newTestLogger(nil))
+	h := firewall.Handler(wafUpstream())
+
+	// With partial inspection, the body is forwarded whole, beyond the
+	// inspected part
+	body := "name=ada&bio=" + strings.Repeat("x", 64) + url.QueryEscape("<script>")
+	rec := wafRequest(h, "POST", "/profile", "application/x-www-form-urlencoded", body)
+	if rec.Code != http.StatusOK || rec.Body.String() != body {
+		t.Errorf("Expected the body forwarded intact, got %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestWAFBodyLimit(t *testing.T) {
+	firewall, _ := waf.New(waf.Options{BuiltinRules: true}, newTestLogger(nil))
+	h := firewall.Handler(wafUpstream())
+
+	attack := "q=" + url.QueryEscape("1' UNION SELECT password FROM users--")
+	if rec := wafRequest(h, "POST", "/search", "application/x-www-form-urlencoded", attack); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected the attack to be blocked, got %d", rec.Code)
+	}
+	// Padding cannot push the attack past the inspected part of the body
+	padded := "pad=" + strings.Repeat("a", 128<<10) + "&" + attack
+	if rec := wafRequest(h, "POST", "/search", "application/x-www-form-urlencoded", padded); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 for a body over the inspection limit, got %d", rec.Code)
+	}
+	// Bodies of exactly the limit are inspected whole
+	exact := strings.Repeat("a", 128<<10)
+	if rec := wafRequest(h, "POST", "/upload", "application/octet-stream", exact); rec.Code != http.StatusOK || rec.Body.Len() != len(exact) {
+		t.Errorf("Expected a body at the limit to pass, got %d", rec.Code)
+	}
+}
+
+func TestWAFScoring(t *testing.T) {
+	var logs bytes.Buffer
+	rules := []config.WAFRule{
+		{ID: "100", Targets: []string{"headers:User-Agent"}, Pattern: `^curl/`, Score: 2},
+		{ID: "101", Targets: []string{"method"}, Pattern: `^(?:TRACE|TRACK)$`, Score: 3},
+		{ID: "102", Targets: []string{"arg_names"}, Pattern: `^debug$`, Transforms: []string{"lowercase"}, Score: 2},
+	}
+	firewall, err := waf.New(waf.Options{Rules: rules}, newTestLogger(&logs))
+	if err != nil {
+		t.Fatalf("Failed to create firewall: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "/?DEBUG=1", nil)
+	req.Header.Set("User-Agent", "curl/8.5.0")
+	result, err := firewall.Inspect(req)
+	if err != nil {
+		t.Fatalf("Failed to inspect request: %v", err)
+	}
+	if result.Score != 4 || len(result.Matches) != 2 || result.Blocked {
+		t.Errorf("Expected score 4 below the threshold, got %+v", result)
+	}
+
+	req = httptest.NewRequest("TRACE", "/?debug=1", nil)
+	req.Header.Set("User-Agent", "curl/8.5.0")
+	result, _ = firewall.Inspect(req)
+	if result.Score != 7 || !result.Blocked {
+		t.Errorf("Expected score 7 to be blocked, got %+v", result)
+	}
+
+	rec := httptest.NewRecorder()
+	firewall.Handler(wafUpstream()).ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("Expected 403, got %d", rec.Code)
+	}
+	if !strings.Contains(logs.String(), "Request blocked by WAF") || !strings.Contains(logs.String(), `"101"`) {
+		t.Errorf("Expected the block to be logged with the rule, got %s", logs.String())
+	}
+}
+
+func TestWAFDetectMode(t *testing.T) {
+	var logs bytes.Buffer
+	firewall, _ := waf.New(waf.Options{Mode: waf.ModeDetect, BuiltinRules: true}, newTestLogger(&logs))
+	h := firewall.Handler(wafUpstream())
+
+	rec := wafRequest(h, "GET", "/items?id="+url.QueryEscape("1 union select 1"), "", "")
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected detect mode to pass the request, got %d", rec.Code)
+	}
+	if !strings.Contains(logs.String(), "not blocked in detect mode") || !strings.Contains(logs.String(), "942110") {
+		t.Errorf("Expected the detection to be logged, got %s", logs.String())
+	}
+}
+
+func TestWAFRoutes(t *testing.T) {
+	firewall, err := waf.New(waf.Options{
+		BuiltinRules: true,
+		Routes: []config.WAFRoute{
+			{PathPrefix: "/cms/", DisabledRules: []string{"941100", "941110"}},
+			{
+				PathPrefix: "/cms/editor/",
+				Exclusions: []config.WAFExclusion{{Targets: []string{"args:content"}}},
+			},
+			{PathPrefix: "/internal/", Mode: waf.ModeOff},
+			{PathPrefix: "/api/", Mode: waf.ModeDetect},
+			{
+				PathPrefix: "/admin/",
+				Rules:      []config.WAFRule{{ID: "200", Targets: []string{"args:role"}, Pattern: `^root$`}},
+			},
+		},
+	}, newTestLogger(nil))
+	if err != nil {
+		t.Fatalf("Failed to create firewall: %v", err)
+	}
+	h := firewall.Handler(wafUpstream())
+
+	script := url.QueryEscape("<script>alert(1)</script>")
+	tests := []struct {
+		target string
+		code   int
+	}{
+		{"/page?content=" + script, http.StatusForbidden},
+		// The script tag and event handler rules are disabled under /cms/
+		{"/cms/page?content=" + script, http.StatusOK},
+		{"/cms/page?content=" + url.QueryEscape("javascript:alert(1)"), http.StatusForbidden},
+		// The editor route excludes its content argument from every rule,
+		// and, being its own route, keeps the rules /cms/ disables
+		{"/cms/editor/save?content=" + url.QueryEscape("javascript:alert(1)"), http.StatusOK},
+		{"/cms/editor/save?title=" + script, http.StatusForbidden},
+		{"/internal/debug?q=" + script, http.StatusOK},
+		{"/api/search?q=" + script, http.StatusOK},
+		{"/admin/users?role=root", http.StatusForbidden},
+		// Routes are matched once the path is cleaned
+		{"//admin/users?role=root", http.StatusForbidden},
+		{"/x/../admin/users?role=root", http.StatusForbidden},
+		{"/users?role=root", http.StatusOK},
+	}
+	for _, tt := range tests {
+		if rec := wafRequest(h, "GET", tt.target, "", ""); rec.Code != tt.code {
+			t.Errorf("GET %s: expected %d, got %d", tt.target, tt.code, rec.Code)
+		}
+	}
+}
+
+func TestWAFConfigErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		opts waf.Options
+	}{
+		{"mode", waf.Options{Mode: "monitor"}},
+		{"missing id", waf.Options{Rules: []config.WAFRule{{Targets: []string{"path"}, Pattern: "x"}}}},
+		{"target", waf.Options{Rules: []config.WAFRule{{ID: "1", Targets: []string{"uri"}, Pattern: "x"}}}},
+		{"empty member", waf.Options{Rules: []config.WAFRule{{ID: "1", Targets: []string{"args:"}, Pattern: "x"}}}},
+		{"pattern", waf.Options{Rules: []config.WAFRule{{ID: "1", Targets: []string{"path"}, Pattern: "("}}}},
+		{"transform", waf.Options{Rules: []config.WAFRule{{ID: "1", Targets: []string{"path"}, Pattern: "x", Transforms: []string{"base64"}}}}},
+		{"duplicate", waf.Options{BuiltinRules: true, Rules: []config.WAFRule{{ID: "942100", Targets: []string{"path"}, Pattern: "x"}}}},
+		{"disabled rule", waf.Options{Routes: []config.WAFRoute{{PathPrefix: "/", DisabledRules: []string{"942100"}}}}},
+		{"exclusion rule", waf.Options{BuiltinRules: true, Routes: []config.WAFRoute{{PathPrefix: "/", Exclusions: []config.WAFExclusion{{Rules: []string{"1"}, Targets: []string{"args"}}}}}}},
+		{"exclusion target", waf.Options{Routes: []config.WAFRoute{{PathPrefix: "/", Exclusions: []config.WAFExclusion{{Targets: []string{"params"}}}}}}},
+		{"route prefix", waf.Options{Routes: []config.WAFRoute{{Mode: waf.ModeOff}}}},
+		{"body limit action", waf.Options{BodyLimitAction: "truncate"}},
+	}
+	for _, tt := range tests {
+		if _, err := waf.New(tt.opts, newTestLogger(nil)); err == nil {
+			t.Errorf("%s: expected error", tt.name)
+		}
+	}
+}